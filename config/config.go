@@ -2,11 +2,13 @@ package config
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
 type DBConfig struct {
+	Backend  string `toml:"backend"` // mongo (default) or memory
 	URI      string `toml:"uri"`
 	Database string `toml:"database"`
 }
@@ -17,13 +19,54 @@ type LoggerOptions struct {
 }
 
 type IndexConfig struct {
-	HeaderFirstMode bool `toml:"mode"`
+	HeaderFirstMode bool   `toml:"mode"`
+	Network         string `toml:"network"`     // btc (default), btct, btcrt or btcs
+	IndexMode       string `toml:"index_mode"`  // full (default), light or pruned
+	PruneDepth      int32  `toml:"prune_depth"` // blocks of spent history kept in pruned mode
+	SafeDepth       int32  `toml:"safe_depth"`  // confirmations after which a tx is safe
+}
+
+type ServerConfig struct {
+	Address        string        `toml:"address"`         // host:port of the API, 127.0.0.1:8080 by default
+	RequestTimeout time.Duration `toml:"request_timeout"` // like "10s"
+}
+
+// ElectrumConfig enables the electrum server when an address is set
+type ElectrumConfig struct {
+	Address    string `toml:"address"`     // host:port for plain TCP
+	TLSAddress string `toml:"tls_address"` // host:port for TLS, needs cert_file and key_file
+	CertFile   string `toml:"cert_file"`
+	KeyFile    string `toml:"key_file"`
+}
+
+// GRPCConfig enables the gRPC API when an address is set
+type GRPCConfig struct {
+	Address string `toml:"address"` // host:port
+}
+
+// RPCConfig enables the bitcoind compatible JSON-RPC server when an address is set
+type RPCConfig struct {
+	Address  string `toml:"address"`  // host:port
+	User     string `toml:"user"`     // basic auth like rpcuser, none when empty
+	Password string `toml:"password"` // like rpcpassword
+}
+
+// WebhookConfig enables watches and their webhook deliveries when an address is set
+type WebhookConfig struct {
+	Address string `toml:"address"` // host:port of the admin API
+	Token   string `toml:"token"`   // bearer token of the admin API, none when empty
+	Secret  string `toml:"secret"`  // signs the deliveries, required
 }
 
 type Config struct {
-	DB          DBConfig      `toml:"db"`
-	Logger      LoggerOptions `toml:"logger"`
-	IndexConfig IndexConfig   `toml:"indexCfg"`
+	DB          DBConfig       `toml:"db"`
+	Logger      LoggerOptions  `toml:"logger"`
+	IndexConfig IndexConfig    `toml:"indexCfg"`
+	Server      ServerConfig   `toml:"server"`
+	Electrum    ElectrumConfig `toml:"electrum"`
+	GRPC        GRPCConfig     `toml:"grpc"`
+	RPC         RPCConfig      `toml:"rpc"`
+	Webhook     WebhookConfig  `toml:"webhook"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -0,0 +1,56 @@
+package database
+
+// statuses of Broadcast
+const (
+	BroadcastPending   = "pending"   // checked against the index, not yet fetched by a peer
+	BroadcastRelayed   = "relayed"   // fetched by at least one peer
+	BroadcastRejected  = "rejected"  // rejected by the peers that answered, none fetched it
+	BroadcastConfirmed = "confirmed" // indexed in a best chain block
+)
+
+// Broadcast is a raw tx submitted for relay to the peers of the indexer
+type Broadcast struct {
+	ID      Hash            `bson:"_id" json:"txid"`
+	Raw     []byte          `bson:"raw" json:"-"`
+	Status  string          `bson:"status" json:"status"`                     // indexed with created
+	Peers   []BroadcastPeer `bson:"peers,omitempty" json:"peers,omitempty"`   // peers that fetched or rejected the tx
+	Reject  string          `bson:"reject,omitempty" json:"reject,omitempty"` // code and reason of the last reject
+	Created int64           `bson:"created" json:"created"`
+	Updated int64           `bson:"updated" json:"updated"`
+}
+
+// BroadcastPeer is what one peer made of a broadcast, Status is relayed or rejected
+type BroadcastPeer struct {
+	Addr    string `bson:"addr" json:"addr"`
+	Status  string `bson:"status" json:"status"`
+	Reject  string `bson:"reject,omitempty" json:"reject,omitempty"`
+	Updated int64  `bson:"updated" json:"updated"`
+}
+
+// SetPeer records the status of the broadcast at the peer addr and derives the overall status from the peers,
+// a confirmed broadcast stays confirmed
+func (b *Broadcast) SetPeer(addr, status, reject string, now int64) {
+	peers := make([]BroadcastPeer, 0, len(b.Peers)+1)
+	for _, peer := range b.Peers {
+		if peer.Addr != addr {
+			peers = append(peers, peer)
+		}
+	}
+	b.Peers = append(peers, BroadcastPeer{Addr: addr, Status: status, Reject: reject, Updated: now})
+	if reject != "" {
+		b.Reject = reject
+	}
+	b.Updated = now
+	if b.Status == BroadcastConfirmed {
+		return
+	}
+
+	b.Status = BroadcastPending
+	for _, peer := range b.Peers {
+		if peer.Status == BroadcastRelayed {
+			b.Status = BroadcastRelayed
+			return
+		}
+		b.Status = BroadcastRejected
+	}
+}
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/btcsuite/btcd/wire"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// Hash is a block or tx hash in its usual hex form.
+// It is stored as BSON binary in the same byte order as the hex string (reverse of the wire order),
+// so stored hashes sort and range match like their hex form. Empty hashes are stored as null.
+type Hash string
+
+func (h Hash) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	if h == "" {
+		return bsontype.Null, nil, nil
+	}
+	b, err := hex.DecodeString(string(h))
+	if err != nil {
+		return 0, nil, fmt.Errorf("hash %q: %w", string(h), err)
+	}
+	return bsontype.Binary, bsoncore.AppendBinary(nil, bsontype.BinaryGeneric, b), nil
+}
+
+func (h *Hash) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	s, err := unmarshalHex(t, data)
+	*h = Hash(s)
+	return err
+}
+
+// Script is a script or any other byte string in hex form, stored as BSON binary
+type Script string
+
+func (s Script) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	b, err := hex.DecodeString(string(s))
+	if err != nil {
+		return 0, nil, fmt.Errorf("script %q: %w", string(s), err)
+	}
+	return bsontype.Binary, bsoncore.AppendBinary(nil, bsontype.BinaryGeneric, b), nil
+}
+
+func (s *Script) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	v, err := unmarshalHex(t, data)
+	*s = Script(v)
+	return err
+}
+
+func (s Script) Bytes() ([]byte, error) {
+	return hex.DecodeString(string(s))
+}
+
+// unmarshalHex decodes binary values, hex strings written before the binary schema are returned as is
+func unmarshalHex(t bsontype.Type, data []byte) (string, error) {
+	switch t {
+	case bsontype.Null, bsontype.Undefined:
+		return "", nil
+	case bsontype.String:
+		s, _, ok := bsoncore.ReadString(data)
+		if !ok {
+			return "", fmt.Errorf("invalid string value")
+		}
+		return s, nil
+	case bsontype.Binary:
+		_, b, _, ok := bsoncore.ReadBinary(data)
+		if !ok {
+			return "", fmt.Errorf("invalid binary value")
+		}
+		return hex.EncodeToString(b), nil
+	}
+	return "", fmt.Errorf("cannot decode %s into a hex string", t)
+}
+
+// serializeWitness encodes a witness stack like the segwit serialization of a tx input
+func serializeWitness(witness wire.TxWitness) Script {
+	if len(witness) == 0 {
+		return ""
+	}
+	var buf bytes.Buffer
+	wire.WriteVarInt(&buf, 0, uint64(len(witness)))
+	for _, item := range witness {
+		wire.WriteVarBytes(&buf, 0, item)
+	}
+	return Script(hex.EncodeToString(buf.Bytes()))
+}
@@ -0,0 +1,114 @@
+package database
+
+import (
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// EventType is the kind of chain change an Event records
+type EventType string
+
+const (
+	EventBlockConnected    EventType = "block_connected"
+	EventBlockDisconnected EventType = "block_disconnected"
+	EventTxConfirmed       EventType = "tx_confirmed"
+	EventTxOrphaned        EventType = "tx_orphaned"
+	EventOutPointSpent     EventType = "outpoint_spent"
+	EventOutPointUnspent   EventType = "outpoint_unspent"
+)
+
+// Event is an entry of the append only journal, Seq increases by one with every event.
+// tx events carry the tx hash, outpoint events the funding tx hash and index and the spending tx
+type Event struct {
+	Seq       int64     `bson:"_id" json:"seq"`
+	Type      EventType `bson:"type" json:"type"`
+	BlockHash Hash      `bson:"block_hash" json:"block_hash"`
+	Height    int32     `bson:"height" json:"height"`
+
+	TxHash         Hash   `bson:"tx_hash,omitempty" json:"tx_hash,omitempty"`
+	Index          uint32 `bson:"index,omitempty" json:"index"`
+	SpendingTxHash Hash   `bson:"spending_tx_hash,omitempty" json:"spending_tx_hash,omitempty"`
+}
+
+// Listener receives the events of every PutBlock once they are written, in order.
+// it is called with the store locked so it must neither block nor use the store
+type Listener func(events []Event)
+
+// journal numbers the events of a PutBlock until they are written or dropped
+type journal struct {
+	seq       int64 // last numbered event
+	pending   []Event
+	listeners []Listener
+}
+
+func (j *journal) add(event Event) {
+	j.seq++
+	event.Seq = j.seq
+	j.pending = append(j.pending, event)
+}
+
+// take returns the pending events, they are written
+func (j *journal) take() []Event {
+	events := j.pending
+	j.pending = nil
+	return events
+}
+
+// publish hands written events to the listeners
+func (j *journal) publish(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	for _, listener := range j.listeners {
+		listener(events)
+	}
+}
+
+// discard drops the pending events and reuses their numbers, PutBlock failed before writing them
+func (j *journal) discard() {
+	j.seq -= int64(len(j.pending))
+	j.pending = nil
+}
+
+// connectBlock records a block joining the best chain, then its txs in block order and the outpoints they spend
+func (j *journal) connectBlock(txs []*wire.MsgTx, blockhash Hash, height int32) {
+	j.add(Event{Type: EventBlockConnected, BlockHash: blockhash, Height: height})
+	for _, tx := range txs {
+		txHash := Hash(tx.TxHash().String())
+		j.add(Event{Type: EventTxConfirmed, BlockHash: blockhash, Height: height, TxHash: txHash})
+		if blockchain.IsCoinBaseTx(tx) {
+			continue
+		}
+		for _, txIn := range tx.TxIn {
+			j.add(Event{
+				Type:           EventOutPointSpent,
+				BlockHash:      blockhash,
+				Height:         height,
+				TxHash:         Hash(txIn.PreviousOutPoint.Hash.String()),
+				Index:          txIn.PreviousOutPoint.Index,
+				SpendingTxHash: txHash,
+			})
+		}
+	}
+}
+
+// disconnectBlock undoes connectBlock in reverse order, txs must be in block order
+func (j *journal) disconnectBlock(block Block, txs []Transaction) {
+	for i := len(txs) - 1; i >= 0; i-- {
+		tx := txs[i]
+		if !tx.Coinbase {
+			for k := len(tx.Inputs) - 1; k >= 0; k-- {
+				j.add(Event{
+					Type:           EventOutPointUnspent,
+					BlockHash:      block.ID,
+					Height:         block.Height,
+					TxHash:         tx.Inputs[k].TxHash,
+					Index:          tx.Inputs[k].Index,
+					SpendingTxHash: tx.ID,
+				})
+			}
+		}
+		j.add(Event{Type: EventTxOrphaned, BlockHash: block.ID, Height: block.Height, TxHash: tx.ID})
+	}
+	j.add(Event{Type: EventBlockDisconnected, BlockHash: block.ID, Height: block.Height})
+}
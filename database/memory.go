@@ -0,0 +1,1230 @@
+package database
+
+import (
+	"btc-indexer/pkg/logger"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var errDuplicateKey = errors.New("duplicate key")
+
+// memStore keeps the whole index in memory
+// it follows the same semantics as the mongo store and is meant for tests and short lived sessions
+type memStore struct {
+	blocks       map[Hash]*Block
+	blockHeights map[int32][]Hash // block hashes per height in insertion order
+	rawBlocks    map[Hash]*wire.MsgBlock
+	txIDs        map[Hash][]Hash // txids per block, kept when the txs are pruned
+
+	txs      map[Hash]*Transaction
+	txOrder  []Hash
+	blockTxs map[Hash][]Hash
+
+	out      []*OutPoint
+	outIndex map[wire.OutPoint][]*OutPoint
+	spends   map[Hash][]*OutPoint // outpoints by spending tx hash
+
+	addresses map[string]*Address
+	events    []Event // events[i].Seq is i+1
+
+	watches    map[string]*Watch
+	watchIndex watchIndex
+	deliveries map[string]*Delivery
+	broadcasts map[Hash]*Broadcast
+
+	latestHeight int32
+	chainParams  *chaincfg.Params
+	pruneDepth   int32
+	safeDepth    int32
+	journal      journal
+
+	mu     sync.RWMutex
+	logger *logger.CustomLogger
+}
+
+// NewMemoryStore returns an empty store indexing the chain of chainParams
+func NewMemoryStore(chainParams *chaincfg.Params) Store {
+	return &memStore{
+		blocks:       make(map[Hash]*Block),
+		blockHeights: make(map[int32][]Hash),
+		rawBlocks:    make(map[Hash]*wire.MsgBlock),
+		txIDs:        make(map[Hash][]Hash),
+		txs:          make(map[Hash]*Transaction),
+		blockTxs:     make(map[Hash][]Hash),
+		outIndex:     make(map[wire.OutPoint][]*OutPoint),
+		spends:       make(map[Hash][]*OutPoint),
+		addresses:    make(map[string]*Address),
+		watches:      make(map[string]*Watch),
+		watchIndex:   make(watchIndex),
+		deliveries:   make(map[string]*Delivery),
+		broadcasts:   make(map[Hash]*Broadcast),
+		latestHeight: -1,
+		chainParams:  chainParams,
+		safeDepth:    DefaultSafeDepth,
+		logger:       logger.NewDefaultLogger(),
+		mu:           sync.RWMutex{},
+	}
+}
+
+func (s *memStore) SetPruneDepth(depth int32) {
+	s.pruneDepth = minPruneDepth(depth)
+}
+
+func (s *memStore) SetSafeDepth(ctx context.Context, depth int32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.safeDepth = max(depth, 1)
+	for height := s.latestHeight; height > max(safeCutoff(s.latestHeight, s.safeDepth), 0); height-- {
+		block, err := s.getBlockByHeight(height)
+		if err != nil {
+			break
+		}
+		for _, txHash := range s.blockTxs[block.ID] {
+			if tx, ok := s.txs[txHash]; ok {
+				tx.Safe, tx.SafeHeight = false, 0
+			}
+		}
+	}
+	s.markSafe()
+	return nil
+}
+
+func (s *memStore) Listen(listener Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.journal.listeners = append(s.journal.listeners, listener)
+}
+
+func (s *memStore) GetBlockByHeight(ctx context.Context, height int32) (Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getBlockByHeight(height)
+}
+
+func (s *memStore) GetBlockByHash(ctx context.Context, hash string) (Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getBlockByHash(Hash(hash))
+}
+
+func (s *memStore) GetOrphanBlocks(ctx context.Context, minHeight int32) ([]Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	blocks := make([]Block, 0)
+	for _, block := range s.blocks {
+		if block.IsOrphan && block.Height >= minHeight {
+			blocks = append(blocks, *block)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].Height != blocks[j].Height {
+			return blocks[i].Height < blocks[j].Height
+		}
+		return blocks[i].ID < blocks[j].ID
+	})
+	return blocks, nil
+}
+
+func (s *memStore) GetBlocksByHeights(ctx context.Context, heights []int32) ([]Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	blocks := make([]Block, 0, len(heights))
+	seen := make(map[int32]bool, len(heights))
+	for _, height := range heights {
+		if seen[height] {
+			continue
+		}
+		seen[height] = true
+		if block, err := s.getBlockByHeight(height); err == nil {
+			blocks = append(blocks, block)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Height < blocks[j].Height })
+	return blocks, nil
+}
+
+func (s *memStore) PutWatch(ctx context.Context, watch Watch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.watches[watch.ID]; ok {
+		return errDuplicateKey
+	}
+	s.watches[watch.ID] = &watch
+	s.watchIndex.add(watch)
+	return nil
+}
+
+func (s *memStore) GetWatches(ctx context.Context) ([]Watch, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	watches := make([]Watch, 0, len(s.watches))
+	for _, watch := range s.watches {
+		watches = append(watches, *watch)
+	}
+	sort.Slice(watches, func(i, j int) bool {
+		if watches[i].Created != watches[j].Created {
+			return watches[i].Created < watches[j].Created
+		}
+		return watches[i].ID < watches[j].ID
+	})
+	return watches, nil
+}
+
+func (s *memStore) DeleteWatch(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.watches[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.watches, id)
+	s.watchIndex.remove(id)
+	return nil
+}
+
+func (s *memStore) AddDeliveries(ctx context.Context, deliveries []Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, delivery := range deliveries {
+		s.addDelivery(delivery)
+	}
+	return nil
+}
+
+func (s *memStore) addDelivery(delivery Delivery) {
+	if _, ok := s.deliveries[delivery.ID]; !ok {
+		s.deliveries[delivery.ID] = &delivery
+	}
+}
+
+func (s *memStore) UpdateDelivery(ctx context.Context, delivery Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.deliveries[delivery.ID]; !ok {
+		return ErrNotFound
+	}
+	s.deliveries[delivery.ID] = &delivery
+	return nil
+}
+
+func (s *memStore) DeleteDelivery(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.deliveries[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.deliveries, id)
+	return nil
+}
+
+func (s *memStore) GetDelivery(ctx context.Context, id string) (Delivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	delivery, ok := s.deliveries[id]
+	if !ok {
+		return Delivery{}, ErrNotFound
+	}
+	return *delivery, nil
+}
+
+func (s *memStore) GetDueDeliveries(ctx context.Context, tip int32, now int64, limit int64) ([]Delivery, error) {
+	deliveries := s.findDeliveries(func(delivery *Delivery) bool { return delivery.due(tip, now) })
+	sort.Slice(deliveries, func(i, j int) bool {
+		if deliveries[i].NextAttempt != deliveries[j].NextAttempt {
+			return deliveries[i].NextAttempt < deliveries[j].NextAttempt
+		}
+		return deliveries[i].ID < deliveries[j].ID
+	})
+	return deliveries[:min(int64(len(deliveries)), limit)], nil
+}
+
+func (s *memStore) GetDeadDeliveries(ctx context.Context, after string, limit int64) ([]Delivery, error) {
+	deliveries := s.findDeliveries(func(delivery *Delivery) bool { return delivery.Status == DeliveryDead && delivery.ID > after })
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID < deliveries[j].ID })
+	return deliveries[:min(int64(len(deliveries)), limit)], nil
+}
+
+func (s *memStore) findDeliveries(match func(delivery *Delivery) bool) []Delivery {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	deliveries := make([]Delivery, 0)
+	for _, delivery := range s.deliveries {
+		if match(delivery) {
+			deliveries = append(deliveries, *delivery)
+		}
+	}
+	return deliveries
+}
+
+func (s *memStore) PruneDeliveries(ctx context.Context, height int32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, delivery := range s.deliveries {
+		if delivery.Status == DeliveryDelivered && delivery.Height < height {
+			delete(s.deliveries, id)
+		}
+	}
+	return nil
+}
+
+func (s *memStore) PutBroadcast(ctx context.Context, broadcast Broadcast) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.broadcasts[broadcast.ID] = &broadcast
+	return nil
+}
+
+func (s *memStore) UpdateBroadcast(ctx context.Context, broadcast Broadcast) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.broadcasts[broadcast.ID]; !ok {
+		return ErrNotFound
+	}
+	s.broadcasts[broadcast.ID] = &broadcast
+	return nil
+}
+
+func (s *memStore) GetBroadcast(ctx context.Context, txid string) (Broadcast, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	broadcast, ok := s.broadcasts[Hash(txid)]
+	if !ok {
+		return Broadcast{}, ErrNotFound
+	}
+	return *broadcast, nil
+}
+
+func (s *memStore) GetBroadcasts(ctx context.Context, status string) ([]Broadcast, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	broadcasts := make([]Broadcast, 0)
+	for _, broadcast := range s.broadcasts {
+		if broadcast.Status == status {
+			broadcasts = append(broadcasts, *broadcast)
+		}
+	}
+	sort.Slice(broadcasts, func(i, j int) bool {
+		if broadcasts[i].Created != broadcasts[j].Created {
+			return broadcasts[i].Created < broadcasts[j].Created
+		}
+		return broadcasts[i].ID < broadcasts[j].ID
+	})
+	return broadcasts, nil
+}
+
+// getBlockByHeight returns the best chain block at height
+func (s *memStore) getBlockByHeight(height int32) (Block, error) {
+	for _, hash := range s.blockHeights[height] {
+		if !s.blocks[hash].IsOrphan {
+			return *s.blocks[hash], nil
+		}
+	}
+	return Block{}, ErrNotFound
+}
+
+func (s *memStore) getBlockByHash(hash Hash) (Block, error) {
+	block, ok := s.blocks[hash]
+	if !ok {
+		return Block{}, ErrNotFound
+	}
+	return *block, nil
+}
+
+func (s *memStore) GetBlockHashByHeight(ctx context.Context, height int32) (string, error) {
+	block, err := s.GetBlockByHeight(ctx, height)
+	return string(block.ID), err
+}
+
+func (s *memStore) GetLatestBlockHeight() (int32, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.latestHeight, nil
+}
+
+func (s *memStore) GetLatestBlockHash(ctx context.Context) (*chainhash.Hash, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.latestHeight < 0 {
+		return nil, ErrNotFound
+	}
+	latest, err := s.getBlockByHeight(s.latestHeight)
+	if err != nil {
+		return nil, err
+	}
+	return chainhash.NewHashFromStr(string(latest.ID))
+}
+
+func (s *memStore) GetLatestTxHash(ctx context.Context) (*chainhash.Hash, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.txOrder) == 0 {
+		return nil, ErrNotFound
+	}
+	return chainhash.NewHashFromStr(string(s.txOrder[0]))
+}
+
+func (s *memStore) GetTx(ctx context.Context, hash string) (Transaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tx, ok := s.txs[Hash(hash)]
+	if !ok {
+		return Transaction{}, ErrNotFound
+	}
+	transaction := *tx
+	transaction.setConfirmations(s.latestHeight)
+	return transaction, nil
+}
+
+func (s *memStore) GetTxs(ctx context.Context, hashes []string) ([]Transaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	txs := make([]Transaction, 0, len(hashes))
+	seen := make(map[Hash]bool, len(hashes))
+	for _, hash := range hashes {
+		tx, ok := s.txs[Hash(hash)]
+		if !ok || seen[tx.ID] {
+			continue
+		}
+		seen[tx.ID] = true
+		transaction := *tx
+		transaction.setConfirmations(s.latestHeight)
+		txs = append(txs, transaction)
+	}
+	sort.Slice(txs, func(i, j int) bool { return txs[i].ID < txs[j].ID })
+	return txs, nil
+}
+
+func (s *memStore) GetBlockTxs(ctx context.Context, blockHash string) ([]Transaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	txs := make([]Transaction, 0, len(s.blockTxs[Hash(blockHash)]))
+	for _, txHash := range s.blockTxs[Hash(blockHash)] {
+		if tx, ok := s.txs[txHash]; ok {
+			transaction := *tx
+			transaction.setConfirmations(s.latestHeight)
+			txs = append(txs, transaction)
+		}
+	}
+	return txs, nil
+}
+
+func (s *memStore) GetBlockTxIDs(ctx context.Context, blockHash string) ([]Hash, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.blocks[Hash(blockHash)]; !ok {
+		return nil, ErrNotFound
+	}
+	txIDs, ok := s.txIDs[Hash(blockHash)]
+	if !ok {
+		return nil, ErrNoTxIDs
+	}
+	return append([]Hash(nil), txIDs...), nil
+}
+
+func (s *memStore) GetLastEventSeq(ctx context.Context) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return int64(len(s.events)), nil
+}
+
+func (s *memStore) GetEvents(ctx context.Context, since int64, limit int64) ([]Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	since = min(max(since, 0), int64(len(s.events)))
+	events := s.events[since:]
+	if limit > 0 && int64(len(events)) > limit {
+		events = events[:limit]
+	}
+	return append(make([]Event, 0, len(events)), events...), nil
+}
+
+func (s *memStore) GetMsgTx(ctx context.Context, hash string) (*wire.MsgTx, error) {
+	return msgTx(ctx, s, hash)
+}
+
+func (s *memStore) GetSafeTxs(ctx context.Context, since int32) ([]Transaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	txs := make([]Transaction, 0)
+	for _, tx := range s.txs {
+		if tx.Safe && tx.SafeHeight > since {
+			transaction := *tx
+			transaction.setConfirmations(s.latestHeight)
+			txs = append(txs, transaction)
+		}
+	}
+	sort.Slice(txs, func(i, j int) bool {
+		if txs[i].SafeHeight != txs[j].SafeHeight {
+			return txs[i].SafeHeight < txs[j].SafeHeight
+		}
+		if txs[i].BlockHeight != txs[j].BlockHeight {
+			return txs[i].BlockHeight < txs[j].BlockHeight
+		}
+		return txs[i].BlockIndex < txs[j].BlockIndex
+	})
+	return txs, nil
+}
+
+func (s *memStore) GetAddress(ctx context.Context, address string) (Address, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	addr, ok := s.addresses[address]
+	if !ok {
+		return Address{}, ErrNotFound
+	}
+	return *addr, nil
+}
+
+func (s *memStore) GetSpendableUTXOs(ctx context.Context, address string) ([]OutPoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	outPoints := make([]OutPoint, 0)
+	for _, outPoint := range s.out {
+		if outPoint.Spender == address && outPoint.Spendable(s.latestHeight) {
+			outPoints = append(outPoints, *outPoint)
+		}
+	}
+	sort.Slice(outPoints, func(i, j int) bool {
+		if outPoints[i].FundingHeight != outPoints[j].FundingHeight {
+			return outPoints[i].FundingHeight < outPoints[j].FundingHeight
+		}
+		if outPoints[i].FundingTxHash != outPoints[j].FundingTxHash {
+			return outPoints[i].FundingTxHash < outPoints[j].FundingTxHash
+		}
+		return outPoints[i].FundingTxIndex < outPoints[j].FundingTxIndex
+	})
+	return outPoints, nil
+}
+
+func (s *memStore) GetScriptHashHistory(ctx context.Context, scriptHash string) ([]HistoryItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.history(func(outPoint *OutPoint) bool { return outPoint.ScriptHash == Hash(scriptHash) }, nil, 0, false), nil
+}
+
+func (s *memStore) GetScriptHashUTXOs(ctx context.Context, scriptHash string) ([]OutPoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	outPoints := make([]OutPoint, 0)
+	for _, outPoint := range s.out {
+		if outPoint.ScriptHash == Hash(scriptHash) && outPoint.SpendingTxHash == "" {
+			outPoints = append(outPoints, *outPoint)
+		}
+	}
+	sort.Slice(outPoints, func(i, j int) bool {
+		return outPoints[i].UTXOCursor().afterUTXO(&outPoints[j])
+	})
+	return outPoints, nil
+}
+
+func (s *memStore) GetAddressHistory(ctx context.Context, address string, after *Cursor, limit int64) ([]HistoryItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.history(func(outPoint *OutPoint) bool { return outPoint.Spender == address }, after, limit, false), nil
+}
+
+func (s *memStore) GetAddressHistoryBefore(ctx context.Context, address string, before *Cursor, limit int64) ([]HistoryItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.history(func(outPoint *OutPoint) bool { return outPoint.Spender == address }, before, limit, true), nil
+}
+
+// history returns the txs funding or spending the outpoints matching in block order, past the cursor,
+// newestFirst reverses both
+func (s *memStore) history(match func(*OutPoint) bool, cursor *Cursor, limit int64, newestFirst bool) []HistoryItem {
+	heights := make(map[Hash]int32)
+	for _, outPoint := range s.out {
+		if !match(outPoint) {
+			continue
+		}
+		heights[outPoint.FundingTxHash] = outPoint.FundingHeight
+		if outPoint.SpendingTxHash != "" {
+			heights[outPoint.SpendingTxHash] = outPoint.SpendingHeight
+		}
+	}
+
+	history := make([]HistoryItem, 0, len(heights))
+	for txHash, height := range heights {
+		item := HistoryItem{TxHash: txHash, Height: height}
+		if tx, ok := s.txs[txHash]; ok {
+			item.Position = tx.BlockIndex
+		}
+		if cursor == nil || cursor.afterItem(item) != newestFirst && *item.Cursor() != *cursor {
+			history = append(history, item)
+		}
+	}
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].Cursor().afterItem(history[j]) != newestFirst
+	})
+	if limit > 0 && int64(len(history)) > limit {
+		history = history[:limit]
+	}
+	return history
+}
+
+func (s *memStore) GetAddressUTXOs(ctx context.Context, address string, after *Cursor, limit int64) ([]OutPoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	outPoints := make([]OutPoint, 0)
+	for _, outPoint := range s.out {
+		if outPoint.Spender == address && outPoint.SpendingTxHash == "" && after.afterUTXO(outPoint) {
+			outPoints = append(outPoints, *outPoint)
+		}
+	}
+	sort.Slice(outPoints, func(i, j int) bool {
+		return outPoints[i].UTXOCursor().afterUTXO(&outPoints[j])
+	})
+	if limit > 0 && int64(len(outPoints)) > limit {
+		outPoints = outPoints[:limit]
+	}
+	return outPoints, nil
+}
+
+func (s *memStore) GetOutPointsByTx(ctx context.Context, fundingTxHash string) ([]OutPoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	outPoints := make([]OutPoint, 0)
+	for _, outPoint := range s.out {
+		if outPoint.FundingTxHash == Hash(fundingTxHash) {
+			outPoints = append(outPoints, *outPoint)
+		}
+	}
+	sort.Slice(outPoints, func(i, j int) bool { return outPoints[i].FundingTxIndex < outPoints[j].FundingTxIndex })
+	return outPoints, nil
+}
+
+func (s *memStore) GetOutPointsSpentBy(ctx context.Context, spendingTxHash string) ([]OutPoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	outPoints := make([]OutPoint, 0)
+	for _, outPoint := range s.spends[Hash(spendingTxHash)] {
+		outPoints = append(outPoints, *outPoint)
+	}
+	sort.Slice(outPoints, func(i, j int) bool { return outPoints[i].SpendingTxIndex < outPoints[j].SpendingTxIndex })
+	return outPoints, nil
+}
+
+func (s *memStore) GetOutPointsByTxs(ctx context.Context, fundingTxHashes []string) ([]OutPoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	funding := make(map[Hash]bool, len(fundingTxHashes))
+	for _, hash := range fundingTxHashes {
+		funding[Hash(hash)] = true
+	}
+	outPoints := make([]OutPoint, 0)
+	for _, outPoint := range s.out {
+		if funding[outPoint.FundingTxHash] {
+			outPoints = append(outPoints, *outPoint)
+		}
+	}
+	sort.Slice(outPoints, func(i, j int) bool {
+		if outPoints[i].FundingTxHash != outPoints[j].FundingTxHash {
+			return outPoints[i].FundingTxHash < outPoints[j].FundingTxHash
+		}
+		return outPoints[i].FundingTxIndex < outPoints[j].FundingTxIndex
+	})
+	return outPoints, nil
+}
+
+func (s *memStore) GetOutPointsSpentByTxs(ctx context.Context, spendingTxHashes []string) ([]OutPoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	outPoints := make([]OutPoint, 0)
+	seen := make(map[Hash]bool, len(spendingTxHashes))
+	for _, hash := range spendingTxHashes {
+		if seen[Hash(hash)] {
+			continue
+		}
+		seen[Hash(hash)] = true
+		for _, outPoint := range s.spends[Hash(hash)] {
+			outPoints = append(outPoints, *outPoint)
+		}
+	}
+	sort.Slice(outPoints, func(i, j int) bool {
+		if outPoints[i].SpendingTxHash != outPoints[j].SpendingTxHash {
+			return outPoints[i].SpendingTxHash < outPoints[j].SpendingTxHash
+		}
+		return outPoints[i].SpendingTxIndex < outPoints[j].SpendingTxIndex
+	})
+	return outPoints, nil
+}
+
+func (s *memStore) GetOutPointsByPayload(ctx context.Context, prefix string, limit int64) ([]OutPoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	outPoints := make([]OutPoint, 0)
+	for _, outPoint := range s.payloads(prefix) {
+		outPoints = append(outPoints, *outPoint)
+	}
+	sort.SliceStable(outPoints, func(i, j int) bool { return outPoints[i].FundingHeight < outPoints[j].FundingHeight })
+	if limit > 0 && int64(len(outPoints)) > limit {
+		outPoints = outPoints[:limit]
+	}
+	return outPoints, nil
+}
+
+func (s *memStore) GetPayloadStats(ctx context.Context, prefix string) (PayloadStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var stats PayloadStats
+	for _, outPoint := range s.payloads(prefix) {
+		if stats.Count == 0 || outPoint.PayloadSize < stats.MinSize {
+			stats.MinSize = outPoint.PayloadSize
+		}
+		stats.MaxSize = max(stats.MaxSize, outPoint.PayloadSize)
+		stats.TotalSize += int64(outPoint.PayloadSize)
+		stats.Count++
+	}
+	return stats, nil
+}
+
+func (s *memStore) GetBlocksByPrefix(ctx context.Context, prefix string, limit int64) ([]Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	prefix = strings.ToLower(prefix)
+	blocks := make([]Block, 0)
+	for hash, block := range s.blocks {
+		if strings.HasPrefix(string(hash), prefix) {
+			blocks = append(blocks, *block)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].ID < blocks[j].ID })
+	if limit > 0 && int64(len(blocks)) > limit {
+		blocks = blocks[:limit]
+	}
+	return blocks, nil
+}
+
+func (s *memStore) GetTxsByPrefix(ctx context.Context, prefix string, limit int64) ([]Transaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	prefix = strings.ToLower(prefix)
+	txs := make([]Transaction, 0)
+	for hash, tx := range s.txs {
+		if strings.HasPrefix(string(hash), prefix) {
+			transaction := *tx
+			transaction.setConfirmations(s.latestHeight)
+			txs = append(txs, transaction)
+		}
+	}
+	sort.Slice(txs, func(i, j int) bool { return txs[i].ID < txs[j].ID })
+	if limit > 0 && int64(len(txs)) > limit {
+		txs = txs[:limit]
+	}
+	return txs, nil
+}
+
+func (s *memStore) payloads(prefix string) []*OutPoint {
+	prefix = strings.ToLower(prefix)
+	outPoints := make([]*OutPoint, 0)
+	for _, outPoint := range s.out {
+		if outPoint.Payload != "" && strings.HasPrefix(outPoint.Payload, prefix) {
+			outPoints = append(outPoints, outPoint)
+		}
+	}
+	return outPoints
+}
+
+func (s *memStore) GetOutPoint(ctx context.Context, fundingTxHash string, fundingTxIndex uint32) (OutPoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hash, err := chainhash.NewHashFromStr(fundingTxHash)
+	if err != nil {
+		return OutPoint{}, err
+	}
+	outPoint := s.findOutPoint(wire.OutPoint{Hash: *hash, Index: fundingTxIndex})
+	if outPoint == nil {
+		return OutPoint{}, ErrNotFound
+	}
+	return *outPoint, nil
+}
+
+func (s *memStore) PutBlock(ctx context.Context, block *wire.MsgBlock) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer func() {
+		events := s.journal.take()
+		s.events = append(s.events, events...)
+		s.journal.publish(events)
+	}()
+
+	blockHash := Hash(block.BlockHash().String())
+	if _, ok := s.blocks[blockHash]; ok {
+		s.logger.Warn(fmt.Sprintf("Block %s already exists", blockHash))
+		return nil
+	}
+
+	prevBlock, err := s.getBlockByHash(Hash(block.Header.PrevBlock.String()))
+	if err != nil {
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	}
+
+	prevTimestamps := s.prevTimestamps(prevBlock)
+
+	// latest best chain is as long as incoming block then incoming block is orphan
+	height := prevBlock.Height + 1
+	if height <= s.latestHeight {
+		s.insertBlock(newBlock(block, height, true, s.chainParams, prevTimestamps))
+		s.rawBlocks[blockHash] = block
+		s.txIDs[blockHash] = blockTxIDs(block)
+		return nil
+	}
+
+	// redefine bestChain
+	if prevBlock.IsOrphan {
+		if err := s.reorganize(prevBlock); err != nil {
+			return err
+		}
+	}
+
+	s.insertBlock(newBlock(block, height, false, s.chainParams, prevTimestamps))
+	s.rawBlocks[blockHash] = block
+	s.txIDs[blockHash] = blockTxIDs(block)
+
+	s.blocks[blockHash].TotalFees = s.processTxs(block.Transactions, blockHash, height)
+
+	s.latestHeight = height
+	s.markSafe()
+
+	// raw blocks are only needed to reconnect blocks within the reorg window
+	for _, hash := range s.blockHeights[height-reorgWindow] {
+		delete(s.rawBlocks, hash)
+	}
+
+	s.prune()
+	return nil
+}
+
+// markSafe marks the txs reaching safeDepth confirmations at the tip,
+// walking down the best chain until a block already marked
+func (s *memStore) markSafe() {
+	for height := safeCutoff(s.latestHeight, s.safeDepth); height > 0; height-- {
+		block, err := s.getBlockByHeight(height)
+		if err != nil {
+			return
+		}
+		marked := false
+		for _, txHash := range s.blockTxs[block.ID] {
+			if tx, ok := s.txs[txHash]; ok && !tx.Safe {
+				tx.Safe, tx.SafeHeight = true, s.latestHeight
+				marked = true
+			}
+		}
+		if !marked {
+			return
+		}
+	}
+}
+
+// prune deletes outpoints spent more than pruneDepth blocks ago
+// and the transactions left without any outpoint
+func (s *memStore) prune() {
+	cutoff := s.latestHeight - s.pruneDepth
+	if s.pruneDepth == 0 || cutoff <= 0 {
+		return
+	}
+
+	fundingTxs := make(map[Hash]bool)
+	out := make([]*OutPoint, 0, len(s.out))
+	for _, outPoint := range s.out {
+		if outPoint.SpendingHeight == 0 || outPoint.SpendingHeight > cutoff {
+			out = append(out, outPoint)
+			continue
+		}
+		fundingTxs[outPoint.FundingTxHash] = true
+		hash, _ := chainhash.NewHashFromStr(string(outPoint.FundingTxHash))
+		delete(s.outIndex, wire.OutPoint{Hash: *hash, Index: outPoint.FundingTxIndex})
+	}
+	if len(fundingTxs) == 0 {
+		return
+	}
+	s.out = out
+
+	for _, outPoint := range s.out {
+		delete(fundingTxs, outPoint.FundingTxHash)
+	}
+	for txHash := range fundingTxs {
+		s.removeTx(txHash)
+	}
+}
+
+// reorganize makes the side chain ending at tip the best chain
+func (s *memStore) reorganize(tip Block) error {
+	branch := make([]Block, 0)
+	for parent := tip; parent.IsOrphan; {
+		if _, ok := s.rawBlocks[parent.ID]; !ok {
+			return fmt.Errorf("block %s is below the reorg window", parent.ID)
+		}
+		branch = append(branch, parent)
+
+		var err error
+		parent, err = s.getBlockByHash(parent.PreviousBlock)
+		if err != nil {
+			return err
+		}
+	}
+	forkHeight := branch[len(branch)-1].Height - 1
+
+	for height := s.latestHeight; height > forkHeight; height-- {
+		bl, err := s.getBlockByHeight(height)
+		if err != nil {
+			return err
+		}
+		s.disconnectBlock(bl)
+		s.latestHeight = height - 1
+	}
+
+	for i := len(branch) - 1; i >= 0; i-- {
+		s.blocks[branch[i].ID].IsOrphan = false
+		s.blocks[branch[i].ID].TotalFees = s.processTxs(s.rawBlocks[branch[i].ID].Transactions, branch[i].ID, branch[i].Height)
+		s.latestHeight = branch[i].Height
+	}
+	return nil
+}
+
+// disconnectBlock marks a best chain block as orphan and removes its transactions
+// outpoints spent by them become unspent again
+func (s *memStore) disconnectBlock(block Block) {
+	txs := make(Transactions, 0, len(s.blockTxs[block.ID]))
+	for _, txHash := range s.blockTxs[block.ID] {
+		if tx, ok := s.txs[txHash]; ok {
+			txs = append(txs, *tx)
+		}
+	}
+	s.journal.disconnectBlock(block, txs)
+
+	deltas := make(addressDeltas)
+	removed := make(map[Hash]bool)
+	for _, txHash := range s.blockTxs[block.ID] {
+		for _, outPoint := range s.spends[txHash] {
+			deltas.spend(outPoint, txHash)
+			outPoint.SpendingTxHash = ""
+			outPoint.SpendingTxIndex = 0
+			outPoint.SpendingHeight = 0
+			outPoint.Sequence = 0
+			outPoint.SignatureScript = ""
+			outPoint.SignatureScriptAsm = ""
+			outPoint.Witness = nil
+			outPoint.RevealedScript = ""
+			outPoint.RevealedScriptAsm = ""
+		}
+		delete(s.spends, txHash)
+		delete(s.txs, txHash)
+		removed[txHash] = true
+	}
+	delete(s.blockTxs, block.ID)
+
+	txOrder := make([]Hash, 0, len(s.txOrder))
+	for _, txHash := range s.txOrder {
+		if !removed[txHash] {
+			txOrder = append(txOrder, txHash)
+		}
+	}
+	s.txOrder = txOrder
+
+	out := make([]*OutPoint, 0, len(s.out))
+	for _, outPoint := range s.out {
+		if !removed[outPoint.FundingTxHash] {
+			out = append(out, outPoint)
+			continue
+		}
+		deltas.fund(outPoint)
+		hash, _ := chainhash.NewHashFromStr(string(outPoint.FundingTxHash))
+		delete(s.outIndex, wire.OutPoint{Hash: *hash, Index: outPoint.FundingTxIndex})
+	}
+	s.out = out
+
+	s.disconnectAddresses(deltas, block.Height)
+	s.orphanDeliveries(block.ID)
+	s.blocks[block.ID].IsOrphan = true
+}
+
+// orphanDeliveries cancels or reverts the deliveries of the txs of a block leaving the best chain
+func (s *memStore) orphanDeliveries(blockhash Hash) {
+	var deliveries []Delivery
+	for _, delivery := range s.deliveries {
+		if delivery.BlockHash == blockhash {
+			deliveries = append(deliveries, *delivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID < deliveries[j].ID })
+	cancelled, orphaned := orphanDeliveries(deliveries)
+	for _, id := range cancelled {
+		delete(s.deliveries, id)
+	}
+	for _, delivery := range orphaned {
+		s.addDelivery(delivery)
+	}
+}
+
+func (s *memStore) connectAddresses(deltas addressDeltas, height int32) {
+	for address, delta := range deltas {
+		addr, ok := s.addresses[address]
+		if !ok {
+			addr = &Address{ID: address, FirstSeenHeight: height}
+			s.addresses[address] = addr
+		}
+		delta.apply(addr, 1)
+		addr.FirstSeenHeight = min(addr.FirstSeenHeight, height)
+		addr.LastSeenHeight = max(addr.LastSeenHeight, height)
+	}
+}
+
+// disconnectAddresses reverts the deltas of the block disconnected at height,
+// addresses it was the last activity of get their last seen height from the remaining outpoints
+func (s *memStore) disconnectAddresses(deltas addressDeltas, height int32) {
+	stale := make(map[string]*Address)
+	for address, delta := range deltas {
+		addr, ok := s.addresses[address]
+		if !ok {
+			continue
+		}
+		delta.apply(addr, -1)
+		if addr.TxCount <= 0 {
+			delete(s.addresses, address)
+			continue
+		}
+		if addr.LastSeenHeight >= height {
+			addr.LastSeenHeight = 0
+			stale[address] = addr
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+
+	for _, outPoint := range s.out {
+		if addr, ok := stale[outPoint.Spender]; ok {
+			addr.LastSeenHeight = max(addr.LastSeenHeight, outPoint.FundingHeight, outPoint.SpendingHeight)
+		}
+	}
+}
+
+// prevTimestamps returns the timestamps of prev and up to 9 of its ancestors
+func (s *memStore) prevTimestamps(prev Block) []int64 {
+	timestamps := []int64{prev.Timestamp}
+	for bl, ok := s.blocks[prev.PreviousBlock]; ok && len(timestamps) < medianTimeBlocks-1; bl, ok = s.blocks[bl.PreviousBlock] {
+		timestamps = append(timestamps, bl.Timestamp)
+	}
+	return timestamps
+}
+
+// processTxs returns the fees paid by txs
+func (s *memStore) processTxs(txs []*wire.MsgTx, blockhash Hash, height int32) int64 {
+	s.journal.connectBlock(txs, blockhash, height)
+	values := make(map[wire.OutPoint]int64)
+	for _, tx := range txs {
+		for i, out := range tx.TxOut {
+			values[wire.OutPoint{Hash: tx.TxHash(), Index: uint32(i)}] = out.Value
+		}
+	}
+
+	var fees int64
+	for i, tx := range txs {
+		transaction, ok := newTransaction(tx, blockhash, height, uint32(i), s.prevValue(values))
+		if !ok {
+			s.logger.Warn(fmt.Sprintf("Transaction %s spends unknown outpoints, fee not computed", transaction.ID))
+		}
+		if err := s.insertTx(transaction); err != nil {
+			s.logger.Warn(fmt.Sprintf("Transaction %s already exists", txs[0].TxHash().String()))
+			return 0
+		}
+		fees += transaction.Fee
+	}
+
+	deltas := make(addressDeltas)
+	for _, tx := range txs {
+		for i := range tx.TxOut {
+			outPoint := newOutPoint(tx, uint32(i), height, s.chainParams)
+			s.insertOutPoint(&outPoint)
+			deltas.fund(&outPoint)
+		}
+	}
+
+	for _, tx := range txs {
+		for i, txIn := range tx.TxIn {
+			outPoint := s.findOutPoint(txIn.PreviousOutPoint)
+			if outPoint == nil {
+				continue
+			}
+			s.spendOutPoint(outPoint, tx, uint32(i), txIn, height)
+			deltas.spend(outPoint, outPoint.SpendingTxHash)
+		}
+	}
+
+	s.connectAddresses(deltas, height)
+	for _, delivery := range s.watchIndex.matchTxs(txs, blockhash, height, s.findOutPoint) {
+		s.addDelivery(delivery)
+	}
+	return fees
+}
+
+// PutTx stores a single tx, its position in the block is not known and left at 0
+func (s *memStore) PutTx(ctx context.Context, tx *wire.MsgTx, blockhash string, height int32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transaction, _ := newTransaction(tx, Hash(blockhash), height, 0, s.prevValue(nil))
+	if height <= safeCutoff(s.latestHeight, s.safeDepth) {
+		transaction.Safe, transaction.SafeHeight = true, s.latestHeight
+	}
+	if err := s.insertTx(transaction); err != nil {
+		s.logger.Warn(fmt.Sprintf("Transaction %s already exists", tx.TxHash().String()))
+		return nil
+	}
+
+	deltas := make(addressDeltas)
+	defer s.connectAddresses(deltas, height)
+
+	for i := range tx.TxOut {
+		outPoint := newOutPoint(tx, uint32(i), height, s.chainParams)
+		s.insertOutPoint(&outPoint)
+		deltas.fund(&outPoint)
+	}
+
+	for i, txIn := range tx.TxIn {
+		outPoint := s.findOutPoint(txIn.PreviousOutPoint)
+		if outPoint == nil {
+			return fmt.Errorf("fundingTx %v index %d: %w", txIn.PreviousOutPoint.Hash.String(), txIn.PreviousOutPoint.Index, ErrNotFound)
+		}
+		s.spendOutPoint(outPoint, tx, uint32(i), txIn, height)
+		deltas.spend(outPoint, outPoint.SpendingTxHash)
+	}
+	return nil
+}
+
+func (s *memStore) InitGenesisBlock(ctx context.Context, block *wire.MsgBlock) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.blocks[Hash(block.BlockHash().String())]; ok {
+		s.latestHeight = 0
+		return fmt.Errorf("block %s: %w", block.BlockHash().String(), errDuplicateKey)
+	}
+	s.insertBlock(newBlock(block, 0, false, s.chainParams, nil))
+	s.txIDs[Hash(block.BlockHash().String())] = blockTxIDs(block)
+	s.latestHeight = 0
+	return nil
+}
+
+func (s *memStore) InitCoinBaseTx(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.insertOutPoint(&OutPoint{
+		FundingTxHash:  "0000000000000000000000000000000000000000000000000000000000000000",
+		FundingTxIndex: 4294967295,
+	})
+	return nil
+}
+
+func (s *memStore) insertBlock(block Block) {
+	s.blocks[block.ID] = &block
+	s.blockHeights[block.Height] = append(s.blockHeights[block.Height], block.ID)
+}
+
+func (s *memStore) insertTx(tx Transaction) error {
+	if _, ok := s.txs[tx.ID]; ok {
+		return errDuplicateKey
+	}
+	s.txs[tx.ID] = &tx
+	s.txOrder = append(s.txOrder, tx.ID)
+	s.blockTxs[tx.BlockHash] = append(s.blockTxs[tx.BlockHash], tx.ID)
+	return nil
+}
+
+func (s *memStore) removeTx(txHash Hash) {
+	tx, ok := s.txs[txHash]
+	if !ok {
+		return
+	}
+	delete(s.txs, txHash)
+	delete(s.spends, txHash)
+
+	blockTxs := s.blockTxs[tx.BlockHash]
+	for i, hash := range blockTxs {
+		if hash == txHash {
+			s.blockTxs[tx.BlockHash] = append(blockTxs[:i:i], blockTxs[i+1:]...)
+			break
+		}
+	}
+	for i, hash := range s.txOrder {
+		if hash == txHash {
+			s.txOrder = append(s.txOrder[:i:i], s.txOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s *memStore) insertOutPoint(outPoint *OutPoint) {
+	outPoint.ID = primitive.NewObjectID()
+	hash, _ := chainhash.NewHashFromStr(string(outPoint.FundingTxHash))
+	key := wire.OutPoint{Hash: *hash, Index: outPoint.FundingTxIndex}
+	s.out = append(s.out, outPoint)
+	s.outIndex[key] = append(s.outIndex[key], outPoint)
+}
+
+// findOutPoint returns the first outpoint stored for prevOut, like FindOne does for mongo
+func (s *memStore) findOutPoint(prevOut wire.OutPoint) *OutPoint {
+	outPoints := s.outIndex[prevOut]
+	if len(outPoints) == 0 {
+		return nil
+	}
+	return outPoints[0]
+}
+
+// prevValue resolves spent outpoints from values first, then from stored outpoints
+func (s *memStore) prevValue(values map[wire.OutPoint]int64) func(wire.OutPoint) (int64, bool) {
+	return func(prevOut wire.OutPoint) (int64, bool) {
+		if value, ok := values[prevOut]; ok {
+			return value, true
+		}
+		outPoint := s.findOutPoint(prevOut)
+		if outPoint == nil {
+			return 0, false
+		}
+		return outPoint.Value, true
+	}
+}
+
+func (s *memStore) spendOutPoint(outPoint *OutPoint, tx *wire.MsgTx, index uint32, txIn *wire.TxIn, height int32) {
+	outPoint.SpendingTxHash = Hash(tx.TxHash().String())
+	outPoint.SpendingTxIndex = index
+	outPoint.SpendingHeight = height
+	outPoint.Sequence = txIn.Sequence
+	outPoint.SignatureScript = Script(hex.EncodeToString(txIn.SignatureScript))
+	outPoint.SignatureScriptAsm = disasm(txIn.SignatureScript)
+	outPoint.Witness = witnessItems(txIn.Witness)
+
+	pkScript, _ := outPoint.PkScript.Bytes()
+	revealed := revealedScript(pkScript, txIn.SignatureScript, txIn.Witness)
+	outPoint.RevealedScript = Script(hex.EncodeToString(revealed))
+	outPoint.RevealedScriptAsm = disasm(revealed)
+	s.spends[outPoint.SpendingTxHash] = append(s.spends[outPoint.SpendingTxHash], outPoint)
+}
@@ -0,0 +1,15 @@
+package database_test
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/database/storetest"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+func TestMemoryStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) database.Store {
+		return database.NewMemoryStore(&chaincfg.RegressionNetParams)
+	})
+}
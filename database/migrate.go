@@ -0,0 +1,784 @@
+package database
+
+import (
+	"btc-indexer/pkg/logger"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrNetworkMismatch    = errors.New("database was built for another network")
+	ErrIncompatibleSchema = errors.New("database schema is newer than this indexer")
+	ErrPrunedDatabase     = errors.New("database is pruned")
+)
+
+// modePruned matches blockchain.ModePruned
+const modePruned = "pruned"
+
+const (
+	metadataID       = "indexer"
+	migrateBatchSize = 1000
+)
+
+// Settings describe what a database is indexed for
+type Settings struct {
+	Network     string
+	Mode        string
+	ChainParams *chaincfg.Params // params of Network, used to derive addresses
+	SafeDepth   int32            // confirmations after which a tx is safe
+}
+
+// Metadata is the single document of the Metadata collection
+type Metadata struct {
+	ID            string `bson:"_id"`
+	SchemaVersion int    `bson:"schema_version"`
+	Network       string `bson:"network"`
+	Mode          string `bson:"mode"`
+}
+
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, db *mongo.Database, settings Settings) error
+}
+
+// migrations upgrade the schema one version at a time, databases created before
+// the Metadata collection existed are at version 0
+// never edit a released migration, append a new one instead
+var migrations = []migration{
+	{1, "create indexes", createIndexes},
+	{2, "store hashes and scripts as binary", migrateHexToBinary},
+	{3, "index transactions by block", createTxBlockIndex},
+	{4, "record spending height of outpoints", migrateSpendingHeight},
+	{5, "rename block_index of transactions to block_height", migrateTxBlockHeight},
+	{6, "store witness items and disassembled scripts", migrateWitnessItems},
+	{7, "summarize addresses", migrateAddresses},
+	{8, "index outpoints by script hash", migrateScriptHash},
+	{9, "index OP_RETURN payloads", migratePayload},
+	{10, "record owners of outpoints", migrateOwners},
+	{11, "flag coinbase outpoints and their maturity", migrateCoinbase},
+	{12, "track safe transactions", migrateSafe},
+	{13, "index webhook deliveries", createDeliveryIndexes},
+	{14, "store the txids of blocks", migrateBlockTxIDs},
+	{15, "index broadcasts", createBroadcastIndexes},
+}
+
+// SchemaVersion is the schema version this indexer writes
+var SchemaVersion = migrations[len(migrations)-1].version
+
+// migrate runs pending migrations and records settings in the Metadata collection
+func migrate(ctx context.Context, db *mongo.Database, settings Settings) error {
+	log := logger.NewDefaultLogger()
+	metaCol := db.Collection("Metadata")
+
+	meta := Metadata{ID: metadataID}
+	err := metaCol.FindOne(ctx, bson.D{{Key: "_id", Value: metadataID}}).Decode(&meta)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	if meta.Network != "" && meta.Network != settings.Network {
+		return fmt.Errorf("%w: %s, not %s", ErrNetworkMismatch, meta.Network, settings.Network)
+	}
+	if meta.Mode == modePruned && settings.Mode != modePruned {
+		return fmt.Errorf("%w: history is gone, it can not be indexed in %s mode", ErrPrunedDatabase, settings.Mode)
+	}
+	if meta.SchemaVersion > SchemaVersion {
+		return fmt.Errorf("%w: version %d, expected at most %d", ErrIncompatibleSchema, meta.SchemaVersion, SchemaVersion)
+	}
+
+	save := func() error {
+		_, err := metaCol.ReplaceOne(ctx, bson.D{{Key: "_id", Value: metadataID}}, meta, options.Replace().SetUpsert(true))
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= meta.SchemaVersion {
+			continue
+		}
+		log.Info(fmt.Sprintf("Migrating schema to version %d: %s", m.version, m.name))
+		if err := m.up(ctx, db, settings); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		meta.SchemaVersion = m.version
+		if err := save(); err != nil {
+			return err
+		}
+	}
+
+	meta.Network = settings.Network
+	meta.Mode = settings.Mode
+	return save()
+}
+
+func createIndexes(ctx context.Context, db *mongo.Database, _ Settings) error {
+	heightIndex := mongo.IndexModel{
+		Keys:    bson.D{{Key: "height", Value: 1}},
+		Options: options.Index().SetUnique(false),
+	}
+
+	prevBlockIndex := mongo.IndexModel{
+		Keys:    bson.D{{Key: "previous_block", Value: 1}},
+		Options: options.Index().SetUnique(false),
+	}
+
+	_, err := db.Collection("Blocks").Indexes().CreateMany(ctx, []mongo.IndexModel{heightIndex, prevBlockIndex})
+	if err != nil {
+		return err
+	}
+
+	spendingTxhashIndex := mongo.IndexModel{
+		Keys:    bson.D{{Key: "spending_tx_hash", Value: 1}},
+		Options: options.Index().SetUnique(false),
+	}
+
+	fundingTxIndex := mongo.IndexModel{
+		Keys:    bson.D{{Key: "funding_tx_hash", Value: 1}, {Key: "funding_tx_index", Value: 1}},
+		Options: options.Index().SetUnique(false),
+	}
+
+	_, err = db.Collection("OutPoints").Indexes().CreateMany(ctx, []mongo.IndexModel{spendingTxhashIndex, fundingTxIndex})
+	return err
+}
+
+// migrateHexToBinary rewrites documents written while hashes and scripts were stored as hex strings
+// documents keyed by a hash are reinserted since _id can not be updated in place,
+// the binary copy is upserted before the string one is deleted so an interrupted run can be resumed
+func migrateHexToBinary(ctx context.Context, db *mongo.Database, _ Settings) error {
+	if err := migrateCollection(ctx, db.Collection("Blocks"), "_id", true, hexBlockToBinary); err != nil {
+		return err
+	}
+	if err := migrateCollection(ctx, db.Collection("Transactions"), "_id", true, hexTxToBinary); err != nil {
+		return err
+	}
+	return migrateCollection(ctx, db.Collection("OutPoints"), "funding_tx_hash", false, hexOutPointToBinary)
+}
+
+func hexBlockToBinary(doc bson.M) error {
+	toBinary(doc, []string{"_id", "previous_block", "merkle_root"}, nil)
+	return nil
+}
+
+func hexTxToBinary(doc bson.M) error {
+	toBinary(doc, []string{"_id", "block_hash"}, nil)
+	return nil
+}
+
+func hexOutPointToBinary(doc bson.M) error {
+	// witness items used to be joined with commas
+	if witness, ok := doc["witness"].(string); ok {
+		var stack wire.TxWitness
+		if witness != "" {
+			for _, item := range strings.Split(witness, ",") {
+				b, err := hex.DecodeString(item)
+				if err != nil {
+					return err
+				}
+				stack = append(stack, b)
+			}
+		}
+		doc["witness"] = serializeWitness(stack)
+	}
+	toBinary(doc, []string{"spending_tx_hash", "funding_tx_hash"}, []string{"signature_script", "pk_script"})
+	return nil
+}
+
+// migrateCollection converts every document whose key is still a string
+func migrateCollection(ctx context.Context, col *mongo.Collection, key string, reinsert bool, convert func(doc bson.M) error) error {
+	cursor, err := col.Find(ctx, bson.D{{Key: key, Value: bson.D{{Key: "$type", Value: "string"}}}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	models := make([]mongo.WriteModel, 0, migrateBatchSize)
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		id := doc["_id"]
+		if err := convert(doc); err != nil {
+			return err
+		}
+
+		if reinsert {
+			// the binary copy may be left over from an interrupted run, it is overwritten rather than inserted again
+			models = append(models,
+				mongo.NewReplaceOneModel().SetFilter(bson.D{{Key: "_id", Value: doc["_id"]}}).SetReplacement(doc).SetUpsert(true),
+				mongo.NewDeleteOneModel().SetFilter(bson.D{{Key: "_id", Value: id}}))
+		} else {
+			models = append(models, mongo.NewReplaceOneModel().SetFilter(bson.D{{Key: "_id", Value: id}}).SetReplacement(doc))
+		}
+
+		if len(models) >= migrateBatchSize {
+			if _, err := col.BulkWrite(ctx, models); err != nil {
+				return err
+			}
+			models = models[:0]
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	if len(models) > 0 {
+		_, err = col.BulkWrite(ctx, models)
+	}
+	return err
+}
+
+func toBinary(doc bson.M, hashes []string, scripts []string) {
+	for _, key := range hashes {
+		if v, ok := doc[key].(string); ok {
+			doc[key] = Hash(v)
+		}
+	}
+	for _, key := range scripts {
+		if v, ok := doc[key].(string); ok {
+			doc[key] = Script(v)
+		}
+	}
+}
+
+func createTxBlockIndex(ctx context.Context, db *mongo.Database, _ Settings) error {
+	_, err := db.Collection("Transactions").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "block_hash", Value: 1}},
+		Options: options.Index().SetUnique(false),
+	})
+	return err
+}
+
+// migrateSpendingHeight indexes spending_height and fills it from the spending transactions
+func migrateSpendingHeight(ctx context.Context, db *mongo.Database, _ Settings) error {
+	_, err := db.Collection("OutPoints").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "spending_height", Value: 1}},
+		Options: options.Index().SetUnique(false),
+	})
+	if err != nil {
+		return err
+	}
+
+	// block_index holds the height of the block including the transaction
+	cursor, err := db.Collection("OutPoints").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "spending_height", Value: bson.D{{Key: "$exists", Value: false}}}}}},
+		{{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: "Transactions"},
+			{Key: "localField", Value: "spending_tx_hash"},
+			{Key: "foreignField", Value: "_id"},
+			{Key: "as", Value: "spending_tx"},
+		}}},
+		{{Key: "$project", Value: bson.D{{Key: "spending_height", Value: bson.D{{Key: "$ifNull", Value: bson.A{
+			bson.D{{Key: "$arrayElemAt", Value: bson.A{"$spending_tx.block_index", 0}}},
+			int32(0),
+		}}}}}}},
+		{{Key: "$merge", Value: bson.D{
+			{Key: "into", Value: "OutPoints"},
+			{Key: "on", Value: "_id"},
+			{Key: "whenMatched", Value: "merge"},
+			{Key: "whenNotMatched", Value: "discard"},
+		}}},
+	})
+	if err != nil {
+		return err
+	}
+	return cursor.Close(ctx)
+}
+
+// migrateTxBlockHeight moves the height out of block_index, which now holds the position in the block.
+// positions, sizes and fees of transactions indexed before are not backfilled
+func migrateTxBlockHeight(ctx context.Context, db *mongo.Database, _ Settings) error {
+	_, err := db.Collection("Transactions").UpdateMany(ctx,
+		bson.D{{Key: "block_height", Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.D{{Key: "$rename", Value: bson.D{{Key: "block_index", Value: "block_height"}}}})
+	return err
+}
+
+// migrateWitnessItems splits serialized witnesses into items and fills the disassembled scripts
+func migrateWitnessItems(ctx context.Context, db *mongo.Database, _ Settings) error {
+	err := updateCollection(ctx, db.Collection("OutPoints"), bson.D{{Key: "pk_script_asm", Value: bson.D{{Key: "$exists", Value: false}}}}, func(raw bson.Raw) (bson.D, error) {
+		var outPoint struct {
+			SignatureScript Script        `bson:"signature_script"`
+			Witness         bson.RawValue `bson:"witness"`
+			PkScript        Script        `bson:"pk_script"`
+		}
+		if err := bson.Unmarshal(raw, &outPoint); err != nil {
+			return nil, err
+		}
+		pkScript, err := outPoint.PkScript.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		sigScript, err := outPoint.SignatureScript.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		// unspent outpoints have no signature script nor witness, nothing is revealed
+		witness, err := deserializeWitness(outPoint.Witness)
+		if err != nil {
+			return nil, err
+		}
+		revealed := revealedScript(pkScript, sigScript, witness)
+		return bson.D{
+			{Key: "pk_script_asm", Value: disasm(pkScript)},
+			{Key: "signature_script_asm", Value: disasm(sigScript)},
+			{Key: "witness", Value: witnessItems(witness)},
+			{Key: "revealed_script", Value: Script(hex.EncodeToString(revealed))},
+			{Key: "revealed_script_asm", Value: disasm(revealed)},
+		}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// only coinbase inputs keep their witness
+	return updateCollection(ctx, db.Collection("Transactions"), bson.D{{Key: "inputs.witness", Value: bson.D{{Key: "$type", Value: "binData"}}}}, func(raw bson.Raw) (bson.D, error) {
+		var tx struct {
+			Inputs []struct {
+				TxHash          Hash          `bson:"tx_hash"`
+				Index           uint32        `bson:"index"`
+				Sequence        uint32        `bson:"sequence"`
+				SignatureScript Script        `bson:"signature_script"`
+				Witness         bson.RawValue `bson:"witness"`
+			} `bson:"inputs"`
+		}
+		if err := bson.Unmarshal(raw, &tx); err != nil {
+			return nil, err
+		}
+		inputs := make([]Input, len(tx.Inputs))
+		for i, input := range tx.Inputs {
+			witness, err := deserializeWitness(input.Witness)
+			if err != nil {
+				return nil, err
+			}
+			inputs[i] = Input{input.TxHash, input.Index, input.Sequence, input.SignatureScript, witnessItems(witness)}
+		}
+		return bson.D{{Key: "inputs", Value: inputs}}, nil
+	})
+}
+
+// deserializeWitness decodes a witness written by serializeWitness
+func deserializeWitness(v bson.RawValue) (wire.TxWitness, error) {
+	if v.Type != bsontype.Binary {
+		return nil, nil
+	}
+	_, b := v.Binary()
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	r := bytes.NewReader(b)
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	witness := make(wire.TxWitness, count)
+	for i := range witness {
+		witness[i], err = wire.ReadVarBytes(r, 0, wire.MaxMessagePayload, "witness item")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return witness, nil
+}
+
+// updateCollection applies the $set returned by update to every document matching filter,
+// documents update returns nil for are left as they are
+func updateCollection(ctx context.Context, col *mongo.Collection, filter bson.D, update func(doc bson.Raw) (bson.D, error)) error {
+	cursor, err := col.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	models := make([]mongo.WriteModel, 0, migrateBatchSize)
+	for cursor.Next(ctx) {
+		set, err := update(cursor.Current)
+		if err != nil {
+			return err
+		}
+		if set == nil {
+			continue
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: cursor.Current.Lookup("_id")}}).
+			SetUpdate(bson.D{{Key: "$set", Value: set}}))
+
+		if len(models) >= migrateBatchSize {
+			if _, err := col.BulkWrite(ctx, models); err != nil {
+				return err
+			}
+			models = models[:0]
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	if len(models) > 0 {
+		_, err = col.BulkWrite(ctx, models)
+	}
+	return err
+}
+
+// migrateAddresses records the funding height of outpoints and builds the Addresses collection from them.
+// outpoints already pruned are missing from the summary
+func migrateAddresses(ctx context.Context, db *mongo.Database, _ Settings) error {
+	_, err := db.Collection("OutPoints").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "spender", Value: 1}},
+		Options: options.Index().SetUnique(false),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = aggregateOutPoints(ctx, db, mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "funding_height", Value: bson.D{{Key: "$exists", Value: false}}}}}},
+		{{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: "Transactions"},
+			{Key: "localField", Value: "funding_tx_hash"},
+			{Key: "foreignField", Value: "_id"},
+			{Key: "as", Value: "funding_tx"},
+		}}},
+		{{Key: "$project", Value: bson.D{{Key: "funding_height", Value: bson.D{{Key: "$ifNull", Value: bson.A{
+			bson.D{{Key: "$arrayElemAt", Value: bson.A{"$funding_tx.block_height", 0}}},
+			int32(0),
+		}}}}}}},
+		{{Key: "$merge", Value: bson.D{
+			{Key: "into", Value: "OutPoints"},
+			{Key: "on", Value: "_id"},
+			{Key: "whenMatched", Value: "merge"},
+			{Key: "whenNotMatched", Value: "discard"},
+		}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	return buildAddresses(ctx, db)
+}
+
+// buildAddresses summarizes the outpoints of every spender into the Addresses collection
+func buildAddresses(ctx context.Context, db *mongo.Database) error {
+	spender := bson.D{{Key: "$match", Value: bson.D{{Key: "spender", Value: bson.D{{Key: "$nin", Value: bson.A{"", nil}}}}}}}
+	spent := bson.D{{Key: "$ne", Value: bson.A{bson.D{{Key: "$ifNull", Value: bson.A{"$spending_tx_hash", nil}}}, nil}}}
+	err := aggregateOutPoints(ctx, db, mongo.Pipeline{
+		spender,
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$spender"},
+			{Key: "funded", Value: bson.D{{Key: "$sum", Value: "$value"}}},
+			{Key: "spent", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$cond", Value: bson.A{spent, "$value", int64(0)}}}}}},
+			{Key: "utxo_count", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$cond", Value: bson.A{spent, int64(0), int64(1)}}}}}},
+			{Key: "first_seen_height", Value: bson.D{{Key: "$min", Value: "$funding_height"}}},
+			{Key: "last_funded_height", Value: bson.D{{Key: "$max", Value: "$funding_height"}}},
+			{Key: "last_spent_height", Value: bson.D{{Key: "$max", Value: "$spending_height"}}},
+		}}},
+		{{Key: "$project", Value: bson.D{
+			{Key: "funded", Value: 1},
+			{Key: "spent", Value: 1},
+			{Key: "balance", Value: bson.D{{Key: "$subtract", Value: bson.A{"$funded", "$spent"}}}},
+			{Key: "utxo_count", Value: 1},
+			{Key: "first_seen_height", Value: 1},
+			{Key: "last_seen_height", Value: bson.D{{Key: "$max", Value: bson.A{"$last_funded_height", "$last_spent_height"}}}},
+		}}},
+		mergeInto("Addresses"),
+	})
+	if err != nil {
+		return err
+	}
+
+	// txs funding or spending an address are counted once
+	return aggregateOutPoints(ctx, db, mongo.Pipeline{
+		spender,
+		{{Key: "$project", Value: bson.D{{Key: "spender", Value: 1}, {Key: "tx", Value: bson.A{"$funding_tx_hash", "$spending_tx_hash"}}}}},
+		{{Key: "$unwind", Value: "$tx"}},
+		{{Key: "$match", Value: bson.D{{Key: "tx", Value: bson.D{{Key: "$ne", Value: nil}}}}}},
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: bson.D{{Key: "spender", Value: "$spender"}, {Key: "tx", Value: "$tx"}}}}}},
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$_id.spender"}, {Key: "tx_count", Value: bson.D{{Key: "$sum", Value: int64(1)}}}}}},
+		mergeInto("Addresses"),
+	})
+}
+
+func aggregateOutPoints(ctx context.Context, db *mongo.Database, pipeline mongo.Pipeline) error {
+	cursor, err := db.Collection("OutPoints").Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	return cursor.Close(ctx)
+}
+
+func mergeInto(col string) bson.D {
+	return bson.D{{Key: "$merge", Value: bson.D{
+		{Key: "into", Value: col},
+		{Key: "on", Value: "_id"},
+		{Key: "whenMatched", Value: "merge"},
+		{Key: "whenNotMatched", Value: "insert"},
+	}}}
+}
+
+func migrateScriptHash(ctx context.Context, db *mongo.Database, _ Settings) error {
+	err := updateCollection(ctx, db.Collection("OutPoints"), bson.D{{Key: "script_hash", Value: bson.D{{Key: "$exists", Value: false}}}}, func(raw bson.Raw) (bson.D, error) {
+		var outPoint struct {
+			PkScript Script `bson:"pk_script"`
+		}
+		if err := bson.Unmarshal(raw, &outPoint); err != nil {
+			return nil, err
+		}
+		pkScript, err := outPoint.PkScript.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: "script_hash", Value: scriptHash(pkScript)}}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Collection("OutPoints").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "script_hash", Value: 1}},
+		Options: options.Index().SetUnique(false),
+	})
+	return err
+}
+
+// migratePayload extracts payloads of OP_RETURN outputs, they are either nulldata or nonstandard
+func migratePayload(ctx context.Context, db *mongo.Database, _ Settings) error {
+	filter := bson.D{{Key: "type", Value: bson.D{{Key: "$in", Value: bson.A{"nulldata", "nonstandard"}}}}}
+	err := updateCollection(ctx, db.Collection("OutPoints"), filter, func(raw bson.Raw) (bson.D, error) {
+		var outPoint OutPoint
+		if err := bson.Unmarshal(raw, &outPoint); err != nil {
+			return nil, err
+		}
+		pkScript, err := outPoint.PkScript.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		outPoint.setPayload(pkScript)
+		if outPoint.Payload == "" {
+			return nil, nil
+		}
+		return bson.D{{Key: "payload", Value: outPoint.Payload}, {Key: "payload_size", Value: outPoint.PayloadSize}}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Collection("OutPoints").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "payload", Value: 1}},
+		Options: options.Index().SetUnique(false).
+			SetPartialFilterExpression(bson.D{{Key: "payload", Value: bson.D{{Key: "$exists", Value: true}}}}),
+	})
+	return err
+}
+
+// migrateOwners fills the owner of outpoints. Those with an address keep it,
+// the others are classified again and the address summaries rebuilt for their new spenders.
+// pruned databases keep balances and utxo counts, totals lose the outpoints already pruned
+func migrateOwners(ctx context.Context, db *mongo.Database, settings Settings) error {
+	col := db.Collection("OutPoints")
+	_, err := col.UpdateMany(ctx,
+		bson.D{{Key: "owner", Value: bson.D{{Key: "$exists", Value: false}}}, {Key: "spender", Value: bson.D{{Key: "$nin", Value: bson.A{"", nil}}}}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.D{{Key: "owner", Value: bson.D{{Key: "address", Value: "$spender"}}}}}}})
+	if err != nil {
+		return err
+	}
+
+	err = updateCollection(ctx, col, bson.D{{Key: "owner", Value: bson.D{{Key: "$exists", Value: false}}}}, func(raw bson.Raw) (bson.D, error) {
+		var outPoint struct {
+			PkScript Script `bson:"pk_script"`
+		}
+		if err := bson.Unmarshal(raw, &outPoint); err != nil {
+			return nil, err
+		}
+		pkScript, err := outPoint.PkScript.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		class, owner, spender := classify(pkScript, settings.ChainParams)
+		return bson.D{{Key: "owner", Value: owner}, {Key: "spender", Value: spender}, {Key: "type", Value: class.String()}}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := db.Collection("Addresses").Drop(ctx); err != nil {
+		return err
+	}
+	return buildAddresses(ctx, db)
+}
+
+// migrateCoinbase flags coinbase txs and their outpoints and records when the outpoints mature.
+// txs stored before their inputs were recorded are coinbase when they spend no outpoint,
+// on pruned databases those whose spent outpoints are gone are flagged too
+func migrateCoinbase(ctx context.Context, db *mongo.Database, settings Settings) error {
+	inputs := bson.D{{Key: "$ifNull", Value: bson.A{"$inputs", bson.A{}}}}
+	cursor, err := db.Collection("Transactions").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "coinbase", Value: bson.D{{Key: "$exists", Value: false}}}}}},
+		{{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: "OutPoints"},
+			{Key: "localField", Value: "_id"},
+			{Key: "foreignField", Value: "spending_tx_hash"},
+			{Key: "as", Value: "spent"},
+		}}},
+		{{Key: "$project", Value: bson.D{{Key: "coinbase", Value: bson.D{{Key: "$cond", Value: bson.A{
+			bson.D{{Key: "$gt", Value: bson.A{bson.D{{Key: "$size", Value: inputs}}, 0}}},
+			bson.D{{Key: "$eq", Value: bson.A{bson.D{{Key: "$arrayElemAt", Value: bson.A{"$inputs.index", 0}}}, int64(wire.MaxPrevOutIndex)}}},
+			bson.D{{Key: "$eq", Value: bson.A{bson.D{{Key: "$size", Value: "$spent"}}, 0}}},
+		}}}}}}},
+		{{Key: "$merge", Value: bson.D{
+			{Key: "into", Value: "Transactions"},
+			{Key: "on", Value: "_id"},
+			{Key: "whenMatched", Value: "merge"},
+			{Key: "whenNotMatched", Value: "discard"},
+		}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	if err := cursor.Close(ctx); err != nil {
+		return err
+	}
+
+	coinbase := bson.D{{Key: "$ifNull", Value: bson.A{bson.D{{Key: "$arrayElemAt", Value: bson.A{"$funding_tx.coinbase", 0}}}, false}}}
+	return aggregateOutPoints(ctx, db, mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "coinbase", Value: bson.D{{Key: "$exists", Value: false}}}}}},
+		{{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: "Transactions"},
+			{Key: "localField", Value: "funding_tx_hash"},
+			{Key: "foreignField", Value: "_id"},
+			{Key: "as", Value: "funding_tx"},
+		}}},
+		{{Key: "$project", Value: bson.D{{Key: "coinbase", Value: coinbase}, {Key: "mature_height", Value: bson.D{{Key: "$cond", Value: bson.A{
+			coinbase,
+			bson.D{{Key: "$add", Value: bson.A{"$funding_height", int32(settings.ChainParams.CoinbaseMaturity)}}},
+			"$funding_height",
+		}}}}}}},
+		{{Key: "$merge", Value: bson.D{
+			{Key: "into", Value: "OutPoints"},
+			{Key: "on", Value: "_id"},
+			{Key: "whenMatched", Value: "merge"},
+			{Key: "whenNotMatched", Value: "discard"},
+		}}},
+	})
+}
+
+// migrateSafe replaces the safe flag every tx was stored with by the one of settings.SafeDepth,
+// txs already safe are taken as having become safe at the height they reached the depth
+func migrateSafe(ctx context.Context, db *mongo.Database, settings Settings) error {
+	col := db.Collection("Transactions")
+	_, err := col.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "safe", Value: 1}, {Key: "block_height", Value: 1}}, Options: options.Index().SetUnique(false)},
+		{Keys: bson.D{{Key: "safe_height", Value: 1}}, Options: options.Index().SetUnique(false).SetSparse(true)},
+	})
+	if err != nil {
+		return err
+	}
+
+	var tip struct {
+		Height int32 `bson:"height"`
+	}
+	err = db.Collection("Blocks").FindOne(ctx, bson.D{{Key: "is_orphan", Value: false}},
+		options.FindOne().SetSort(bson.D{{Key: "height", Value: -1}}).SetProjection(bson.M{"height": 1})).Decode(&tip)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	depth := settings.SafeDepth
+	if depth <= 0 {
+		depth = DefaultSafeDepth
+	}
+	_, err = col.UpdateMany(ctx, bson.D{{Key: "safe_height", Value: bson.D{{Key: "$exists", Value: false}}}}, mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{{Key: "safe", Value: bson.D{{Key: "$lte", Value: bson.A{"$block_height", safeCutoff(tip.Height, depth)}}}}}}},
+		{{Key: "$set", Value: bson.D{{Key: "safe_height", Value: bson.D{{Key: "$cond", Value: bson.A{
+			"$safe",
+			bson.D{{Key: "$add", Value: bson.A{"$block_height", depth - 1}}},
+			"$$REMOVE",
+		}}}}}}},
+	})
+	return err
+}
+
+func createDeliveryIndexes(ctx context.Context, db *mongo.Database, _ Settings) error {
+	_, err := db.Collection("Deliveries").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt", Value: 1}}, Options: options.Index().SetUnique(false)},
+		{Keys: bson.D{{Key: "block_hash", Value: 1}}, Options: options.Index().SetUnique(false)},
+	})
+	return err
+}
+
+func createBroadcastIndexes(ctx context.Context, db *mongo.Database, _ Settings) error {
+	_, err := db.Collection("Broadcasts").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "created", Value: 1}}, Options: options.Index().SetUnique(false),
+	})
+	return err
+}
+
+// migrateBlockTxIDs stores the txids of the blocks whose txs are all still stored with their position,
+// blocks still holding their raw bytes take them from those instead.
+// blocks with pruned txs or txs indexed before positions were stored are left without and get no merkle proofs
+func migrateBlockTxIDs(ctx context.Context, db *mongo.Database, _ Settings) error {
+	cursor, err := db.Collection("Transactions").Aggregate(ctx, blockTxIDsPipeline(), options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	if err := cursor.Close(ctx); err != nil {
+		return err
+	}
+
+	blocks := db.Collection("Blocks")
+	filter := bson.D{{Key: "txids", Value: bson.D{{Key: "$exists", Value: false}}}, {Key: "raw", Value: bson.D{{Key: "$exists", Value: true}}}}
+	return updateCollection(ctx, blocks, filter, rawBlockTxIDs)
+}
+
+// blockTxIDsPipeline groups the txids of each block in block order and sets them on the block
+// when they are exactly the positions 0 to tx_count-1, blocks stored before tx_count was recorded get none
+func blockTxIDsPipeline() mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "block_index", Value: bson.D{{Key: "$exists", Value: true}}}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "block_hash", Value: 1}, {Key: "block_index", Value: 1}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$block_hash"},
+			{Key: "txids", Value: bson.D{{Key: "$push", Value: "$_id"}}},
+			{Key: "positions", Value: bson.D{{Key: "$push", Value: "$block_index"}}},
+		}}},
+		{{Key: "$merge", Value: bson.D{
+			{Key: "into", Value: "Blocks"},
+			{Key: "on", Value: "_id"},
+			{Key: "whenMatched", Value: mongo.Pipeline{
+				{{Key: "$set", Value: bson.D{{Key: "txids", Value: bson.D{{Key: "$cond", Value: bson.A{
+					bson.D{{Key: "$eq", Value: bson.A{"$$new.positions", bson.D{{Key: "$range", Value: bson.A{0, bson.D{{Key: "$ifNull", Value: bson.A{"$tx_count", 0}}}}}}}}},
+					"$$new.txids",
+					"$$REMOVE",
+				}}}}}}},
+			}},
+			{Key: "whenNotMatched", Value: "discard"},
+		}}},
+	}
+}
+
+// rawBlockTxIDs sets the txids of a block from its raw bytes
+func rawBlockTxIDs(doc bson.Raw) (bson.D, error) {
+	_, raw, ok := doc.Lookup("raw").BinaryOK()
+	if !ok {
+		return nil, nil
+	}
+	block, err := deserializeBlock(raw)
+	if err != nil {
+		return nil, fmt.Errorf("block at height %s: %w", doc.Lookup("height"), err)
+	}
+	return bson.D{{Key: "txids", Value: blockTxIDs(block)}}, nil
+}
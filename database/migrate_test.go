@@ -0,0 +1,350 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var testSettings = Settings{
+	Network:     "btcrt",
+	Mode:        "full",
+	ChainParams: &chaincfg.RegressionNetParams,
+	SafeDepth:   DefaultSafeDepth,
+}
+
+// testDB returns an empty database of its own, dropped afterwards.
+// the test is skipped unless BTC_INDEXER_TEST_MONGO_URI points at a replica set
+func testDB(t *testing.T) *mongo.Database {
+	t.Helper()
+	uri := os.Getenv("BTC_INDEXER_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("BTC_INDEXER_TEST_MONGO_URI is not set")
+	}
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	db := client.Database(fmt.Sprintf("migratetest_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	return db
+}
+
+// runMigration runs the migration of version on db
+func runMigration(t *testing.T, db *mongo.Database, version int) {
+	t.Helper()
+	for _, m := range migrations {
+		if m.version == version {
+			if err := m.up(context.Background(), db, testSettings); err != nil {
+				t.Fatalf("migration %d: %v", version, err)
+			}
+			return
+		}
+	}
+	t.Fatalf("no migration %d", version)
+}
+
+func insert(t *testing.T, col *mongo.Collection, docs ...interface{}) {
+	t.Helper()
+	if _, err := col.InsertMany(context.Background(), docs); err != nil {
+		t.Fatalf("InsertMany into %s: %v", col.Name(), err)
+	}
+}
+
+func TestHexToBinary(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	prev := strings.Repeat("cd", 32)
+	block := bson.M{"_id": hash, "previous_block": prev, "merkle_root": Hash(hash), "height": int32(1)}
+	if err := hexBlockToBinary(block); err != nil {
+		t.Fatalf("hexBlockToBinary: %v", err)
+	}
+	// values already binary and other fields are left alone
+	if want := (bson.M{"_id": Hash(hash), "previous_block": Hash(prev), "merkle_root": Hash(hash), "height": int32(1)}); !reflect.DeepEqual(block, want) {
+		t.Fatalf("block %v, want %v", block, want)
+	}
+
+	tx := bson.M{"_id": hash, "block_hash": prev, "block_height": int32(1)}
+	if err := hexTxToBinary(tx); err != nil {
+		t.Fatalf("hexTxToBinary: %v", err)
+	}
+	if want := (bson.M{"_id": Hash(hash), "block_hash": Hash(prev), "block_height": int32(1)}); !reflect.DeepEqual(tx, want) {
+		t.Fatalf("tx %v, want %v", tx, want)
+	}
+
+	outPoint := bson.M{"_id": 1, "funding_tx_hash": hash, "spending_tx_hash": prev, "pk_script": "0014", "signature_script": "", "witness": "3044,02ab", "value": int64(5)}
+	if err := hexOutPointToBinary(outPoint); err != nil {
+		t.Fatalf("hexOutPointToBinary: %v", err)
+	}
+	want := bson.M{"_id": 1, "funding_tx_hash": Hash(hash), "spending_tx_hash": Hash(prev), "pk_script": Script("0014"), "signature_script": Script(""),
+		"witness": serializeWitness(wire.TxWitness{{0x30, 0x44}, {0x02, 0xab}}), "value": int64(5)}
+	if !reflect.DeepEqual(outPoint, want) {
+		t.Fatalf("outpoint %v, want %v", outPoint, want)
+	}
+
+	outPoint = bson.M{"funding_tx_hash": hash, "witness": ""}
+	if err := hexOutPointToBinary(outPoint); err != nil || outPoint["witness"] != Script("") {
+		t.Fatalf("hexOutPointToBinary without witness = %v, %v", outPoint, err)
+	}
+	if err := hexOutPointToBinary(bson.M{"funding_tx_hash": hash, "witness": "30,zz"}); err == nil {
+		t.Fatal("hexOutPointToBinary of a witness item that is not hex succeeded")
+	}
+}
+
+// an interrupted run leaves the binary copy of a reinserted document next to the string one, the next run overwrites it
+func TestMigrateHexToBinary(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	hashA, hashB := strings.Repeat("0a", 32), strings.Repeat("0b", 32)
+	prev, root, txid := strings.Repeat("01", 32), strings.Repeat("02", 32), strings.Repeat("03", 32)
+	insert(t, db.Collection("Blocks"),
+		bson.D{{Key: "_id", Value: hashA}, {Key: "previous_block", Value: prev}, {Key: "merkle_root", Value: root}, {Key: "height", Value: 1}},
+		bson.D{{Key: "_id", Value: Hash(hashA)}, {Key: "previous_block", Value: Hash(prev)}, {Key: "height", Value: 1}},
+		bson.D{{Key: "_id", Value: hashB}, {Key: "previous_block", Value: hashA}, {Key: "merkle_root", Value: root}, {Key: "height", Value: 2}})
+	insert(t, db.Collection("Transactions"), bson.D{{Key: "_id", Value: txid}, {Key: "block_hash", Value: hashA}, {Key: "block_index", Value: 1}})
+	insert(t, db.Collection("OutPoints"),
+		bson.D{{Key: "funding_tx_hash", Value: txid}, {Key: "funding_tx_index", Value: 0}, {Key: "spending_tx_hash", Value: ""},
+			{Key: "pk_script", Value: "0014"}, {Key: "signature_script", Value: ""}, {Key: "witness", Value: "3044,02ab"}})
+
+	for run := 0; run < 2; run++ {
+		runMigration(t, db, 2)
+		for _, name := range []string{"Blocks", "Transactions"} {
+			n, err := db.Collection(name).CountDocuments(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$type", Value: "string"}}}})
+			if err != nil || n != 0 {
+				t.Fatalf("run %d: %d %s keyed by a string, %v", run, n, name, err)
+			}
+		}
+
+		var blocks []struct {
+			ID         Hash  `bson:"_id"`
+			Previous   Hash  `bson:"previous_block"`
+			MerkleRoot Hash  `bson:"merkle_root"`
+			Height     int32 `bson:"height"`
+		}
+		cursor, err := db.Collection("Blocks").Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "height", Value: 1}}))
+		if err != nil || cursor.All(ctx, &blocks) != nil {
+			t.Fatalf("run %d: Find blocks: %v", run, err)
+		}
+		if len(blocks) != 2 || blocks[0].ID != Hash(hashA) || blocks[0].MerkleRoot != Hash(root) || blocks[0].Previous != Hash(prev) ||
+			blocks[1].ID != Hash(hashB) || blocks[1].Previous != Hash(hashA) {
+			t.Fatalf("run %d: blocks %+v", run, blocks)
+		}
+
+		var tx struct {
+			ID        Hash `bson:"_id"`
+			BlockHash Hash `bson:"block_hash"`
+		}
+		if err := db.Collection("Transactions").FindOne(ctx, bson.D{{Key: "_id", Value: Hash(txid)}}).Decode(&tx); err != nil || tx.BlockHash != Hash(hashA) {
+			t.Fatalf("run %d: tx %+v, %v", run, tx, err)
+		}
+
+		var outPoint struct {
+			FundingTxHash Hash   `bson:"funding_tx_hash"`
+			PkScript      Script `bson:"pk_script"`
+			Witness       Script `bson:"witness"`
+		}
+		if err := db.Collection("OutPoints").FindOne(ctx, bson.D{{Key: "funding_tx_hash", Value: Hash(txid)}}).Decode(&outPoint); err != nil ||
+			outPoint.PkScript != "0014" || outPoint.Witness != serializeWitness(wire.TxWitness{{0x30, 0x44}, {0x02, 0xab}}) {
+			t.Fatalf("run %d: outpoint %+v, %v", run, outPoint, err)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	meta := func() Metadata {
+		t.Helper()
+		var meta Metadata
+		if err := db.Collection("Metadata").FindOne(ctx, bson.D{{Key: "_id", Value: metadataID}}).Decode(&meta); err != nil {
+			t.Fatalf("metadata: %v", err)
+		}
+		return meta
+	}
+	setMeta := func(meta Metadata) {
+		t.Helper()
+		if _, err := db.Collection("Metadata").ReplaceOne(ctx, bson.D{{Key: "_id", Value: metadataID}}, meta); err != nil {
+			t.Fatalf("ReplaceOne: %v", err)
+		}
+	}
+
+	// a new database runs every migration, a migrated one none
+	for run := 0; run < 2; run++ {
+		if err := migrate(ctx, db, testSettings); err != nil {
+			t.Fatalf("run %d: migrate: %v", run, err)
+		}
+		want := Metadata{ID: metadataID, SchemaVersion: SchemaVersion, Network: testSettings.Network, Mode: testSettings.Mode}
+		if got := meta(); got != want {
+			t.Fatalf("run %d: metadata %+v, want %+v", run, got, want)
+		}
+	}
+
+	mainnet := testSettings
+	mainnet.Network = "btc"
+	if err := migrate(ctx, db, mainnet); !errors.Is(err, ErrNetworkMismatch) {
+		t.Fatalf("migrate for another network = %v, want ErrNetworkMismatch", err)
+	}
+
+	pruned := testSettings
+	pruned.Mode = modePruned
+	if err := migrate(ctx, db, pruned); err != nil {
+		t.Fatalf("migrate in pruned mode: %v", err)
+	}
+	if err := migrate(ctx, db, testSettings); !errors.Is(err, ErrPrunedDatabase) {
+		t.Fatalf("migrate of a pruned database in full mode = %v, want ErrPrunedDatabase", err)
+	}
+
+	newer := meta()
+	newer.Mode = testSettings.Mode
+	newer.SchemaVersion = SchemaVersion + 1
+	setMeta(newer)
+	if err := migrate(ctx, db, testSettings); !errors.Is(err, ErrIncompatibleSchema) {
+		t.Fatalf("migrate of a newer schema = %v, want ErrIncompatibleSchema", err)
+	}
+
+	// a database left at an older version resumes from the next migration
+	older := newer
+	older.SchemaVersion = SchemaVersion - 1
+	setMeta(older)
+	if err := migrate(ctx, db, testSettings); err != nil {
+		t.Fatalf("migrate from version %d: %v", older.SchemaVersion, err)
+	}
+	if got := meta(); got.SchemaVersion != SchemaVersion {
+		t.Fatalf("metadata %+v, want version %d", got, SchemaVersion)
+	}
+}
+
+// testBlock returns a block of n txs, blocks of distinct nonces share no tx
+func testBlock(nonce uint32, n int) *wire.MsgBlock {
+	block := wire.NewMsgBlock(wire.NewBlockHeader(1, chaincfg.RegressionNetParams.GenesisHash, chaincfg.RegressionNetParams.GenesisHash, 0, nonce))
+	for i := 0; i < n; i++ {
+		tx := wire.NewMsgTx(wire.TxVersion)
+		tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(chaincfg.RegressionNetParams.GenesisHash, uint32(i)), nil, nil))
+		tx.AddTxOut(wire.NewTxOut(int64(i+1), []byte{0x51}))
+		tx.LockTime = nonce
+		block.AddTransaction(tx)
+	}
+	return block
+}
+
+func TestBlockTxIDsPipeline(t *testing.T) {
+	pipeline := blockTxIDsPipeline()
+	// txs indexed before their position was stored are left out rather than pushed in any order
+	match := bson.D{{Key: "$match", Value: bson.D{{Key: "block_index", Value: bson.D{{Key: "$exists", Value: true}}}}}}
+	if !reflect.DeepEqual(pipeline[0], match) {
+		t.Fatalf("first stage = %v, want %v", pipeline[0], match)
+	}
+	if pipeline[1][0].Key != "$sort" || pipeline[2][0].Key != "$group" || pipeline[3][0].Key != "$merge" {
+		t.Fatalf("stages = %v", pipeline)
+	}
+	group := pipeline[2][0].Value.(bson.D)
+	if group[2].Key != "positions" {
+		t.Fatalf("group = %v, positions are not collected", group)
+	}
+}
+
+func TestRawBlockTxIDs(t *testing.T) {
+	block := testBlock(0, 3)
+	raw, err := serializeBlock(block)
+	if err != nil {
+		t.Fatalf("serializeBlock: %v", err)
+	}
+	doc, err := bson.Marshal(bson.D{{Key: "height", Value: 1}, {Key: "raw", Value: raw}})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	set, err := rawBlockTxIDs(doc)
+	if err != nil {
+		t.Fatalf("rawBlockTxIDs: %v", err)
+	}
+	if want := (bson.D{{Key: "txids", Value: blockTxIDs(block)}}); !reflect.DeepEqual(set, want) {
+		t.Fatalf("rawBlockTxIDs = %v, want %v", set, want)
+	}
+
+	doc, _ = bson.Marshal(bson.D{{Key: "height", Value: 1}, {Key: "raw", Value: raw[:len(raw)-1]}})
+	if _, err := rawBlockTxIDs(doc); err == nil {
+		t.Fatal("rawBlockTxIDs of a truncated block succeeded")
+	}
+	doc, _ = bson.Marshal(bson.D{{Key: "height", Value: 1}})
+	if set, err := rawBlockTxIDs(doc); set != nil || err != nil {
+		t.Fatalf("rawBlockTxIDs of a block without raw = %v, %v", set, err)
+	}
+}
+
+func TestMigrateBlockTxIDs(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	type seeded struct {
+		block     *wire.MsgBlock
+		positions []int // positions of the stored txs, nil for txs indexed before positions were stored
+		raw       bool
+		want      bool // whether txids are stored
+	}
+	blocks := map[string]seeded{
+		"positions":       {testBlock(1, 3), []int{2, 0, 1}, false, true},
+		"legacy":          {testBlock(2, 3), nil, false, false},
+		"legacy with raw": {testBlock(3, 2), nil, true, true},
+		"pruned tx":       {testBlock(4, 3), []int{0, 2}, false, false},
+		"pruned with raw": {testBlock(5, 3), []int{2}, true, true},
+		"duplicate":       {testBlock(6, 2), []int{0, 0}, false, false},
+	}
+
+	for name, seed := range blocks {
+		hash := Hash(seed.block.BlockHash().String())
+		doc := bson.D{{Key: "_id", Value: hash}, {Key: "height", Value: 1}, {Key: "tx_count", Value: len(seed.block.Transactions)}}
+		if seed.raw {
+			raw, err := serializeBlock(seed.block)
+			if err != nil {
+				t.Fatalf("%s: serializeBlock: %v", name, err)
+			}
+			doc = append(doc, bson.E{Key: "raw", Value: raw})
+		}
+		insert(t, db.Collection("Blocks"), doc)
+
+		txids := blockTxIDs(seed.block)
+		if seed.positions == nil {
+			for _, txid := range txids {
+				insert(t, db.Collection("Transactions"), bson.D{{Key: "_id", Value: txid}, {Key: "block_hash", Value: hash}, {Key: "block_height", Value: 1}})
+			}
+			continue
+		}
+		for i, position := range seed.positions {
+			// a txid of its own keeps duplicated positions apart
+			txid := txids[position]
+			if i > 0 && seed.positions[i-1] == position {
+				txid = Hash(fmt.Sprintf("%064x", i))
+			}
+			insert(t, db.Collection("Transactions"), bson.D{{Key: "_id", Value: txid}, {Key: "block_hash", Value: hash}, {Key: "block_height", Value: 1}, {Key: "block_index", Value: position}})
+		}
+	}
+
+	runMigration(t, db, 14)
+
+	for name, seed := range blocks {
+		var doc blockDoc
+		if err := db.Collection("Blocks").FindOne(ctx, bson.D{{Key: "_id", Value: Hash(seed.block.BlockHash().String())}}).Decode(&doc); err != nil {
+			t.Fatalf("%s: FindOne: %v", name, err)
+		}
+		var want []Hash
+		if seed.want {
+			want = blockTxIDs(seed.block)
+		}
+		if !reflect.DeepEqual(doc.TxIDs, want) {
+			t.Errorf("%s: txids = %v, want %v", name, doc.TxIDs, want)
+		}
+	}
+}
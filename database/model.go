@@ -1,49 +1,526 @@
 package database
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type Block struct {
-	ID string `bson:"_id"` //blockhash
+	ID Hash `bson:"_id" json:"hash"` //blockhash
+
+	Height   int32 `bson:"height" json:"height"` // should be indexed
+	IsOrphan bool  `bson:"is_orphan" json:"is_orphan"`
+
+	PreviousBlock Hash   `bson:"previous_block" json:"previous_block"` // indexed
+	Version       int32  `bson:"version" json:"version"`
+	Nonce         uint32 `bson:"nonce" json:"nonce"`
+	Timestamp     int64  `bson:"timestamp" json:"timestamp"` // time stamp indexed
+	Bits          uint32 `bson:"bits" json:"bits"`
+	MerkleRoot    Hash   `bson:"merkle_root" json:"merkle_root"`
+
+	Size         int     `bson:"size" json:"size"`
+	StrippedSize int     `bson:"stripped_size" json:"stripped_size"`
+	Weight       int     `bson:"weight" json:"weight"`
+	TxCount      int     `bson:"tx_count" json:"tx_count"`
+	MedianTime   int64   `bson:"median_time" json:"median_time"` // median time past of the block and its 10 ancestors
+	Difficulty   float64 `bson:"difficulty" json:"difficulty"`
+
+	Subsidy   int64 `bson:"subsidy" json:"subsidy"`
+	TotalFees int64 `bson:"total_fees" json:"total_fees"` // set once the block is connected to the best chain
+
+	CoinbaseScript    Script `bson:"coinbase_script" json:"coinbase_script"`
+	CoinbaseHeight    int32  `bson:"coinbase_height,omitempty" json:"coinbase_height,omitempty"` // BIP34 height, 0 when not encoded
+	WitnessCommitment Script `bson:"witness_commitment,omitempty" json:"witness_commitment,omitempty"`
+}
+
+// medianTimeBlocks is the number of blocks median time past is computed over
+const medianTimeBlocks = 11
+
+// difficulty1Bits is the target of difficulty 1 on every network, like bitcoind reports it
+const difficulty1Bits = 0x1d00ffff
 
-	Height   int32 `bson:"height"` // should be indexed
-	IsOrphan bool  `bson:"is_orphan"`
+// blocks within reorgWindow of the tip keep their raw bytes so they can be reconnected
+const reorgWindow = 100
+
+// DefaultSafeDepth is the number of confirmations after which a tx is safe when no depth is configured
+const DefaultSafeDepth int32 = 6
+
+// safeCutoff is the highest block height whose txs are safe at tip
+func safeCutoff(tip, depth int32) int32 {
+	return tip - depth + 1
+}
 
-	PreviousBlock string `bson:"previous_block"` // indexed
-	Version       int32  `bson:"version"`
-	Nonce         uint32 `bson:"nonce"`
-	Timestamp     int64  `bson:"timestamp"` // time stamp indexed
-	Bits          uint32 `bson:"bits"`
-	MerkleRoot    string `bson:"merkle_root"`
+// minPruneDepth keeps pruning out of the reorg window, disconnecting a block needs its spends
+func minPruneDepth(depth int32) int32 {
+	if depth > 0 && depth < reorgWindow {
+		return reorgWindow
+	}
+	return depth
+}
+
+// blockDoc is the stored form of a Block, Raw is dropped once the block leaves the reorg window.
+// TxIDs are kept for merkle proofs, blocks stored before schema version 14 may lack them
+type blockDoc struct {
+	Block `bson:",inline"`
+	Raw   []byte `bson:"raw,omitempty"`
+	TxIDs []Hash `bson:"txids,omitempty"`
+}
+
+// blockTxIDs returns the txids of block in block order
+func blockTxIDs(block *wire.MsgBlock) []Hash {
+	txIDs := make([]Hash, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		txIDs[i] = Hash(tx.TxHash().String())
+	}
+	return txIDs
+}
+
+// toHashes converts hex hashes for a $in filter
+func toHashes(hashes []string) []Hash {
+	items := make([]Hash, len(hashes))
+	for i, hash := range hashes {
+		items[i] = Hash(hash)
+	}
+	return items
+}
+
+func serializeBlock(block *wire.MsgBlock) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(block.SerializeSize())
+	err := block.Serialize(&buf)
+	return buf.Bytes(), err
+}
+
+func deserializeBlock(raw []byte) (*wire.MsgBlock, error) {
+	block := new(wire.MsgBlock)
+	err := block.Deserialize(bytes.NewReader(raw))
+	return block, err
+}
+
+// newBlock builds the Block for block, prevTimestamps are the timestamps of up to 10 ancestors
+func newBlock(block *wire.MsgBlock, height int32, isOrphan bool, chainParams *chaincfg.Params, prevTimestamps []int64) Block {
+	size := block.SerializeSize()
+	strippedSize := block.SerializeSizeStripped()
+
+	bl := Block{
+		ID:            Hash(block.BlockHash().String()),
+		Height:        height,
+		IsOrphan:      isOrphan,
+		PreviousBlock: Hash(block.Header.PrevBlock.String()),
+		Version:       block.Header.Version,
+		Nonce:         block.Header.Nonce,
+		Timestamp:     block.Header.Timestamp.Unix(),
+		Bits:          block.Header.Bits,
+		MerkleRoot:    Hash(block.Header.MerkleRoot.String()),
+		Size:          size,
+		StrippedSize:  strippedSize,
+		Weight:        strippedSize*(blockchain.WitnessScaleFactor-1) + size,
+		TxCount:       len(block.Transactions),
+		MedianTime:    medianTime(append([]int64{block.Header.Timestamp.Unix()}, prevTimestamps...)),
+		Difficulty:    difficulty(block.Header.Bits),
+	}
+	if chainParams != nil {
+		bl.Subsidy = blockchain.CalcBlockSubsidy(height, chainParams)
+	}
+
+	if len(block.Transactions) == 0 || len(block.Transactions[0].TxIn) == 0 {
+		return bl
+	}
+	coinbase := btcutil.NewTx(block.Transactions[0])
+	bl.CoinbaseScript = Script(hex.EncodeToString(coinbase.MsgTx().TxIn[0].SignatureScript))
+	if block.Header.Version >= 2 {
+		if coinbaseHeight, err := blockchain.ExtractCoinbaseHeight(coinbase); err == nil {
+			bl.CoinbaseHeight = coinbaseHeight
+		}
+	}
+	if commitment, ok := blockchain.ExtractWitnessCommitment(coinbase); ok {
+		bl.WitnessCommitment = Script(hex.EncodeToString(commitment))
+	}
+	return bl
+}
+
+func medianTime(timestamps []int64) int64 {
+	sorted := append([]int64(nil), timestamps...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
+
+// difficulty is the ratio of the difficulty 1 target to the block target
+func difficulty(bits uint32) float64 {
+	target := new(big.Float).SetInt(blockchain.CompactToBig(bits))
+	if target.Sign() <= 0 {
+		return 0
+	}
+	d, _ := new(big.Float).Quo(new(big.Float).SetInt(blockchain.CompactToBig(difficulty1Bits)), target).Float64()
+	return d
 }
 
 type Transaction struct {
-	ID string `bson:"_id,omitempty"` //txhash
+	ID Hash `bson:"_id,omitempty" json:"txid"` //txhash
+
+	LockTime uint32 `bson:"lock_time" json:"lock_time"`
+	Version  int32  `bson:"version" json:"version"`
+
+	// Safe is set once the tx has safeDepth confirmations, at tip SafeHeight.
+	// Confirmations is not stored, getters fill it from the tip
+	Safe          bool  `bson:"safe" json:"safe"`
+	SafeHeight    int32 `bson:"safe_height,omitempty" json:"safe_height,omitempty"`
+	Confirmations int32 `bson:"-" json:"confirmations"`
+
+	BlockHash   Hash   `bson:"block_hash" json:"block_hash"` // indexed
+	BlockHeight int32  `bson:"block_height" json:"block_height"`
+	BlockIndex  uint32 `bson:"block_index" json:"block_index"` // position in the block
+
+	Inputs      []Input `bson:"inputs" json:"inputs"`
+	InputCount  int     `bson:"input_count" json:"input_count"`
+	OutputCount int     `bson:"output_count" json:"output_count"`
 
-	LockTime uint32 `bson:"lock_time"`
-	Version  int32  `bson:"version"`
-	Safe     bool   `bson:"safe"`
+	Size     int   `bson:"size" json:"size"`
+	VSize    int   `bson:"vsize" json:"vsize"`
+	Weight   int   `bson:"weight" json:"weight"`
+	Segwit   bool  `bson:"segwit" json:"segwit"`
+	Coinbase bool  `bson:"coinbase" json:"coinbase"`
+	Fee      int64 `bson:"fee" json:"fee"` // 0 for coinbase or when a prevout could not be resolved
+}
+
+// setConfirmations counts the blocks from the tx block to tip, both included
+func (tx *Transaction) setConfirmations(tip int32) {
+	tx.Confirmations = max(tip-tx.BlockHeight+1, 0)
+}
 
-	BlockHash  string `bson:"block_hash"`
-	BlockIndex int32  `bson:"block_index"`
+// Input is the outpoint spent by a tx input, in input order.
+// Spend details are on the spent OutPoint, only coinbase inputs keep them here
+type Input struct {
+	TxHash          Hash     `bson:"tx_hash" json:"tx_hash"`
+	Index           uint32   `bson:"index" json:"index"`
+	Sequence        uint32   `bson:"sequence,omitempty" json:"sequence,omitempty"`
+	SignatureScript Script   `bson:"signature_script,omitempty" json:"signature_script,omitempty"`
+	Witness         []Script `bson:"witness,omitempty" json:"witness,omitempty"`
+}
+
+// newTransaction builds the Transaction for tx at position index of a block,
+// prevValue resolves the value of spent outpoints for the fee
+func newTransaction(tx *wire.MsgTx, blockhash Hash, height int32, index uint32, prevValue func(wire.OutPoint) (int64, bool)) (Transaction, bool) {
+	size := tx.SerializeSize()
+	weight := tx.SerializeSizeStripped()*(blockchain.WitnessScaleFactor-1) + size
+
+	transaction := Transaction{
+		ID:          Hash(tx.TxHash().String()),
+		LockTime:    tx.LockTime,
+		Version:     tx.Version,
+		BlockHash:   blockhash,
+		BlockHeight: height,
+		BlockIndex:  index,
+		Inputs:      make([]Input, len(tx.TxIn)),
+		InputCount:  len(tx.TxIn),
+		OutputCount: len(tx.TxOut),
+		Size:        size,
+		VSize:       (weight + blockchain.WitnessScaleFactor - 1) / blockchain.WitnessScaleFactor,
+		Weight:      weight,
+		Segwit:      tx.HasWitness(),
+		Coinbase:    blockchain.IsCoinBaseTx(tx),
+	}
+
+	coinbase := transaction.Coinbase
+	for i, txIn := range tx.TxIn {
+		transaction.Inputs[i] = Input{
+			TxHash: Hash(txIn.PreviousOutPoint.Hash.String()),
+			Index:  txIn.PreviousOutPoint.Index,
+		}
+		if coinbase {
+			transaction.Inputs[i].Sequence = txIn.Sequence
+			transaction.Inputs[i].SignatureScript = Script(hex.EncodeToString(txIn.SignatureScript))
+			transaction.Inputs[i].Witness = witnessItems(txIn.Witness)
+		}
+	}
+	if coinbase {
+		return transaction, true
+	}
+
+	var in, out int64
+	for _, txIn := range tx.TxIn {
+		value, ok := prevValue(txIn.PreviousOutPoint)
+		if !ok {
+			return transaction, false
+		}
+		in += value
+	}
+	for _, txOut := range tx.TxOut {
+		out += txOut.Value
+	}
+	transaction.Fee = in - out
+	return transaction, true
+}
+
+// prevOutValue resolves values of spent outpoints for newTransaction
+func prevOutValue(prevOuts map[wire.OutPoint]*OutPoint) func(wire.OutPoint) (int64, bool) {
+	return func(prevOut wire.OutPoint) (int64, bool) {
+		out, ok := prevOuts[prevOut]
+		if !ok {
+			return 0, false
+		}
+		return out.Value, true
+	}
 }
 
 type OutPoint struct {
-	ID primitive.ObjectID `bson:"_id,omitempty"`
+	ID primitive.ObjectID `bson:"_id,omitempty" json:"-"`
 
-	SpendingTxHash  string `bson:"spending_tx_hash"` // indexed
-	SpendingTxIndex uint32 `bson:"spending_tx_index"`
-	Sequence        uint32 `bson:"sequence"`
-	SignatureScript string `bson:"signature_script"`
-	Witness         string `bson:"witness"`
+	SpendingTxHash     Hash     `bson:"spending_tx_hash" json:"spending_tx_hash"` // indexed
+	SpendingTxIndex    uint32   `bson:"spending_tx_index" json:"spending_tx_index"`
+	SpendingHeight     int32    `bson:"spending_height" json:"spending_height"` // indexed, 0 while unspent
+	Sequence           uint32   `bson:"sequence" json:"sequence"`
+	SignatureScript    Script   `bson:"signature_script" json:"signature_script"`
+	SignatureScriptAsm string   `bson:"signature_script_asm" json:"signature_script_asm"`
+	Witness            []Script `bson:"witness" json:"witness"`                 // witness stack items, null while unspent
+	RevealedScript     Script   `bson:"revealed_script" json:"revealed_script"` // redeem, witness or leaf script revealed by the spend
+	RevealedScriptAsm  string   `bson:"revealed_script_asm" json:"revealed_script_asm"`
 
-	FundingTxHash  string `bson:"funding_tx_hash"`  // indexed
-	FundingTxIndex uint32 `bson:"funding_tx_index"` // index
-	PkScript       string `bson:"pk_script"`
-	Value          int64  `bson:"value"`
-	Spender        string `bson:"spender"`
-	Type           string `bson:"type"`
+	FundingTxHash  Hash   `bson:"funding_tx_hash" json:"funding_tx_hash"`   // indexed
+	FundingTxIndex uint32 `bson:"funding_tx_index" json:"funding_tx_index"` // index
+	FundingHeight  int32  `bson:"funding_height" json:"funding_height"`
+	Coinbase       bool   `bson:"coinbase" json:"coinbase"`
+	MatureHeight   int32  `bson:"mature_height" json:"mature_height"` // first height the outpoint can be spent at
+	PkScript       Script `bson:"pk_script" json:"pk_script"`
+	PkScriptAsm    string `bson:"pk_script_asm" json:"pk_script_asm"`
+	ScriptHash     Hash   `bson:"script_hash" json:"script_hash"` // indexed, electrum script hash of PkScript
+	// data pushed by OP_RETURN outputs, hex so prefix queries can use the index
+	Payload     string `bson:"payload,omitempty" json:"payload,omitempty"` // indexed
+	PayloadSize int    `bson:"payload_size,omitempty" json:"payload_size,omitempty"`
+	Value       int64  `bson:"value" json:"value"`
+	Owner       Owner  `bson:"owner" json:"owner"`
+	Spender     string `bson:"spender" json:"spender"` // indexed, address or script hash of scripts without one
+	Type        string `bson:"type" json:"type"`
+}
+
+// Spendable tells if the outpoint can be spent by a tx in the block after tip
+func (outPoint OutPoint) Spendable(tip int32) bool {
+	return outPoint.SpendingTxHash == "" && outPoint.MatureHeight <= tip+1 && outPoint.Type != txscript.NullDataTy.String()
+}
+
+// Owner is who can spend an output as far as its script tells
+type Owner struct {
+	Address  string   `bson:"address,omitempty" json:"address,omitempty"`   // p2pk outputs get the p2pkh address of their pubkey
+	PubKeys  []Script `bson:"pub_keys,omitempty" json:"pub_keys,omitempty"` // p2pk and bare multisig
+	Required int      `bson:"required,omitempty" json:"required,omitempty"` // signatures required by bare multisig
+}
+
+func newOutPoint(tx *wire.MsgTx, index uint32, height int32, chainParams *chaincfg.Params) OutPoint {
+	out := tx.TxOut[index]
+	class, owner, spender := classify(out.PkScript, chainParams)
+	coinbase := blockchain.IsCoinBaseTx(tx)
+	matureHeight := height
+	if coinbase {
+		matureHeight += int32(chainParams.CoinbaseMaturity)
+	}
+	outPoint := OutPoint{
+		FundingTxHash:  Hash(tx.TxHash().String()),
+		FundingTxIndex: index,
+		FundingHeight:  height,
+		Coinbase:       coinbase,
+		MatureHeight:   matureHeight,
+		PkScript:       Script(hex.EncodeToString(out.PkScript)),
+		PkScriptAsm:    disasm(out.PkScript),
+		ScriptHash:     scriptHash(out.PkScript),
+		Value:          out.Value,
+		Owner:          owner,
+		Spender:        spender,
+		Type:           class.String(),
+	}
+	outPoint.setPayload(out.PkScript)
+	return outPoint
+}
+
+// setPayload records the payload of OP_RETURN outputs
+func (outPoint *OutPoint) setPayload(pkScript []byte) {
+	if payload, ok := opReturnPayload(pkScript); ok {
+		outPoint.Payload = hex.EncodeToString(payload)
+		outPoint.PayloadSize = len(payload)
+	}
+}
+
+// spendUpdate is the $set applied to an outpoint with pkScript spent by input index of tx
+func spendUpdate(tx *wire.MsgTx, index uint32, height int32, pkScript []byte) bson.D {
+	txIn := tx.TxIn[index]
+	revealed := revealedScript(pkScript, txIn.SignatureScript, txIn.Witness)
+	return bson.D{
+		{Key: "spending_tx_hash", Value: Hash(tx.TxHash().String())},
+		{Key: "spending_tx_index", Value: index},
+		{Key: "spending_height", Value: height},
+		{Key: "sequence", Value: txIn.Sequence},
+		{Key: "signature_script", Value: Script(hex.EncodeToString(txIn.SignatureScript))},
+		{Key: "signature_script_asm", Value: disasm(txIn.SignatureScript)},
+		{Key: "witness", Value: witnessItems(txIn.Witness)},
+		{Key: "revealed_script", Value: Script(hex.EncodeToString(revealed))},
+		{Key: "revealed_script_asm", Value: disasm(revealed)},
+	}
+}
+
+// unspendUpdate is the $set reverting spendUpdate
+var unspendUpdate = bson.D{
+	{Key: "spending_tx_hash", Value: Hash("")},
+	{Key: "spending_tx_index", Value: uint32(0)},
+	{Key: "spending_height", Value: int32(0)},
+	{Key: "sequence", Value: uint32(0)},
+	{Key: "signature_script", Value: Script("")},
+	{Key: "signature_script_asm", Value: ""},
+	{Key: "witness", Value: nil},
+	{Key: "revealed_script", Value: Script("")},
+	{Key: "revealed_script_asm", Value: ""},
 }
 
 type Transactions []Transaction
+
+// PayloadStats summarize the OP_RETURN payloads sharing a prefix
+type PayloadStats struct {
+	Count     int64 `bson:"count" json:"count"`
+	TotalSize int64 `bson:"total_size" json:"total_size"`
+	MinSize   int   `bson:"min_size" json:"min_size"`
+	MaxSize   int   `bson:"max_size" json:"max_size"`
+}
+
+// HistoryItem is a tx funding or spending a script hash or an address
+type HistoryItem struct {
+	TxHash   Hash   `bson:"_id" json:"txid"`
+	Height   int32  `bson:"height" json:"height"`
+	Position uint32 `bson:"position" json:"position"` // of the tx in its block
+}
+
+// Cursor is the sort key of the last item of a page, the next page starts after it.
+// history items are sorted by Height, Position and TxHash, utxos by Height, TxHash and Index
+type Cursor struct {
+	Height   int32  `json:"height"`
+	Position uint32 `json:"position,omitempty"`
+	TxHash   Hash   `json:"txid"`
+	Index    uint32 `json:"index,omitempty"`
+}
+
+// Cursor is the cursor of the page ending with item
+func (item HistoryItem) Cursor() *Cursor {
+	return &Cursor{Height: item.Height, Position: item.Position, TxHash: item.TxHash}
+}
+
+// UTXOCursor is the cursor of the utxo page ending with outPoint
+func (outPoint OutPoint) UTXOCursor() *Cursor {
+	return &Cursor{Height: outPoint.FundingHeight, TxHash: outPoint.FundingTxHash, Index: outPoint.FundingTxIndex}
+}
+
+// afterItem tells if item sorts after the history cursor c
+func (c *Cursor) afterItem(item HistoryItem) bool {
+	if c == nil || item.Height != c.Height {
+		return c == nil || item.Height > c.Height
+	}
+	if item.Position != c.Position {
+		return item.Position > c.Position
+	}
+	return item.TxHash > c.TxHash
+}
+
+// afterUTXO tells if outPoint sorts after the utxo cursor c
+func (c *Cursor) afterUTXO(outPoint *OutPoint) bool {
+	if c == nil || outPoint.FundingHeight != c.Height {
+		return c == nil || outPoint.FundingHeight > c.Height
+	}
+	if outPoint.FundingTxHash != c.TxHash {
+		return outPoint.FundingTxHash > c.TxHash
+	}
+	return outPoint.FundingTxIndex > c.Index
+}
+
+// ScriptHashStatus is the electrum status of a script hash history in block order,
+// empty when the script hash has no history
+func ScriptHashStatus(history []HistoryItem) string {
+	if len(history) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	for _, item := range history {
+		fmt.Fprintf(h, "%s:%d:", item.TxHash, item.Height)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Address is the running summary of the outpoints paying an address
+type Address struct {
+	ID string `bson:"_id" json:"address"` // address
+
+	Funded    int64 `bson:"funded" json:"funded"` // total received
+	Spent     int64 `bson:"spent" json:"spent"`
+	Balance   int64 `bson:"balance" json:"balance"`
+	UTXOCount int64 `bson:"utxo_count" json:"utxo_count"`
+	TxCount   int64 `bson:"tx_count" json:"tx_count"` // txs funding or spending the address
+
+	FirstSeenHeight int32 `bson:"first_seen_height" json:"first_seen_height"`
+	LastSeenHeight  int32 `bson:"last_seen_height" json:"last_seen_height"`
+}
+
+type addressDelta struct {
+	funded int64
+	spent  int64
+	utxos  int64
+	txs    map[Hash]struct{}
+}
+
+// addressDeltas accumulates the changes a block makes to the addresses it touches
+type addressDeltas map[string]*addressDelta
+
+func (d addressDeltas) get(address string) *addressDelta {
+	delta, ok := d[address]
+	if !ok {
+		delta = &addressDelta{txs: make(map[Hash]struct{})}
+		d[address] = delta
+	}
+	return delta
+}
+
+func (d addressDeltas) fund(outPoint *OutPoint) {
+	if outPoint.Spender == "" {
+		return
+	}
+	delta := d.get(outPoint.Spender)
+	delta.funded += outPoint.Value
+	delta.utxos++
+	delta.txs[outPoint.FundingTxHash] = struct{}{}
+}
+
+func (d addressDeltas) spend(outPoint *OutPoint, spendingTx Hash) {
+	if outPoint.Spender == "" {
+		return
+	}
+	delta := d.get(outPoint.Spender)
+	delta.spent += outPoint.Value
+	delta.utxos--
+	delta.txs[spendingTx] = struct{}{}
+}
+
+// inc is the $inc adding the delta to an address, sign is -1 to revert it
+func (delta *addressDelta) inc(sign int64) bson.D {
+	return bson.D{
+		{Key: "funded", Value: sign * delta.funded},
+		{Key: "spent", Value: sign * delta.spent},
+		{Key: "balance", Value: sign * (delta.funded - delta.spent)},
+		{Key: "utxo_count", Value: sign * delta.utxos},
+		{Key: "tx_count", Value: sign * int64(len(delta.txs))},
+	}
+}
+
+// apply adds the delta to address, sign is -1 to revert it
+func (delta *addressDelta) apply(address *Address, sign int64) {
+	address.Funded += sign * delta.funded
+	address.Spent += sign * delta.spent
+	address.Balance += sign * (delta.funded - delta.spent)
+	address.UTXOCount += sign * delta.utxos
+	address.TxCount += sign * int64(len(delta.txs))
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"context"
+	"errors"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// ErrIncompleteTx is returned by GetMsgTx when parts of the tx are not stored,
+// pruned outpoints or txs indexed before their inputs were recorded
+var ErrIncompleteTx = errors.New("tx is not fully stored")
+
+// msgTx rebuilds the wire form of a tx from its stored fields, its outputs and the spend details on the outpoints it spends.
+// the rebuilt tx must hash to the requested one
+func msgTx(ctx context.Context, s Store, hash string) (*wire.MsgTx, error) {
+	tx, err := s.GetTx(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(tx.Inputs) != tx.InputCount {
+		return nil, ErrIncompleteTx
+	}
+	outputs, err := s.GetOutPointsByTx(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(outputs) != tx.OutputCount {
+		return nil, ErrIncompleteTx
+	}
+
+	msg := wire.NewMsgTx(tx.Version)
+	msg.LockTime = tx.LockTime
+
+	if tx.Coinbase {
+		for _, input := range tx.Inputs {
+			txIn, err := newTxIn(input.TxHash, input.Index, input.SignatureScript, input.Witness, input.Sequence)
+			if err != nil {
+				return nil, err
+			}
+			msg.AddTxIn(txIn)
+		}
+	} else {
+		spent, err := s.GetOutPointsSpentBy(ctx, hash)
+		if err != nil {
+			return nil, err
+		}
+		byIndex := make(map[uint32]OutPoint, len(spent))
+		for _, outPoint := range spent {
+			byIndex[outPoint.SpendingTxIndex] = outPoint
+		}
+		for i, input := range tx.Inputs {
+			outPoint, ok := byIndex[uint32(i)]
+			if !ok {
+				return nil, ErrIncompleteTx
+			}
+			txIn, err := newTxIn(input.TxHash, input.Index, outPoint.SignatureScript, outPoint.Witness, outPoint.Sequence)
+			if err != nil {
+				return nil, err
+			}
+			msg.AddTxIn(txIn)
+		}
+	}
+
+	for _, output := range outputs {
+		pkScript, err := output.PkScript.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		msg.AddTxOut(wire.NewTxOut(output.Value, pkScript))
+	}
+
+	if msg.TxHash().String() != string(tx.ID) {
+		return nil, ErrIncompleteTx
+	}
+	return msg, nil
+}
+
+func newTxIn(prevHash Hash, prevIndex uint32, sigScript Script, witness []Script, sequence uint32) (*wire.TxIn, error) {
+	hash := new(chainhash.Hash)
+	if prevHash != "" {
+		var err error
+		if hash, err = chainhash.NewHashFromStr(string(prevHash)); err != nil {
+			return nil, err
+		}
+	}
+	script, err := sigScript.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	txIn := wire.NewTxIn(wire.NewOutPoint(hash, prevIndex), script, nil)
+	txIn.Sequence = sequence
+	for _, item := range witness {
+		data, err := item.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		txIn.Witness = append(txIn.Witness, data)
+	}
+	return txIn, nil
+}
@@ -0,0 +1,155 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/bech32"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// witnessItems returns the witness stack as stored, nil when the input has no witness
+func witnessItems(witness wire.TxWitness) []Script {
+	if len(witness) == 0 {
+		return nil
+	}
+	items := make([]Script, len(witness))
+	for i, item := range witness {
+		items[i] = Script(hex.EncodeToString(item))
+	}
+	return items
+}
+
+// classify returns the class of pkScript, who can spend it and the identifier outputs are grouped by:
+// its address when it has one, its script hash otherwise and nothing for unspendable OP_RETURN outputs
+func classify(pkScript []byte, chainParams *chaincfg.Params) (txscript.ScriptClass, Owner, string) {
+	class := txscript.GetScriptClass(pkScript)
+	// txscript never returns WitnessUnknownTy itself
+	if class == txscript.NonStandardTy && txscript.IsWitnessProgram(pkScript) {
+		class = txscript.WitnessUnknownTy
+	}
+	var owner Owner
+
+	switch class {
+	case txscript.PubKeyHashTy, txscript.ScriptHashTy, txscript.WitnessV0PubKeyHashTy,
+		txscript.WitnessV0ScriptHashTy, txscript.WitnessV1TaprootTy:
+		_, addrs, _, err := txscript.ExtractPkScriptAddrs(pkScript, chainParams)
+		if err == nil && len(addrs) == 1 {
+			owner.Address = addrs[0].EncodeAddress()
+		}
+	case txscript.PubKeyTy:
+		pushes, _ := txscript.PushedData(pkScript)
+		owner.PubKeys = []Script{Script(hex.EncodeToString(pushes[0]))}
+		// pubkeys off the curve have no address
+		if addr, err := btcutil.NewAddressPubKey(pushes[0], chainParams); err == nil {
+			owner.Address = addr.AddressPubKeyHash().EncodeAddress()
+		}
+	case txscript.MultiSigTy:
+		pushes, _ := txscript.PushedData(pkScript)
+		for _, pubKey := range pushes {
+			owner.PubKeys = append(owner.PubKeys, Script(hex.EncodeToString(pubKey)))
+		}
+		_, owner.Required, _ = txscript.CalcMultiSigStats(pkScript)
+	case txscript.WitnessUnknownTy:
+		owner.Address = witnessAddress(pkScript, chainParams)
+	case txscript.NullDataTy:
+		return class, owner, ""
+	}
+
+	if owner.Address != "" {
+		return class, owner, owner.Address
+	}
+	if _, ok := opReturnPayload(pkScript); ok {
+		return class, owner, ""
+	}
+	return class, owner, string(scriptHash(pkScript))
+}
+
+// witnessAddress encodes witness programs of versions btcutil has no address type for, bech32m as per BIP350
+func witnessAddress(pkScript []byte, chainParams *chaincfg.Params) string {
+	version, program, err := txscript.ExtractWitnessProgramInfo(pkScript)
+	if err != nil || version == 0 {
+		return ""
+	}
+	data, err := bech32.ConvertBits(program, 8, 5, true)
+	if err != nil {
+		return ""
+	}
+	addr, err := bech32.EncodeM(chainParams.Bech32HRPSegwit, append([]byte{byte(version)}, data...))
+	if err != nil {
+		return ""
+	}
+	return addr
+}
+
+// scriptHash is the electrum script hash of pkScript, its sha256 in reverse byte order
+func scriptHash(pkScript []byte) Hash {
+	hash := sha256.Sum256(pkScript)
+	for i, j := 0, len(hash)-1; i < j; i, j = i+1, j-1 {
+		hash[i], hash[j] = hash[j], hash[i]
+	}
+	return Hash(hex.EncodeToString(hash[:]))
+}
+
+// opReturnPayload returns the data pushed after OP_RETURN, ok is false for other scripts.
+// pushes are concatenated, scripts that fail to parse keep the data pushed before the error
+func opReturnPayload(pkScript []byte) (payload []byte, ok bool) {
+	if len(pkScript) == 0 || pkScript[0] != txscript.OP_RETURN {
+		return nil, false
+	}
+	tokenizer := txscript.MakeScriptTokenizer(0, pkScript[1:])
+	for tokenizer.Next() {
+		payload = append(payload, tokenizer.Data()...)
+	}
+	return payload, true
+}
+
+// disasm is txscript.DisasmString, scripts that fail to parse keep the part disassembled so far
+func disasm(script []byte) string {
+	asm, _ := txscript.DisasmString(script)
+	return asm
+}
+
+// revealedScript returns the script a spend reveals for its pkScript:
+// the redeem script of p2sh, the witness script of p2wsh (also nested in p2sh)
+// and the leaf script of a taproot script path spend
+func revealedScript(pkScript []byte, sigScript []byte, witness wire.TxWitness) []byte {
+	switch txscript.GetScriptClass(pkScript) {
+	case txscript.ScriptHashTy:
+		pushes, err := txscript.PushedData(sigScript)
+		if err != nil || len(pushes) == 0 {
+			return nil
+		}
+		redeemScript := pushes[len(pushes)-1]
+		if txscript.IsPayToWitnessScriptHash(redeemScript) {
+			return witnessScript(witness)
+		}
+		return redeemScript
+	case txscript.WitnessV0ScriptHashTy:
+		return witnessScript(witness)
+	case txscript.WitnessV1TaprootTy:
+		return tapscript(witness)
+	}
+	return nil
+}
+
+func witnessScript(witness wire.TxWitness) []byte {
+	if len(witness) == 0 {
+		return nil
+	}
+	return witness[len(witness)-1]
+}
+
+// tapscript returns the leaf script of a script path spend, key path spends reveal nothing
+func tapscript(witness wire.TxWitness) []byte {
+	if len(witness) >= 2 && len(witness[len(witness)-1]) > 0 && witness[len(witness)-1][0] == txscript.TaprootAnnexTag {
+		witness = witness[:len(witness)-1]
+	}
+	if len(witness) < 2 {
+		return nil
+	}
+	return witness[len(witness)-2]
+}
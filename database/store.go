@@ -3,59 +3,176 @@ package database
 import (
 	"btc-indexer/pkg/logger"
 	"context"
-	"encoding/hex"
+	"errors"
 	"fmt"
+	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 
+	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
-	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// pruneBatchSize spent outpoints are deleted at a time
+const pruneBatchSize = 10000
+
+// ErrNotFound is returned by the Store getters when nothing matches
+var ErrNotFound = mongo.ErrNoDocuments
+
+// ErrNoTxIDs is returned by GetBlockTxIDs for blocks whose txids were not stored
+var ErrNoTxIDs = errors.New("txids of the block are not stored")
+
+// ErrNoTransactions is returned by NewStore when mongo is a standalone server, blocks are put in transactions
+var ErrNoTransactions = errors.New("mongo must run as a replica set to support transactions")
+
 type store struct {
-	blocks *mongo.Collection
-	txs    *mongo.Collection
-	out    *mongo.Collection
+	blocks     *mongo.Collection
+	txs        *mongo.Collection
+	out        *mongo.Collection
+	addresses  *mongo.Collection
+	events     *mongo.Collection
+	watches    *mongo.Collection
+	deliveries *mongo.Collection
+	broadcasts *mongo.Collection
 
-	latestHeight int32
+	latestHeight atomic.Int32 // the committed tip, PutBlock keeps the one it moves local to its transaction
 	chainParams  *chaincfg.Params
+	pruneDepth   int32
+	safeDepth    int32
+	journal      journal
+	watchIndex   watchIndex
 
 	mu     sync.Mutex
 	logger *logger.CustomLogger
 }
 
 type Store interface {
-	GetBlockByHeight(height int32) (Block, error)
-	GetBlockByHash(hash string) (Block, error)
-	GetBlockHashByHeight(height int32) (string, error)
+	GetBlockByHeight(ctx context.Context, height int32) (Block, error)
+	GetBlockByHash(ctx context.Context, hash string) (Block, error)
+	GetBlockHashByHeight(ctx context.Context, height int32) (string, error)
+	// GetOrphanBlocks returns the blocks off the best chain from height minHeight on, lowest first
+	GetOrphanBlocks(ctx context.Context, minHeight int32) ([]Block, error)
+	// GetBlocksByHeights returns the best chain blocks at heights, lowest first, heights without one are left out
+	GetBlocksByHeights(ctx context.Context, heights []int32) ([]Block, error)
 
 	GetLatestBlockHeight() (int32, error)
-	GetLatestBlockHash() (*chainhash.Hash, error)
+	GetLatestBlockHash(ctx context.Context) (*chainhash.Hash, error)
 
-	GetLatestTxHash() (*chainhash.Hash, error)
+	GetLatestTxHash(ctx context.Context) (*chainhash.Hash, error)
 
-	PutBlock(*wire.MsgBlock) error
-	PutTx(*wire.MsgTx, string, int32) error
+	GetTx(ctx context.Context, hash string) (Transaction, error)
+	// GetTxs returns the stored txs among hashes in txid order, pruned and unknown ones are left out
+	GetTxs(ctx context.Context, hashes []string) ([]Transaction, error)
+	// GetBlockTxs returns the stored txs of a block in block order
+	GetBlockTxs(ctx context.Context, blockHash string) ([]Transaction, error)
+	// GetBlockTxIDs returns the txids of every tx of a block in block order, pruned ones included
+	GetBlockTxIDs(ctx context.Context, blockHash string) ([]Hash, error)
+	// GetMsgTx rebuilds the wire form of a tx, ErrIncompleteTx when parts of it are no longer stored
+	GetMsgTx(ctx context.Context, hash string) (*wire.MsgTx, error)
+	// GetSafeTxs returns the txs that became safe after tip height since, in the order they did
+	GetSafeTxs(ctx context.Context, since int32) ([]Transaction, error)
+	// GetEvents returns up to limit journal events numbered after since, in order
+	GetEvents(ctx context.Context, since int64, limit int64) ([]Event, error)
+	// GetLastEventSeq returns the number of the last written event, 0 when there is none
+	GetLastEventSeq(ctx context.Context) (int64, error)
+	GetOutPoint(ctx context.Context, fundingTxHash string, fundingTxIndex uint32) (OutPoint, error)
+	// GetOutPointsByTx returns the outputs of a tx in output order
+	GetOutPointsByTx(ctx context.Context, fundingTxHash string) ([]OutPoint, error)
+	// GetOutPointsSpentBy returns the outpoints spent by a tx in input order
+	GetOutPointsSpentBy(ctx context.Context, spendingTxHash string) ([]OutPoint, error)
+	// GetOutPointsByTxs returns the outputs of the txs ordered by funding txid then output
+	GetOutPointsByTxs(ctx context.Context, fundingTxHashes []string) ([]OutPoint, error)
+	// GetOutPointsSpentByTxs returns the outpoints spent by the txs ordered by spending txid then input
+	GetOutPointsSpentByTxs(ctx context.Context, spendingTxHashes []string) ([]OutPoint, error)
+	GetAddress(ctx context.Context, address string) (Address, error)
+	// GetSpendableUTXOs returns the unspent outputs of address a tx in the next block may spend, immature coinbase outputs are left out
+	GetSpendableUTXOs(ctx context.Context, address string) ([]OutPoint, error)
+	// GetAddressUTXOs returns up to limit unspent outputs of address after the cursor, nil starts with the oldest
+	GetAddressUTXOs(ctx context.Context, address string, after *Cursor, limit int64) ([]OutPoint, error)
+	// GetAddressHistory returns up to limit txs funding or spending address after the cursor, in block order
+	GetAddressHistory(ctx context.Context, address string, after *Cursor, limit int64) ([]HistoryItem, error)
+	// GetAddressHistoryBefore returns up to limit txs funding or spending address before the cursor, newest first, nil starts with the newest
+	GetAddressHistoryBefore(ctx context.Context, address string, before *Cursor, limit int64) ([]HistoryItem, error)
+	// GetScriptHashHistory returns the txs funding or spending outputs with the electrum scriptHash, in block order
+	GetScriptHashHistory(ctx context.Context, scriptHash string) ([]HistoryItem, error)
+	// GetScriptHashUTXOs returns the unspent outputs with the electrum scriptHash, oldest first
+	GetScriptHashUTXOs(ctx context.Context, scriptHash string) ([]OutPoint, error)
+	// GetOutPointsByPayload returns up to limit OP_RETURN outputs whose payload starts with the hex prefix, oldest first
+	GetOutPointsByPayload(ctx context.Context, prefix string, limit int64) ([]OutPoint, error)
+	// GetPayloadStats summarizes the OP_RETURN payloads starting with the hex prefix
+	GetPayloadStats(ctx context.Context, prefix string) (PayloadStats, error)
+	// GetBlocksByPrefix returns up to limit blocks whose hash starts with the hex prefix, orphans included, in hash order
+	GetBlocksByPrefix(ctx context.Context, prefix string, limit int64) ([]Block, error)
+	// GetTxsByPrefix returns up to limit txs whose txid starts with the hex prefix, in txid order
+	GetTxsByPrefix(ctx context.Context, prefix string, limit int64) ([]Transaction, error)
 
-	InitGenesisBlock(block *wire.MsgBlock) error
-	InitCoinBaseTx() error
+	PutBlock(ctx context.Context, block *wire.MsgBlock) error
+	PutTx(ctx context.Context, tx *wire.MsgTx, blockhash string, height int32) error
 
-	SetChainCfg(chainParams *chaincfg.Params)
+	InitGenesisBlock(ctx context.Context, block *wire.MsgBlock) error
+	InitCoinBaseTx(ctx context.Context) error
+
+	// SetPruneDepth enables pruned mode, spent outpoints and fully spent transactions
+	// more than depth blocks below the tip are deleted
+	SetPruneDepth(depth int32)
+	// SetSafeDepth sets the confirmations after which a tx is safe, DefaultSafeDepth by default.
+	// the stored txs are marked again for depth, a raised depth takes back the safe flag of the txs short of it
+	SetSafeDepth(ctx context.Context, depth int32) error
+	// Listen adds a listener for the events of every PutBlock
+	Listen(listener Listener)
+
+	// PutWatch stores a new watch, the txs of blocks connected from then on are matched against it
+	PutWatch(ctx context.Context, watch Watch) error
+	// GetWatches returns every watch, oldest first
+	GetWatches(ctx context.Context) ([]Watch, error)
+	DeleteWatch(ctx context.Context, id string) error
+	// AddDeliveries stores new deliveries, deliveries with an ID already stored are kept as they are
+	AddDeliveries(ctx context.Context, deliveries []Delivery) error
+	UpdateDelivery(ctx context.Context, delivery Delivery) error
+	DeleteDelivery(ctx context.Context, id string) error
+	GetDelivery(ctx context.Context, id string) (Delivery, error)
+	// GetDueDeliveries returns up to limit pending deliveries that may be attempted at tip height and unix time now, longest waiting first
+	GetDueDeliveries(ctx context.Context, tip int32, now int64, limit int64) ([]Delivery, error)
+	// GetDeadDeliveries returns up to limit dead deliveries with an ID after after, in ID order
+	GetDeadDeliveries(ctx context.Context, after string, limit int64) ([]Delivery, error)
+	// PruneDeliveries deletes the delivered deliveries of txs below height
+	PruneDeliveries(ctx context.Context, height int32) error
+
+	// PutBroadcast stores a tx to broadcast, replacing a stored one with the same txid
+	PutBroadcast(ctx context.Context, broadcast Broadcast) error
+	UpdateBroadcast(ctx context.Context, broadcast Broadcast) error
+	GetBroadcast(ctx context.Context, txid string) (Broadcast, error)
+	// GetBroadcasts returns the broadcasts with status, oldest first
+	GetBroadcasts(ctx context.Context, status string) ([]Broadcast, error)
 
 	// PutRandBLock() error
 }
 
-func NewStore(blocks, txs, outpoints *mongo.Collection) (Store, error) {
+// NewStore returns a store indexing the chain of chainParams into the collections.
+// blocks are put in transactions, so mongo must run as a replica set, a single node one will do
+func NewStore(ctx context.Context, chainParams *chaincfg.Params, blocks, txs, outpoints, addresses, events, watches, deliveries, broadcasts *mongo.Collection) (Store, error) {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := blocks.Database().RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		return nil, err
+	}
+	if hello.SetName == "" && hello.Msg != "isdbgrid" {
+		return nil, ErrNoTransactions
+	}
+
 	var block struct {
 		Height int32 `bson:"height"`
 	}
 
-	err := blocks.FindOne(context.TODO(), bson.D{}, options.FindOne().SetSort(bson.D{{Key: "height", Value: -1}}).SetProjection(bson.M{"height": 1})).Decode(&block)
+	err := blocks.FindOne(ctx, bson.D{{Key: "is_orphan", Value: false}}, options.FindOne().SetSort(bson.D{{Key: "height", Value: -1}}).SetProjection(bson.M{"height": 1})).Decode(&block)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			block.Height = -1
@@ -64,158 +181,920 @@ func NewStore(blocks, txs, outpoints *mongo.Collection) (Store, error) {
 		}
 	}
 
-	return &store{
-		blocks:       blocks,
-		txs:          txs,
-		out:          outpoints,
-		latestHeight: block.Height,
-		logger:       logger.NewDefaultLogger(),
-		mu:           sync.Mutex{},
-	}, nil
+	var event struct {
+		Seq int64 `bson:"_id"`
+	}
+	err = events.FindOne(ctx, bson.D{}, options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}}).SetProjection(bson.M{"_id": 1})).Decode(&event)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	cursor, err := watches.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	var registered []Watch
+	if err := cursor.All(ctx, &registered); err != nil {
+		return nil, err
+	}
+
+	s := &store{
+		blocks:      blocks,
+		txs:         txs,
+		out:         outpoints,
+		addresses:   addresses,
+		events:      events,
+		watches:     watches,
+		deliveries:  deliveries,
+		broadcasts:  broadcasts,
+		chainParams: chainParams,
+		journal:     journal{seq: event.Seq},
+		watchIndex:  newWatchIndex(registered),
+		safeDepth:   DefaultSafeDepth,
+		logger:      logger.NewDefaultLogger(),
+		mu:          sync.Mutex{},
+	}
+	s.latestHeight.Store(block.Height)
+	return s, nil
+}
+
+func (s *store) SetPruneDepth(depth int32) {
+	s.pruneDepth = minPruneDepth(depth)
+}
+
+func (s *store) SetSafeDepth(ctx context.Context, depth int32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.safeDepth = max(depth, 1)
+	tip := s.latestHeight.Load()
+	_, err := s.txs.UpdateMany(ctx,
+		bson.D{{Key: "safe", Value: true}, {Key: "block_height", Value: bson.D{{Key: "$gt", Value: safeCutoff(tip, s.safeDepth)}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "safe", Value: false}}}, {Key: "$unset", Value: bson.D{{Key: "safe_height", Value: ""}}}})
+	if err != nil {
+		return err
+	}
+	return s.markSafe(ctx, tip)
+}
+
+func (s *store) Listen(listener Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.journal.listeners = append(s.journal.listeners, listener)
+}
+
+func (s *store) PutWatch(ctx context.Context, watch Watch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.watches.InsertOne(ctx, watch); err != nil {
+		return err
+	}
+	s.watchIndex.add(watch)
+	return nil
+}
+
+func (s *store) GetWatches(ctx context.Context) ([]Watch, error) {
+	cursor, err := s.watches.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "created", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	watches := make([]Watch, 0)
+	err = cursor.All(ctx, &watches)
+	return watches, err
+}
+
+func (s *store) DeleteWatch(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, err := s.watches.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	s.watchIndex.remove(id)
+	return nil
+}
+
+func (s *store) AddDeliveries(ctx context.Context, deliveries []Delivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, len(deliveries))
+	for i, delivery := range deliveries {
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: delivery.ID}}).
+			SetUpdate(bson.D{{Key: "$setOnInsert", Value: delivery}}).
+			SetUpsert(true)
+	}
+	_, err := s.deliveries.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+func (s *store) UpdateDelivery(ctx context.Context, delivery Delivery) error {
+	result, err := s.deliveries.ReplaceOne(ctx, bson.D{{Key: "_id", Value: delivery.ID}}, delivery)
+	if err == nil && result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *store) DeleteDelivery(ctx context.Context, id string) error {
+	result, err := s.deliveries.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}})
+	if err == nil && result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *store) GetDelivery(ctx context.Context, id string) (Delivery, error) {
+	var delivery Delivery
+	err := s.deliveries.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&delivery)
+	return delivery, err
+}
+
+func (s *store) GetDueDeliveries(ctx context.Context, tip int32, now int64, limit int64) ([]Delivery, error) {
+	return s.findDeliveries(ctx, bson.D{
+		{Key: "status", Value: DeliveryPending},
+		{Key: "next_attempt", Value: bson.D{{Key: "$lte", Value: now}}},
+		{Key: "due_height", Value: bson.D{{Key: "$lte", Value: tip}}},
+	}, options.Find().SetSort(bson.D{{Key: "next_attempt", Value: 1}, {Key: "_id", Value: 1}}).SetLimit(limit))
+}
+
+func (s *store) GetDeadDeliveries(ctx context.Context, after string, limit int64) ([]Delivery, error) {
+	return s.findDeliveries(ctx, bson.D{{Key: "status", Value: DeliveryDead}, {Key: "_id", Value: bson.D{{Key: "$gt", Value: after}}}},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(limit))
+}
+
+func (s *store) findDeliveries(ctx context.Context, filter bson.D, opts *options.FindOptions) ([]Delivery, error) {
+	cursor, err := s.deliveries.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]Delivery, 0)
+	err = cursor.All(ctx, &deliveries)
+	return deliveries, err
+}
+
+func (s *store) PutBroadcast(ctx context.Context, broadcast Broadcast) error {
+	_, err := s.broadcasts.ReplaceOne(ctx, bson.D{{Key: "_id", Value: broadcast.ID}}, broadcast, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *store) UpdateBroadcast(ctx context.Context, broadcast Broadcast) error {
+	result, err := s.broadcasts.ReplaceOne(ctx, bson.D{{Key: "_id", Value: broadcast.ID}}, broadcast)
+	if err == nil && result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *store) GetBroadcast(ctx context.Context, txid string) (Broadcast, error) {
+	var broadcast Broadcast
+	err := s.broadcasts.FindOne(ctx, bson.D{{Key: "_id", Value: Hash(txid)}}).Decode(&broadcast)
+	return broadcast, err
 }
 
-func (s *store) SetChainCfg(chainParams *chaincfg.Params) {
-	s.chainParams = chainParams
+func (s *store) GetBroadcasts(ctx context.Context, status string) ([]Broadcast, error) {
+	cursor, err := s.broadcasts.Find(ctx, bson.D{{Key: "status", Value: status}}, options.Find().SetSort(bson.D{{Key: "created", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	broadcasts := make([]Broadcast, 0)
+	err = cursor.All(ctx, &broadcasts)
+	return broadcasts, err
 }
 
-func (s *store) GetBlockByHeight(height int32) (Block, error) {
+// orphanDeliveries cancels or reverts the deliveries of the txs of a block leaving the best chain
+func (s *store) orphanDeliveries(ctx context.Context, blockhash Hash) error {
+	deliveries, err := s.findDeliveries(ctx, bson.D{{Key: "block_hash", Value: blockhash}}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	cancelled, orphaned := orphanDeliveries(deliveries)
+	if len(cancelled) > 0 {
+		if _, err := s.deliveries.DeleteMany(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: cancelled}}}}); err != nil {
+			return err
+		}
+	}
+	return s.AddDeliveries(ctx, orphaned)
+}
+
+func (s *store) PruneDeliveries(ctx context.Context, height int32) error {
+	_, err := s.deliveries.DeleteMany(ctx, bson.D{{Key: "status", Value: DeliveryDelivered}, {Key: "height", Value: bson.D{{Key: "$lt", Value: height}}}})
+	return err
+}
+
+// GetBlockByHeight returns the best chain block at height
+func (s *store) GetBlockByHeight(ctx context.Context, height int32) (Block, error) {
 	var block Block
-	err := s.blocks.FindOne(context.TODO(), bson.D{{Key: "height", Value: height}}).Decode(&block)
+	err := s.blocks.FindOne(ctx, bson.D{{Key: "height", Value: height}, {Key: "is_orphan", Value: false}}, options.FindOne().SetProjection(bson.M{"raw": 0, "txids": 0})).Decode(&block)
 	return block, err
 }
 
-func (s *store) GetBlockByHash(hash string) (Block, error) {
+func (s *store) GetBlockByHash(ctx context.Context, hash string) (Block, error) {
 	var block Block
-	err := s.blocks.FindOne(context.TODO(), bson.D{{Key: "_id", Value: hash}}).Decode(&block)
+	err := s.blocks.FindOne(ctx, bson.D{{Key: "_id", Value: Hash(hash)}}, options.FindOne().SetProjection(bson.M{"raw": 0, "txids": 0})).Decode(&block)
 	return block, err
 }
 
-func (s *store) GetBlockHashByHeight(height int32) (string, error) {
+func (s *store) GetBlockHashByHeight(ctx context.Context, height int32) (string, error) {
 	// s.logger.Info(fmt.Sprintf("GetBlockHashByHeight: %d", height))
 	var BlockHash struct {
-		ID string `bson:"_id"`
+		ID Hash `bson:"_id"`
+	}
+	err := s.blocks.FindOne(ctx, bson.D{{Key: "height", Value: height}, {Key: "is_orphan", Value: false}}, options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&BlockHash)
+	return string(BlockHash.ID), err
+}
+
+func (s *store) GetBlocksByHeights(ctx context.Context, heights []int32) ([]Block, error) {
+	cursor, err := s.blocks.Find(ctx, bson.D{{Key: "height", Value: bson.D{{Key: "$in", Value: heights}}}, {Key: "is_orphan", Value: false}},
+		options.Find().SetSort(bson.D{{Key: "height", Value: 1}}).SetProjection(bson.M{"raw": 0, "txids": 0}))
+	if err != nil {
+		return nil, err
 	}
-	err := s.blocks.FindOne(context.TODO(), bson.D{{Key: "height", Value: height}}, options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&BlockHash)
-	return BlockHash.ID, err
+	blocks := make([]Block, 0, len(heights))
+	err = cursor.All(ctx, &blocks)
+	return blocks, err
+}
+
+func (s *store) GetOrphanBlocks(ctx context.Context, minHeight int32) ([]Block, error) {
+	cursor, err := s.blocks.Find(ctx, bson.D{{Key: "height", Value: bson.D{{Key: "$gte", Value: minHeight}}}, {Key: "is_orphan", Value: true}},
+		options.Find().SetSort(bson.D{{Key: "height", Value: 1}, {Key: "_id", Value: 1}}).SetProjection(bson.M{"raw": 0, "txids": 0}))
+	if err != nil {
+		return nil, err
+	}
+	blocks := make([]Block, 0)
+	err = cursor.All(ctx, &blocks)
+	return blocks, err
 }
 
 func (s *store) GetLatestBlockHeight() (int32, error) {
-	return s.latestHeight, nil
+	return s.latestHeight.Load(), nil
 }
 
-func (s *store) GetLatestBlockHash() (*chainhash.Hash, error) {
+func (s *store) GetLatestBlockHash(ctx context.Context) (*chainhash.Hash, error) {
 	var block struct {
-		Hash string `bson:"_id"`
+		Hash Hash `bson:"_id"`
 	}
-	err := s.blocks.FindOne(context.TODO(), bson.D{}, options.FindOne().SetSort(bson.D{{Key: "height", Value: -1}}).SetProjection(bson.M{"_id": 1})).Decode(&block)
+	err := s.blocks.FindOne(ctx, bson.D{{Key: "is_orphan", Value: false}}, options.FindOne().SetSort(bson.D{{Key: "height", Value: -1}}).SetProjection(bson.M{"_id": 1})).Decode(&block)
 	if err != nil {
 		return nil, err
 	}
-	return chainhash.NewHashFromStr(block.Hash)
+	return chainhash.NewHashFromStr(string(block.Hash))
 }
 
-func (s *store) GetLatestTxHash() (*chainhash.Hash, error) {
+func (s *store) GetLatestTxHash(ctx context.Context) (*chainhash.Hash, error) {
 	var tx struct {
-		Hash string `bson:"_id"`
+		Hash Hash `bson:"_id"`
 	}
-	err := s.txs.FindOne(context.TODO(), bson.D{}, options.FindOne().SetSort(bson.D{{Key: "height", Value: -1}}).SetProjection(bson.M{"_id": 1})).Decode(&tx)
+	err := s.txs.FindOne(ctx, bson.D{}, options.FindOne().SetSort(bson.D{{Key: "height", Value: -1}}).SetProjection(bson.M{"_id": 1})).Decode(&tx)
 	if err != nil {
 		return nil, err
 	}
-	return chainhash.NewHashFromStr(tx.Hash)
+	return chainhash.NewHashFromStr(string(tx.Hash))
+}
+
+func (s *store) GetTx(ctx context.Context, hash string) (Transaction, error) {
+	var tx Transaction
+	if err := s.txs.FindOne(ctx, bson.D{{Key: "_id", Value: Hash(hash)}}).Decode(&tx); err != nil {
+		return tx, err
+	}
+	tx.setConfirmations(s.latestHeight.Load())
+	return tx, nil
+}
+
+func (s *store) GetTxs(ctx context.Context, hashes []string) ([]Transaction, error) {
+	cursor, err := s.txs.Find(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: toHashes(hashes)}}}}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	txs := make([]Transaction, 0, len(hashes))
+	if err := cursor.All(ctx, &txs); err != nil {
+		return nil, err
+	}
+	for i := range txs {
+		txs[i].setConfirmations(s.latestHeight.Load())
+	}
+	return txs, nil
 }
 
-func (s *store) PutBlock(block *wire.MsgBlock) error {
+func (s *store) GetBlockTxs(ctx context.Context, blockHash string) ([]Transaction, error) {
+	cursor, err := s.txs.Find(ctx, bson.D{{Key: "block_hash", Value: Hash(blockHash)}}, options.Find().SetSort(bson.D{{Key: "block_index", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	txs := make([]Transaction, 0)
+	if err := cursor.All(ctx, &txs); err != nil {
+		return nil, err
+	}
+	for i := range txs {
+		txs[i].setConfirmations(s.latestHeight.Load())
+	}
+	return txs, nil
+}
+
+func (s *store) GetBlockTxIDs(ctx context.Context, blockHash string) ([]Hash, error) {
+	var block struct {
+		TxCount int    `bson:"tx_count"`
+		TxIDs   []Hash `bson:"txids"`
+	}
+	err := s.blocks.FindOne(ctx, bson.D{{Key: "_id", Value: Hash(blockHash)}}, options.FindOne().SetProjection(bson.M{"tx_count": 1, "txids": 1})).Decode(&block)
+	if err != nil {
+		return nil, err
+	}
+	if len(block.TxIDs) == 0 || len(block.TxIDs) != block.TxCount {
+		return nil, ErrNoTxIDs
+	}
+	return block.TxIDs, nil
+}
+
+func (s *store) GetLastEventSeq(ctx context.Context) (int64, error) {
+	var event struct {
+		Seq int64 `bson:"_id"`
+	}
+	err := s.events.FindOne(ctx, bson.D{}, options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}}).SetProjection(bson.M{"_id": 1})).Decode(&event)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	return event.Seq, err
+}
+
+func (s *store) GetEvents(ctx context.Context, since int64, limit int64) ([]Event, error) {
+	cursor, err := s.events.Find(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: since}}}},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	events := make([]Event, 0)
+	err = cursor.All(ctx, &events)
+	return events, err
+}
+
+func (s *store) GetMsgTx(ctx context.Context, hash string) (*wire.MsgTx, error) {
+	return msgTx(ctx, s, hash)
+}
+
+func (s *store) GetSafeTxs(ctx context.Context, since int32) ([]Transaction, error) {
+	cursor, err := s.txs.Find(ctx, bson.D{{Key: "safe_height", Value: bson.D{{Key: "$gt", Value: since}}}},
+		options.Find().SetSort(bson.D{{Key: "safe_height", Value: 1}, {Key: "block_height", Value: 1}, {Key: "block_index", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	txs := make([]Transaction, 0)
+	if err := cursor.All(ctx, &txs); err != nil {
+		return nil, err
+	}
+	for i := range txs {
+		txs[i].setConfirmations(s.latestHeight.Load())
+	}
+	return txs, nil
+}
+
+func (s *store) GetOutPoint(ctx context.Context, fundingTxHash string, fundingTxIndex uint32) (OutPoint, error) {
+	var outPoint OutPoint
+	err := s.out.FindOne(ctx, bson.D{{Key: "funding_tx_hash", Value: Hash(fundingTxHash)}, {Key: "funding_tx_index", Value: fundingTxIndex}}).Decode(&outPoint)
+	return outPoint, err
+}
+
+func (s *store) GetOutPointsByTx(ctx context.Context, fundingTxHash string) ([]OutPoint, error) {
+	return s.findOutPoints(ctx, bson.D{{Key: "funding_tx_hash", Value: Hash(fundingTxHash)}}, bson.D{{Key: "funding_tx_index", Value: 1}})
+}
+
+func (s *store) GetOutPointsSpentBy(ctx context.Context, spendingTxHash string) ([]OutPoint, error) {
+	return s.findOutPoints(ctx, bson.D{{Key: "spending_tx_hash", Value: Hash(spendingTxHash)}}, bson.D{{Key: "spending_tx_index", Value: 1}})
+}
+
+func (s *store) GetOutPointsByTxs(ctx context.Context, fundingTxHashes []string) ([]OutPoint, error) {
+	return s.findOutPoints(ctx, bson.D{{Key: "funding_tx_hash", Value: bson.D{{Key: "$in", Value: toHashes(fundingTxHashes)}}}},
+		bson.D{{Key: "funding_tx_hash", Value: 1}, {Key: "funding_tx_index", Value: 1}})
+}
+
+func (s *store) GetOutPointsSpentByTxs(ctx context.Context, spendingTxHashes []string) ([]OutPoint, error) {
+	return s.findOutPoints(ctx, bson.D{{Key: "spending_tx_hash", Value: bson.D{{Key: "$in", Value: toHashes(spendingTxHashes)}}}},
+		bson.D{{Key: "spending_tx_hash", Value: 1}, {Key: "spending_tx_index", Value: 1}})
+}
+
+func (s *store) findOutPoints(ctx context.Context, filter, sort bson.D) ([]OutPoint, error) {
+	cursor, err := s.out.Find(ctx, filter, options.Find().SetSort(sort))
+	if err != nil {
+		return nil, err
+	}
+	outPoints := make([]OutPoint, 0)
+	err = cursor.All(ctx, &outPoints)
+	return outPoints, err
+}
+
+func (s *store) GetAddress(ctx context.Context, address string) (Address, error) {
+	var addr Address
+	err := s.addresses.FindOne(ctx, bson.D{{Key: "_id", Value: address}}).Decode(&addr)
+	return addr, err
+}
+
+func (s *store) GetSpendableUTXOs(ctx context.Context, address string) ([]OutPoint, error) {
+	cursor, err := s.out.Find(ctx, bson.D{
+		{Key: "spender", Value: address},
+		{Key: "spending_tx_hash", Value: nil},
+		{Key: "mature_height", Value: bson.D{{Key: "$lte", Value: s.latestHeight.Load() + 1}}},
+	}, options.Find().SetSort(bson.D{{Key: "funding_height", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	outPoints := make([]OutPoint, 0)
+	err = cursor.All(ctx, &outPoints)
+	return outPoints, err
+}
+
+func (s *store) GetScriptHashHistory(ctx context.Context, scriptHash string) ([]HistoryItem, error) {
+	return s.history(ctx, bson.D{{Key: "script_hash", Value: Hash(scriptHash)}}, nil, 0, false)
+}
+
+func (s *store) GetScriptHashUTXOs(ctx context.Context, scriptHash string) ([]OutPoint, error) {
+	return s.findOutPoints(ctx, bson.D{{Key: "script_hash", Value: Hash(scriptHash)}, {Key: "spending_tx_hash", Value: nil}},
+		bson.D{{Key: "funding_height", Value: 1}, {Key: "funding_tx_hash", Value: 1}, {Key: "funding_tx_index", Value: 1}})
+}
+
+func (s *store) GetAddressHistory(ctx context.Context, address string, after *Cursor, limit int64) ([]HistoryItem, error) {
+	return s.history(ctx, bson.D{{Key: "spender", Value: address}}, after, limit, false)
+}
+
+func (s *store) GetAddressHistoryBefore(ctx context.Context, address string, before *Cursor, limit int64) ([]HistoryItem, error) {
+	return s.history(ctx, bson.D{{Key: "spender", Value: address}}, before, limit, true)
+}
+
+// history returns the txs funding or spending the outpoints matching filter in block order, past the cursor,
+// newestFirst reverses both
+func (s *store) history(ctx context.Context, filter bson.D, cursor *Cursor, limit int64, newestFirst bool) ([]HistoryItem, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$project", Value: bson.D{{Key: "_id", Value: 0}, {Key: "txs", Value: bson.A{
+			bson.D{{Key: "_id", Value: "$funding_tx_hash"}, {Key: "height", Value: "$funding_height"}},
+			bson.D{{Key: "_id", Value: "$spending_tx_hash"}, {Key: "height", Value: "$spending_height"}},
+		}}}}},
+		{{Key: "$unwind", Value: "$txs"}},
+		{{Key: "$replaceRoot", Value: bson.D{{Key: "newRoot", Value: "$txs"}}}},
+		{{Key: "$match", Value: bson.D{{Key: "_id", Value: bson.D{{Key: "$ne", Value: nil}}}}}},
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$_id"}, {Key: "height", Value: bson.D{{Key: "$first", Value: "$height"}}}}}},
+		{{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: s.txs.Name()},
+			{Key: "localField", Value: "_id"},
+			{Key: "foreignField", Value: "_id"},
+			{Key: "as", Value: "tx"},
+		}}},
+		{{Key: "$project", Value: bson.D{{Key: "height", Value: 1}, {Key: "position", Value: bson.D{{Key: "$ifNull", Value: bson.A{
+			bson.D{{Key: "$arrayElemAt", Value: bson.A{"$tx.block_index", 0}}},
+			int64(0),
+		}}}}}}},
+	}
+	past, order := "$gt", 1
+	if newestFirst {
+		past, order = "$lt", -1
+	}
+	if cursor != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "height", Value: bson.D{{Key: past, Value: cursor.Height}}}},
+			bson.D{{Key: "height", Value: cursor.Height}, {Key: "position", Value: bson.D{{Key: past, Value: cursor.Position}}}},
+			bson.D{{Key: "height", Value: cursor.Height}, {Key: "position", Value: cursor.Position}, {Key: "_id", Value: bson.D{{Key: past, Value: cursor.TxHash}}}},
+		}}}}})
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$sort", Value: bson.D{{Key: "height", Value: order}, {Key: "position", Value: order}, {Key: "_id", Value: order}}}})
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+
+	results, err := s.out.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+	history := make([]HistoryItem, 0)
+	err = results.All(ctx, &history)
+	return history, err
+}
+
+func (s *store) GetAddressUTXOs(ctx context.Context, address string, after *Cursor, limit int64) ([]OutPoint, error) {
+	filter := bson.D{{Key: "spender", Value: address}, {Key: "spending_tx_hash", Value: nil}}
+	if after != nil {
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: "funding_height", Value: bson.D{{Key: "$gt", Value: after.Height}}}},
+			bson.D{{Key: "funding_height", Value: after.Height}, {Key: "funding_tx_hash", Value: bson.D{{Key: "$gt", Value: after.TxHash}}}},
+			bson.D{{Key: "funding_height", Value: after.Height}, {Key: "funding_tx_hash", Value: after.TxHash}, {Key: "funding_tx_index", Value: bson.D{{Key: "$gt", Value: after.Index}}}},
+		}})
+	}
+	cursor, err := s.out.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "funding_height", Value: 1}, {Key: "funding_tx_hash", Value: 1}, {Key: "funding_tx_index", Value: 1}}).
+		SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	outPoints := make([]OutPoint, 0)
+	err = cursor.All(ctx, &outPoints)
+	return outPoints, err
+}
+
+// GetOutPointsByPayload returns up to limit OP_RETURN outputs whose payload starts with the hex prefix, oldest first
+func (s *store) GetOutPointsByPayload(ctx context.Context, prefix string, limit int64) ([]OutPoint, error) {
+	cursor, err := s.out.Find(ctx, payloadFilter(prefix),
+		options.Find().SetSort(bson.D{{Key: "funding_height", Value: 1}}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	outPoints := make([]OutPoint, 0)
+	err = cursor.All(ctx, &outPoints)
+	return outPoints, err
+}
+
+func (s *store) GetPayloadStats(ctx context.Context, prefix string) (PayloadStats, error) {
+	var stats PayloadStats
+	cursor, err := s.out.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: payloadFilter(prefix)}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: nil},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: int64(1)}}},
+			{Key: "total_size", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$toLong", Value: "$payload_size"}}}}},
+			{Key: "min_size", Value: bson.D{{Key: "$min", Value: "$payload_size"}}},
+			{Key: "max_size", Value: bson.D{{Key: "$max", Value: "$payload_size"}}},
+		}}},
+	})
+	if err != nil {
+		return stats, err
+	}
+	defer cursor.Close(ctx)
+	if cursor.Next(ctx) {
+		err = cursor.Decode(&stats)
+	}
+	return stats, err
+}
+
+// payloadFilter matches payloads by prefix, an anchored regex on a plain prefix is answered from the index
+func payloadFilter(prefix string) bson.D {
+	return bson.D{{Key: "payload", Value: bson.D{{Key: "$regex", Value: "^" + regexp.QuoteMeta(strings.ToLower(prefix))}}}}
+}
+
+func (s *store) GetBlocksByPrefix(ctx context.Context, prefix string, limit int64) ([]Block, error) {
+	cursor, err := s.blocks.Find(ctx, hashPrefixFilter(prefix),
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(limit).SetProjection(bson.M{"raw": 0, "txids": 0}))
+	if err != nil {
+		return nil, err
+	}
+	blocks := make([]Block, 0)
+	err = cursor.All(ctx, &blocks)
+	return blocks, err
+}
+
+func (s *store) GetTxsByPrefix(ctx context.Context, prefix string, limit int64) ([]Transaction, error) {
+	cursor, err := s.txs.Find(ctx, hashPrefixFilter(prefix),
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	txs := make([]Transaction, 0)
+	if err := cursor.All(ctx, &txs); err != nil {
+		return nil, err
+	}
+	for i := range txs {
+		txs[i].setConfirmations(s.latestHeight.Load())
+	}
+	return txs, nil
+}
+
+// hashPrefixFilter matches the _id hashes starting with the hex prefix. hashes are stored as 32 byte binaries in display order,
+// so the prefix padded with zeros and with fs bounds a range answered from the _id index
+func hashPrefixFilter(prefix string) bson.D {
+	prefix = strings.ToLower(prefix)
+	padding := 2*chainhash.HashSize - len(prefix)
+	return bson.D{{Key: "_id", Value: bson.D{
+		{Key: "$gte", Value: Hash(prefix + strings.Repeat("0", padding))},
+		{Key: "$lte", Value: Hash(prefix + strings.Repeat("f", padding))},
+	}}}
+}
+
+func (s *store) PutBlock(ctx context.Context, block *wire.MsgBlock) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	// if incoming block num is less than latest consider it has orphan
-	// if incoming block is same as latest then get previous block
-	// recursively set all its parents to not orphan and corresponding non orphan blocks to orphan
-	// else if parent is not orphan consider as bestChain and continue indexing blocks
+	defer s.journal.discard()
+
+	// the block, the reorg it causes and their events are written in one transaction,
+	// a PutBlock failing halfway leaves neither indexed txs without events nor events of txs rolled back
+	session, err := s.blocks.Database().Client().StartSession()
+	if err != nil {
+		s.logger.Error(err.Error())
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	// the tip moves within the transaction, readers only see it once committed
+	var tip int32
+	result, err := session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		// a retried transaction starts over from the state before the block
+		tip = s.latestHeight.Load()
+		s.journal.discard()
+		return s.putBlock(sc, block, &tip)
+	})
+	if err != nil {
+		s.logger.Error(err.Error())
+		return err
+	}
+	s.latestHeight.Store(tip)
+	s.journal.publish(s.journal.take())
+	if connected, _ := result.(bool); !connected {
+		return nil
+	}
+
+	// raw blocks are only needed to reconnect blocks within the reorg window
+	_, err = s.blocks.UpdateMany(ctx, bson.D{{Key: "height", Value: bson.D{{Key: "$lte", Value: tip - reorgWindow}}}, {Key: "raw", Value: bson.D{{Key: "$exists", Value: true}}}}, bson.D{{Key: "$unset", Value: bson.D{{Key: "raw", Value: ""}}}})
+	if err != nil {
+		s.logger.Error(err.Error())
+		return err
+	}
+
+	if err := s.prune(ctx, tip); err != nil {
+		s.logger.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+// putBlock writes block within the transaction of PutBlock and tells if it joined the best chain,
+// tip is the height of the best chain as the transaction changes it
+func (s *store) putBlock(ctx context.Context, block *wire.MsgBlock, tip *int32) (bool, error) {
+	// if incoming block is already known ignore it
+	// if incoming block does not extend the best chain consider it as orphan and keep it raw
+	// if its parent is orphan the side chain became longer, disconnect best chain down to the fork
+	// and connect the side chain blocks before indexing the incoming block
 	// finally update latestBlock Height in store
-	prevBlock, err := s.GetBlockByHash(block.Header.PrevBlock.String())
+	blockHash := Hash(block.BlockHash().String())
+	if _, err := s.GetBlockByHash(ctx, string(blockHash)); err == nil {
+		s.logger.Warn(fmt.Sprintf("Block %s already exists", blockHash))
+		return false, nil
+	} else if err != mongo.ErrNoDocuments {
+		return false, err
+	}
+
+	prevBlock, err := s.GetBlockByHash(ctx, block.Header.PrevBlock.String())
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return nil
+			return false, nil
 		}
-		s.logger.Error(err.Error())
-		return err
+		return false, err
+	}
+
+	raw, err := serializeBlock(block)
+	if err != nil {
+		return false, err
+	}
+
+	prevTimestamps, err := s.prevTimestamps(ctx, prevBlock)
+	if err != nil {
+		return false, err
+	}
+
+	// latest best chain is as long as incoming block then incoming block is orphan
+	height := prevBlock.Height + 1
+	if height <= *tip {
+		_, err := s.blocks.InsertOne(ctx, blockDoc{newBlock(block, height, true, s.chainParams, prevTimestamps), raw, blockTxIDs(block)})
+		return false, err
+	}
+
+	// redefine bestChain
+	if prevBlock.IsOrphan {
+		if err := s.reorganize(ctx, prevBlock, tip); err != nil {
+			return false, err
+		}
+	}
+
+	_, err = s.blocks.InsertOne(ctx, blockDoc{newBlock(block, height, false, s.chainParams, prevTimestamps), raw, blockTxIDs(block)})
+	if err != nil {
+		return false, err
+	}
+
+	if err := s.connectTxs(ctx, block.Transactions, blockHash, height); err != nil {
+		return false, err
+	}
+
+	*tip = height
+
+	if err := s.markSafe(ctx, height); err != nil {
+		return false, err
 	}
 
-	// latest best chain is longer than incoming block then incoming block is orphan
-	if s.latestHeight-1 > prevBlock.Height {
-		bl := Block{
-			ID:            block.BlockHash().String(),
-			Height:        prevBlock.Height + 1,
-			IsOrphan:      true,
-			PreviousBlock: block.Header.PrevBlock.String(),
-			Version:       block.Header.Version,
-			Nonce:         block.Header.Nonce,
-			Timestamp:     block.Header.Timestamp.Unix(),
-			Bits:          block.Header.Bits,
-			MerkleRoot:    block.Header.MerkleRoot.String(),
-		}
-		_, err := s.blocks.InsertOne(context.TODO(), bl)
+	if err := s.writeEvents(ctx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// writeEvents appends the pending events of the block being put to the journal, within its transaction.
+// PutBlock hands them to the listeners once the transaction is committed
+func (s *store) writeEvents(ctx context.Context) error {
+	if len(s.journal.pending) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, len(s.journal.pending))
+	for i := range s.journal.pending {
+		docs[i] = s.journal.pending[i]
+	}
+	_, err := s.events.InsertMany(ctx, docs)
+	return err
+}
+
+// markSafe marks the txs reaching safeDepth confirmations at the tip.
+// txs of disconnected blocks are removed with them, reconnected ones start unsafe again
+func (s *store) markSafe(ctx context.Context, tip int32) error {
+	_, err := s.txs.UpdateMany(ctx,
+		bson.D{{Key: "safe", Value: false}, {Key: "block_height", Value: bson.D{{Key: "$lte", Value: safeCutoff(tip, s.safeDepth)}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "safe", Value: true}, {Key: "safe_height", Value: tip}}}})
+	return err
+}
+
+// prune deletes outpoints spent more than pruneDepth blocks ago
+// and the transactions left without any outpoint
+func (s *store) prune(ctx context.Context, tip int32) error {
+	cutoff := tip - s.pruneDepth
+	if s.pruneDepth == 0 || cutoff <= 0 {
+		return nil
+	}
+
+	// the first prune of a large database deletes millions of outpoints, they are taken in batches
+	// so no query or result grows past the document size limit
+	filter := bson.D{{Key: "spending_height", Value: bson.D{{Key: "$gt", Value: 0}, {Key: "$lte", Value: cutoff}}}}
+	for {
+		cursor, err := s.out.Find(ctx, filter,
+			options.Find().SetLimit(pruneBatchSize).SetProjection(bson.M{"_id": 1, "funding_tx_hash": 1}))
 		if err != nil {
-			if mongo.IsDuplicateKeyError(err) {
-				s.logger.Warn(fmt.Sprintf("Block %s already exists", block.BlockHash().String()))
-				return nil
+			return err
+		}
+		var spent []struct {
+			ID            interface{} `bson:"_id"`
+			FundingTxHash Hash        `bson:"funding_tx_hash"`
+		}
+		if err := cursor.All(ctx, &spent); err != nil {
+			return err
+		}
+		if len(spent) == 0 {
+			return nil
+		}
+
+		ids := make([]interface{}, len(spent))
+		seen := make(map[Hash]bool)
+		fundingTxs := make([]Hash, 0)
+		for i, outPoint := range spent {
+			ids[i] = outPoint.ID
+			if !seen[outPoint.FundingTxHash] {
+				seen[outPoint.FundingTxHash] = true
+				fundingTxs = append(fundingTxs, outPoint.FundingTxHash)
 			}
-			s.logger.Error(err.Error())
+		}
+		if _, err := s.out.DeleteMany(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}}); err != nil {
 			return err
 		}
-		s.processTxs(block.Transactions, block.BlockHash().String(), prevBlock.Height+1)
-		return nil
+
+		remaining, err := s.out.Distinct(ctx, "funding_tx_hash", bson.D{{Key: "funding_tx_hash", Value: bson.D{{Key: "$in", Value: fundingTxs}}}})
+		if err != nil {
+			return err
+		}
+		_, err = s.txs.DeleteMany(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: fundingTxs}, {Key: "$nin", Value: remaining}}}})
+		if err != nil {
+			return err
+		}
+		if len(spent) < pruneBatchSize {
+			return nil
+		}
 	}
+}
 
-	// redefine bestChain
-	if s.latestHeight == prevBlock.Height || (s.latestHeight-1) == prevBlock.Height {
-		parentBlock := prevBlock
-		for parentBlock.IsOrphan {
-			// update corresponding non orphan block to orphan
-			_, err := s.blocks.UpdateOne(context.TODO(), bson.D{{Key: "height", Value: parentBlock.Height}, {Key: "is_orphan", Value: false}}, bson.D{{Key: "$set", Value: bson.D{{Key: "is_orphan", Value: true}}}})
-			if err != nil {
-				s.logger.Error(err.Error())
-				return err
-			}
+// reorganize makes the side chain ending at tip the best chain, latest follows its height as blocks are disconnected and connected
+func (s *store) reorganize(ctx context.Context, tip Block, latest *int32) error {
+	branch := make([]blockDoc, 0)
+	for parent := tip; parent.IsOrphan; {
+		var bl blockDoc
+		err := s.blocks.FindOne(ctx, bson.D{{Key: "_id", Value: parent.ID}}).Decode(&bl)
+		if err != nil {
+			return err
+		}
+		if bl.Raw == nil {
+			return fmt.Errorf("block %s is below the reorg window", bl.ID)
+		}
+		branch = append(branch, bl)
 
-			// make sure parent is not orphan
-			_, err = s.blocks.UpdateOne(context.TODO(), bson.D{{Key: "_id", Value: parentBlock.ID}}, bson.D{{Key: "$set", Value: bson.D{{Key: "is_orphan", Value: false}}}})
-			if err != nil {
-				s.logger.Error(err.Error())
-				return err
-			}
+		parent, err = s.GetBlockByHash(ctx, string(parent.PreviousBlock))
+		if err != nil {
+			return err
+		}
+	}
+	forkHeight := branch[len(branch)-1].Height - 1
 
-			parentBlock, err = s.GetBlockByHash(parentBlock.PreviousBlock)
-			if err != nil {
-				s.logger.Error(err.Error())
-				return err
-			}
+	for height := *latest; height > forkHeight; height-- {
+		bl, err := s.GetBlockByHeight(ctx, height)
+		if err != nil {
+			return err
+		}
+		if err := s.disconnectBlock(ctx, bl); err != nil {
+			return err
+		}
+		*latest = height - 1
+	}
+
+	for i := len(branch) - 1; i >= 0; i-- {
+		block, err := deserializeBlock(branch[i].Raw)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.blocks.UpdateOne(ctx, bson.D{{Key: "_id", Value: branch[i].ID}}, bson.D{{Key: "$set", Value: bson.D{{Key: "is_orphan", Value: false}}}})
+		if err != nil {
+			return err
+		}
+		if err := s.connectTxs(ctx, block.Transactions, branch[i].ID, branch[i].Height); err != nil {
+			return err
 		}
+		*latest = branch[i].Height
 	}
+	return nil
+}
 
-	bl := Block{
-		ID:            block.BlockHash().String(),
-		Height:        prevBlock.Height + 1,
-		IsOrphan:      false,
-		PreviousBlock: block.Header.PrevBlock.String(),
-		Version:       block.Header.Version,
-		Nonce:         block.Header.Nonce,
-		Timestamp:     block.Header.Timestamp.Unix(),
-		Bits:          block.Header.Bits,
-		MerkleRoot:    block.Header.MerkleRoot.String(),
+// disconnectBlock marks a best chain block as orphan and removes its transactions
+// outpoints spent by them become unspent again
+func (s *store) disconnectBlock(ctx context.Context, block Block) error {
+	cursor, err := s.txs.Find(ctx, bson.D{{Key: "block_hash", Value: block.ID}},
+		options.Find().SetProjection(bson.M{"_id": 1, "coinbase": 1, "inputs": 1}).SetSort(bson.D{{Key: "block_index", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	var txs Transactions
+	if err := cursor.All(ctx, &txs); err != nil {
+		return err
+	}
+	s.journal.disconnectBlock(block, txs)
+	txHashes := make([]Hash, len(txs))
+	for i, tx := range txs {
+		txHashes[i] = tx.ID
 	}
-	_, err = s.blocks.InsertOne(context.TODO(), bl)
+
+	deltas, err := s.blockAddressDeltas(ctx, txHashes)
 	if err != nil {
-		s.logger.Error(err.Error())
 		return err
 	}
 
-	s.processTxs(block.Transactions, block.BlockHash().String(), prevBlock.Height+1)
+	_, err = s.out.UpdateMany(ctx, bson.D{{Key: "spending_tx_hash", Value: bson.D{{Key: "$in", Value: txHashes}}}}, bson.D{{Key: "$set", Value: unspendUpdate}})
+	if err != nil {
+		return err
+	}
 
-	s.latestHeight = prevBlock.Height + 1
-	// s.logger.Info(fmt.Sprintf("Height: %d", s.latestHeight))
-	return nil
+	_, err = s.out.DeleteMany(ctx, bson.D{{Key: "funding_tx_hash", Value: bson.D{{Key: "$in", Value: txHashes}}}})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.txs.DeleteMany(ctx, bson.D{{Key: "block_hash", Value: block.ID}})
+	if err != nil {
+		return err
+	}
+
+	if err := s.disconnectAddresses(ctx, deltas, block.Height); err != nil {
+		return err
+	}
+
+	if err := s.orphanDeliveries(ctx, block.ID); err != nil {
+		return err
+	}
+
+	_, err = s.blocks.UpdateOne(ctx, bson.D{{Key: "_id", Value: block.ID}}, bson.D{{Key: "$set", Value: bson.D{{Key: "is_orphan", Value: true}}}})
+	return err
+}
+
+// prevTimestamps returns the timestamps of prev and up to 9 of its ancestors, following prev's own chain
+func (s *store) prevTimestamps(ctx context.Context, prev Block) ([]int64, error) {
+	cursor, err := s.blocks.Find(ctx,
+		bson.D{{Key: "height", Value: bson.D{{Key: "$gt", Value: prev.Height - medianTimeBlocks + 1}, {Key: "$lt", Value: prev.Height}}}},
+		options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}, {Key: "previous_block", Value: 1}, {Key: "timestamp", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var ancestors []Block
+	if err := cursor.All(ctx, &ancestors); err != nil {
+		return nil, err
+	}
+	byHash := make(map[Hash]Block, len(ancestors))
+	for _, bl := range ancestors {
+		byHash[bl.ID] = bl
+	}
+
+	timestamps := []int64{prev.Timestamp}
+	for bl, ok := byHash[prev.PreviousBlock]; ok && len(timestamps) < medianTimeBlocks-1; bl, ok = byHash[bl.PreviousBlock] {
+		timestamps = append(timestamps, bl.Timestamp)
+	}
+	return timestamps, nil
+}
+
+// connectTxs indexes the txs of a best chain block and records the fees they pay
+func (s *store) connectTxs(ctx context.Context, txs []*wire.MsgTx, blockhash Hash, height int32) error {
+	s.journal.connectBlock(txs, blockhash, height)
+	fees, err := s.processTxs(ctx, txs, blockhash, height)
+	if err != nil {
+		return err
+	}
+	_, err = s.blocks.UpdateOne(ctx, bson.D{{Key: "_id", Value: blockhash}}, bson.D{{Key: "$set", Value: bson.D{{Key: "total_fees", Value: fees}}}})
+	return err
 }
 
 // process TXs V0
@@ -229,107 +1108,288 @@ func (s *store) PutBlock(block *wire.MsgBlock) error {
 // }
 
 // process tx v1
-func (s *store) processTxs(txs []*wire.MsgTx, blockhash string, blockIndex int32) {
+// processTxs returns the fees paid by txs, a failed write fails the block
+func (s *store) processTxs(ctx context.Context, txs []*wire.MsgTx, blockhash Hash, height int32) (int64, error) {
 	// iterate through all txs
 	// batch all outpoints and insert
 	// then batch all txs and insert
 	// then batch all inputs and insert
-	transactions := make([]interface{}, 0)
 	outpoints := make([]interface{}, 0)
-	for _, tx := range txs {
-		// batching all txs and insert
-		transaction := Transaction{
-			ID:         tx.TxHash().String(),
-			LockTime:   tx.LockTime,
-			Version:    tx.Version,
-			Safe:       true,
-			BlockHash:  blockhash,
-			BlockIndex: blockIndex,
+	prevOuts := make(map[wire.OutPoint]*OutPoint)
+	deltas := make(addressDeltas)
+	duplicate := s.duplicateCoinbase(height)
+	for k, tx := range txs {
+		if k == 0 && duplicate {
+			continue
 		}
-		transactions = append(transactions, transaction)
-
 		// batching all outpoints and insert
-		for i, out := range tx.TxOut {
-			spenderAddress := ""
-
-			pkScript, err := txscript.ParsePkScript(out.PkScript)
-			if err == nil {
-				addr, err := pkScript.Address(s.chainParams)
-				if err != nil {
-					s.logger.Error(err.Error())
-				}
-				spenderAddress = addr.EncodeAddress()
-			}
-
-			outPoint := OutPoint{
-				FundingTxHash:  tx.TxHash().String(),
-				FundingTxIndex: uint32(i),
-				PkScript:       hex.EncodeToString(out.PkScript),
-				Value:          out.Value,
-				Spender:        spenderAddress,
-				Type:           pkScript.Class().String(),
-			}
+		for i := range tx.TxOut {
+			outPoint := newOutPoint(tx, uint32(i), height, s.chainParams)
 			outpoints = append(outpoints, outPoint)
+			prevOuts[wire.OutPoint{Hash: tx.TxHash(), Index: uint32(i)}] = &outPoint
+			deltas.fund(&outPoint)
 		}
 	}
 
-	_, err := s.txs.InsertMany(context.TODO(), transactions)
-	if err != nil {
-		if mongo.IsDuplicateKeyError(err) {
-			s.logger.Warn(fmt.Sprintf("Transaction %s already exists", txs[0].TxHash().String()))
-			return
+	if err := s.resolvePrevOuts(ctx, txs, prevOuts); err != nil {
+		return 0, err
+	}
+	prevValue := prevOutValue(prevOuts)
+
+	// batching all txs and insert
+	var fees int64
+	transactions := make([]interface{}, 0, len(txs))
+	for i, tx := range txs {
+		transaction, ok := newTransaction(tx, blockhash, height, uint32(i), prevValue)
+		if !ok {
+			s.logger.Warn(fmt.Sprintf("Transaction %s spends unknown outpoints, fee not computed", transaction.ID))
 		}
-		s.logger.Error(err.Error())
-		return
+		fees += transaction.Fee
+		if i == 0 && duplicate {
+			s.logger.Warn(fmt.Sprintf("Coinbase %s of block %s already exists", transaction.ID, blockhash))
+			continue
+		}
+		transactions = append(transactions, transaction)
 	}
 
-	_, err = s.out.InsertMany(context.TODO(), outpoints)
-	if err != nil {
-		s.logger.Error(err.Error())
-		return
+	if _, err := s.txs.InsertMany(ctx, transactions); err != nil {
+		return 0, err
+	}
+
+	if len(outpoints) > 0 {
+		if _, err := s.out.InsertMany(ctx, outpoints); err != nil {
+			return 0, err
+		}
 	}
 
 	// bulk update funding txs
 	bulkWriteModels := make([]mongo.WriteModel, 0)
 	for _, tx := range txs {
 		for i, txIn := range tx.TxIn {
-			witness := make([]string, len(txIn.Witness))
-			for i, w := range txIn.Witness {
-				witness[i] = hex.EncodeToString(w)
+			var pkScript []byte
+			if prevOut, ok := prevOuts[txIn.PreviousOutPoint]; ok {
+				pkScript, _ = prevOut.PkScript.Bytes()
+				deltas.spend(prevOut, Hash(tx.TxHash().String()))
 			}
-			witnessToHex := strings.Join(witness, ",")
-
 			bulkWriteModels = append(bulkWriteModels, mongo.NewUpdateOneModel().
 				SetFilter(bson.D{
-					{Key: "funding_tx_hash", Value: txIn.PreviousOutPoint.Hash.String()},
+					{Key: "funding_tx_hash", Value: Hash(txIn.PreviousOutPoint.Hash.String())},
 					{Key: "funding_tx_index", Value: txIn.PreviousOutPoint.Index}}).
-				SetUpdate(bson.D{{Key: "$set", Value: bson.D{
-					{Key: "spending_tx_hash", Value: tx.TxHash().String()},
-					{Key: "spending_tx_index", Value: uint32(i)},
-					{Key: "witness", Value: witnessToHex},
-					{Key: "sequence", Value: txIn.Sequence},
-					{Key: "signature_script", Value: hex.EncodeToString(txIn.SignatureScript)},
-				}}}))
+				SetUpdate(bson.D{{Key: "$set", Value: spendUpdate(tx, uint32(i), height, pkScript)}}))
+		}
+	}
+
+	if len(bulkWriteModels) > 0 {
+		if _, err := s.out.BulkWrite(ctx, bulkWriteModels); err != nil {
+			return 0, err
 		}
 	}
 
-	_, err = s.out.BulkWrite(context.TODO(), bulkWriteModels)
+	if err := s.connectAddresses(ctx, deltas, height); err != nil {
+		return 0, err
+	}
+
+	deliveries := s.watchIndex.matchTxs(txs, blockhash, height, func(prevOut wire.OutPoint) *OutPoint { return prevOuts[prevOut] })
+	if err := s.AddDeliveries(ctx, deliveries); err != nil {
+		return 0, err
+	}
+	return fees, nil
+}
+
+// bip30Duplicates are the mainnet heights whose coinbase reuses the txid of an earlier one, BIP30 allows just these two.
+// a write failing in a transaction aborts it, so their coinbase is left out rather than inserted again
+var bip30Duplicates = map[int32]bool{91842: true, 91880: true}
+
+// duplicateCoinbase tells if the coinbase of the best chain block at height is already stored
+func (s *store) duplicateCoinbase(height int32) bool {
+	return s.chainParams.Net == wire.MainNet && bip30Duplicates[height]
+}
+
+// resolvePrevOuts adds the outpoints spent by txs and funded by earlier blocks to prevOuts
+func (s *store) resolvePrevOuts(ctx context.Context, txs []*wire.MsgTx, prevOuts map[wire.OutPoint]*OutPoint) error {
+	missing := make(map[wire.OutPoint]struct{})
+	fundingTxs := make([]Hash, 0)
+	for _, tx := range txs {
+		if blockchain.IsCoinBaseTx(tx) {
+			continue
+		}
+		for _, txIn := range tx.TxIn {
+			if _, ok := prevOuts[txIn.PreviousOutPoint]; ok {
+				continue
+			}
+			if _, ok := missing[txIn.PreviousOutPoint]; !ok {
+				fundingTxs = append(fundingTxs, Hash(txIn.PreviousOutPoint.Hash.String()))
+			}
+			missing[txIn.PreviousOutPoint] = struct{}{}
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	cursor, err := s.out.Find(ctx,
+		bson.D{{Key: "funding_tx_hash", Value: bson.D{{Key: "$in", Value: fundingTxs}}}},
+		options.Find().SetProjection(bson.D{
+			{Key: "funding_tx_hash", Value: 1},
+			{Key: "funding_tx_index", Value: 1},
+			{Key: "funding_height", Value: 1},
+			{Key: "pk_script", Value: 1},
+			{Key: "value", Value: 1},
+			{Key: "spender", Value: 1},
+			{Key: "script_hash", Value: 1},
+			{Key: "type", Value: 1},
+		}))
 	if err != nil {
-		s.logger.Error(err.Error())
-		return
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		outPoint := new(OutPoint)
+		if err := cursor.Decode(outPoint); err != nil {
+			return err
+		}
+		hash, err := chainhash.NewHashFromStr(string(outPoint.FundingTxHash))
+		if err != nil {
+			return err
+		}
+		prevOut := wire.OutPoint{Hash: *hash, Index: outPoint.FundingTxIndex}
+		if _, ok := missing[prevOut]; ok {
+			prevOuts[prevOut] = outPoint
+		}
 	}
+	return cursor.Err()
 }
 
-func (s *store) PutTx(tx *wire.MsgTx, blockhash string, blockIndex int32) error {
-	transaction := Transaction{
-		ID:         tx.TxHash().String(),
-		LockTime:   tx.LockTime,
-		Version:    tx.Version,
-		Safe:       true,
-		BlockHash:  blockhash,
-		BlockIndex: blockIndex,
+// blockAddressDeltas rebuilds the address deltas of the block holding txHashes from its outpoints
+func (s *store) blockAddressDeltas(ctx context.Context, txHashes []Hash) (addressDeltas, error) {
+	deltas := make(addressDeltas)
+	projection := options.Find().SetProjection(bson.D{
+		{Key: "funding_tx_hash", Value: 1},
+		{Key: "spending_tx_hash", Value: 1},
+		{Key: "value", Value: 1},
+		{Key: "spender", Value: 1},
+	})
+
+	var funded []*OutPoint
+	cursor, err := s.out.Find(ctx, bson.D{{Key: "funding_tx_hash", Value: bson.D{{Key: "$in", Value: txHashes}}}}, projection)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &funded); err != nil {
+		return nil, err
+	}
+	for _, outPoint := range funded {
+		deltas.fund(outPoint)
+	}
+
+	var spent []*OutPoint
+	cursor, err = s.out.Find(ctx, bson.D{{Key: "spending_tx_hash", Value: bson.D{{Key: "$in", Value: txHashes}}}}, projection)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &spent); err != nil {
+		return nil, err
+	}
+	for _, outPoint := range spent {
+		deltas.spend(outPoint, outPoint.SpendingTxHash)
+	}
+	return deltas, nil
+}
+
+// connectAddresses applies the deltas of a block connected at height to the Addresses collection
+func (s *store) connectAddresses(ctx context.Context, deltas addressDeltas, height int32) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, 0, len(deltas))
+	for address, delta := range deltas {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: address}}).
+			SetUpdate(bson.D{
+				{Key: "$inc", Value: delta.inc(1)},
+				{Key: "$min", Value: bson.D{{Key: "first_seen_height", Value: height}}},
+				{Key: "$max", Value: bson.D{{Key: "last_seen_height", Value: height}}},
+			}).
+			SetUpsert(true))
+	}
+	_, err := s.addresses.BulkWrite(ctx, models)
+	return err
+}
+
+// disconnectAddresses reverts the deltas of the block disconnected at height,
+// addresses it was the last activity of get their last seen height from the remaining outpoints
+func (s *store) disconnectAddresses(ctx context.Context, deltas addressDeltas, height int32) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+	addresses := make([]string, 0, len(deltas))
+	models := make([]mongo.WriteModel, 0, len(deltas))
+	for address, delta := range deltas {
+		addresses = append(addresses, address)
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: address}}).
+			SetUpdate(bson.D{{Key: "$inc", Value: delta.inc(-1)}}))
+	}
+	_, err := s.addresses.BulkWrite(ctx, models)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.addresses.DeleteMany(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: addresses}}}, {Key: "tx_count", Value: bson.D{{Key: "$lte", Value: 0}}}})
+	if err != nil {
+		return err
 	}
-	_, err := s.txs.InsertOne(context.TODO(), transaction)
+
+	stale, err := s.addresses.Distinct(ctx, "_id", bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: addresses}}}, {Key: "last_seen_height", Value: bson.D{{Key: "$gte", Value: height}}}})
+	if err != nil || len(stale) == 0 {
+		return err
+	}
+
+	cursor, err := s.out.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "spender", Value: bson.D{{Key: "$in", Value: stale}}}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$spender"},
+			{Key: "funding_height", Value: bson.D{{Key: "$max", Value: "$funding_height"}}},
+			{Key: "spending_height", Value: bson.D{{Key: "$max", Value: "$spending_height"}}},
+		}}},
+	})
+	if err != nil {
+		return err
+	}
+	var lastSeen []struct {
+		ID             string `bson:"_id"`
+		FundingHeight  int32  `bson:"funding_height"`
+		SpendingHeight int32  `bson:"spending_height"`
+	}
+	if err := cursor.All(ctx, &lastSeen); err != nil {
+		return err
+	}
+
+	models = make([]mongo.WriteModel, 0, len(lastSeen))
+	for _, last := range lastSeen {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: last.ID}}).
+			SetUpdate(bson.D{{Key: "$set", Value: bson.D{{Key: "last_seen_height", Value: max(last.FundingHeight, last.SpendingHeight)}}}}))
+	}
+	if len(models) == 0 {
+		return nil
+	}
+	_, err = s.addresses.BulkWrite(ctx, models)
+	return err
+}
+
+// PutTx stores a single tx, its position in the block is not known and left at 0
+func (s *store) PutTx(ctx context.Context, tx *wire.MsgTx, blockhash string, height int32) error {
+	prevOuts := make(map[wire.OutPoint]*OutPoint)
+	if err := s.resolvePrevOuts(ctx, []*wire.MsgTx{tx}, prevOuts); err != nil {
+		return err
+	}
+	transaction, _ := newTransaction(tx, Hash(blockhash), height, 0, prevOutValue(prevOuts))
+	if tip := s.latestHeight.Load(); height <= safeCutoff(tip, s.safeDepth) {
+		transaction.Safe, transaction.SafeHeight = true, tip
+	}
+	_, err := s.txs.InsertOne(ctx, transaction)
 	if err != nil {
 		if mongo.IsDuplicateKeyError(err) {
 			s.logger.Warn(fmt.Sprintf("Transaction %s already exists", tx.TxHash().String()))
@@ -343,85 +1403,52 @@ func (s *store) PutTx(tx *wire.MsgTx, blockhash string, blockIndex int32) error
 	// for all outputs create them as new fundingTxs
 	// for all inputs link it to its previous outPoint i e; fundingTx and inputs are spendingTx
 
-	for i, out := range tx.TxOut {
-		spenderAddress := ""
-
-		pkScript, err := txscript.ParsePkScript(out.PkScript)
-		if err == nil {
-			addr, err := pkScript.Address(s.chainParams)
-			if err != nil {
-				return err
-			}
-			spenderAddress = addr.EncodeAddress()
-		}
-
-		outPoint := OutPoint{
-			FundingTxHash:  tx.TxHash().String(),
-			FundingTxIndex: uint32(i),
-			PkScript:       hex.EncodeToString(out.PkScript),
-			Value:          out.Value,
-			Spender:        spenderAddress,
-			Type:           pkScript.Class().String(),
-		}
-		_, err = s.out.InsertOne(context.TODO(), outPoint)
+	deltas := make(addressDeltas)
+	for i := range tx.TxOut {
+		outPoint := newOutPoint(tx, uint32(i), height, s.chainParams)
+		_, err = s.out.InsertOne(ctx, outPoint)
 		if err != nil {
 			if mongo.IsDuplicateKeyError(err) {
 				s.logger.Warn(fmt.Sprintf("OutPoint %s already exists", outPoint.FundingTxHash))
 			}
 			return err
 		}
+		deltas.fund(&outPoint)
 	}
 
 	for i, txIn := range tx.TxIn {
-		witness := make([]string, len(txIn.Witness))
-		for i, w := range txIn.Witness {
-			witness[i] = hex.EncodeToString(w)
-		}
-		witnessToHex := strings.Join(witness, ",")
-
 		// get previous txOut
 		var outPoint OutPoint
-		err = s.out.FindOne(context.TODO(), bson.D{{Key: "funding_tx_hash", Value: txIn.PreviousOutPoint.Hash.String()}, {Key: "funding_tx_index", Value: txIn.PreviousOutPoint.Index}}).Decode(&outPoint)
+		err = s.out.FindOne(ctx, bson.D{{Key: "funding_tx_hash", Value: Hash(txIn.PreviousOutPoint.Hash.String())}, {Key: "funding_tx_index", Value: txIn.PreviousOutPoint.Index}}).Decode(&outPoint)
 		if err != nil {
 			s.logger.Error(fmt.Sprintf("Error: %s fundingTx %v index %d", err.Error(), txIn.PreviousOutPoint.Hash.String(), txIn.PreviousOutPoint.Index))
 			return err
 		}
 
-		outPoint.SpendingTxHash = tx.TxHash().String()
-		outPoint.SpendingTxIndex = uint32(i)
-		outPoint.Sequence = txIn.Sequence
-		outPoint.SignatureScript = hex.EncodeToString(txIn.SignatureScript)
-		outPoint.Witness = witnessToHex
-		_, err = s.out.UpdateOne(context.TODO(), bson.D{{Key: "_id", Value: outPoint.ID}}, bson.D{{Key: "$set", Value: outPoint}})
+		pkScript, err := outPoint.PkScript.Bytes()
 		if err != nil {
 			return err
 		}
+		_, err = s.out.UpdateOne(ctx, bson.D{{Key: "_id", Value: outPoint.ID}}, bson.D{{Key: "$set", Value: spendUpdate(tx, uint32(i), height, pkScript)}})
+		if err != nil {
+			return err
+		}
+		deltas.spend(&outPoint, Hash(tx.TxHash().String()))
 	}
-	return nil
+	return s.connectAddresses(ctx, deltas, height)
 }
 
-func (s *store) InitGenesisBlock(block *wire.MsgBlock) error {
-	bl := Block{
-		ID:            block.BlockHash().String(),
-		Height:        0,
-		IsOrphan:      false,
-		PreviousBlock: block.Header.PrevBlock.String(),
-		Version:       block.Header.Version,
-		Nonce:         block.Header.Nonce,
-		Timestamp:     block.Header.Timestamp.Unix(),
-		Bits:          block.Header.Bits,
-		MerkleRoot:    block.Header.MerkleRoot.String(),
-	}
-	_, err := s.blocks.InsertOne(context.TODO(), bl)
-	s.latestHeight = 0
+func (s *store) InitGenesisBlock(ctx context.Context, block *wire.MsgBlock) error {
+	_, err := s.blocks.InsertOne(ctx, blockDoc{Block: newBlock(block, 0, false, s.chainParams, nil), TxIDs: blockTxIDs(block)})
+	s.latestHeight.Store(0)
 	return err
 }
 
-func (s *store) InitCoinBaseTx() error {
+func (s *store) InitCoinBaseTx(ctx context.Context) error {
 	tx := OutPoint{
 		FundingTxHash:  "0000000000000000000000000000000000000000000000000000000000000000",
 		FundingTxIndex: 4294967295,
 	}
-	_, err := s.out.InsertOne(context.TODO(), tx)
+	_, err := s.out.InsertOne(ctx, tx)
 	return err
 }
@@ -0,0 +1,54 @@
+package database_test
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/database/storetest"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// testMongoURIEnv names the variable pointing the mongo store tests at a replica set, they are skipped without it.
+// every subtest runs against a database of its own which is dropped afterwards
+const testMongoURIEnv = "BTC_INDEXER_TEST_MONGO_URI"
+
+func TestMongoStore(t *testing.T) {
+	uri := os.Getenv(testMongoURIEnv)
+	if uri == "" {
+		t.Skip(testMongoURIEnv + " is not set")
+	}
+	mi, err := database.NewMongoDBConnection(uri)
+	if err != nil {
+		t.Fatalf("NewMongoDBConnection: %v", err)
+	}
+	t.Cleanup(func() { mi.Client.Disconnect(context.Background()) })
+
+	prefix := fmt.Sprintf("storetest_%d_", time.Now().UnixNano())
+	n := 0
+	newStore := func(t *testing.T) database.Store {
+		n++
+		name := fmt.Sprintf("%s%d", prefix, n)
+		t.Cleanup(func() { mi.Client.Database(name).Drop(context.Background()) })
+
+		db, err := mi.SetupIndexerClient(context.Background(), name, database.Settings{
+			Network:     "btcrt",
+			Mode:        "full",
+			ChainParams: &chaincfg.RegressionNetParams,
+			SafeDepth:   database.DefaultSafeDepth,
+		})
+		if err != nil {
+			t.Fatalf("SetupIndexerClient: %v", err)
+		}
+		store, err := database.NewStore(context.Background(), &chaincfg.RegressionNetParams, db.BlocksCol, db.TxCol, db.OutCol, db.AddrCol, db.EventCol, db.WatchCol, db.DeliveryCol, db.BroadcastCol)
+		if err != nil {
+			t.Fatalf("NewStore: %v", err)
+		}
+		return store
+	}
+	storetest.Run(t, newStore)
+	t.Run("Atomic", func(t *testing.T) { storetest.RunAtomic(t, newStore) })
+}
@@ -0,0 +1,186 @@
+package storetest
+
+import (
+	"btc-indexer/database"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// ctx is passed to every store call of the suite
+var ctx = context.Background()
+
+// fixture builds regtest blocks on top of the genesis block and feeds them to a store
+// blocks are not valid for consensus, only the parts the store looks at are filled
+type fixture struct {
+	t      *testing.T
+	store  database.Store
+	params *chaincfg.Params
+
+	genesis *wire.MsgBlock
+	heights map[*wire.MsgBlock]int32
+	nonce   uint32
+}
+
+func newFixture(t *testing.T, store database.Store) *fixture {
+	params := &chaincfg.RegressionNetParams
+	if err := store.InitGenesisBlock(ctx, params.GenesisBlock); err != nil {
+		t.Fatalf("InitGenesisBlock: %v", err)
+	}
+	if err := store.InitCoinBaseTx(ctx); err != nil {
+		t.Fatalf("InitCoinBaseTx: %v", err)
+	}
+
+	return &fixture{
+		t:       t,
+		store:   store,
+		params:  params,
+		genesis: params.GenesisBlock,
+		heights: map[*wire.MsgBlock]int32{params.GenesisBlock: 0},
+	}
+}
+
+// script returns a unique p2wpkh pkScript
+func (f *fixture) script() []byte {
+	f.nonce++
+	program := make([]byte, 20)
+	binary.BigEndian.PutUint32(program, f.nonce)
+	script, err := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(program).Script()
+	if err != nil {
+		f.t.Fatalf("script: %v", err)
+	}
+	return script
+}
+
+// address returns the address the store derives from pkScript
+func (f *fixture) address(pkScript []byte) string {
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(pkScript, f.params)
+	if err != nil || len(addrs) != 1 {
+		f.t.Fatalf("address: %v", err)
+	}
+	return addrs[0].EncodeAddress()
+}
+
+func (f *fixture) coinbase(height int32) *wire.MsgTx {
+	f.nonce++
+	sigScript, err := txscript.NewScriptBuilder().AddInt64(int64(height)).AddInt64(int64(f.nonce)).Script()
+	if err != nil {
+		f.t.Fatalf("coinbase: %v", err)
+	}
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+		SignatureScript:  sigScript,
+		Sequence:         wire.MaxTxInSequenceNum,
+	})
+	tx.AddTxOut(wire.NewTxOut(blockchain.CalcBlockSubsidy(height, f.params), f.script()))
+	return tx
+}
+
+// spend returns a tx spending every given output of prev into two new outputs
+func (f *fixture) spend(prev *wire.MsgTx, indexes ...uint32) *wire.MsgTx {
+	tx := wire.NewMsgTx(wire.TxVersion)
+	var value int64
+	for _, index := range indexes {
+		txIn := wire.NewTxIn(wire.NewOutPoint(txHash(prev), index), nil, [][]byte{{0x30, byte(index)}, {0x02}})
+		tx.AddTxIn(txIn)
+		value += prev.TxOut[index].Value
+	}
+	tx.AddTxOut(wire.NewTxOut(value/2, f.script()))
+	tx.AddTxOut(wire.NewTxOut(value/2-1000, f.script()))
+	return tx
+}
+
+// block returns a child of parent holding a fresh coinbase followed by txs
+func (f *fixture) block(parent *wire.MsgBlock, txs ...*wire.MsgTx) *wire.MsgBlock {
+	height, ok := f.heights[parent]
+	if !ok {
+		f.t.Fatalf("block: unknown parent %s", parent.BlockHash())
+	}
+	height++
+
+	f.nonce++
+	block := &wire.MsgBlock{
+		Header: wire.BlockHeader{
+			Version:   4,
+			PrevBlock: parent.BlockHash(),
+			Timestamp: parent.Header.Timestamp.Add(10 * time.Minute),
+			Bits:      f.params.PowLimitBits,
+			Nonce:     f.nonce,
+		},
+		Transactions: append([]*wire.MsgTx{f.coinbase(height)}, txs...),
+	}
+
+	utilTxs := make([]*btcutil.Tx, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		utilTxs[i] = btcutil.NewTx(tx)
+	}
+	block.Header.MerkleRoot = blockchain.CalcMerkleRoot(utilTxs, false)
+
+	f.heights[block] = height
+	return block
+}
+
+// chain builds n empty blocks on top of parent and returns them
+func (f *fixture) chain(parent *wire.MsgBlock, n int) []*wire.MsgBlock {
+	blocks := make([]*wire.MsgBlock, n)
+	for i := range blocks {
+		blocks[i] = f.block(parent)
+		parent = blocks[i]
+	}
+	return blocks
+}
+
+func (f *fixture) put(blocks ...*wire.MsgBlock) {
+	f.t.Helper()
+	for _, block := range blocks {
+		if err := f.store.PutBlock(ctx, block); err != nil {
+			f.t.Fatalf("PutBlock %s: %v", block.BlockHash(), err)
+		}
+	}
+}
+
+func txHash(tx *wire.MsgTx) *chainhash.Hash {
+	hash := tx.TxHash()
+	return &hash
+}
+
+// Chain builds regtest blocks on top of the genesis block of a store, for the tests of the packages serving one.
+// blocks are not valid for consensus, only the parts the store looks at are filled
+type Chain struct {
+	f *fixture
+}
+
+// NewChain puts the genesis block in store, which must be an empty regtest store
+func NewChain(t *testing.T, store database.Store) *Chain {
+	return &Chain{f: newFixture(t, store)}
+}
+
+func (c *Chain) Genesis() *wire.MsgBlock {
+	return c.f.genesis
+}
+
+// Block returns a child of parent holding a fresh coinbase paying a unique p2wpkh script, followed by txs
+func (c *Chain) Block(parent *wire.MsgBlock, txs ...*wire.MsgTx) *wire.MsgBlock {
+	return c.f.block(parent, txs...)
+}
+
+// Spend returns a tx spending every given output of prev into two new p2wpkh outputs
+func (c *Chain) Spend(prev *wire.MsgTx, indexes ...uint32) *wire.MsgTx {
+	return c.f.spend(prev, indexes...)
+}
+
+// Put puts blocks in the store in order and fails the test on an error
+func (c *Chain) Put(blocks ...*wire.MsgBlock) {
+	c.f.t.Helper()
+	c.f.put(blocks...)
+}
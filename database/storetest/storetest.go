@@ -0,0 +1,1286 @@
+// Package storetest is a conformance suite every database.Store implementation must pass.
+//
+// A backend wires it up from its own test file:
+//
+//	func TestStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) database.Store {
+//			return database.NewMemoryStore(&chaincfg.RegressionNetParams)
+//		})
+//	}
+package storetest
+
+import (
+	"btc-indexer/database"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/bech32"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Run runs the suite, newStore must return an empty regtest store for every subtest
+func Run(t *testing.T, newStore func(t *testing.T) database.Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, f *fixture)
+	}{
+		{"Genesis", testGenesis},
+		{"LinearChain", testLinearChain},
+		{"Transactions", testTransactions},
+		{"Batches", testBatches},
+		{"SameBlockSpend", testSameBlockSpend},
+		{"Scripts", testScripts},
+		{"Addresses", testAddresses},
+		{"ScriptHash", testScriptHash},
+		{"Payloads", testPayloads},
+		{"Owners", testOwners},
+		{"Coinbase", testCoinbase},
+		{"Safe", testSafe},
+		{"Events", testEvents},
+		{"Pages", testPages},
+		{"RawTx", testRawTx},
+		{"Webhooks", testWebhooks},
+		{"WebhookMatch", testWebhookMatch},
+		{"Broadcasts", testBroadcasts},
+		{"HashPrefix", testHashPrefix},
+		{"DuplicateBlock", testDuplicateBlock},
+		{"UnknownParent", testUnknownParent},
+		{"ShorterFork", testShorterFork},
+		{"Reorg", testReorg},
+		{"DeepReorg", testDeepReorg},
+		{"ReorgBack", testReorgBack},
+		{"Pruned", testPruned},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, newFixture(t, newStore(t)))
+		})
+	}
+}
+
+func testGenesis(t *testing.T, f *fixture) {
+	assertBestChain(t, f, f.genesis)
+
+	block, err := f.store.GetBlockByHash(ctx, f.genesis.BlockHash().String())
+	if err != nil {
+		t.Fatalf("GetBlockByHash: %v", err)
+	}
+	if block.Height != 0 || string(block.MerkleRoot) != f.genesis.Header.MerkleRoot.String() {
+		t.Fatalf("genesis block = %+v", block)
+	}
+}
+
+func testLinearChain(t *testing.T, f *fixture) {
+	blocks := f.chain(f.genesis, 5)
+	f.put(blocks...)
+
+	assertBestChain(t, f, append([]*wire.MsgBlock{f.genesis}, blocks...)...)
+	for i, bl := range blocks {
+		block, err := f.store.GetBlockByHash(ctx, bl.BlockHash().String())
+		if err != nil {
+			t.Fatalf("GetBlockByHash: %v", err)
+		}
+		if string(block.PreviousBlock) != bl.Header.PrevBlock.String() || block.Nonce != bl.Header.Nonce ||
+			block.Timestamp != bl.Header.Timestamp.Unix() || block.Bits != bl.Header.Bits {
+			t.Fatalf("block %d = %+v", i+1, block)
+		}
+	}
+}
+
+func testTransactions(t *testing.T, f *fixture) {
+	b1 := f.block(f.genesis)
+	spend := f.spend(b1.Transactions[0], 0)
+	b2 := f.block(b1, spend)
+	f.put(b1, b2)
+
+	assertTx(t, f, b1.Transactions[0], b1)
+	assertTx(t, f, spend, b2)
+	if tx, _ := f.store.GetTx(ctx, spend.TxHash().String()); tx.Fee != 1000 {
+		t.Fatalf("spend fee = %d, want 1000", tx.Fee)
+	}
+	if tx, _ := f.store.GetTx(ctx, b1.Transactions[0].TxHash().String()); tx.Fee != 0 {
+		t.Fatalf("coinbase fee = %d, want 0", tx.Fee)
+	}
+
+	block, err := f.store.GetBlockByHash(ctx, b2.BlockHash().String())
+	if err != nil {
+		t.Fatalf("GetBlockByHash: %v", err)
+	}
+	if block.TotalFees != 1000 || block.Subsidy != blockchain.CalcBlockSubsidy(2, f.params) || block.TxCount != 2 ||
+		block.Size != b2.SerializeSize() || block.StrippedSize != b2.SerializeSizeStripped() ||
+		block.Weight != b2.SerializeSizeStripped()*3+b2.SerializeSize() || block.CoinbaseHeight != 2 ||
+		string(block.CoinbaseScript) != hex.EncodeToString(b2.Transactions[0].TxIn[0].SignatureScript) ||
+		block.MedianTime != b1.Header.Timestamp.Unix() || block.Difficulty <= 0 {
+		t.Fatalf("block = %+v", block)
+	}
+
+	coinbaseOut := assertOutPoint(t, f, b1.Transactions[0], 0)
+	if coinbaseOut.Value != b1.Transactions[0].TxOut[0].Value || coinbaseOut.Spender == "" || coinbaseOut.Type != "witness_v0_keyhash" {
+		t.Fatalf("coinbase outpoint = %+v", coinbaseOut)
+	}
+	assertSpentBy(t, f, b1.Transactions[0], 0, spend, 0)
+	assertUnspent(t, f, spend, 0)
+	assertUnspent(t, f, spend, 1)
+
+	txIDs, err := f.store.GetBlockTxIDs(ctx, b2.BlockHash().String())
+	if err != nil || len(txIDs) != 2 || string(txIDs[0]) != txHash(b2.Transactions[0]).String() || string(txIDs[1]) != txHash(spend).String() {
+		t.Fatalf("GetBlockTxIDs = %v, %v", txIDs, err)
+	}
+	if _, err := f.store.GetBlockTxIDs(ctx, strings.Repeat("00", 32)); err != database.ErrNotFound {
+		t.Fatalf("GetBlockTxIDs of a missing block: %v, want ErrNotFound", err)
+	}
+}
+
+// testBatches looks up several txs, outpoints and blocks at once, duplicates and unknown keys are skipped
+func testBatches(t *testing.T, f *fixture) {
+	b1 := f.block(f.genesis)
+	coinbase := b1.Transactions[0]
+	spend1 := f.spend(coinbase, 0)
+	spend2 := f.spend(spend1, 0, 1)
+	b2 := f.block(b1, spend1)
+	side2 := f.block(b1)
+	b3 := f.block(b2, spend2)
+	f.put(b1, b2, side2, b3)
+	// not the null txid, the coinbase placeholder outpoint is funded by it
+	unknown := strings.Repeat("ab", 32)
+
+	// keys are txid:index, which sort like the store orders by txid then index
+	outPointKeys := func(keys ...string) string {
+		sort.Strings(keys)
+		return strings.Join(keys, " ")
+	}
+	key := func(tx *wire.MsgTx, index uint32) string {
+		return fmt.Sprintf("%s:%d", tx.TxHash(), index)
+	}
+
+	txs, err := f.store.GetTxs(ctx, []string{spend2.TxHash().String(), unknown, coinbase.TxHash().String(), spend1.TxHash().String(), spend1.TxHash().String()})
+	if err != nil {
+		t.Fatalf("GetTxs: %v", err)
+	}
+	var got []string
+	for _, tx := range txs {
+		if tx.Confirmations < 1 {
+			t.Fatalf("GetTxs returned %+v without confirmations", tx)
+		}
+		got = append(got, string(tx.ID))
+	}
+	if want := outPointKeys(coinbase.TxHash().String(), spend1.TxHash().String(), spend2.TxHash().String()); strings.Join(got, " ") != want {
+		t.Fatalf("GetTxs = %v, want %s", got, want)
+	}
+
+	outPoints, err := f.store.GetOutPointsByTxs(ctx, []string{spend1.TxHash().String(), unknown, coinbase.TxHash().String()})
+	if err != nil {
+		t.Fatalf("GetOutPointsByTxs: %v", err)
+	}
+	got = nil
+	for _, outPoint := range outPoints {
+		got = append(got, fmt.Sprintf("%s:%d", outPoint.FundingTxHash, outPoint.FundingTxIndex))
+	}
+	if want := outPointKeys(key(coinbase, 0), key(spend1, 0), key(spend1, 1)); strings.Join(got, " ") != want {
+		t.Fatalf("GetOutPointsByTxs = %v, want %s", got, want)
+	}
+
+	// coinbases are left out, they all spend the one placeholder outpoint
+	spent, err := f.store.GetOutPointsSpentByTxs(ctx, []string{spend2.TxHash().String(), unknown, spend1.TxHash().String(), spend2.TxHash().String()})
+	if err != nil {
+		t.Fatalf("GetOutPointsSpentByTxs: %v", err)
+	}
+	got = nil
+	for _, outPoint := range spent {
+		got = append(got, fmt.Sprintf("%s:%d", outPoint.SpendingTxHash, outPoint.SpendingTxIndex))
+	}
+	if want := outPointKeys(key(spend1, 0), key(spend2, 0), key(spend2, 1)); strings.Join(got, " ") != want {
+		t.Fatalf("GetOutPointsSpentByTxs = %v, want %s", got, want)
+	}
+
+	// the best chain block of a height, not the orphan
+	blocks, err := f.store.GetBlocksByHeights(ctx, []int32{3, 2, 2, 9})
+	if err != nil {
+		t.Fatalf("GetBlocksByHeights: %v", err)
+	}
+	if len(blocks) != 2 || string(blocks[0].ID) != b2.BlockHash().String() || string(blocks[1].ID) != b3.BlockHash().String() {
+		t.Fatalf("GetBlocksByHeights = %+v, want blocks 2 and 3", blocks)
+	}
+}
+
+func testSameBlockSpend(t *testing.T, f *fixture) {
+	b1 := f.block(f.genesis)
+	parent := f.spend(b1.Transactions[0], 0)
+	child := f.spend(parent, 0, 1)
+	b2 := f.block(b1, parent, child)
+	f.put(b1, b2)
+
+	assertSpentBy(t, f, b1.Transactions[0], 0, parent, 0)
+	assertSpentBy(t, f, parent, 0, child, 0)
+	assertSpentBy(t, f, parent, 1, child, 1)
+	assertUnspent(t, f, child, 0)
+}
+
+func testScripts(t *testing.T, f *fixture) {
+	leaf := []byte{txscript.OP_TRUE}
+	leafHash := sha256.Sum256(leaf)
+	p2wsh, err := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(leafHash[:]).Script()
+	if err != nil {
+		t.Fatalf("script: %v", err)
+	}
+	internalKey := make([]byte, 32)
+	internalKey[31] = 1
+	p2tr, err := txscript.NewScriptBuilder().AddOp(txscript.OP_1).AddData(internalKey).Script()
+	if err != nil {
+		t.Fatalf("script: %v", err)
+	}
+
+	b1 := f.block(f.genesis)
+	fund := f.spend(b1.Transactions[0], 0)
+	fund.TxOut[0].PkScript = p2wsh
+	fund.TxOut[1].PkScript = p2tr
+	spend := f.spend(fund, 0, 1)
+	spend.TxIn[0].Witness = wire.TxWitness{leaf}
+	spend.TxIn[1].Witness = wire.TxWitness{leaf, append([]byte{0xc0}, internalKey...)}
+	b2 := f.block(b1, fund, spend)
+	f.put(b1, b2)
+
+	assertSpentBy(t, f, fund, 0, spend, 0)
+	assertSpentBy(t, f, fund, 1, spend, 1)
+	for index := uint32(0); index < 2; index++ {
+		outPoint := assertOutPoint(t, f, fund, index)
+		if string(outPoint.RevealedScript) != hex.EncodeToString(leaf) || outPoint.RevealedScriptAsm != "1" || outPoint.PkScriptAsm == "" {
+			t.Fatalf("outpoint %d = %+v, want leaf script revealed", index, outPoint)
+		}
+	}
+
+	// p2wpkh spends reveal nothing
+	assertSpentBy(t, f, b1.Transactions[0], 0, fund, 0)
+	if outPoint := assertOutPoint(t, f, b1.Transactions[0], 0); outPoint.RevealedScript != "" {
+		t.Fatalf("p2wpkh outpoint revealed %s", outPoint.RevealedScript)
+	}
+}
+
+func testAddresses(t *testing.T, f *fixture) {
+	b1 := f.block(f.genesis)
+	coinbase := b1.Transactions[0]
+	spend := f.spend(coinbase, 0)
+	b2 := f.block(b1, spend)
+	f.put(b1, b2)
+
+	subsidy := coinbase.TxOut[0].Value
+	miner := f.address(coinbase.TxOut[0].PkScript)
+	assertAddress(t, f, miner, database.Address{
+		ID: miner, Funded: subsidy, Spent: subsidy, TxCount: 2, FirstSeenHeight: 1, LastSeenHeight: 2,
+	})
+	change := f.address(spend.TxOut[1].PkScript)
+	assertAddress(t, f, change, database.Address{
+		ID: change, Funded: spend.TxOut[1].Value, Balance: spend.TxOut[1].Value, UTXOCount: 1, TxCount: 1, FirstSeenHeight: 2, LastSeenHeight: 2,
+	})
+
+	// a longer side chain without the spend reverts it
+	side := f.chain(b1, 2)
+	f.put(side...)
+	assertBestChain(t, f, f.genesis, b1, side[0], side[1])
+	assertAddress(t, f, miner, database.Address{
+		ID: miner, Funded: subsidy, Balance: subsidy, UTXOCount: 1, TxCount: 1, FirstSeenHeight: 1, LastSeenHeight: 1,
+	})
+	if _, err := f.store.GetAddress(ctx, change); err != database.ErrNotFound {
+		t.Fatalf("GetAddress %s: %v, want ErrNotFound", change, err)
+	}
+}
+
+func testScriptHash(t *testing.T, f *fixture) {
+	// a bare p2pk output has no address but still a script hash
+	pubKey := append([]byte{0x02}, make([]byte, 32)...)
+	pubKey[32] = 1
+	p2pk, err := txscript.NewScriptBuilder().AddData(pubKey).AddOp(txscript.OP_CHECKSIG).Script()
+	if err != nil {
+		t.Fatalf("script: %v", err)
+	}
+	sum := sha256.Sum256(p2pk)
+	for i, j := 0, len(sum)-1; i < j; i, j = i+1, j-1 {
+		sum[i], sum[j] = sum[j], sum[i]
+	}
+	hash := hex.EncodeToString(sum[:])
+
+	b1 := f.block(f.genesis)
+	fund := f.spend(b1.Transactions[0], 0)
+	fund.TxOut[0].PkScript = p2pk
+	b2 := f.block(b1, fund)
+	spend := f.spend(fund, 0)
+	b3 := f.block(b2, spend)
+	f.put(b1, b2)
+
+	history, err := f.store.GetScriptHashHistory(ctx, hash)
+	if err != nil || len(history) != 1 || string(history[0].TxHash) != fund.TxHash().String() || history[0].Height != 2 {
+		t.Fatalf("GetScriptHashHistory = %+v, %v", history, err)
+	}
+	utxos, err := f.store.GetScriptHashUTXOs(ctx, hash)
+	if err != nil || len(utxos) != 1 || string(utxos[0].FundingTxHash) != fund.TxHash().String() || utxos[0].FundingTxIndex != 0 {
+		t.Fatalf("GetScriptHashUTXOs = %+v, %v", utxos, err)
+	}
+
+	f.put(b3)
+	history, err = f.store.GetScriptHashHistory(ctx, hash)
+	if err != nil || len(history) != 2 || string(history[1].TxHash) != spend.TxHash().String() || history[1].Height != 3 {
+		t.Fatalf("GetScriptHashHistory = %+v, %v", history, err)
+	}
+	want := sha256.Sum256([]byte(fund.TxHash().String() + ":2:" + spend.TxHash().String() + ":3:"))
+	if status := database.ScriptHashStatus(history); status != hex.EncodeToString(want[:]) {
+		t.Fatalf("ScriptHashStatus = %s", status)
+	}
+	if utxos, err := f.store.GetScriptHashUTXOs(ctx, hash); err != nil || len(utxos) != 0 {
+		t.Fatalf("GetScriptHashUTXOs after spend = %+v, %v", utxos, err)
+	}
+}
+
+func testPayloads(t *testing.T, f *fixture) {
+	opReturn := func(data ...[]byte) []byte {
+		builder := txscript.NewScriptBuilder().AddOp(txscript.OP_RETURN)
+		for _, d := range data {
+			builder.AddData(d)
+		}
+		script, err := builder.Script()
+		if err != nil {
+			t.Fatalf("script: %v", err)
+		}
+		return script
+	}
+
+	b1 := f.block(f.genesis)
+	anchor := f.spend(b1.Transactions[0], 0)
+	anchor.TxOut[1].PkScript = opReturn([]byte("anchor"), []byte{0x01, 0x02})
+	b2 := f.block(b1, anchor)
+	b3 := f.block(b2)
+	b3.Transactions[0].AddTxOut(wire.NewTxOut(0, opReturn([]byte("anchor-v2"))))
+	b4 := f.block(b3)
+	b4.Transactions[0].AddTxOut(wire.NewTxOut(0, opReturn([]byte("other"))))
+	f.put(b1, b2, b3, b4)
+
+	outPoint := assertOutPoint(t, f, anchor, 1)
+	if outPoint.Payload != hex.EncodeToString([]byte("anchor\x01\x02")) || outPoint.PayloadSize != 8 {
+		t.Fatalf("outpoint = %+v", outPoint)
+	}
+
+	prefix := strings.ToUpper(hex.EncodeToString([]byte("anchor")))
+	outPoints, err := f.store.GetOutPointsByPayload(ctx, prefix, 10)
+	if err != nil || len(outPoints) != 2 || outPoints[0].FundingHeight != 2 || outPoints[1].FundingHeight != 3 {
+		t.Fatalf("GetOutPointsByPayload = %+v, %v", outPoints, err)
+	}
+	if outPoints, err := f.store.GetOutPointsByPayload(ctx, prefix, 1); err != nil || len(outPoints) != 1 {
+		t.Fatalf("GetOutPointsByPayload limit 1 = %+v, %v", outPoints, err)
+	}
+
+	stats, err := f.store.GetPayloadStats(ctx, prefix)
+	if err != nil || stats != (database.PayloadStats{Count: 2, TotalSize: 17, MinSize: 8, MaxSize: 9}) {
+		t.Fatalf("GetPayloadStats = %+v, %v", stats, err)
+	}
+	if stats, err := f.store.GetPayloadStats(ctx, ""); err != nil || stats.Count != 3 {
+		t.Fatalf("GetPayloadStats all = %+v, %v", stats, err)
+	}
+}
+
+func testOwners(t *testing.T, f *fixture) {
+	privKey, _ := btcec.PrivKeyFromBytes([]byte{1, 2, 3})
+	pubKey := privKey.PubKey().SerializeCompressed()
+	otherKey := append([]byte{0x03}, make([]byte, 32)...)
+	build := func(builder *txscript.ScriptBuilder) []byte {
+		script, err := builder.Script()
+		if err != nil {
+			t.Fatalf("script: %v", err)
+		}
+		return script
+	}
+	p2pk := build(txscript.NewScriptBuilder().AddData(pubKey).AddOp(txscript.OP_CHECKSIG))
+	multisig := build(txscript.NewScriptBuilder().AddOp(txscript.OP_1).AddData(pubKey).AddData(otherKey).AddOp(txscript.OP_2).AddOp(txscript.OP_CHECKMULTISIG))
+	witnessV2 := build(txscript.NewScriptBuilder().AddOp(txscript.OP_2).AddData(make([]byte, 32)))
+	nonstandard := []byte{txscript.OP_TRUE}
+	nulldata := build(txscript.NewScriptBuilder().AddOp(txscript.OP_RETURN).AddData([]byte("data")))
+
+	b1 := f.block(f.genesis)
+	b1.Transactions[0].TxOut[0].PkScript = p2pk
+	for _, script := range [][]byte{multisig, witnessV2, nonstandard, nulldata} {
+		b1.Transactions[0].AddTxOut(wire.NewTxOut(0, script))
+	}
+	f.put(b1)
+	coinbase := b1.Transactions[0]
+
+	pubKeyHash, err := btcutil.NewAddressPubKeyHash(btcutil.Hash160(pubKey), f.params)
+	if err != nil {
+		t.Fatalf("address: %v", err)
+	}
+	outPoint := assertOutPoint(t, f, coinbase, 0)
+	if outPoint.Type != "pubkey" || outPoint.Owner.Address != pubKeyHash.EncodeAddress() || outPoint.Spender != outPoint.Owner.Address ||
+		len(outPoint.Owner.PubKeys) != 1 || string(outPoint.Owner.PubKeys[0]) != hex.EncodeToString(pubKey) {
+		t.Fatalf("p2pk outpoint = %+v", outPoint)
+	}
+
+	outPoint = assertOutPoint(t, f, coinbase, 1)
+	if outPoint.Type != "multisig" || outPoint.Owner.Address != "" || outPoint.Owner.Required != 1 || len(outPoint.Owner.PubKeys) != 2 ||
+		string(outPoint.Owner.PubKeys[1]) != hex.EncodeToString(otherKey) || outPoint.Spender != string(outPoint.ScriptHash) {
+		t.Fatalf("multisig outpoint = %+v", outPoint)
+	}
+
+	outPoint = assertOutPoint(t, f, coinbase, 2)
+	_, data, version, err := bech32.DecodeGeneric(outPoint.Owner.Address)
+	if outPoint.Type != "witness_unknown" || err != nil || version != bech32.VersionM || data[0] != 2 || outPoint.Spender != outPoint.Owner.Address {
+		t.Fatalf("witness v2 outpoint = %+v, %v", outPoint, err)
+	}
+
+	outPoint = assertOutPoint(t, f, coinbase, 3)
+	if outPoint.Type != "nonstandard" || outPoint.Owner.Address != "" || outPoint.Spender != string(outPoint.ScriptHash) {
+		t.Fatalf("nonstandard outpoint = %+v", outPoint)
+	}
+
+	outPoint = assertOutPoint(t, f, coinbase, 4)
+	if outPoint.Type != "nulldata" || outPoint.Spender != "" {
+		t.Fatalf("nulldata outpoint = %+v", outPoint)
+	}
+}
+
+func testCoinbase(t *testing.T, f *fixture) {
+	b1 := f.block(f.genesis)
+	coinbase := b1.Transactions[0]
+	coinbase.AddTxOut(wire.NewTxOut(0, f.script()))
+	miner := coinbase.TxOut[0].PkScript
+	pay := f.spend(coinbase, 1)
+	pay.TxOut[0].PkScript = miner
+	b2 := f.block(b1, pay)
+	f.put(b1, b2)
+
+	if tx, err := f.store.GetTx(ctx, txHash(coinbase).String()); err != nil || !tx.Coinbase {
+		t.Fatalf("GetTx coinbase = %+v, %v", tx, err)
+	}
+	if tx, err := f.store.GetTx(ctx, txHash(pay).String()); err != nil || tx.Coinbase {
+		t.Fatalf("GetTx pay = %+v, %v", tx, err)
+	}
+	outPoint := assertOutPoint(t, f, coinbase, 0)
+	if !outPoint.Coinbase || outPoint.MatureHeight != 1+int32(f.params.CoinbaseMaturity) || outPoint.Spendable(2) {
+		t.Fatalf("coinbase outpoint = %+v", outPoint)
+	}
+	outPoint = assertOutPoint(t, f, pay, 0)
+	if outPoint.Coinbase || outPoint.MatureHeight != 2 || !outPoint.Spendable(2) {
+		t.Fatalf("pay outpoint = %+v", outPoint)
+	}
+
+	assertSpendable := func(want ...*wire.MsgTx) {
+		t.Helper()
+		utxos, err := f.store.GetSpendableUTXOs(ctx, f.address(miner))
+		if err != nil || len(utxos) != len(want) {
+			t.Fatalf("GetSpendableUTXOs = %+v, %v, want %d", utxos, err, len(want))
+		}
+		for i, tx := range want {
+			if string(utxos[i].FundingTxHash) != txHash(tx).String() {
+				t.Fatalf("GetSpendableUTXOs[%d] = %s, want %s", i, utxos[i].FundingTxHash, txHash(tx))
+			}
+		}
+	}
+	assertSpendable(pay)
+
+	// the coinbase output can be spent in the block at height 1+maturity
+	blocks := f.chain(b2, int(f.params.CoinbaseMaturity)-3)
+	f.put(blocks...)
+	assertSpendable(pay)
+	f.put(f.block(blocks[len(blocks)-1]))
+	assertSpendable(coinbase, pay)
+}
+
+func testSafe(t *testing.T, f *fixture) {
+	if err := f.store.SetSafeDepth(ctx, 3); err != nil {
+		t.Fatalf("SetSafeDepth: %v", err)
+	}
+	b1 := f.block(f.genesis)
+	pay := f.spend(b1.Transactions[0], 0)
+	b2 := f.block(b1, pay)
+	f.put(b1, b2)
+
+	tx, err := f.store.GetTx(ctx, txHash(b1.Transactions[0]).String())
+	if err != nil || tx.Safe || tx.Confirmations != 2 {
+		t.Fatalf("GetTx before depth = %+v, %v", tx, err)
+	}
+
+	assertSafe := func(since int32, want ...*wire.MsgTx) {
+		t.Helper()
+		txs, err := f.store.GetSafeTxs(ctx, since)
+		if err != nil || len(txs) != len(want) {
+			t.Fatalf("GetSafeTxs(%d) = %+v, %v, want %d txs", since, txs, err, len(want))
+		}
+		for i, tx := range want {
+			if string(txs[i].ID) != txHash(tx).String() || !txs[i].Safe {
+				t.Fatalf("GetSafeTxs(%d)[%d] = %+v, want %s", since, i, txs[i], txHash(tx))
+			}
+		}
+	}
+
+	blocks := f.chain(b2, 2)
+	f.put(blocks...)
+	assertSafe(0, b1.Transactions[0], b2.Transactions[0], pay)
+	assertSafe(3, b2.Transactions[0], pay)
+	tx, err = f.store.GetTx(ctx, txHash(pay).String())
+	if err != nil || !tx.Safe || tx.SafeHeight != 4 || tx.Confirmations != 3 {
+		t.Fatalf("GetTx pay = %+v, %v", tx, err)
+	}
+
+	// the side chain from b1 takes the safe b2 away when it gets longer at height 5, pay is reconnected deep enough to be safe again
+	s2 := f.block(b1, pay)
+	side := append([]*wire.MsgBlock{s2}, f.chain(s2, 4)...)
+	f.put(side...)
+	assertBestChain(t, f, f.genesis, b1, side[0], side[1], side[2], side[3], side[4])
+	if _, err := f.store.GetTx(ctx, txHash(b2.Transactions[0]).String()); err != database.ErrNotFound {
+		t.Fatalf("GetTx orphaned coinbase: %v, want ErrNotFound", err)
+	}
+	assertSafe(4, s2.Transactions[0], pay, side[1].Transactions[0], side[2].Transactions[0])
+	tx, err = f.store.GetTx(ctx, txHash(pay).String())
+	if err != nil || tx.SafeHeight != 5 || tx.Confirmations != 5 {
+		t.Fatalf("GetTx pay after reorg = %+v, %v", tx, err)
+	}
+
+	// a raised depth takes back the safe flag of the txs short of it, a lowered one marks the txs reaching it at the tip
+	if err := f.store.SetSafeDepth(ctx, 5); err != nil {
+		t.Fatalf("SetSafeDepth: %v", err)
+	}
+	assertSafe(0, b1.Transactions[0], s2.Transactions[0], pay)
+	tx, err = f.store.GetTx(ctx, txHash(side[1].Transactions[0]).String())
+	if err != nil || tx.Safe || tx.SafeHeight != 0 {
+		t.Fatalf("GetTx at 4 confirmations after raising the depth to 5 = %+v, %v", tx, err)
+	}
+	if err := f.store.SetSafeDepth(ctx, 2); err != nil {
+		t.Fatalf("SetSafeDepth: %v", err)
+	}
+	assertSafe(5, side[1].Transactions[0], side[2].Transactions[0], side[3].Transactions[0])
+	assertSafe(0, b1.Transactions[0], s2.Transactions[0], pay, side[1].Transactions[0], side[2].Transactions[0], side[3].Transactions[0])
+}
+
+// RunAtomic checks a PutBlock failing halfway through a reorg leaves the best chain and the journal as they were.
+// newStore must return an empty regtest store refusing a txid indexed twice, the memory store overwrites it so it does not run this
+func RunAtomic(t *testing.T, newStore func(t *testing.T) database.Store) {
+	f := newFixture(t, newStore(t))
+	var heard []database.Event
+	f.store.Listen(func(events []database.Event) { heard = append(heard, events...) })
+
+	b1 := f.block(f.genesis)
+	pay := f.spend(b1.Transactions[0], 0)
+	b2 := f.block(b1, pay)
+	f.put(b1, b2)
+	seq, err := f.store.GetLastEventSeq(ctx)
+	if err != nil {
+		t.Fatalf("GetLastEventSeq: %v", err)
+	}
+	before := len(heard)
+
+	// b2 is disconnected before side2 fails to connect, it repeats the coinbase of b1
+	side2 := f.block(b1, b1.Transactions[0])
+	side3 := f.block(side2)
+	f.put(side2)
+	if err := f.store.PutBlock(ctx, side3); err == nil {
+		t.Fatalf("PutBlock %s succeeded with a txid indexed twice", side3.BlockHash())
+	}
+	assertBestChain(t, f, f.genesis, b1, b2)
+	assertTx(t, f, pay, b2)
+	assertSpentBy(t, f, b1.Transactions[0], 0, pay, 0)
+	if got, err := f.store.GetLastEventSeq(ctx); err != nil || got != seq {
+		t.Fatalf("GetLastEventSeq = %d, %v, want %d", got, err, seq)
+	}
+	if len(heard) != before {
+		t.Fatalf("listener heard %+v of a failed PutBlock", heard[before:])
+	}
+
+	// the journal goes on numbering from the last written event
+	b3 := f.block(b2)
+	f.put(b3)
+	events, err := f.store.GetEvents(ctx, seq, 0)
+	if err != nil || len(events) != 2 || events[0].Seq != seq+1 || events[0].Type != database.EventBlockConnected || string(events[0].BlockHash) != b3.BlockHash().String() {
+		t.Fatalf("GetEvents(%d) = %+v, %v", seq, events, err)
+	}
+}
+
+func testEvents(t *testing.T, f *fixture) {
+	var heard []database.Event
+	f.store.Listen(func(events []database.Event) { heard = append(heard, events...) })
+
+	b1 := f.block(f.genesis)
+	pay := f.spend(b1.Transactions[0], 0)
+	b2 := f.block(b1, pay)
+	f.put(b1, b2)
+
+	hash := func(tx *wire.MsgTx) database.Hash { return database.Hash(txHash(tx).String()) }
+	blockHash := func(block *wire.MsgBlock) database.Hash { return database.Hash(block.BlockHash().String()) }
+	connected := func(block *wire.MsgBlock, height int32) []database.Event {
+		events := []database.Event{
+			{Type: database.EventBlockConnected, BlockHash: blockHash(block), Height: height},
+			{Type: database.EventTxConfirmed, BlockHash: blockHash(block), Height: height, TxHash: hash(block.Transactions[0])},
+		}
+		if len(block.Transactions) > 1 {
+			events = append(events,
+				database.Event{Type: database.EventTxConfirmed, BlockHash: blockHash(block), Height: height, TxHash: hash(pay)},
+				database.Event{Type: database.EventOutPointSpent, BlockHash: blockHash(block), Height: height, TxHash: hash(b1.Transactions[0]), SpendingTxHash: hash(pay)},
+			)
+		}
+		return events
+	}
+	want := append(connected(b1, 1), connected(b2, 2)...)
+	assertEvents(t, f, 0, want)
+
+	// a longer side chain disconnects b2 in reverse order before connecting itself
+	side := f.chain(b1, 2)
+	f.put(side...)
+	want = append(want,
+		database.Event{Type: database.EventOutPointUnspent, BlockHash: blockHash(b2), Height: 2, TxHash: hash(b1.Transactions[0]), SpendingTxHash: hash(pay)},
+		database.Event{Type: database.EventTxOrphaned, BlockHash: blockHash(b2), Height: 2, TxHash: hash(pay)},
+		database.Event{Type: database.EventTxOrphaned, BlockHash: blockHash(b2), Height: 2, TxHash: hash(b2.Transactions[0])},
+		database.Event{Type: database.EventBlockDisconnected, BlockHash: blockHash(b2), Height: 2},
+	)
+	want = append(want, connected(side[0], 2)...)
+	want = append(want, connected(side[1], 3)...)
+	assertEvents(t, f, 0, want)
+	assertEvents(t, f, 6, want[6:])
+
+	events, err := f.store.GetEvents(ctx, 4, 3)
+	if err != nil || len(events) != 3 || events[0].Seq != 5 || events[2].Seq != 7 {
+		t.Fatalf("GetEvents(4, 3) = %+v, %v", events, err)
+	}
+	if seq, err := f.store.GetLastEventSeq(ctx); err != nil || seq != int64(len(want)) {
+		t.Fatalf("GetLastEventSeq = %d, %v, want %d", seq, err, len(want))
+	}
+	// listeners hear of every written event in order
+	if len(heard) != len(want) || heard[0] != want[0] || heard[len(heard)-1] != want[len(want)-1] {
+		t.Fatalf("listener heard %+v, want %+v", heard, want)
+	}
+
+	// the txs of an orphaned block are gone, the ones of the best chain come in block order
+	if txs, err := f.store.GetBlockTxs(ctx, string(blockHash(b2))); err != nil || len(txs) != 0 {
+		t.Fatalf("GetBlockTxs(orphan) = %+v, %v", txs, err)
+	}
+	txs, err := f.store.GetBlockTxs(ctx, string(blockHash(b1)))
+	if err != nil || len(txs) != 1 || txs[0].ID != hash(b1.Transactions[0]) || txs[0].Confirmations != 3 {
+		t.Fatalf("GetBlockTxs = %+v, %v", txs, err)
+	}
+}
+
+func assertEvents(t *testing.T, f *fixture, since int64, want []database.Event) {
+	t.Helper()
+	events, err := f.store.GetEvents(ctx, since, 0)
+	if err != nil || len(events) != len(want) {
+		t.Fatalf("GetEvents(%d) = %+v, %v, want %d events", since, events, err, len(want))
+	}
+	for i := range want {
+		want[i].Seq = since + int64(i) + 1
+		if events[i] != want[i] {
+			t.Fatalf("GetEvents(%d)[%d] = %+v, want %+v", since, i, events[i], want[i])
+		}
+	}
+}
+
+func testPages(t *testing.T, f *fixture) {
+	b1 := f.block(f.genesis)
+	miner := b1.Transactions[0].TxOut[0].PkScript
+	pay := f.spend(b1.Transactions[0], 0)
+	pay.TxOut[0].PkScript = miner
+	pay.TxOut[1].PkScript = miner
+	b2 := f.block(b1, pay)
+	b3 := f.block(b2)
+	b3.Transactions[0].TxOut[0].PkScript = miner
+	f.put(b1, b2, b3)
+	address := f.address(miner)
+
+	outPoints, err := f.store.GetOutPointsByTx(ctx, txHash(pay).String())
+	if err != nil || len(outPoints) != 2 || outPoints[0].FundingTxIndex != 0 || outPoints[1].FundingTxIndex != 1 {
+		t.Fatalf("GetOutPointsByTx = %+v, %v", outPoints, err)
+	}
+	outPoints, err = f.store.GetOutPointsSpentBy(ctx, txHash(pay).String())
+	if err != nil || len(outPoints) != 1 || string(outPoints[0].FundingTxHash) != txHash(b1.Transactions[0]).String() {
+		t.Fatalf("GetOutPointsSpentBy = %+v, %v", outPoints, err)
+	}
+
+	utxos, err := f.store.GetAddressUTXOs(ctx, address, nil, 2)
+	if err != nil || len(utxos) != 2 || string(utxos[0].FundingTxHash) != txHash(pay).String() || utxos[1].FundingTxIndex != 1 {
+		t.Fatalf("GetAddressUTXOs first page = %+v, %v", utxos, err)
+	}
+	utxos, err = f.store.GetAddressUTXOs(ctx, address, utxos[1].UTXOCursor(), 2)
+	if err != nil || len(utxos) != 1 || string(utxos[0].FundingTxHash) != txHash(b3.Transactions[0]).String() {
+		t.Fatalf("GetAddressUTXOs second page = %+v, %v", utxos, err)
+	}
+
+	history, err := f.store.GetAddressHistory(ctx, address, nil, 2)
+	if err != nil || len(history) != 2 || string(history[0].TxHash) != txHash(b1.Transactions[0]).String() ||
+		string(history[1].TxHash) != txHash(pay).String() || history[1].Height != 2 || history[1].Position != 1 {
+		t.Fatalf("GetAddressHistory first page = %+v, %v", history, err)
+	}
+	history, err = f.store.GetAddressHistory(ctx, address, history[1].Cursor(), 2)
+	if err != nil || len(history) != 1 || string(history[0].TxHash) != txHash(b3.Transactions[0]).String() {
+		t.Fatalf("GetAddressHistory second page = %+v, %v", history, err)
+	}
+
+	history, err = f.store.GetAddressHistoryBefore(ctx, address, nil, 2)
+	if err != nil || len(history) != 2 || string(history[0].TxHash) != txHash(b3.Transactions[0]).String() || string(history[1].TxHash) != txHash(pay).String() {
+		t.Fatalf("GetAddressHistoryBefore first page = %+v, %v", history, err)
+	}
+	history, err = f.store.GetAddressHistoryBefore(ctx, address, history[1].Cursor(), 2)
+	if err != nil || len(history) != 1 || string(history[0].TxHash) != txHash(b1.Transactions[0]).String() {
+		t.Fatalf("GetAddressHistoryBefore second page = %+v, %v", history, err)
+	}
+}
+
+func testRawTx(t *testing.T, f *fixture) {
+	b1 := f.block(f.genesis)
+	b1.Transactions[0].TxIn[0].Witness = wire.TxWitness{make([]byte, 32)}
+	pay := f.spend(b1.Transactions[0], 0)
+	pay.TxIn[0].SignatureScript = []byte{txscript.OP_TRUE}
+	pay.LockTime = 7
+	f.put(b1, f.block(b1, pay))
+
+	for _, tx := range []*wire.MsgTx{b1.Transactions[0], pay} {
+		msg, err := f.store.GetMsgTx(ctx, txHash(tx).String())
+		if err != nil {
+			t.Fatalf("GetMsgTx %s: %v", txHash(tx), err)
+		}
+		var want, got bytes.Buffer
+		tx.Serialize(&want)
+		msg.Serialize(&got)
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Fatalf("GetMsgTx %s = %x, want %x", txHash(tx), got.Bytes(), want.Bytes())
+		}
+	}
+}
+
+func testWebhooks(t *testing.T, f *fixture) {
+	for i, id := range []string{"b", "a"} {
+		if err := f.store.PutWatch(ctx, database.Watch{ID: id, URL: "http://localhost/" + id, Kind: database.WatchTx, Target: "00", Confirmations: 1, Created: int64(i)}); err != nil {
+			t.Fatalf("PutWatch %s: %v", id, err)
+		}
+	}
+	if err := f.store.PutWatch(ctx, database.Watch{ID: "a"}); err == nil {
+		t.Fatalf("PutWatch of a stored ID succeeded")
+	}
+	watches, err := f.store.GetWatches(ctx)
+	if err != nil || len(watches) != 2 || watches[0].ID != "b" || watches[1].ID != "a" {
+		t.Fatalf("GetWatches = %+v, %v", watches, err)
+	}
+	if err := f.store.DeleteWatch(ctx, "b"); err != nil {
+		t.Fatalf("DeleteWatch: %v", err)
+	}
+	if err := f.store.DeleteWatch(ctx, "b"); err != database.ErrNotFound {
+		t.Fatalf("DeleteWatch of a deleted watch: %v, want ErrNotFound", err)
+	}
+
+	tx := database.Hash(strings.Repeat("ab", 32))
+	deliveries := []database.Delivery{
+		{ID: "1", TxHash: tx, Height: 1, DueHeight: 1, Status: database.DeliveryPending, NextAttempt: 20},
+		{ID: "2", TxHash: tx, Height: 1, DueHeight: 3, Status: database.DeliveryPending, NextAttempt: 10},
+		{ID: "3", Height: 1, Status: database.DeliveryPending, NextAttempt: 10},
+		{ID: "4", Height: 1, Status: database.DeliveryDead},
+		{ID: "5", Height: 1, Status: database.DeliveryDead},
+	}
+	if err := f.store.AddDeliveries(ctx, deliveries); err != nil {
+		t.Fatalf("AddDeliveries: %v", err)
+	}
+	// adding a stored delivery again keeps the stored one
+	if err := f.store.AddDeliveries(ctx, []database.Delivery{{ID: "1", Status: database.DeliveryDead}}); err != nil {
+		t.Fatalf("AddDeliveries again: %v", err)
+	}
+	if delivery, err := f.store.GetDelivery(ctx, "1"); err != nil || delivery.Status != database.DeliveryPending || delivery.TxHash != tx {
+		t.Fatalf("GetDelivery = %+v, %v", delivery, err)
+	}
+
+	assertDeliveries := func(what string, got []database.Delivery, err error, want ...string) {
+		t.Helper()
+		ids := make([]string, len(got))
+		for i, delivery := range got {
+			ids[i] = delivery.ID
+		}
+		if err != nil || strings.Join(ids, ",") != strings.Join(want, ",") {
+			t.Fatalf("%s = %v, %v, want %v", what, ids, err, want)
+		}
+	}
+	due, err := f.store.GetDueDeliveries(ctx, 2, 20, 10)
+	assertDeliveries("GetDueDeliveries(2, 20)", due, err, "3", "1")
+	due, err = f.store.GetDueDeliveries(ctx, 3, 15, 10)
+	assertDeliveries("GetDueDeliveries(3, 15)", due, err, "2", "3")
+	due, err = f.store.GetDueDeliveries(ctx, 3, 20, 1)
+	assertDeliveries("GetDueDeliveries(3, 20, 1)", due, err, "2")
+	dead, err := f.store.GetDeadDeliveries(ctx, "", 1)
+	assertDeliveries("GetDeadDeliveries", dead, err, "4")
+	dead, err = f.store.GetDeadDeliveries(ctx, "4", 10)
+	assertDeliveries("GetDeadDeliveries after 4", dead, err, "5")
+
+	delivered := deliveries[0]
+	delivered.Status = database.DeliveryDelivered
+	delivered.Attempts = 1
+	if err := f.store.UpdateDelivery(ctx, delivered); err != nil {
+		t.Fatalf("UpdateDelivery: %v", err)
+	}
+	if err := f.store.UpdateDelivery(ctx, database.Delivery{ID: "missing"}); err != database.ErrNotFound {
+		t.Fatalf("UpdateDelivery of a missing delivery: %v, want ErrNotFound", err)
+	}
+	if err := f.store.DeleteDelivery(ctx, "3"); err != nil {
+		t.Fatalf("DeleteDelivery: %v", err)
+	}
+	if err := f.store.PruneDeliveries(ctx, 2); err != nil {
+		t.Fatalf("PruneDeliveries: %v", err)
+	}
+	if _, err := f.store.GetDelivery(ctx, "1"); err != database.ErrNotFound {
+		t.Fatalf("GetDelivery of a pruned delivery: %v, want ErrNotFound", err)
+	}
+	due, err = f.store.GetDueDeliveries(ctx, 3, 20, 10)
+	assertDeliveries("GetDueDeliveries after updates", due, err, "2")
+}
+
+func testWebhookMatch(t *testing.T, f *fixture) {
+	b1 := f.block(f.genesis)
+	f.put(b1)
+	coinbase := b1.Transactions[0]
+	spend := f.spend(coinbase, 0)
+	miner := database.Watch{ID: "miner", URL: "http://localhost/miner", Kind: database.WatchAddress, Target: f.address(coinbase.TxOut[0].PkScript), Confirmations: 2}
+	payment := database.Watch{ID: "payment", URL: "http://localhost/payment", Kind: database.WatchTx, Target: txHash(spend).String(), Confirmations: 1}
+	for _, watch := range []database.Watch{miner, payment} {
+		if err := f.store.PutWatch(ctx, watch); err != nil {
+			t.Fatalf("PutWatch %s: %v", watch.ID, err)
+		}
+	}
+
+	// the spend matches both watches, the address one waits for a second confirmation
+	b2 := f.block(b1, spend)
+	f.put(b2)
+	spendHash, b2Hash := database.Hash(txHash(spend).String()), database.Hash(b2.BlockHash().String())
+	minerID := database.DeliveryID(miner.ID, database.EventTxConfirmed, spendHash, b2Hash)
+	paymentID := database.DeliveryID(payment.ID, database.EventTxConfirmed, spendHash, b2Hash)
+	assertDue := func(tip int32, want ...string) {
+		t.Helper()
+		due, err := f.store.GetDueDeliveries(ctx, tip, 0, 10)
+		ids := make([]string, len(due))
+		for i, delivery := range due {
+			ids[i] = delivery.ID
+		}
+		if err != nil || strings.Join(ids, ",") != strings.Join(want, ",") {
+			t.Fatalf("GetDueDeliveries(%d) = %v, %v, want %v", tip, ids, err, want)
+		}
+	}
+	assertDue(2, paymentID)
+	assertDue(3, minerID, paymentID)
+
+	delivered, err := f.store.GetDelivery(ctx, paymentID)
+	if err != nil || delivered.TxHash != spendHash || delivered.Height != 2 || delivered.URL != payment.URL {
+		t.Fatalf("GetDelivery = %+v, %v", delivered, err)
+	}
+	delivered.Status = database.DeliveryDelivered
+	delivered.Attempts = 1
+	if err := f.store.UpdateDelivery(ctx, delivered); err != nil {
+		t.Fatalf("UpdateDelivery: %v", err)
+	}
+
+	// the reorg cancels the waiting delivery and reports the delivered one orphaned
+	side := f.chain(b1, 2)
+	f.put(side...)
+	if _, err := f.store.GetDelivery(ctx, minerID); err != database.ErrNotFound {
+		t.Fatalf("GetDelivery of a cancelled delivery: %v, want ErrNotFound", err)
+	}
+	orphanedID := database.DeliveryID(payment.ID, database.EventTxOrphaned, spendHash, b2Hash)
+	assertDue(0, orphanedID)
+
+	// a deleted watch no longer matches
+	if err := f.store.DeleteWatch(ctx, payment.ID); err != nil {
+		t.Fatalf("DeleteWatch: %v", err)
+	}
+	b4 := f.block(side[1], spend)
+	f.put(b4)
+	assertDue(5, database.DeliveryID(miner.ID, database.EventTxConfirmed, spendHash, database.Hash(b4.BlockHash().String())), orphanedID)
+}
+
+func testBroadcasts(t *testing.T, f *fixture) {
+	first, second := database.Hash(strings.Repeat("01", 32)), database.Hash(strings.Repeat("02", 32))
+	for _, broadcast := range []database.Broadcast{
+		{ID: second, Raw: []byte{2}, Status: database.BroadcastPending, Created: 2},
+		{ID: first, Raw: []byte{1}, Status: database.BroadcastPending, Created: 1},
+	} {
+		if err := f.store.PutBroadcast(ctx, broadcast); err != nil {
+			t.Fatalf("PutBroadcast: %v", err)
+		}
+	}
+	pending, err := f.store.GetBroadcasts(ctx, database.BroadcastPending)
+	if err != nil || len(pending) != 2 || pending[0].ID != first || pending[1].ID != second {
+		t.Fatalf("GetBroadcasts = %+v, %v", pending, err)
+	}
+
+	relayed := pending[0]
+	relayed.SetPeer("127.0.0.1:8333", database.BroadcastRelayed, "", 2)
+	if err := f.store.UpdateBroadcast(ctx, relayed); err != nil {
+		t.Fatalf("UpdateBroadcast: %v", err)
+	}
+	if err := f.store.UpdateBroadcast(ctx, database.Broadcast{ID: database.Hash(strings.Repeat("03", 32))}); err != database.ErrNotFound {
+		t.Fatalf("UpdateBroadcast of a missing broadcast: %v, want ErrNotFound", err)
+	}
+	broadcast, err := f.store.GetBroadcast(ctx, string(first))
+	if err != nil || broadcast.Status != database.BroadcastRelayed || len(broadcast.Peers) != 1 || broadcast.Peers[0] != relayed.Peers[0] || !bytes.Equal(broadcast.Raw, []byte{1}) {
+		t.Fatalf("GetBroadcast = %+v, %v", broadcast, err)
+	}
+
+	// broadcasting a tx again starts over
+	if err := f.store.PutBroadcast(ctx, database.Broadcast{ID: first, Raw: []byte{1}, Status: database.BroadcastPending, Created: 3}); err != nil {
+		t.Fatalf("PutBroadcast again: %v", err)
+	}
+	pending, err = f.store.GetBroadcasts(ctx, database.BroadcastPending)
+	if err != nil || len(pending) != 2 || pending[0].ID != second || pending[1].ID != first || pending[1].Peers != nil {
+		t.Fatalf("GetBroadcasts after a new broadcast = %+v, %v", pending, err)
+	}
+}
+
+func testHashPrefix(t *testing.T, f *fixture) {
+	blocks := f.chain(f.genesis, 20)
+	f.put(blocks...)
+
+	txid := blocks[7].Transactions[0].TxHash().String()
+	for _, prefix := range []string{txid[:1], txid[:5], strings.ToUpper(txid[:6]), txid} {
+		txs, err := f.store.GetTxsByPrefix(ctx, prefix, 100)
+		if err != nil {
+			t.Fatalf("GetTxsByPrefix(%s): %v", prefix, err)
+		}
+		found := false
+		for i, tx := range txs {
+			if !strings.HasPrefix(string(tx.ID), strings.ToLower(prefix)) || (i > 0 && txs[i-1].ID >= tx.ID) {
+				t.Fatalf("GetTxsByPrefix(%s) = %+v", prefix, txs)
+			}
+			found = found || string(tx.ID) == txid
+		}
+		if !found || (prefix == txid && len(txs) != 1) || txs[0].Confirmations == 0 {
+			t.Fatalf("GetTxsByPrefix(%s) = %+v, want %s", prefix, txs, txid)
+		}
+	}
+	if txs, err := f.store.GetTxsByPrefix(ctx, "", 3); err != nil || len(txs) != 3 {
+		t.Fatalf("GetTxsByPrefix with limit 3 = %d txs, %v", len(txs), err)
+	}
+
+	hash := blocks[12].BlockHash().String()
+	found, err := f.store.GetBlocksByPrefix(ctx, hash[:3], 100)
+	if err != nil || len(found) == 0 {
+		t.Fatalf("GetBlocksByPrefix(%s) = %+v, %v", hash[:3], found, err)
+	}
+	var block *database.Block
+	for i := range found {
+		if !strings.HasPrefix(string(found[i].ID), hash[:3]) || (i > 0 && found[i-1].ID >= found[i].ID) {
+			t.Fatalf("GetBlocksByPrefix(%s) = %+v", hash[:3], found)
+		}
+		if string(found[i].ID) == hash {
+			block = &found[i]
+		}
+	}
+	if block == nil || block.Height != 13 {
+		t.Fatalf("GetBlocksByPrefix(%s) = %+v, want block 13", hash[:3], found)
+	}
+}
+
+func testDuplicateBlock(t *testing.T, f *fixture) {
+	blocks := f.chain(f.genesis, 3)
+	f.put(blocks...)
+	f.put(blocks[1], blocks[2])
+
+	assertBestChain(t, f, f.genesis, blocks[0], blocks[1], blocks[2])
+	assertTx(t, f, blocks[1].Transactions[0], blocks[1])
+}
+
+func testUnknownParent(t *testing.T, f *fixture) {
+	blocks := f.chain(f.genesis, 2)
+	f.put(blocks[1])
+
+	assertBestChain(t, f, f.genesis)
+	assertMissing(t, f, blocks[1])
+
+	f.put(blocks...)
+	assertBestChain(t, f, f.genesis, blocks[0], blocks[1])
+}
+
+func testShorterFork(t *testing.T, f *fixture) {
+	best := f.chain(f.genesis, 3)
+	f.put(best...)
+
+	// a competitor for the tip and a stale block deeper down do not replace the best chain
+	tipFork := f.block(best[1])
+	deepFork := f.block(best[0])
+	f.put(tipFork, deepFork)
+
+	assertBestChain(t, f, f.genesis, best[0], best[1], best[2])
+	assertOrphan(t, f, tipFork, 3)
+	assertOrphan(t, f, deepFork, 2)
+	assertNoTx(t, f, tipFork.Transactions[0])
+	assertNoTx(t, f, deepFork.Transactions[0])
+
+	orphans, err := f.store.GetOrphanBlocks(ctx, 0)
+	if err != nil || len(orphans) != 2 || string(orphans[0].ID) != deepFork.BlockHash().String() || string(orphans[1].ID) != tipFork.BlockHash().String() {
+		t.Fatalf("GetOrphanBlocks(0) = %+v, %v", orphans, err)
+	}
+	if orphans, err := f.store.GetOrphanBlocks(ctx, 3); err != nil || len(orphans) != 1 || string(orphans[0].ID) != tipFork.BlockHash().String() {
+		t.Fatalf("GetOrphanBlocks(3) = %+v, %v", orphans, err)
+	}
+}
+
+func testReorg(t *testing.T, f *fixture) {
+	b1 := f.block(f.genesis)
+	spend := f.spend(b1.Transactions[0], 0)
+	b2 := f.block(b1, spend)
+	f.put(b1, b2)
+
+	// the side chain confirms the same spend one block later
+	side2 := f.block(b1)
+	side3 := f.block(side2, spend)
+	f.put(side2)
+	assertOrphan(t, f, side2, 2)
+
+	f.put(side3)
+	assertBestChain(t, f, f.genesis, b1, side2, side3)
+	assertOrphan(t, f, b2, 2)
+	assertNoTx(t, f, b2.Transactions[0])
+	assertTx(t, f, spend, side3)
+	assertSpentBy(t, f, b1.Transactions[0], 0, spend, 0)
+}
+
+func testDeepReorg(t *testing.T, f *fixture) {
+	base := f.chain(f.genesis, 2)
+	f.put(base...)
+
+	b3 := f.block(base[1])
+	oldSpend := f.spend(b3.Transactions[0], 0)
+	b4 := f.block(b3, oldSpend)
+	b5 := f.block(b4)
+	f.put(b3, b4, b5)
+
+	// a longer side chain forking below b3 spends base[1] coinbase instead
+	newSpend := f.spend(base[1].Transactions[0], 0)
+	side3 := f.block(base[1], newSpend)
+	side4 := f.block(side3)
+	side5 := f.block(side4)
+	side6 := f.block(side5)
+	f.put(side3, side4, side5)
+	assertBestChain(t, f, f.genesis, base[0], base[1], b3, b4, b5)
+	assertUnspent(t, f, base[1].Transactions[0], 0)
+
+	f.put(side6)
+	assertBestChain(t, f, f.genesis, base[0], base[1], side3, side4, side5, side6)
+	for i, bl := range []*wire.MsgBlock{b3, b4, b5} {
+		assertOrphan(t, f, bl, int32(i+3))
+		assertNoTx(t, f, bl.Transactions[0])
+		assertNoOutPoint(t, f, bl.Transactions[0], 0)
+	}
+	assertNoTx(t, f, oldSpend)
+	assertNoOutPoint(t, f, oldSpend, 0)
+
+	assertTx(t, f, newSpend, side3)
+	assertSpentBy(t, f, base[1].Transactions[0], 0, newSpend, 0)
+	assertUnspent(t, f, newSpend, 0)
+}
+
+func testReorgBack(t *testing.T, f *fixture) {
+	b1 := f.block(f.genesis)
+	spend := f.spend(b1.Transactions[0], 0)
+	b2 := f.block(b1, spend)
+	b3 := f.block(b2)
+	b4 := f.block(b3)
+	side2 := f.block(b1)
+	side3 := f.block(side2)
+	side4 := f.block(side3)
+	side5 := f.block(side4)
+
+	f.put(b1, b2, b3, side2, side3, side4)
+	assertBestChain(t, f, f.genesis, b1, side2, side3, side4)
+	assertUnspent(t, f, b1.Transactions[0], 0)
+
+	f.put(b4, side5)
+	assertBestChain(t, f, f.genesis, b1, side2, side3, side4, side5)
+
+	b5 := f.block(b4)
+	b6 := f.block(b5)
+	f.put(b5, b6)
+	assertBestChain(t, f, f.genesis, b1, b2, b3, b4, b5, b6)
+	for i, bl := range []*wire.MsgBlock{side2, side3, side4, side5} {
+		assertOrphan(t, f, bl, int32(i+2))
+		assertNoTx(t, f, bl.Transactions[0])
+	}
+	assertTx(t, f, spend, b2)
+	assertSpentBy(t, f, b1.Transactions[0], 0, spend, 0)
+}
+
+func testPruned(t *testing.T, f *fixture) {
+	// depths below the reorg window are raised to it
+	f.store.SetPruneDepth(1)
+
+	b1 := f.block(f.genesis)
+	spend := f.spend(b1.Transactions[0], 0)
+	b2 := f.block(b1, spend)
+	blocks := f.chain(b2, 100)
+	f.put(b1, b2)
+	f.put(blocks[:99]...)
+
+	assertSpentBy(t, f, b1.Transactions[0], 0, spend, 0)
+	assertTx(t, f, b1.Transactions[0], b1)
+
+	f.put(blocks[99])
+	assertNoOutPoint(t, f, b1.Transactions[0], 0)
+	assertNoTx(t, f, b1.Transactions[0])
+	assertTx(t, f, spend, b2)
+	assertUnspent(t, f, spend, 0)
+	assertTx(t, f, b2.Transactions[0], b2)
+	assertUnspent(t, f, b2.Transactions[0], 0)
+
+	// the txids of a block outlive its pruned txs
+	txIDs, err := f.store.GetBlockTxIDs(ctx, b1.BlockHash().String())
+	if err != nil || len(txIDs) != 1 || string(txIDs[0]) != txHash(b1.Transactions[0]).String() {
+		t.Fatalf("GetBlockTxIDs = %v, %v", txIDs, err)
+	}
+}
+
+// assertBestChain checks blocks are the best chain from genesis up to the tip
+func assertBestChain(t *testing.T, f *fixture, blocks ...*wire.MsgBlock) {
+	t.Helper()
+	tip := int32(len(blocks) - 1)
+
+	height, err := f.store.GetLatestBlockHeight()
+	if err != nil {
+		t.Fatalf("GetLatestBlockHeight: %v", err)
+	}
+	if height != tip {
+		t.Fatalf("latest height = %d, want %d", height, tip)
+	}
+
+	hash, err := f.store.GetLatestBlockHash(ctx)
+	if err != nil {
+		t.Fatalf("GetLatestBlockHash: %v", err)
+	}
+	if *hash != blocks[tip].BlockHash() {
+		t.Fatalf("latest hash = %s, want %s", hash, blocks[tip].BlockHash())
+	}
+
+	for height, bl := range blocks {
+		block, err := f.store.GetBlockByHeight(ctx, int32(height))
+		if err != nil {
+			t.Fatalf("GetBlockByHeight %d: %v", height, err)
+		}
+		if string(block.ID) != bl.BlockHash().String() || block.IsOrphan || block.Height != int32(height) {
+			t.Fatalf("block at %d = %s orphan %v, want %s", height, block.ID, block.IsOrphan, bl.BlockHash())
+		}
+
+		blockHash, err := f.store.GetBlockHashByHeight(ctx, int32(height))
+		if err != nil {
+			t.Fatalf("GetBlockHashByHeight %d: %v", height, err)
+		}
+		if blockHash != string(block.ID) {
+			t.Fatalf("block hash at %d = %s, want %s", height, blockHash, block.ID)
+		}
+	}
+
+	if _, err := f.store.GetBlockByHeight(ctx, tip+1); err != database.ErrNotFound {
+		t.Fatalf("GetBlockByHeight above tip: %v, want ErrNotFound", err)
+	}
+}
+
+func assertOrphan(t *testing.T, f *fixture, bl *wire.MsgBlock, height int32) {
+	t.Helper()
+	block, err := f.store.GetBlockByHash(ctx, bl.BlockHash().String())
+	if err != nil {
+		t.Fatalf("GetBlockByHash %s: %v", bl.BlockHash(), err)
+	}
+	if !block.IsOrphan || block.Height != height {
+		t.Fatalf("block %s orphan %v at %d, want orphan at %d", block.ID, block.IsOrphan, block.Height, height)
+	}
+}
+
+func assertMissing(t *testing.T, f *fixture, bl *wire.MsgBlock) {
+	t.Helper()
+	if _, err := f.store.GetBlockByHash(ctx, bl.BlockHash().String()); err != database.ErrNotFound {
+		t.Fatalf("GetBlockByHash %s: %v, want ErrNotFound", bl.BlockHash(), err)
+	}
+}
+
+func assertTx(t *testing.T, f *fixture, msgTx *wire.MsgTx, bl *wire.MsgBlock) {
+	t.Helper()
+	tx, err := f.store.GetTx(ctx, msgTx.TxHash().String())
+	if err != nil {
+		t.Fatalf("GetTx %s: %v", msgTx.TxHash(), err)
+	}
+	position := -1
+	for i, blockTx := range bl.Transactions {
+		if blockTx == msgTx {
+			position = i
+		}
+	}
+	if string(tx.BlockHash) != bl.BlockHash().String() || tx.BlockHeight != f.heights[bl] || int(tx.BlockIndex) != position ||
+		tx.Version != msgTx.Version || tx.LockTime != msgTx.LockTime {
+		t.Fatalf("tx %s = %+v, want in block %s", msgTx.TxHash(), tx, bl.BlockHash())
+	}
+	if tx.InputCount != len(msgTx.TxIn) || len(tx.Inputs) != len(msgTx.TxIn) || tx.OutputCount != len(msgTx.TxOut) ||
+		tx.Size != msgTx.SerializeSize() || tx.Weight != msgTx.SerializeSizeStripped()*3+msgTx.SerializeSize() ||
+		tx.VSize != (tx.Weight+3)/4 || tx.Segwit != msgTx.HasWitness() {
+		t.Fatalf("tx %s = %+v, sizes or counts differ", msgTx.TxHash(), tx)
+	}
+	for i, txIn := range msgTx.TxIn {
+		if string(tx.Inputs[i].TxHash) != txIn.PreviousOutPoint.Hash.String() || tx.Inputs[i].Index != txIn.PreviousOutPoint.Index {
+			t.Fatalf("tx %s input %d = %+v", msgTx.TxHash(), i, tx.Inputs[i])
+		}
+	}
+}
+
+func assertAddress(t *testing.T, f *fixture, address string, want database.Address) {
+	t.Helper()
+	addr, err := f.store.GetAddress(ctx, address)
+	if err != nil {
+		t.Fatalf("GetAddress %s: %v", address, err)
+	}
+	if addr != want {
+		t.Fatalf("address = %+v, want %+v", addr, want)
+	}
+}
+
+func assertNoTx(t *testing.T, f *fixture, msgTx *wire.MsgTx) {
+	t.Helper()
+	if _, err := f.store.GetTx(ctx, msgTx.TxHash().String()); err != database.ErrNotFound {
+		t.Fatalf("GetTx %s: %v, want ErrNotFound", msgTx.TxHash(), err)
+	}
+}
+
+func assertOutPoint(t *testing.T, f *fixture, funding *wire.MsgTx, index uint32) database.OutPoint {
+	t.Helper()
+	outPoint, err := f.store.GetOutPoint(ctx, funding.TxHash().String(), index)
+	if err != nil {
+		t.Fatalf("GetOutPoint %s:%d: %v", funding.TxHash(), index, err)
+	}
+	if string(outPoint.FundingTxHash) != funding.TxHash().String() || outPoint.FundingTxIndex != index {
+		t.Fatalf("outpoint %s:%d = %+v", funding.TxHash(), index, outPoint)
+	}
+	return outPoint
+}
+
+func assertNoOutPoint(t *testing.T, f *fixture, funding *wire.MsgTx, index uint32) {
+	t.Helper()
+	if _, err := f.store.GetOutPoint(ctx, funding.TxHash().String(), index); err != database.ErrNotFound {
+		t.Fatalf("GetOutPoint %s:%d: %v, want ErrNotFound", funding.TxHash(), index, err)
+	}
+}
+
+func assertSpentBy(t *testing.T, f *fixture, funding *wire.MsgTx, index uint32, spending *wire.MsgTx, inputIndex uint32) {
+	t.Helper()
+	outPoint := assertOutPoint(t, f, funding, index)
+	txIn := spending.TxIn[inputIndex]
+	if string(outPoint.SpendingTxHash) != spending.TxHash().String() || outPoint.SpendingTxIndex != inputIndex ||
+		outPoint.Sequence != txIn.Sequence {
+		t.Fatalf("outpoint %s:%d spent by %s:%d, want %s:%d", funding.TxHash(), index, outPoint.SpendingTxHash, outPoint.SpendingTxIndex, spending.TxHash(), inputIndex)
+	}
+	if len(outPoint.Witness) != len(txIn.Witness) {
+		t.Fatalf("outpoint %s:%d witness = %v, want %d items", funding.TxHash(), index, outPoint.Witness, len(txIn.Witness))
+	}
+	for i, item := range txIn.Witness {
+		if string(outPoint.Witness[i]) != hex.EncodeToString(item) {
+			t.Fatalf("outpoint %s:%d witness item %d = %s", funding.TxHash(), index, i, outPoint.Witness[i])
+		}
+	}
+}
+
+func assertUnspent(t *testing.T, f *fixture, funding *wire.MsgTx, index uint32) {
+	t.Helper()
+	outPoint := assertOutPoint(t, f, funding, index)
+	if outPoint.SpendingTxHash != "" {
+		t.Fatalf("outpoint %s:%d spent by %s, want unspent", funding.TxHash(), index, outPoint.SpendingTxHash)
+	}
+}
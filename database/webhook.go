@@ -0,0 +1,198 @@
+package database
+
+import (
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// kinds of Watch
+const (
+	WatchAddress    = "address"
+	WatchScriptHash = "scripthash"
+	WatchTx         = "tx"
+)
+
+// Watch registers a URL for the txs touching an address or script hash, or for one tx.
+// a tx is reported once it has Confirmations confirmations, and again if its block leaves the best chain
+type Watch struct {
+	ID            string `bson:"_id" json:"id"`
+	URL           string `bson:"url" json:"url"`
+	Kind          string `bson:"kind" json:"kind"`
+	Target        string `bson:"target" json:"target"` // the address, script hash or txid
+	Confirmations int32  `bson:"confirmations" json:"confirmations"`
+	Created       int64  `bson:"created" json:"created"`
+}
+
+// statuses of Delivery
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead" // out of attempts, kept until replayed or deleted
+)
+
+// Delivery is a webhook POST for a watch. Type is tx_confirmed or tx_orphaned, the ID is derived from
+// the watch, type, tx and block so a block connected twice does not queue it twice
+type Delivery struct {
+	ID      string `bson:"_id" json:"id"`
+	WatchID string `bson:"watch_id" json:"watch_id"`
+	URL     string `bson:"url" json:"url"`
+	Kind    string `bson:"kind" json:"kind"`
+	Target  string `bson:"target" json:"target"`
+
+	Type      EventType `bson:"type" json:"type"`
+	TxHash    Hash      `bson:"tx_hash" json:"txid"`
+	BlockHash Hash      `bson:"block_hash" json:"block_hash"` // indexed
+	Height    int32     `bson:"height" json:"height"`
+	DueHeight int32     `bson:"due_height" json:"due_height"` // tip height the delivery waits for
+
+	Status      string `bson:"status" json:"status"` // indexed with next_attempt
+	Attempts    int    `bson:"attempts" json:"attempts"`
+	NextAttempt int64  `bson:"next_attempt" json:"next_attempt"` // unix seconds
+	LastError   string `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	Created     int64  `bson:"created" json:"created"`
+}
+
+// DeliveryID is the ID of the delivery of event type of txHash in blockHash for a watch
+func DeliveryID(watchID string, eventType EventType, txHash, blockHash Hash) string {
+	return watchID + ":" + string(eventType) + ":" + string(txHash) + ":" + string(blockHash)
+}
+
+// due tells if the delivery may be attempted at tip height and unix time now
+func (delivery *Delivery) due(tip int32, now int64) bool {
+	return delivery.Status == DeliveryPending && delivery.DueHeight <= tip && delivery.NextAttempt <= now
+}
+
+func newDelivery(watch Watch, eventType EventType, txHash, blockhash Hash, height, dueHeight int32) Delivery {
+	return Delivery{
+		ID:        DeliveryID(watch.ID, eventType, txHash, blockhash),
+		WatchID:   watch.ID,
+		URL:       watch.URL,
+		Kind:      watch.Kind,
+		Target:    watch.Target,
+		Type:      eventType,
+		TxHash:    txHash,
+		BlockHash: blockhash,
+		Height:    height,
+		DueHeight: dueHeight,
+		Status:    DeliveryPending,
+		Created:   time.Now().Unix(),
+	}
+}
+
+// ConfirmedDelivery is the delivery of a tx confirmed in blockhash at height for watch, due once the tx has the watch confirmations
+func ConfirmedDelivery(watch Watch, txHash, blockhash Hash, height int32) Delivery {
+	return newDelivery(watch, EventTxConfirmed, txHash, blockhash, height, height+max(watch.Confirmations, 1)-1)
+}
+
+// OrphanedDelivery reports that the tx of a tx_confirmed delivery left the best chain with its block, it is due right away
+func OrphanedDelivery(confirmed Delivery) Delivery {
+	watch := Watch{ID: confirmed.WatchID, URL: confirmed.URL, Kind: confirmed.Kind, Target: confirmed.Target}
+	return newDelivery(watch, EventTxOrphaned, confirmed.TxHash, confirmed.BlockHash, confirmed.Height, 0)
+}
+
+// watchIndex holds the watches by kind and target so processTxs matches txs without queries
+type watchIndex map[string][]Watch
+
+func watchKey(kind, target string) string {
+	return kind + ":" + target
+}
+
+func newWatchIndex(watches []Watch) watchIndex {
+	w := make(watchIndex)
+	for _, watch := range watches {
+		w.add(watch)
+	}
+	return w
+}
+
+func (w watchIndex) add(watch Watch) {
+	key := watchKey(watch.Kind, watch.Target)
+	w[key] = append(w[key], watch)
+}
+
+func (w watchIndex) remove(id string) {
+	for key, watches := range w {
+		for i, watch := range watches {
+			if watch.ID != id {
+				continue
+			}
+			if len(watches) == 1 {
+				delete(w, key)
+			} else {
+				w[key] = append(watches[:i:i], watches[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// match returns the deliveries of the watches tx touches, funded are its outputs and spent the outpoints it spends.
+// outpoints that could not be resolved are nil
+func (w watchIndex) match(tx *wire.MsgTx, funded, spent []*OutPoint, blockhash Hash, height int32) []Delivery {
+	txHash := Hash(tx.TxHash().String())
+	keys := []string{watchKey(WatchTx, string(txHash))}
+	for _, outPoint := range append(funded, spent...) {
+		if outPoint == nil {
+			continue
+		}
+		if outPoint.Spender != "" {
+			keys = append(keys, watchKey(WatchAddress, outPoint.Spender))
+		}
+		if outPoint.ScriptHash != "" {
+			keys = append(keys, watchKey(WatchScriptHash, string(outPoint.ScriptHash)))
+		}
+	}
+
+	var deliveries []Delivery
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		for _, watch := range w[key] {
+			if !seen[watch.ID] {
+				seen[watch.ID] = true
+				deliveries = append(deliveries, ConfirmedDelivery(watch, txHash, blockhash, height))
+			}
+		}
+	}
+	return deliveries
+}
+
+// matchTxs matches the txs of a block, outPoint resolves their outputs and the outpoints they spend
+func (w watchIndex) matchTxs(txs []*wire.MsgTx, blockhash Hash, height int32, outPoint func(wire.OutPoint) *OutPoint) []Delivery {
+	if len(w) == 0 {
+		return nil
+	}
+	var deliveries []Delivery
+	for _, tx := range txs {
+		txHash := tx.TxHash()
+		funded := make([]*OutPoint, len(tx.TxOut))
+		for i := range tx.TxOut {
+			funded[i] = outPoint(wire.OutPoint{Hash: txHash, Index: uint32(i)})
+		}
+		var spent []*OutPoint
+		if !blockchain.IsCoinBaseTx(tx) {
+			for _, txIn := range tx.TxIn {
+				spent = append(spent, outPoint(txIn.PreviousOutPoint))
+			}
+		}
+		deliveries = append(deliveries, w.match(tx, funded, spent, blockhash, height)...)
+	}
+	return deliveries
+}
+
+// orphanDeliveries handles the tx_confirmed deliveries of a block leaving the best chain.
+// the ones never attempted are cancelled, receivers that may have heard of the others get a tx_orphaned delivery
+func orphanDeliveries(deliveries []Delivery) (cancelled []string, orphaned []Delivery) {
+	for _, delivery := range deliveries {
+		if delivery.Type != EventTxConfirmed {
+			continue
+		}
+		if delivery.Status == DeliveryPending && delivery.Attempts == 0 {
+			cancelled = append(cancelled, delivery.ID)
+			continue
+		}
+		orphaned = append(orphaned, OrphanedDelivery(delivery))
+	}
+	return cancelled, orphaned
+}
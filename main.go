@@ -5,7 +5,12 @@ import (
 	"btc-indexer/database"
 	path "btc-indexer/internal"
 	"btc-indexer/pkg/blockchain"
+	"btc-indexer/pkg/electrum"
+	"btc-indexer/pkg/grpcapi"
 	"btc-indexer/pkg/logger"
+	"btc-indexer/pkg/rpc"
+	"btc-indexer/pkg/server"
+	"btc-indexer/pkg/webhook"
 	"context"
 )
 
@@ -23,38 +28,139 @@ func main() {
 
 	logger.Info("Logger Setup Complete")
 
-	mi, err := database.NewMongoDBConnection(config.DB.URI)
-	if err != nil {
-		logger.Error(err.Error())
+	chainType := blockchain.Mainnet
+	if config.IndexConfig.Network != "" {
+		chainType = blockchain.ChainType(config.IndexConfig.Network)
+	}
+	if blockchain.ChainParams(chainType) == nil {
+		logger.Error("unknown network " + string(chainType))
 		return
 	}
 
-	defer func() {
-		mi.Client.Disconnect(context.TODO())
-	}()
+	mode := blockchain.ModeFull
+	if config.IndexConfig.IndexMode != "" {
+		mode = blockchain.Mode(config.IndexConfig.IndexMode)
+	}
 
-	mi, err = mi.SetupIndexerClient(context.TODO(), config.DB.Database)
-	if err != nil {
-		logger.Error(err.Error())
-		return
+	safeDepth := config.IndexConfig.SafeDepth
+	if safeDepth <= 0 {
+		safeDepth = database.DefaultSafeDepth
 	}
 
-	store, err := database.NewStore(
-		mi.BlocksCol,
-		mi.TxCol,
-		mi.OutCol,
-	)
+	var store database.Store
+	switch config.DB.Backend {
+	case "memory":
+		store = database.NewMemoryStore(blockchain.ChainParams(chainType))
+		logger.Info("Memory Store Setup Complete")
+	default:
+		mi, err := database.NewMongoDBConnection(config.DB.URI)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
 
-	if err != nil {
+		defer func() {
+			mi.Client.Disconnect(context.TODO())
+		}()
+
+		mi, err = mi.SetupIndexerClient(context.TODO(), config.DB.Database, database.Settings{
+			Network:     string(chainType),
+			Mode:        string(mode),
+			ChainParams: blockchain.ChainParams(chainType),
+			SafeDepth:   safeDepth,
+		})
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+
+		store, err = database.NewStore(
+			context.TODO(),
+			blockchain.ChainParams(chainType),
+			mi.BlocksCol,
+			mi.TxCol,
+			mi.OutCol,
+			mi.AddrCol,
+			mi.EventCol,
+			mi.WatchCol,
+			mi.DeliveryCol,
+			mi.BroadcastCol,
+		)
+
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+
+		logger.Info("MongoDB Setup Complete")
+	}
+
+	if err := store.SetSafeDepth(context.TODO(), safeDepth); err != nil {
 		logger.Error(err.Error())
 		return
 	}
 
-	logger.Info("MongoDB Setup Complete")
+	if mode == blockchain.ModePruned {
+		pruneDepth := config.IndexConfig.PruneDepth
+		if pruneDepth <= 0 {
+			pruneDepth = blockchain.DefaultPruneDepth
+		}
+		store.SetPruneDepth(pruneDepth)
+	}
+
+	indexer := blockchain.NewIndexer(mode, chainType, config.IndexConfig.HeaderFirstMode, store)
+
+	// the api serves what is indexed so far while the indexer syncs
+	srv := server.NewServer(config.Server.Address, config.Server.RequestTimeout, blockchain.ChainParams(chainType), indexer.Broadcaster(), store)
+	go func() {
+		if err := srv.Start(); err != nil {
+			logger.Error(err.Error())
+		}
+	}()
+
+	if config.Electrum.Address != "" || config.Electrum.TLSAddress != "" {
+		electrumSrv, err := electrum.NewServer(config.Electrum.Address, config.Electrum.TLSAddress, config.Electrum.CertFile, config.Electrum.KeyFile, store)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		go func() {
+			if err := electrumSrv.Start(); err != nil {
+				logger.Error(err.Error())
+			}
+		}()
+	}
+
+	if config.GRPC.Address != "" {
+		grpcSrv := grpcapi.NewServer(config.GRPC.Address, store)
+		go func() {
+			if err := grpcSrv.Start(); err != nil {
+				logger.Error(err.Error())
+			}
+		}()
+	}
+
+	if config.RPC.Address != "" {
+		rpcSrv := rpc.NewServer(config.RPC.Address, config.RPC.User, config.RPC.Password, blockchain.ChainParams(chainType), mode == blockchain.ModePruned, indexer.Broadcaster(), store)
+		go func() {
+			if err := rpcSrv.Start(); err != nil {
+				logger.Error(err.Error())
+			}
+		}()
+	}
+
+	if config.Webhook.Address != "" {
+		webhookSrv, err := webhook.NewServer(config.Webhook.Address, config.Webhook.Token, config.Webhook.Secret, blockchain.ChainParams(chainType), store)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		go func() {
+			if err := webhookSrv.Start(); err != nil {
+				logger.Error(err.Error())
+			}
+		}()
+	}
 
-	indexer := blockchain.NewIndexer(blockchain.ModeFull, blockchain.Mainnet, config.IndexConfig.HeaderFirstMode, store)
 	indexer.Start()
-	// start indexer [go routines]
-	// load server
-	// run server
 }
@@ -0,0 +1,398 @@
+package blockchain
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/pkg/logger"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/peer"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	// recheckInterval is how often broadcasts are checked for confirmation and relay peers reconnected
+	recheckInterval = time.Minute
+	// rebroadcastInterval is how often unconfirmed txs are announced again, rejected ones once they pass the checks again
+	rebroadcastInterval = 10 * time.Minute
+	// maxRelayPeers bounds the peers dialled for relay besides the one synced from
+	maxRelayPeers = 8
+)
+
+var (
+	ErrTxDecode         = errors.New("TX decode failed")
+	ErrAlreadyConfirmed = errors.New("transaction already in block chain")
+)
+
+// RejectError is a tx failing the checks against the index, MissingInputs is set when it spends outputs that are unknown or spent
+type RejectError struct {
+	Reason        string
+	MissingInputs bool
+}
+
+func (e *RejectError) Error() string {
+	return e.Reason
+}
+
+// Broadcaster checks raw txs against the index and relays them to the connected peers with inv and tx messages.
+// scripts are not verified, that is left to the peers
+type Broadcaster struct {
+	store       database.Store
+	chainParams *chaincfg.Params
+	logger      *logger.CustomLogger
+
+	mu    sync.Mutex
+	peers map[*peer.Peer]struct{}
+	addrs []string // relay peers to dial
+
+	dialing  sync.Mutex // serializes connectPeers
+	updating sync.Mutex // serializes the read-modify-write of stored broadcasts
+}
+
+// NewBroadcaster returns a broadcaster relaying through the peers the indexer connects
+func NewBroadcaster(chainParams *chaincfg.Params, store database.Store) *Broadcaster {
+	b := &Broadcaster{
+		store:       store,
+		chainParams: chainParams,
+		logger:      logger.NewDefaultLogger(),
+		peers:       make(map[*peer.Peer]struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Broadcast checks the serialized tx raw and queues it for relay, a tx broadcast before is relayed again
+func (b *Broadcaster) Broadcast(ctx context.Context, raw []byte) (database.Broadcast, error) {
+	var tx wire.MsgTx
+	reader := bytes.NewReader(raw)
+	if err := tx.Deserialize(reader); err != nil || reader.Len() > 0 {
+		return database.Broadcast{}, ErrTxDecode
+	}
+	if err := b.check(ctx, &tx); err != nil {
+		return database.Broadcast{}, err
+	}
+
+	now := time.Now().Unix()
+	broadcast := database.Broadcast{
+		ID:      database.Hash(tx.TxHash().String()),
+		Raw:     raw,
+		Status:  database.BroadcastPending,
+		Created: now,
+		Updated: now,
+	}
+	if err := b.store.PutBroadcast(ctx, broadcast); err != nil {
+		return database.Broadcast{}, err
+	}
+	b.announce([]database.Broadcast{broadcast})
+	return broadcast, nil
+}
+
+// Status returns a broadcast, confirmed once its tx is indexed
+func (b *Broadcaster) Status(ctx context.Context, txid string) (database.Broadcast, error) {
+	broadcast, err := b.store.GetBroadcast(ctx, txid)
+	if err != nil {
+		return broadcast, err
+	}
+	if broadcast.Status != database.BroadcastConfirmed {
+		if _, err := b.store.GetTx(ctx, txid); err == nil {
+			broadcast.Status = database.BroadcastConfirmed
+		}
+	}
+	return broadcast, nil
+}
+
+// check applies the context free rules and looks the inputs up in the index, they must exist, be unspent and mature.
+// in pruned mode a confirmed tx whose outputs are all spent is deleted along with the outpoints it spent,
+// so it is rejected for missing inputs rather than ErrAlreadyConfirmed, as bitcoind does once its outputs left the utxo set
+func (b *Broadcaster) check(ctx context.Context, tx *wire.MsgTx) error {
+	if err := blockchain.CheckTransactionSanity(btcutil.NewTx(tx)); err != nil {
+		return &RejectError{Reason: err.Error()}
+	}
+	if blockchain.IsCoinBaseTx(tx) {
+		return &RejectError{Reason: "coinbase transactions can not be broadcast"}
+	}
+	txHash := tx.TxHash().String()
+	if _, err := b.store.GetTx(ctx, txHash); err == nil {
+		return ErrAlreadyConfirmed
+	} else if !errors.Is(err, database.ErrNotFound) {
+		return err
+	}
+
+	tip, err := b.store.GetLatestBlockHeight()
+	if err != nil {
+		return err
+	}
+	var in int64
+	for _, txIn := range tx.TxIn {
+		prevOut := txIn.PreviousOutPoint
+		outPoint, err := b.store.GetOutPoint(ctx, prevOut.Hash.String(), prevOut.Index)
+		if err == nil && string(outPoint.SpendingTxHash) == txHash {
+			// confirmed by a block put since the lookup above
+			return ErrAlreadyConfirmed
+		}
+		if errors.Is(err, database.ErrNotFound) || (err == nil && outPoint.SpendingTxHash != "") {
+			return &RejectError{Reason: fmt.Sprintf("input %s is missing or spent", prevOut), MissingInputs: true}
+		}
+		if err != nil {
+			return err
+		}
+		if outPoint.MatureHeight > tip+1 {
+			return &RejectError{Reason: fmt.Sprintf("input %s spends an immature coinbase output", prevOut)}
+		}
+		in += outPoint.Value
+		if in > btcutil.MaxSatoshi {
+			return &RejectError{Reason: "total input value is out of range"}
+		}
+	}
+
+	var out int64
+	for _, txOut := range tx.TxOut {
+		out += txOut.Value
+	}
+	if in < out {
+		return &RejectError{Reason: fmt.Sprintf("outputs of %d exceed inputs of %d", out, in)}
+	}
+	return nil
+}
+
+// run marks the broadcasts indexed meanwhile confirmed and announces the others again from time to time
+func (b *Broadcaster) run() {
+	ctx := context.Background()
+	recheck := time.NewTicker(recheckInterval)
+	defer recheck.Stop()
+	rebroadcast := time.NewTicker(rebroadcastInterval)
+	defer rebroadcast.Stop()
+	for {
+		select {
+		case <-recheck.C:
+			b.connectPeers()
+			b.recheck(ctx)
+		case <-rebroadcast.C:
+			b.rebroadcast(ctx)
+		}
+	}
+}
+
+// unconfirmed returns the broadcasts not confirmed yet, rejected ones included
+func (b *Broadcaster) unconfirmed(ctx context.Context) ([]database.Broadcast, error) {
+	var unconfirmed []database.Broadcast
+	for _, status := range []string{database.BroadcastPending, database.BroadcastRelayed, database.BroadcastRejected} {
+		broadcasts, err := b.store.GetBroadcasts(ctx, status)
+		if err != nil {
+			return nil, err
+		}
+		unconfirmed = append(unconfirmed, broadcasts...)
+	}
+	return unconfirmed, nil
+}
+
+// recheck marks the broadcasts whose tx is indexed confirmed and returns the others
+func (b *Broadcaster) recheck(ctx context.Context) []database.Broadcast {
+	broadcasts, err := b.unconfirmed(ctx)
+	if err != nil {
+		b.logger.Error(err.Error())
+		return nil
+	}
+	unconfirmed := broadcasts[:0]
+	for _, broadcast := range broadcasts {
+		if _, err := b.store.GetTx(ctx, string(broadcast.ID)); err != nil {
+			unconfirmed = append(unconfirmed, broadcast)
+			continue
+		}
+		b.update(ctx, string(broadcast.ID), func(broadcast *database.Broadcast) {
+			broadcast.Status = database.BroadcastConfirmed
+			broadcast.Updated = time.Now().Unix()
+		})
+	}
+	return unconfirmed
+}
+
+// rebroadcast announces the unconfirmed broadcasts again. rejected ones are checked against the index first,
+// a peer rejecting a tx for inputs it lacked or a fee below its mempool minimum may take it later
+func (b *Broadcaster) rebroadcast(ctx context.Context) {
+	var announce []database.Broadcast
+	for _, broadcast := range b.recheck(ctx) {
+		if broadcast.Status != database.BroadcastRejected {
+			announce = append(announce, broadcast)
+			continue
+		}
+		var tx wire.MsgTx
+		if err := tx.Deserialize(bytes.NewReader(broadcast.Raw)); err != nil {
+			b.logger.Error(err.Error())
+			continue
+		}
+		var reject *RejectError
+		switch err := b.check(ctx, &tx); {
+		case err == nil:
+			announce = append(announce, broadcast)
+		case errors.As(err, &reject):
+			b.update(ctx, string(broadcast.ID), func(broadcast *database.Broadcast) {
+				broadcast.Reject = reject.Reason
+				broadcast.Updated = time.Now().Unix()
+			})
+		case !errors.Is(err, ErrAlreadyConfirmed):
+			b.logger.Error(err.Error())
+		}
+	}
+	b.announce(announce)
+}
+
+// setRelayPeers sets the peers to relay through besides the sync peer, maxRelayPeers of them are kept connected
+func (b *Broadcaster) setRelayPeers(addrs []string) {
+	b.mu.Lock()
+	b.addrs = append([]string(nil), addrs...)
+	b.mu.Unlock()
+	b.connectPeers()
+}
+
+// connectPeers dials relay peers until maxRelayPeers are connected besides the sync peer
+func (b *Broadcaster) connectPeers() {
+	b.dialing.Lock()
+	defer b.dialing.Unlock()
+
+	b.mu.Lock()
+	connected := make(map[string]bool, len(b.peers))
+	for p := range b.peers {
+		connected[p.Addr()] = true
+	}
+	addrs := b.addrs
+	b.mu.Unlock()
+
+	for _, addr := range addrs {
+		if len(connected) > maxRelayPeers {
+			return
+		}
+		if connected[addr] {
+			continue
+		}
+		p, err := b.dial(addr)
+		if err != nil {
+			b.logger.Warn(fmt.Sprintf("Relay peer %s: %s", addr, err))
+			continue
+		}
+		connected[addr] = true
+		b.addPeer(p)
+	}
+}
+
+// dial connects a relay peer, it only answers the getdata and reject messages of broadcasts
+func (b *Broadcaster) dial(addr string) (*peer.Peer, error) {
+	p, err := peer.NewOutboundPeer(newRelayPeerConfig(b.chainParams, b), addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	p.AssociateConnection(conn)
+	return p, nil
+}
+
+// addPeer relays through p until it disconnects, the unconfirmed broadcasts are announced to it right away
+func (b *Broadcaster) addPeer(p *peer.Peer) {
+	b.mu.Lock()
+	b.peers[p] = struct{}{}
+	b.mu.Unlock()
+	go func() {
+		p.WaitForDisconnect()
+		b.mu.Lock()
+		delete(b.peers, p)
+		b.mu.Unlock()
+	}()
+
+	unconfirmed, err := b.unconfirmed(context.Background())
+	if err != nil {
+		b.logger.Error(err.Error())
+		return
+	}
+	b.announceTo(p, unconfirmed)
+}
+
+// announce announces broadcasts to every connected peer
+func (b *Broadcaster) announce(broadcasts []database.Broadcast) {
+	b.mu.Lock()
+	peers := make([]*peer.Peer, 0, len(b.peers))
+	for p := range b.peers {
+		peers = append(peers, p)
+	}
+	b.mu.Unlock()
+	for _, p := range peers {
+		b.announceTo(p, broadcasts)
+	}
+}
+
+func (b *Broadcaster) announceTo(p *peer.Peer, broadcasts []database.Broadcast) {
+	if len(broadcasts) == 0 {
+		return
+	}
+	inv := wire.NewMsgInv()
+	for _, broadcast := range broadcasts {
+		hash, err := chainhash.NewHashFromStr(string(broadcast.ID))
+		if err != nil {
+			continue
+		}
+		inv.AddInvVect(wire.NewInvVect(wire.InvTypeTx, hash))
+	}
+	p.QueueMessage(inv, nil)
+}
+
+// update applies change to the stored broadcast txid, peers answer concurrently
+func (b *Broadcaster) update(ctx context.Context, txid string, change func(broadcast *database.Broadcast)) {
+	b.updating.Lock()
+	defer b.updating.Unlock()
+	broadcast, err := b.store.GetBroadcast(ctx, txid)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			b.logger.Error(err.Error())
+		}
+		return
+	}
+	change(&broadcast)
+	if err := b.store.UpdateBroadcast(ctx, broadcast); err != nil {
+		b.logger.Error(err.Error())
+	}
+}
+
+// OnGetData sends the broadcast txs a peer asks for after an announcement and records them relayed by it
+func (b *Broadcaster) OnGetData(p *peer.Peer, msg *wire.MsgGetData) {
+	ctx := context.Background()
+	for _, inv := range msg.InvList {
+		if inv.Type != wire.InvTypeTx && inv.Type != wire.InvTypeWitnessTx {
+			continue
+		}
+		broadcast, err := b.store.GetBroadcast(ctx, inv.Hash.String())
+		if err != nil {
+			continue
+		}
+		var tx wire.MsgTx
+		if err := tx.Deserialize(bytes.NewReader(broadcast.Raw)); err != nil {
+			b.logger.Error(err.Error())
+			continue
+		}
+		p.QueueMessage(&tx, nil)
+
+		b.update(ctx, inv.Hash.String(), func(broadcast *database.Broadcast) {
+			broadcast.SetPeer(p.Addr(), database.BroadcastRelayed, "", time.Now().Unix())
+		})
+	}
+}
+
+// OnReject records the rejects of broadcast txs by a peer, peers running bitcoind 0.20 or later no longer send them
+func (b *Broadcaster) OnReject(p *peer.Peer, msg *wire.MsgReject) {
+	if msg.Cmd != wire.CmdTx {
+		return
+	}
+	b.update(context.Background(), msg.Hash.String(), func(broadcast *database.Broadcast) {
+		broadcast.SetPeer(p.Addr(), database.BroadcastRejected, fmt.Sprintf("%s: %s", msg.Code, msg.Reason), time.Now().Unix())
+	})
+}
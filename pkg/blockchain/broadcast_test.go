@@ -0,0 +1,405 @@
+package blockchain
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/database/storetest"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/peer"
+	"github.com/btcsuite/btcd/wire"
+)
+
+var ctx = context.Background()
+
+func newTestBroadcaster(t *testing.T) (*Broadcaster, database.Store, *storetest.Chain) {
+	store := database.NewMemoryStore(&chaincfg.RegressionNetParams)
+	chain := storetest.NewChain(t, store)
+	return NewBroadcaster(&chaincfg.RegressionNetParams, store), store, chain
+}
+
+func serialize(t *testing.T, tx *wire.MsgTx) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		t.Fatalf("Serialize: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// assertReject checks raw is rejected with a reason containing reason
+func assertReject(t *testing.T, b *Broadcaster, raw []byte, reason string, missingInputs bool) {
+	t.Helper()
+	_, err := b.Broadcast(ctx, raw)
+	var reject *RejectError
+	if !errors.As(err, &reject) || !strings.Contains(reject.Reason, reason) || reject.MissingInputs != missingInputs {
+		t.Fatalf("Broadcast = %v, want a reject for %q with missing inputs %v", err, reason, missingInputs)
+	}
+}
+
+func TestBroadcastRejects(t *testing.T) {
+	b, store, chain := newTestBroadcaster(t)
+	b1 := chain.Block(chain.Genesis())
+	spend := chain.Spend(b1.Transactions[0], 0)
+	b2 := chain.Block(b1, spend)
+	chain.Put(b1, b2)
+
+	noOutputs := chain.Spend(spend, 0)
+	noOutputs.TxOut = nil
+	negative := chain.Spend(spend, 0)
+	negative.TxOut[0].Value = -1
+	duplicated := chain.Spend(spend, 0, 0)
+	tooMuch := chain.Spend(spend, 1)
+	tooMuch.TxOut[0].Value = spend.TxOut[1].Value
+
+	tests := []struct {
+		name          string
+		tx            *wire.MsgTx
+		reason        string
+		missingInputs bool
+	}{
+		{"no outputs", noOutputs, "no outputs", false},
+		{"negative output", negative, "negative value", false},
+		{"duplicated input", duplicated, "duplicate inputs", false},
+		{"coinbase", b2.Transactions[0], "coinbase", false},
+		{"immature coinbase", chain.Spend(b2.Transactions[0], 0), "immature coinbase", false},
+		{"spent input", chain.Spend(b1.Transactions[0], 0), "missing or spent", true},
+		{"unknown input", chain.Spend(chain.Spend(spend, 0), 0), "missing or spent", true},
+		{"outputs exceed inputs", tooMuch, "exceed inputs", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assertReject(t, b, serialize(t, test.tx), test.reason, test.missingInputs)
+			if _, err := store.GetBroadcast(ctx, test.tx.TxHash().String()); !errors.Is(err, database.ErrNotFound) {
+				t.Fatalf("GetBroadcast of a rejected tx: %v", err)
+			}
+		})
+	}
+
+	raw := serialize(t, chain.Spend(spend, 0))
+	for _, bad := range [][]byte{raw[:len(raw)-1], append(raw, 0)} {
+		if _, err := b.Broadcast(ctx, bad); !errors.Is(err, ErrTxDecode) {
+			t.Fatalf("Broadcast of %x = %v, want ErrTxDecode", bad, err)
+		}
+	}
+	if _, err := b.Broadcast(ctx, serialize(t, spend)); !errors.Is(err, ErrAlreadyConfirmed) {
+		t.Fatalf("Broadcast of a confirmed tx = %v, want ErrAlreadyConfirmed", err)
+	}
+}
+
+// coinbase outputs may be spent by the block CoinbaseMaturity blocks after theirs
+func TestBroadcastMatureCoinbase(t *testing.T) {
+	b, _, chain := newTestBroadcaster(t)
+	b1 := chain.Block(chain.Genesis())
+	chain.Put(b1)
+	raw := serialize(t, chain.Spend(b1.Transactions[0], 0))
+
+	parent := b1
+	for height := 2; height < int(chaincfg.RegressionNetParams.CoinbaseMaturity); height++ {
+		parent = chain.Block(parent)
+		chain.Put(parent)
+	}
+	assertReject(t, b, raw, "immature coinbase", false)
+
+	chain.Put(chain.Block(parent))
+	if _, err := b.Broadcast(ctx, raw); err != nil {
+		t.Fatalf("Broadcast of a mature coinbase spend: %v", err)
+	}
+}
+
+func TestBroadcastConfirmed(t *testing.T) {
+	b, store, chain := newTestBroadcaster(t)
+	b1 := chain.Block(chain.Genesis())
+	spend := chain.Spend(b1.Transactions[0], 0)
+	b2 := chain.Block(b1, spend)
+	chain.Put(b1, b2)
+
+	next := chain.Spend(spend, 0)
+	broadcast, err := b.Broadcast(ctx, serialize(t, next))
+	if err != nil {
+		t.Fatalf("Broadcast: %v", err)
+	}
+	if string(broadcast.ID) != next.TxHash().String() || broadcast.Status != database.BroadcastPending {
+		t.Fatalf("Broadcast = %+v", broadcast)
+	}
+	if status, err := b.Status(ctx, string(broadcast.ID)); err != nil || status.Status != database.BroadcastPending {
+		t.Fatalf("Status = %+v, %v, want pending", status, err)
+	}
+	// a broadcast again is relayed again
+	if _, err := b.Broadcast(ctx, serialize(t, next)); err != nil {
+		t.Fatalf("Broadcast again: %v", err)
+	}
+
+	chain.Put(chain.Block(b2, next))
+	if status, err := b.Status(ctx, string(broadcast.ID)); err != nil || status.Status != database.BroadcastConfirmed {
+		t.Fatalf("Status = %+v, %v, want confirmed", status, err)
+	}
+	// the recheck stores the new status
+	if unconfirmed := b.recheck(ctx); len(unconfirmed) != 0 {
+		t.Fatalf("recheck = %+v, want none unconfirmed", unconfirmed)
+	}
+	stored, err := store.GetBroadcast(ctx, string(broadcast.ID))
+	if err != nil || stored.Status != database.BroadcastConfirmed || stored.Updated < broadcast.Created {
+		t.Fatalf("GetBroadcast = %+v, %v, want confirmed", stored, err)
+	}
+	if _, err := b.Status(ctx, strings.Repeat("ab", 32)); !errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("Status of an unknown txid: %v", err)
+	}
+}
+
+// missingTxStore finds no tx, like a store the tx is put in right after the lookup
+type missingTxStore struct {
+	database.Store
+}
+
+func (missingTxStore) GetTx(ctx context.Context, hash string) (database.Transaction, error) {
+	return database.Transaction{}, database.ErrNotFound
+}
+
+func TestBroadcastConfirmedMeanwhile(t *testing.T) {
+	store := database.NewMemoryStore(&chaincfg.RegressionNetParams)
+	chain := storetest.NewChain(t, store)
+	b := NewBroadcaster(&chaincfg.RegressionNetParams, missingTxStore{store})
+	b1 := chain.Block(chain.Genesis())
+	spend := chain.Spend(b1.Transactions[0], 0)
+	chain.Put(b1, chain.Block(b1, spend))
+
+	if _, err := b.Broadcast(ctx, serialize(t, spend)); !errors.Is(err, ErrAlreadyConfirmed) {
+		t.Fatalf("Broadcast of a tx spending its inputs itself = %v, want ErrAlreadyConfirmed", err)
+	}
+}
+
+// a pruned confirmed tx can not be told from one spending missing inputs
+func TestBroadcastPruned(t *testing.T) {
+	b, store, chain := newTestBroadcaster(t)
+	store.SetPruneDepth(1)
+	b1 := chain.Block(chain.Genesis())
+	spend := chain.Spend(b1.Transactions[0], 0)
+	b2 := chain.Block(b1, spend)
+	b3 := chain.Block(b2, chain.Spend(spend, 0, 1))
+	chain.Put(b1, b2, b3)
+	parent := b3
+	for i := 0; i < 100; i++ {
+		parent = chain.Block(parent)
+		chain.Put(parent)
+	}
+
+	if _, err := store.GetTx(ctx, spend.TxHash().String()); !errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("GetTx of a pruned tx: %v", err)
+	}
+	assertReject(t, b, serialize(t, spend), "missing or spent", true)
+}
+
+// remotePeer listens like a node, it fetches the txs announced to it or rejects them
+type remotePeer struct {
+	addr   string
+	accept atomic.Bool
+	txs    chan *wire.MsgTx
+
+	mu    sync.Mutex
+	peers []*peer.Peer
+}
+
+func newRemotePeer(t *testing.T, accept bool) *remotePeer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	r := &remotePeer{addr: listener.Addr().String(), txs: make(chan *wire.MsgTx, 10)}
+	r.accept.Store(accept)
+	config := &peer.Config{
+		Listeners: peer.MessageListeners{
+			OnInv: r.OnInv,
+			OnTx:  func(p *peer.Peer, msg *wire.MsgTx) { r.txs <- msg },
+		},
+		ChainParams:     &chaincfg.RegressionNetParams,
+		Services:        wire.SFNodeWitness,
+		ProtocolVersion: peer.MaxProtocolVersion,
+		AllowSelfConns:  true,
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			p := peer.NewInboundPeer(config)
+			p.AssociateConnection(conn)
+			r.mu.Lock()
+			r.peers = append(r.peers, p)
+			r.mu.Unlock()
+		}
+	}()
+	t.Cleanup(r.disconnect)
+	return r
+}
+
+func (r *remotePeer) OnInv(p *peer.Peer, msg *wire.MsgInv) {
+	getData := wire.NewMsgGetData()
+	for _, inv := range msg.InvList {
+		if r.accept.Load() {
+			getData.AddInvVect(inv)
+			continue
+		}
+		reject := wire.NewMsgReject(wire.CmdTx, wire.RejectInsufficientFee, "min relay fee not met")
+		reject.Hash = inv.Hash
+		p.QueueMessage(reject, nil)
+	}
+	if len(getData.InvList) > 0 {
+		p.QueueMessage(getData, nil)
+	}
+}
+
+func (r *remotePeer) disconnect() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range r.peers {
+		p.Disconnect()
+		p.WaitForDisconnect()
+	}
+	r.peers = nil
+}
+
+// receive waits for the remote peer to fetch tx
+func (r *remotePeer) receive(t *testing.T, tx *wire.MsgTx) {
+	t.Helper()
+	for {
+		select {
+		case received := <-r.txs:
+			if received.TxHash() == tx.TxHash() {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s did not fetch %s", r.addr, tx.TxHash())
+		}
+	}
+}
+
+// waitBroadcast polls the stored broadcast of tx until done holds
+func waitBroadcast(t *testing.T, store database.Store, tx *wire.MsgTx, done func(database.Broadcast) bool) database.Broadcast {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		broadcast, err := store.GetBroadcast(ctx, tx.TxHash().String())
+		if err != nil {
+			t.Fatalf("GetBroadcast: %v", err)
+		}
+		if done(broadcast) {
+			return broadcast
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("broadcast %+v", broadcast)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (b *Broadcaster) connected() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.peers)
+}
+
+// peerStatus returns the status of broadcast at addr, empty if the peer did not answer
+func peerStatus(broadcast database.Broadcast, addr string) string {
+	for _, peer := range broadcast.Peers {
+		if peer.Addr == addr {
+			return peer.Status
+		}
+	}
+	return ""
+}
+
+func TestBroadcastRelay(t *testing.T) {
+	b, store, chain := newTestBroadcaster(t)
+	b1 := chain.Block(chain.Genesis())
+	spend := chain.Spend(b1.Transactions[0], 0)
+	b2 := chain.Block(b1, spend)
+	other := chain.Spend(b2.Transactions[0], 0)
+	b3 := chain.Block(b2, other)
+	chain.Put(b1, b2, b3)
+
+	accepting, rejecting := newRemotePeer(t, true), newRemotePeer(t, false)
+	b.setRelayPeers([]string{accepting.addr, rejecting.addr})
+	if n := b.connected(); n != 2 {
+		t.Fatalf("%d relay peers connected, want 2", n)
+	}
+
+	// each peer answering is recorded, one fetching the tx makes it relayed
+	tx1 := chain.Spend(spend, 0)
+	if _, err := b.Broadcast(ctx, serialize(t, tx1)); err != nil {
+		t.Fatalf("Broadcast: %v", err)
+	}
+	accepting.receive(t, tx1)
+	broadcast := waitBroadcast(t, store, tx1, func(broadcast database.Broadcast) bool { return len(broadcast.Peers) == 2 })
+	if broadcast.Status != database.BroadcastRelayed || peerStatus(broadcast, accepting.addr) != database.BroadcastRelayed ||
+		peerStatus(broadcast, rejecting.addr) != database.BroadcastRejected || !strings.Contains(broadcast.Reject, "min relay fee not met") {
+		t.Fatalf("broadcast %+v, want relayed by %s and rejected by %s", broadcast, accepting.addr, rejecting.addr)
+	}
+
+	// a tx every peer rejects is rejected, and announced again once it passes the checks
+	accepting.accept.Store(false)
+	tx2 := chain.Spend(spend, 1)
+	if _, err := b.Broadcast(ctx, serialize(t, tx2)); err != nil {
+		t.Fatalf("Broadcast: %v", err)
+	}
+	waitBroadcast(t, store, tx2, func(broadcast database.Broadcast) bool {
+		return len(broadcast.Peers) == 2 && broadcast.Status == database.BroadcastRejected
+	})
+	accepting.accept.Store(true)
+	b.rebroadcast(ctx)
+	accepting.receive(t, tx2)
+	waitBroadcast(t, store, tx2, func(broadcast database.Broadcast) bool {
+		return broadcast.Status == database.BroadcastRelayed && peerStatus(broadcast, accepting.addr) == database.BroadcastRelayed
+	})
+
+	// a rejected tx whose inputs got spent meanwhile is not announced again
+	accepting.accept.Store(false)
+	tx3 := chain.Spend(other, 0)
+	if _, err := b.Broadcast(ctx, serialize(t, tx3)); err != nil {
+		t.Fatalf("Broadcast: %v", err)
+	}
+	waitBroadcast(t, store, tx3, func(broadcast database.Broadcast) bool {
+		return len(broadcast.Peers) == 2 && broadcast.Status == database.BroadcastRejected
+	})
+	b4 := chain.Block(b3, chain.Spend(other, 0, 1))
+	chain.Put(b4)
+	b.rebroadcast(ctx)
+	broadcast = waitBroadcast(t, store, tx3, func(broadcast database.Broadcast) bool { return strings.Contains(broadcast.Reject, "missing or spent") })
+	if broadcast.Status != database.BroadcastRejected {
+		t.Fatalf("broadcast %+v, want rejected", broadcast)
+	}
+
+	// confirmed txs are no longer announced
+	chain.Put(chain.Block(b4, tx1))
+	unconfirmed := b.recheck(ctx)
+	if len(unconfirmed) != 2 {
+		t.Fatalf("recheck = %+v, want tx2 and tx3 unconfirmed", unconfirmed)
+	}
+	if broadcast, err := store.GetBroadcast(ctx, tx1.TxHash().String()); err != nil || broadcast.Status != database.BroadcastConfirmed {
+		t.Fatalf("GetBroadcast = %+v, %v, want confirmed", broadcast, err)
+	}
+
+	// a relay peer that disconnects is dialled again
+	rejecting.disconnect()
+	deadline := time.Now().Add(5 * time.Second)
+	for b.connected() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d relay peers connected after a disconnect, want 1", b.connected())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.connectPeers()
+	if n := b.connected(); n != 2 {
+		t.Fatalf("%d relay peers connected, want 2", n)
+	}
+}
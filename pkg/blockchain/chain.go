@@ -2,6 +2,7 @@ package blockchain
 
 import (
 	"btc-indexer/database"
+	"context"
 
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
@@ -37,7 +38,7 @@ func (c *chain) getBlockLocator(height int32) ([]*chainhash.Hash, error) {
 	step := int32(1)
 
 	for height >= 0 {
-		blockHash, err := c.store.GetBlockHashByHeight(height)
+		blockHash, err := c.store.GetBlockHashByHeight(context.TODO(), height)
 		if err != nil {
 			return nil, err
 		}
@@ -4,6 +4,7 @@ import (
 	"btc-indexer/database"
 	"btc-indexer/internal/network"
 	"btc-indexer/pkg/logger"
+	"context"
 	"fmt"
 	"math/rand"
 	"net"
@@ -15,17 +16,20 @@ import (
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/peer"
 	"github.com/btcsuite/btcd/wire"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type Mode string
 type ChainType string
 
 const (
-	ModeFull  Mode = "full"
-	ModeLight Mode = "light"
+	ModeFull   Mode = "full"
+	ModeLight  Mode = "light"
+	ModePruned Mode = "pruned" // keeps the utxo set and the last PruneDepth blocks of history
 )
 
+// DefaultPruneDepth is used in pruned mode when no depth is configured
+const DefaultPruneDepth int32 = 288
+
 const (
 	Mainnet ChainType = "btc"
 	Testnet ChainType = "btct"
@@ -44,8 +48,9 @@ type indexer struct {
 
 	headersFirstMode bool
 
-	chain Chain
-	store database.Store
+	chain       Chain
+	store       database.Store
+	broadcaster *Broadcaster
 
 	requestedBlocks int
 	processedBlocks int
@@ -58,18 +63,23 @@ type Chain interface {
 	findNextHeaderCheckpoint(height int32) *chaincfg.Checkpoint
 }
 
-func NewIndexer(mode Mode, chainType ChainType, headersFirst bool, store database.Store) *indexer {
-	var chainParams *chaincfg.Params
+// ChainParams returns the params of chainType or nil if it is unknown
+func ChainParams(chainType ChainType) *chaincfg.Params {
 	switch chainType {
 	case Mainnet:
-		chainParams = &chaincfg.MainNetParams
+		return &chaincfg.MainNetParams
 	case Testnet:
-		chainParams = &chaincfg.TestNet3Params
+		return &chaincfg.TestNet3Params
 	case Regtest:
-		chainParams = &chaincfg.RegressionNetParams
+		return &chaincfg.RegressionNetParams
 	case Signet:
-		chainParams = &chaincfg.SimNetParams
+		return &chaincfg.SimNetParams
 	}
+	return nil
+}
+
+func NewIndexer(mode Mode, chainType ChainType, headersFirst bool, store database.Store) *indexer {
+	chainParams := ChainParams(chainType)
 	return &indexer{
 		mode:        mode,
 		chainParams: chainParams,
@@ -77,30 +87,35 @@ func NewIndexer(mode Mode, chainType ChainType, headersFirst bool, store databas
 
 		headersFirstMode: headersFirst,
 
-		chain: NewChain(store, chainParams.Checkpoints),
-		store: store,
+		chain:       NewChain(store, chainParams.Checkpoints),
+		store:       store,
+		broadcaster: NewBroadcaster(chainParams, store),
 
 		stallPeerTicker: time.NewTicker(15 * time.Second),
 	}
 }
 
+// Broadcaster returns the broadcaster relaying txs through the peer the indexer syncs from and the other valid peers
+func (i *indexer) Broadcaster() *Broadcaster {
+	return i.broadcaster
+}
+
 type state struct {
 	LastHeight int32
 	LastHash   *chainhash.Hash
 }
 
 func (i *indexer) Start() {
-	i.store.SetChainCfg(i.chainParams)
 	LastHeight := i.GetInitialBlockHeight()
-	LastHash, err := i.store.GetLatestBlockHash()
+	LastHash, err := i.store.GetLatestBlockHash(context.TODO())
 	if err != nil {
 		i.logger.Error(err.Error())
 	}
 
-	txhash, err := i.store.GetLatestTxHash()
+	txhash, err := i.store.GetLatestTxHash(context.TODO())
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			err = i.store.InitCoinBaseTx()
+		if err == database.ErrNotFound {
+			err = i.store.InitCoinBaseTx(context.TODO())
 			if err != nil {
 				i.logger.Error(err.Error())
 			}
@@ -128,6 +143,7 @@ func (i *indexer) Start() {
 		// }
 		validPeer.Disconnect()
 	}
+	go i.broadcaster.setRelayPeers(i.availablePeers)
 
 	var peerDoneChan = make(chan struct{})
 	i.startSync(peerDoneChan)
@@ -152,6 +168,7 @@ func (i *indexer) startSync(peerDone chan struct{}) {
 	}
 	i.currentPeer = peer
 	i.logger.Info("Peer Connected: " + i.currentPeer.Addr())
+	go i.broadcaster.addPeer(peer)
 
 	go i.msgHandler(msgChan, processDoneChan)
 
@@ -212,6 +229,7 @@ func (i *indexer) GetRandPeer(invDoneChan chan struct{}, msgChan chan interface{
 
 	listeners := newPeerListeners(i.logger, nil, msgChan, invDoneChan, invCountChan)
 	listeners.DisableSend()
+	listeners.broadcaster = i.broadcaster
 	peer, err := peer.NewOutboundPeer(newPeerConfig(i.chainParams, listeners), i.availablePeers[index])
 	if err != nil {
 		return nil, err
@@ -233,7 +251,7 @@ func (i *indexer) GetInitialBlockHeight() int32 {
 	LatestBlockHeight, _ := i.store.GetLatestBlockHeight()
 	// if err != nil {
 	// 	if err == mongo.ErrNoDocuments {
-	// 		if err := i.store.InitGenesisBlock(i.chainParams.GenesisBlock); err != nil {
+	// 		if err := i.store.InitGenesisBlock(context.TODO(), i.chainParams.GenesisBlock); err != nil {
 	// 			i.logger.Error(err.Error())
 	// 		}
 	// 		LatestBlockHeight = 0
@@ -242,7 +260,7 @@ func (i *indexer) GetInitialBlockHeight() int32 {
 	// 	}
 	// }
 	if LatestBlockHeight == -1 {
-		if err := i.store.InitGenesisBlock(i.chainParams.GenesisBlock); err != nil {
+		if err := i.store.InitGenesisBlock(context.TODO(), i.chainParams.GenesisBlock); err != nil {
 			i.logger.Error(err.Error())
 		}
 		LatestBlockHeight = 0
@@ -324,7 +342,7 @@ func (i *indexer) msgHandler(msgChan chan interface{}, processDoneChan chan stru
 	for msg := range msgChan {
 		switch msg := msg.(type) {
 		case *wire.MsgBlock:
-			if err := i.store.PutBlock(msg); err != nil {
+			if err := i.store.PutBlock(context.TODO(), msg); err != nil {
 				i.logger.Error(err.Error())
 			}
 			i.processedBlocks++
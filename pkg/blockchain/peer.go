@@ -16,6 +16,8 @@ func newPeerConfig(params *chaincfg.Params, pr *peerListeners) *peer.Config {
 			OnHeaders: pr.OnHeaders,
 			OnBlock:   pr.OnBlock,
 			OnInv:     pr.OnInv,
+			OnGetData: pr.OnGetData,
+			OnReject:  pr.OnReject,
 			// OnVerAck:  pr.OnVerAck,
 			// OnMemPool:      sp.OnMemPool,
 			// OnTx:           sp.OnTx,
@@ -53,6 +55,16 @@ func newPeerConfig(params *chaincfg.Params, pr *peerListeners) *peer.Config {
 	}
 }
 
+// newRelayPeerConfig configures a peer dialled only to relay broadcast txs, it ignores announcements
+func newRelayPeerConfig(params *chaincfg.Params, broadcaster *Broadcaster) *peer.Config {
+	config := newPeerConfig(params, &peerListeners{})
+	config.Listeners = peer.MessageListeners{
+		OnGetData: broadcaster.OnGetData,
+		OnReject:  broadcaster.OnReject,
+	}
+	return config
+}
+
 type peerListeners struct {
 	logger     *logger.CustomLogger
 	validPeers chan *peer.Peer
@@ -62,6 +74,9 @@ type peerListeners struct {
 	InvMsgChan chan int
 
 	done chan struct{}
+
+	// broadcaster relays broadcast txs through the sync peer too, nil for the peers only probed
+	broadcaster *Broadcaster
 }
 
 func newPeerListeners(logger *logger.CustomLogger, validPeers chan *peer.Peer, msgChan chan interface{}, done chan struct{}, InvMsgChan chan int) *peerListeners {
@@ -114,3 +129,16 @@ func (pr *peerListeners) OnInv(p *peer.Peer, msg *wire.MsgInv) {
 func (pr *peerListeners) OnBlock(p *peer.Peer, msg *wire.MsgBlock, buf []byte) {
 	pr.msgChan <- msg
 }
+
+func (pr *peerListeners) OnGetData(p *peer.Peer, msg *wire.MsgGetData) {
+	if pr.broadcaster != nil {
+		pr.broadcaster.OnGetData(p, msg)
+	}
+}
+
+func (pr *peerListeners) OnReject(p *peer.Peer, msg *wire.MsgReject) {
+	pr.logger.Debug(fmt.Sprintf("Reject: %s", msg))
+	if pr.broadcaster != nil {
+		pr.broadcaster.OnReject(p, msg)
+	}
+}
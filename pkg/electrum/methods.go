@@ -0,0 +1,291 @@
+package electrum
+
+import (
+	"btc-indexer/database"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// relayFee is the minimum relay fee in BTC/kvB reported to wallets, the default of bitcoind
+const relayFee = 0.00001
+
+type tipHeader struct {
+	Hex    string `json:"hex"`
+	Height int32  `json:"height"`
+}
+
+type historyItem struct {
+	TxHash database.Hash `json:"tx_hash"`
+	Height int32         `json:"height"`
+}
+
+type unspent struct {
+	TxPos  uint32        `json:"tx_pos"`
+	Value  int64         `json:"value"`
+	TxHash database.Hash `json:"tx_hash"`
+	Height int32         `json:"height"`
+}
+
+type balance struct {
+	Confirmed   int64 `json:"confirmed"`
+	Unconfirmed int64 `json:"unconfirmed"`
+}
+
+// call runs one method, only confirmed txs are indexed so mempool figures are always empty
+func (c *conn) call(ctx context.Context, method string, params []json.RawMessage) (interface{}, error) {
+	s := c.s
+	switch method {
+	case "server.version":
+		return []string{serverVersion, protocolVersion}, nil
+	case "server.banner":
+		return "btc-indexer electrum server", nil
+	case "server.donation_address":
+		return "", nil
+	case "server.peers.subscribe":
+		return []interface{}{}, nil
+	case "server.ping":
+		return nil, nil
+
+	case "blockchain.relayfee":
+		return relayFee, nil
+	case "blockchain.estimatefee":
+		// no mempool to estimate from
+		return -1, nil
+
+	case "blockchain.headers.subscribe":
+		header, err := s.tipHeader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		c.headers = true
+		c.mu.Unlock()
+		return header, nil
+
+	case "blockchain.block.header":
+		height, err := intParam(params, 0)
+		if err != nil {
+			return nil, err
+		}
+		if cpHeight, _ := intParam(params, 1); cpHeight != 0 {
+			return nil, &rpcError{Code: codeBadRequest, Message: "checkpoint proofs are not supported"}
+		}
+		block, err := s.store.GetBlockByHeight(ctx, height)
+		if errors.Is(err, database.ErrNotFound) {
+			return nil, &rpcError{Code: codeBadRequest, Message: fmt.Sprintf("height %d out of range", height)}
+		}
+		if err != nil {
+			return nil, err
+		}
+		header, err := serializeHeader(block)
+		if err != nil {
+			return nil, err
+		}
+		return hex.EncodeToString(header), nil
+
+	case "blockchain.scripthash.get_balance":
+		scriptHash, err := scriptHashParam(params)
+		if err != nil {
+			return nil, err
+		}
+		utxos, err := s.store.GetScriptHashUTXOs(ctx, scriptHash)
+		if err != nil {
+			return nil, err
+		}
+		var b balance
+		for _, utxo := range utxos {
+			b.Confirmed += utxo.Value
+		}
+		return b, nil
+
+	case "blockchain.scripthash.get_history":
+		scriptHash, err := scriptHashParam(params)
+		if err != nil {
+			return nil, err
+		}
+		history, err := s.store.GetScriptHashHistory(ctx, scriptHash)
+		if err != nil {
+			return nil, err
+		}
+		items := make([]historyItem, len(history))
+		for i, item := range history {
+			items[i] = historyItem{TxHash: item.TxHash, Height: item.Height}
+		}
+		return items, nil
+
+	case "blockchain.scripthash.listunspent":
+		scriptHash, err := scriptHashParam(params)
+		if err != nil {
+			return nil, err
+		}
+		utxos, err := s.store.GetScriptHashUTXOs(ctx, scriptHash)
+		if err != nil {
+			return nil, err
+		}
+		items := make([]unspent, len(utxos))
+		for i, utxo := range utxos {
+			items[i] = unspent{TxPos: utxo.FundingTxIndex, Value: utxo.Value, TxHash: utxo.FundingTxHash, Height: utxo.FundingHeight}
+		}
+		return items, nil
+
+	case "blockchain.scripthash.subscribe":
+		scriptHash, err := scriptHashParam(params)
+		if err != nil {
+			return nil, err
+		}
+		status, err := s.status(ctx, scriptHash)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		c.scriptHashes[scriptHash] = status
+		c.mu.Unlock()
+		return nullable(status), nil
+
+	case "blockchain.scripthash.unsubscribe":
+		scriptHash, err := scriptHashParam(params)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		_, ok := c.scriptHashes[scriptHash]
+		delete(c.scriptHashes, scriptHash)
+		c.mu.Unlock()
+		return ok, nil
+
+	case "blockchain.transaction.get":
+		txid, err := stringParam(params, 0)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := chainhash.NewHashFromStr(txid); err != nil || len(txid) != 64 {
+			return nil, &rpcError{Code: codeInvalidParams, Message: "invalid txid"}
+		}
+		if verbose, _ := boolParam(params, 1); verbose {
+			return nil, &rpcError{Code: codeBadRequest, Message: "verbose transactions are not supported"}
+		}
+		txid = strings.ToLower(txid)
+		tx, err := s.store.GetMsgTx(ctx, txid)
+		if errors.Is(err, database.ErrNotFound) {
+			return nil, &rpcError{Code: codeBadRequest, Message: "no such transaction " + txid}
+		}
+		if errors.Is(err, database.ErrIncompleteTx) {
+			return nil, &rpcError{Code: codeBadRequest, Message: "transaction " + txid + " is not fully stored"}
+		}
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := tx.Serialize(&buf); err != nil {
+			return nil, err
+		}
+		return hex.EncodeToString(buf.Bytes()), nil
+	}
+	return nil, &rpcError{Code: codeMethodNotFound, Message: "unknown method " + method}
+}
+
+// status is the electrum status of a script hash, empty when it has no history
+func (s *Server) status(ctx context.Context, scriptHash string) (string, error) {
+	history, err := s.store.GetScriptHashHistory(ctx, scriptHash)
+	if err != nil {
+		return "", err
+	}
+	return database.ScriptHashStatus(history), nil
+}
+
+func (s *Server) tipHeader(ctx context.Context) (tipHeader, error) {
+	height, err := s.store.GetLatestBlockHeight()
+	if err != nil {
+		return tipHeader{}, err
+	}
+	block, err := s.store.GetBlockByHeight(ctx, height)
+	if err != nil {
+		return tipHeader{}, err
+	}
+	header, err := serializeHeader(block)
+	if err != nil {
+		return tipHeader{}, err
+	}
+	return tipHeader{Hex: hex.EncodeToString(header), Height: height}, nil
+}
+
+// serializeHeader rebuilds the 80 byte header of block
+func serializeHeader(block database.Block) ([]byte, error) {
+	prev, err := chainhash.NewHashFromStr(string(block.PreviousBlock))
+	if err != nil {
+		return nil, err
+	}
+	merkleRoot, err := chainhash.NewHashFromStr(string(block.MerkleRoot))
+	if err != nil {
+		return nil, err
+	}
+	header := wire.BlockHeader{
+		Version:    block.Version,
+		PrevBlock:  *prev,
+		MerkleRoot: *merkleRoot,
+		Timestamp:  time.Unix(block.Timestamp, 0),
+		Bits:       block.Bits,
+		Nonce:      block.Nonce,
+	}
+	var buf bytes.Buffer
+	if err := header.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// nullable maps the empty status to null
+func nullable(status string) interface{} {
+	if status == "" {
+		return nil
+	}
+	return status
+}
+
+func stringParam(params []json.RawMessage, i int) (string, error) {
+	var v string
+	if i >= len(params) || json.Unmarshal(params[i], &v) != nil {
+		return "", &rpcError{Code: codeInvalidParams, Message: fmt.Sprintf("param %d must be a string", i)}
+	}
+	return v, nil
+}
+
+func intParam(params []json.RawMessage, i int) (int32, error) {
+	var v int32
+	if i >= len(params) || json.Unmarshal(params[i], &v) != nil || v < 0 {
+		return 0, &rpcError{Code: codeInvalidParams, Message: fmt.Sprintf("param %d must be a non negative integer", i)}
+	}
+	return v, nil
+}
+
+// boolParam is false when the optional param is left out
+func boolParam(params []json.RawMessage, i int) (bool, error) {
+	var v bool
+	if i >= len(params) {
+		return false, nil
+	}
+	if err := json.Unmarshal(params[i], &v); err != nil {
+		return false, &rpcError{Code: codeInvalidParams, Message: fmt.Sprintf("param %d must be a boolean", i)}
+	}
+	return v, nil
+}
+
+func scriptHashParam(params []json.RawMessage) (string, error) {
+	scriptHash, err := stringParam(params, 0)
+	if err != nil {
+		return "", err
+	}
+	if b, err := hex.DecodeString(scriptHash); err != nil || len(b) != 32 {
+		return "", &rpcError{Code: codeInvalidParams, Message: "invalid script hash"}
+	}
+	return strings.ToLower(scriptHash), nil
+}
@@ -0,0 +1,463 @@
+package electrum
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/pkg/logger"
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	serverVersion   = "btc-indexer 0.1"
+	protocolVersion = "1.4"
+
+	// maxLine bounds a request line, batches included
+	maxLine = 1 << 20
+	// idleTimeout disconnects clients that stop sending, wallets ping every minute or so
+	idleTimeout = 10 * time.Minute
+	// writeTimeout disconnects clients that stop reading
+	writeTimeout = time.Minute
+	// sendBuffer is how many messages a client may lag behind before it is dropped
+	sendBuffer = 256
+)
+
+// Server serves the electrum protocol, newline delimited JSON-RPC over TCP and TLS
+type Server struct {
+	store      database.Store
+	address    string
+	tlsAddress string
+	tlsConfig  *tls.Config
+	logger     *logger.CustomLogger
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[*conn]struct{}
+	done      chan struct{}
+	queue     []database.Event // events the store handed over, notified from run
+	wake      chan struct{}
+
+	// ctx is cancelled by Shutdown so the store lookups still running stop
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewServer returns a server for store listening on address and, with a certificate, on tlsAddress.
+// either address can be empty to leave that transport off
+func NewServer(address, tlsAddress, certFile, keyFile string, store database.Store) (*Server, error) {
+	s := &Server{
+		store:      store,
+		address:    address,
+		tlsAddress: tlsAddress,
+		logger:     logger.NewDefaultLogger(),
+		conns:      make(map[*conn]struct{}),
+		done:       make(chan struct{}),
+		wake:       make(chan struct{}, 1),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if tlsAddress != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("electrum tls: %w", err)
+		}
+		s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	return s, nil
+}
+
+// Start listens and notifies subscribers of new tips until Shutdown is called
+func (s *Server) Start() error {
+	if s.address != "" {
+		listener, err := net.Listen("tcp", s.address)
+		if err != nil {
+			return err
+		}
+		s.serve(listener)
+		s.logger.Info("Electrum server listening on " + s.address)
+	}
+	if s.tlsAddress != "" {
+		listener, err := tls.Listen("tcp", s.tlsAddress, s.tlsConfig)
+		if err != nil {
+			s.Shutdown()
+			return err
+		}
+		s.serve(listener)
+		s.logger.Info("Electrum server listening for TLS on " + s.tlsAddress)
+	}
+
+	s.store.Listen(s.publish)
+	s.run()
+	return nil
+}
+
+// Shutdown closes the listeners and every connection
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		return
+	default:
+		close(s.done)
+	}
+	s.cancel()
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	for c := range s.conns {
+		c.close()
+	}
+}
+
+func (s *Server) serve(listener net.Listener) {
+	s.mu.Lock()
+	s.listeners = append(s.listeners, listener)
+	s.mu.Unlock()
+
+	go func() {
+		for {
+			nc, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					s.logger.Error(err.Error())
+				}
+				return
+			}
+			c := newConn(s, nc)
+			s.mu.Lock()
+			s.conns[c] = struct{}{}
+			s.mu.Unlock()
+			go c.serve()
+		}
+	}()
+}
+
+func (s *Server) remove(c *conn) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+}
+
+// publish is the store listener, it must not block
+func (s *Server) publish(events []database.Event) {
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		return
+	default:
+	}
+	s.queue = append(s.queue, events...)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run notifies subscribers of the blocks the store connects and disconnects until Shutdown is called
+func (s *Server) run() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.wake:
+		}
+		s.mu.Lock()
+		events := s.queue
+		s.queue = nil
+		conns := make([]*conn, 0, len(s.conns))
+		for c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+		s.dispatch(s.ctx, events, conns)
+	}
+}
+
+// dispatch sends the new tip to header subscribers and the new status of the subscribed script hashes the events touched.
+// the outputs of orphaned txs are gone, so after a reorg every subscribed script hash is looked up again
+func (s *Server) dispatch(ctx context.Context, events []database.Event, conns []*conn) {
+	subscribed := make(map[string]bool)
+	for _, c := range conns {
+		c.mu.Lock()
+		for scriptHash := range c.scriptHashes {
+			subscribed[scriptHash] = true
+		}
+		c.mu.Unlock()
+	}
+
+	connected, all := false, false
+	touched := make(map[string]bool)
+	for _, event := range events {
+		switch event.Type {
+		case database.EventBlockConnected:
+			connected = true
+		case database.EventBlockDisconnected:
+			all = true
+		case database.EventTxConfirmed:
+			if all || len(subscribed) == 0 {
+				continue
+			}
+			if err := s.touch(ctx, event.TxHash, subscribed, touched); err != nil {
+				s.logger.Error(err.Error())
+				all = true
+			}
+		}
+	}
+	if !connected {
+		return
+	}
+	if all {
+		touched = subscribed
+	}
+
+	header, err := s.tipHeader(ctx)
+	if err != nil {
+		s.logger.Error(err.Error())
+		return
+	}
+	statuses := make(map[string]string, len(touched))
+	for scriptHash := range touched {
+		status, err := s.status(ctx, scriptHash)
+		if err != nil {
+			s.logger.Error(err.Error())
+			continue
+		}
+		statuses[scriptHash] = status
+	}
+	for _, c := range conns {
+		c.notifyTip(header, statuses)
+	}
+}
+
+// touch adds the subscribed script hashes of the outputs a tx funds and spends to touched
+func (s *Server) touch(ctx context.Context, txHash database.Hash, subscribed, touched map[string]bool) error {
+	funded, err := s.store.GetOutPointsByTx(ctx, string(txHash))
+	if err != nil {
+		return err
+	}
+	spent, err := s.store.GetOutPointsSpentBy(ctx, string(txHash))
+	if err != nil {
+		return err
+	}
+	for _, outPoint := range append(funded, spent...) {
+		if scriptHash := string(outPoint.ScriptHash); subscribed[scriptHash] {
+			touched[scriptHash] = true
+		}
+	}
+	return nil
+}
+
+// conn is a client connection, requests are answered in order.
+// responses and notifications are queued to a writer so a client that stops reading holds up no one else
+type conn struct {
+	s      *Server
+	nc     net.Conn
+	send   chan []byte
+	closed chan struct{}
+	once   sync.Once
+
+	mu           sync.Mutex
+	headers      bool
+	scriptHashes map[string]string // subscribed script hashes and the status last sent
+}
+
+func newConn(s *Server, nc net.Conn) *conn {
+	return &conn{
+		s:            s,
+		nc:           nc,
+		send:         make(chan []byte, sendBuffer),
+		closed:       make(chan struct{}),
+		scriptHashes: make(map[string]string),
+	}
+}
+
+func (c *conn) close() {
+	c.once.Do(func() {
+		close(c.closed)
+		c.nc.Close()
+	})
+}
+
+type request struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// error codes of JSON-RPC and the ones electrum servers add
+const (
+	codeBadRequest     = 1
+	codeParseError     = -32700
+	codeInvalidRequest = -32600
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+	codeInternal       = -32603
+)
+
+func (c *conn) serve() {
+	defer c.s.remove(c)
+	defer c.close()
+	go c.writeLoop()
+	ctx := c.s.ctx
+
+	scanner := bufio.NewScanner(c.nc)
+	scanner.Buffer(make([]byte, 0, 4096), maxLine)
+	for {
+		c.nc.SetReadDeadline(time.Now().Add(idleTimeout))
+		if !scanner.Scan() {
+			return
+		}
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var response interface{}
+		if line[0] == '[' {
+			var batch []json.RawMessage
+			if err := json.Unmarshal(line, &batch); err != nil {
+				response = errorResponse(nil, &rpcError{Code: codeParseError, Message: "invalid JSON"})
+			} else {
+				responses := make([]interface{}, len(batch))
+				for i, raw := range batch {
+					responses[i] = c.handle(ctx, raw)
+				}
+				response = responses
+			}
+		} else {
+			response = c.handle(ctx, line)
+		}
+		if err := c.write(response); err != nil {
+			return
+		}
+	}
+}
+
+func (c *conn) handle(ctx context.Context, raw []byte) interface{} {
+	var req request
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return errorResponse(nil, &rpcError{Code: codeParseError, Message: "invalid JSON"})
+	}
+	if req.Method == "" {
+		return errorResponse(req.ID, &rpcError{Code: codeInvalidRequest, Message: "missing method"})
+	}
+
+	var params []json.RawMessage
+	if len(req.Params) > 0 && string(req.Params) != "null" {
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return errorResponse(req.ID, &rpcError{Code: codeInvalidParams, Message: "params must be an array"})
+		}
+	}
+
+	result, err := c.call(ctx, req.Method, params)
+	if err != nil {
+		var rpcErr *rpcError
+		if !errors.As(err, &rpcErr) {
+			c.s.logger.Error(err.Error())
+			rpcErr = &rpcError{Code: codeInternal, Message: "internal error"}
+		}
+		return errorResponse(req.ID, rpcErr)
+	}
+	return map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": result}
+}
+
+func errorResponse(id json.RawMessage, err *rpcError) map[string]interface{} {
+	return map[string]interface{}{"jsonrpc": "2.0", "id": id, "error": err}
+}
+
+func (c *conn) notify(method string, params ...interface{}) {
+	c.queue(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}, false)
+}
+
+func (c *conn) write(message interface{}) error {
+	return c.queue(message, true)
+}
+
+// queue hands message to the writer. responses wait for room in the queue,
+// a client lagging sendBuffer messages behind on notifications is dropped
+func (c *conn) queue(message interface{}, wait bool) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if wait {
+		// a ready send would otherwise race the close
+		select {
+		case <-c.closed:
+			return net.ErrClosed
+		default:
+		}
+		select {
+		case c.send <- data:
+			return nil
+		case <-c.closed:
+			return net.ErrClosed
+		}
+	}
+	select {
+	case c.send <- data:
+		return nil
+	case <-c.closed:
+		return net.ErrClosed
+	default:
+		c.s.logger.Warn("Dropping slow electrum client " + c.nc.RemoteAddr().String())
+		c.close()
+		return net.ErrClosed
+	}
+}
+
+// writeLoop writes the queued messages in order until the connection is closed
+func (c *conn) writeLoop() {
+	defer c.close()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case data := <-c.send:
+			c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if _, err := c.nc.Write(data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// notifyTip sends the new tip to header subscribers and the script hashes whose status changed,
+// statuses holds the ones the new blocks touched
+func (c *conn) notifyTip(header tipHeader, statuses map[string]string) {
+	c.mu.Lock()
+	headers := c.headers
+	changed := make(map[string]string)
+	for scriptHash, last := range c.scriptHashes {
+		if status, ok := statuses[scriptHash]; ok && status != last {
+			c.scriptHashes[scriptHash] = status
+			changed[scriptHash] = status
+		}
+	}
+	c.mu.Unlock()
+
+	if headers {
+		c.notify("blockchain.headers.subscribe", header)
+	}
+	for scriptHash, status := range changed {
+		c.notify("blockchain.scripthash.subscribe", scriptHash, nullable(status))
+	}
+}
@@ -0,0 +1,190 @@
+package electrum
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/database/storetest"
+	"btc-indexer/pkg/logger"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// testClient speaks the electrum protocol to a test server
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	id     int
+}
+
+// newTestServer serves a regtest memory store on a local port, Start is left out as it listens on configured addresses
+func newTestServer(t *testing.T) (*Server, *storetest.Chain, string) {
+	store := database.NewMemoryStore(&chaincfg.RegressionNetParams)
+	chain := storetest.NewChain(t, store)
+	s, err := NewServer("", "", "", "", store)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s.serve(listener)
+	store.Listen(s.publish)
+	go s.run()
+	t.Cleanup(s.Shutdown)
+	return s, chain, listener.Addr().String()
+}
+
+func dial(t *testing.T, address string) *testClient {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// call sends a request and returns the result of its response
+func (c *testClient) call(method string, params ...interface{}) json.RawMessage {
+	c.t.Helper()
+	c.id++
+	data, _ := json.Marshal(map[string]interface{}{"id": c.id, "method": method, "params": params})
+	if _, err := c.conn.Write(append(data, '\n')); err != nil {
+		c.t.Fatalf("%s: %v", method, err)
+	}
+	msg := c.next()
+	var id int
+	json.Unmarshal(msg["id"], &id)
+	if id != c.id || msg["error"] != nil {
+		c.t.Fatalf("%s = %v", method, msg)
+	}
+	return msg["result"]
+}
+
+// next reads the next message, failing the test when none comes within a second
+func (c *testClient) next() map[string]json.RawMessage {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		c.t.Fatalf("no message: %v", err)
+	}
+	var msg map[string]json.RawMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		c.t.Fatalf("invalid message %s: %v", line, err)
+	}
+	return msg
+}
+
+// notification reads the next message, which must be a notification of method
+func (c *testClient) notification(method string) []json.RawMessage {
+	c.t.Helper()
+	msg := c.next()
+	var got string
+	json.Unmarshal(msg["method"], &got)
+	if got != method {
+		c.t.Fatalf("got %v, want a %s notification", msg, method)
+	}
+	var params []json.RawMessage
+	json.Unmarshal(msg["params"], &params)
+	return params
+}
+
+// quiet checks no message comes within a short while
+func (c *testClient) quiet() {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if line, err := c.reader.ReadBytes('\n'); err == nil {
+		c.t.Fatalf("unexpected message %s", line)
+	}
+}
+
+func electrumScriptHash(pkScript []byte) string {
+	return chainhash.Hash(sha256.Sum256(pkScript)).String()
+}
+
+func (c *testClient) scriptHashNotification(scriptHash string) string {
+	c.t.Helper()
+	params := c.notification("blockchain.scripthash.subscribe")
+	var got, status string
+	if len(params) != 2 || json.Unmarshal(params[0], &got) != nil || got != scriptHash {
+		c.t.Fatalf("scripthash notification %s, want %s", params, scriptHash)
+	}
+	json.Unmarshal(params[1], &status)
+	return status
+}
+
+func (c *testClient) headerNotification(height int32) {
+	c.t.Helper()
+	params := c.notification("blockchain.headers.subscribe")
+	var header tipHeader
+	if len(params) != 1 || json.Unmarshal(params[0], &header) != nil || header.Height != height {
+		c.t.Fatalf("header notification %s, want height %d", params, height)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	s, chain, address := newTestServer(t)
+	b1 := chain.Block(chain.Genesis())
+	b2 := chain.Block(b1)
+	chain.Put(b1, b2)
+	spent := electrumScriptHash(b1.Transactions[0].TxOut[0].PkScript)
+	untouched := electrumScriptHash(b2.Transactions[0].TxOut[0].PkScript)
+
+	c := dial(t, address)
+	c.call("blockchain.headers.subscribe")
+	var before string
+	json.Unmarshal(c.call("blockchain.scripthash.subscribe", spent), &before)
+	c.call("blockchain.scripthash.subscribe", untouched)
+
+	// only the script hash the new block touches is looked up and notified
+	spend := chain.Spend(b1.Transactions[0], 0)
+	b3 := chain.Block(b2, spend)
+	chain.Put(b3)
+	c.headerNotification(3)
+	status := c.scriptHashNotification(spent)
+	want, err := s.status(context.Background(), spent)
+	if err != nil || status != want || status == before {
+		t.Fatalf("status %q, want %q, %v, it was %q", status, want, err, before)
+	}
+	c.quiet()
+
+	// a reorg orphaning the spend brings the status back
+	side3 := chain.Block(b2)
+	side4 := chain.Block(side3)
+	chain.Put(side3, side4)
+	c.headerNotification(4)
+	if status := c.scriptHashNotification(spent); status != before {
+		t.Fatalf("status after the reorg %q, want %q", status, before)
+	}
+	c.quiet()
+}
+
+func TestSlowClientDropped(t *testing.T) {
+	s := &Server{logger: logger.NewDefaultLogger()}
+	client, server := net.Pipe()
+	defer client.Close()
+	c := newConn(s, server)
+	go c.writeLoop()
+
+	// the client reads nothing, so the writer blocks on the first message and the queue fills up
+	for i := 0; i < sendBuffer+2; i++ {
+		c.notify("blockchain.headers.subscribe", tipHeader{Height: int32(i)})
+	}
+	select {
+	case <-c.closed:
+	case <-time.After(time.Second):
+		t.Fatal("a client lagging behind was not dropped")
+	}
+	if err := c.write(map[string]interface{}{"id": 1}); err == nil {
+		t.Fatal("write to a dropped client succeeded")
+	}
+}
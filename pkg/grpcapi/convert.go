@@ -0,0 +1,107 @@
+package grpcapi
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/pkg/grpcapi/pb"
+)
+
+func newBlock(block database.Block) *pb.Block {
+	return &pb.Block{
+		Hash:              string(block.ID),
+		Height:            block.Height,
+		IsOrphan:          block.IsOrphan,
+		PreviousBlock:     string(block.PreviousBlock),
+		Version:           block.Version,
+		Nonce:             block.Nonce,
+		Timestamp:         block.Timestamp,
+		Bits:              block.Bits,
+		MerkleRoot:        string(block.MerkleRoot),
+		Size:              int64(block.Size),
+		StrippedSize:      int64(block.StrippedSize),
+		Weight:            int64(block.Weight),
+		TxCount:           int64(block.TxCount),
+		MedianTime:        block.MedianTime,
+		Difficulty:        block.Difficulty,
+		Subsidy:           block.Subsidy,
+		TotalFees:         block.TotalFees,
+		CoinbaseScript:    string(block.CoinbaseScript),
+		CoinbaseHeight:    block.CoinbaseHeight,
+		WitnessCommitment: string(block.WitnessCommitment),
+	}
+}
+
+func newTransaction(tx database.Transaction) *pb.Transaction {
+	inputs := make([]*pb.Input, len(tx.Inputs))
+	for i, input := range tx.Inputs {
+		inputs[i] = &pb.Input{
+			TxHash:          string(input.TxHash),
+			Index:           input.Index,
+			Sequence:        input.Sequence,
+			SignatureScript: string(input.SignatureScript),
+			Witness:         scripts(input.Witness),
+		}
+	}
+	return &pb.Transaction{
+		Txid:          string(tx.ID),
+		LockTime:      tx.LockTime,
+		Version:       tx.Version,
+		Safe:          tx.Safe,
+		SafeHeight:    tx.SafeHeight,
+		Confirmations: tx.Confirmations,
+		BlockHash:     string(tx.BlockHash),
+		BlockHeight:   tx.BlockHeight,
+		BlockIndex:    tx.BlockIndex,
+		Inputs:        inputs,
+		InputCount:    int64(tx.InputCount),
+		OutputCount:   int64(tx.OutputCount),
+		Size:          int64(tx.Size),
+		Vsize:         int64(tx.VSize),
+		Weight:        int64(tx.Weight),
+		Segwit:        tx.Segwit,
+		Coinbase:      tx.Coinbase,
+		Fee:           tx.Fee,
+	}
+}
+
+func newOutPoint(outPoint database.OutPoint) *pb.OutPoint {
+	return &pb.OutPoint{
+		SpendingTxHash:     string(outPoint.SpendingTxHash),
+		SpendingTxIndex:    outPoint.SpendingTxIndex,
+		SpendingHeight:     outPoint.SpendingHeight,
+		Sequence:           outPoint.Sequence,
+		SignatureScript:    string(outPoint.SignatureScript),
+		SignatureScriptAsm: outPoint.SignatureScriptAsm,
+		Witness:            scripts(outPoint.Witness),
+		RevealedScript:     string(outPoint.RevealedScript),
+		RevealedScriptAsm:  outPoint.RevealedScriptAsm,
+		FundingTxHash:      string(outPoint.FundingTxHash),
+		FundingTxIndex:     outPoint.FundingTxIndex,
+		FundingHeight:      outPoint.FundingHeight,
+		Coinbase:           outPoint.Coinbase,
+		MatureHeight:       outPoint.MatureHeight,
+		PkScript:           string(outPoint.PkScript),
+		PkScriptAsm:        outPoint.PkScriptAsm,
+		ScriptHash:         string(outPoint.ScriptHash),
+		Payload:            outPoint.Payload,
+		PayloadSize:        int64(outPoint.PayloadSize),
+		Value:              outPoint.Value,
+		Owner: &pb.Owner{
+			Address:  outPoint.Owner.Address,
+			PubKeys:  scripts(outPoint.Owner.PubKeys),
+			Required: int64(outPoint.Owner.Required),
+		},
+		Spender: outPoint.Spender,
+		Type:    outPoint.Type,
+	}
+}
+
+func scripts(items []database.Script) []string {
+	if items == nil {
+		return nil
+	}
+	s := make([]string, len(items))
+	for i, item := range items {
+		s[i] = string(item)
+	}
+	return s
+}
@@ -0,0 +1,411 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: indexer.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Indexer_GetTip_FullMethodName                  = "/btcindexer.v1.Indexer/GetTip"
+	Indexer_GetBlock_FullMethodName                = "/btcindexer.v1.Indexer/GetBlock"
+	Indexer_GetTransaction_FullMethodName          = "/btcindexer.v1.Indexer/GetTransaction"
+	Indexer_GetOutPoint_FullMethodName             = "/btcindexer.v1.Indexer/GetOutPoint"
+	Indexer_GetTransactionOutPoints_FullMethodName = "/btcindexer.v1.Indexer/GetTransactionOutPoints"
+	Indexer_SubscribeBlocks_FullMethodName         = "/btcindexer.v1.Indexer/SubscribeBlocks"
+	Indexer_SubscribeTransactions_FullMethodName   = "/btcindexer.v1.Indexer/SubscribeTransactions"
+	Indexer_SubscribeAddress_FullMethodName        = "/btcindexer.v1.Indexer/SubscribeAddress"
+)
+
+// IndexerClient is the client API for Indexer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Indexer serves the indexed best chain. hashes and scripts are hex like in the JSON API
+type IndexerClient interface {
+	GetTip(ctx context.Context, in *GetTipRequest, opts ...grpc.CallOption) (*Block, error)
+	GetBlock(ctx context.Context, in *GetBlockRequest, opts ...grpc.CallOption) (*Block, error)
+	GetTransaction(ctx context.Context, in *GetTransactionRequest, opts ...grpc.CallOption) (*Transaction, error)
+	GetOutPoint(ctx context.Context, in *GetOutPointRequest, opts ...grpc.CallOption) (*OutPoint, error)
+	// GetTransactionOutPoints returns the outputs of a tx in output order
+	GetTransactionOutPoints(ctx context.Context, in *GetTransactionOutPointsRequest, opts ...grpc.CallOption) (*OutPoints, error)
+	// SubscribeBlocks sends the best chain blocks from from_height on, then follows the tip.
+	// blocks leaving the best chain in a reorg are sent again as disconnected before the new branch
+	SubscribeBlocks(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[BlockEvent], error)
+	// SubscribeTransactions sends the txs of the best chain blocks from from_height on in block order
+	SubscribeTransactions(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[TransactionEvent], error)
+	// SubscribeAddress sends the txs funding or spending an address from from_height on
+	SubscribeAddress(ctx context.Context, in *SubscribeAddressRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[AddressEvent], error)
+}
+
+type indexerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewIndexerClient(cc grpc.ClientConnInterface) IndexerClient {
+	return &indexerClient{cc}
+}
+
+func (c *indexerClient) GetTip(ctx context.Context, in *GetTipRequest, opts ...grpc.CallOption) (*Block, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Block)
+	err := c.cc.Invoke(ctx, Indexer_GetTip_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *indexerClient) GetBlock(ctx context.Context, in *GetBlockRequest, opts ...grpc.CallOption) (*Block, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Block)
+	err := c.cc.Invoke(ctx, Indexer_GetBlock_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *indexerClient) GetTransaction(ctx context.Context, in *GetTransactionRequest, opts ...grpc.CallOption) (*Transaction, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Transaction)
+	err := c.cc.Invoke(ctx, Indexer_GetTransaction_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *indexerClient) GetOutPoint(ctx context.Context, in *GetOutPointRequest, opts ...grpc.CallOption) (*OutPoint, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(OutPoint)
+	err := c.cc.Invoke(ctx, Indexer_GetOutPoint_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *indexerClient) GetTransactionOutPoints(ctx context.Context, in *GetTransactionOutPointsRequest, opts ...grpc.CallOption) (*OutPoints, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(OutPoints)
+	err := c.cc.Invoke(ctx, Indexer_GetTransactionOutPoints_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *indexerClient) SubscribeBlocks(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[BlockEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Indexer_ServiceDesc.Streams[0], Indexer_SubscribeBlocks_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SubscribeRequest, BlockEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Indexer_SubscribeBlocksClient = grpc.ServerStreamingClient[BlockEvent]
+
+func (c *indexerClient) SubscribeTransactions(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[TransactionEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Indexer_ServiceDesc.Streams[1], Indexer_SubscribeTransactions_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SubscribeRequest, TransactionEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Indexer_SubscribeTransactionsClient = grpc.ServerStreamingClient[TransactionEvent]
+
+func (c *indexerClient) SubscribeAddress(ctx context.Context, in *SubscribeAddressRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[AddressEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Indexer_ServiceDesc.Streams[2], Indexer_SubscribeAddress_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SubscribeAddressRequest, AddressEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Indexer_SubscribeAddressClient = grpc.ServerStreamingClient[AddressEvent]
+
+// IndexerServer is the server API for Indexer service.
+// All implementations must embed UnimplementedIndexerServer
+// for forward compatibility.
+//
+// Indexer serves the indexed best chain. hashes and scripts are hex like in the JSON API
+type IndexerServer interface {
+	GetTip(context.Context, *GetTipRequest) (*Block, error)
+	GetBlock(context.Context, *GetBlockRequest) (*Block, error)
+	GetTransaction(context.Context, *GetTransactionRequest) (*Transaction, error)
+	GetOutPoint(context.Context, *GetOutPointRequest) (*OutPoint, error)
+	// GetTransactionOutPoints returns the outputs of a tx in output order
+	GetTransactionOutPoints(context.Context, *GetTransactionOutPointsRequest) (*OutPoints, error)
+	// SubscribeBlocks sends the best chain blocks from from_height on, then follows the tip.
+	// blocks leaving the best chain in a reorg are sent again as disconnected before the new branch
+	SubscribeBlocks(*SubscribeRequest, grpc.ServerStreamingServer[BlockEvent]) error
+	// SubscribeTransactions sends the txs of the best chain blocks from from_height on in block order
+	SubscribeTransactions(*SubscribeRequest, grpc.ServerStreamingServer[TransactionEvent]) error
+	// SubscribeAddress sends the txs funding or spending an address from from_height on
+	SubscribeAddress(*SubscribeAddressRequest, grpc.ServerStreamingServer[AddressEvent]) error
+	mustEmbedUnimplementedIndexerServer()
+}
+
+// UnimplementedIndexerServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedIndexerServer struct{}
+
+func (UnimplementedIndexerServer) GetTip(context.Context, *GetTipRequest) (*Block, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTip not implemented")
+}
+func (UnimplementedIndexerServer) GetBlock(context.Context, *GetBlockRequest) (*Block, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlock not implemented")
+}
+func (UnimplementedIndexerServer) GetTransaction(context.Context, *GetTransactionRequest) (*Transaction, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTransaction not implemented")
+}
+func (UnimplementedIndexerServer) GetOutPoint(context.Context, *GetOutPointRequest) (*OutPoint, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetOutPoint not implemented")
+}
+func (UnimplementedIndexerServer) GetTransactionOutPoints(context.Context, *GetTransactionOutPointsRequest) (*OutPoints, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTransactionOutPoints not implemented")
+}
+func (UnimplementedIndexerServer) SubscribeBlocks(*SubscribeRequest, grpc.ServerStreamingServer[BlockEvent]) error {
+	return status.Errorf(codes.Unimplemented, "method SubscribeBlocks not implemented")
+}
+func (UnimplementedIndexerServer) SubscribeTransactions(*SubscribeRequest, grpc.ServerStreamingServer[TransactionEvent]) error {
+	return status.Errorf(codes.Unimplemented, "method SubscribeTransactions not implemented")
+}
+func (UnimplementedIndexerServer) SubscribeAddress(*SubscribeAddressRequest, grpc.ServerStreamingServer[AddressEvent]) error {
+	return status.Errorf(codes.Unimplemented, "method SubscribeAddress not implemented")
+}
+func (UnimplementedIndexerServer) mustEmbedUnimplementedIndexerServer() {}
+func (UnimplementedIndexerServer) testEmbeddedByValue()                 {}
+
+// UnsafeIndexerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to IndexerServer will
+// result in compilation errors.
+type UnsafeIndexerServer interface {
+	mustEmbedUnimplementedIndexerServer()
+}
+
+func RegisterIndexerServer(s grpc.ServiceRegistrar, srv IndexerServer) {
+	// If the following call pancis, it indicates UnimplementedIndexerServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Indexer_ServiceDesc, srv)
+}
+
+func _Indexer_GetTip_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetTipRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IndexerServer).GetTip(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Indexer_GetTip_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IndexerServer).GetTip(ctx, req.(*GetTipRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Indexer_GetBlock_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetBlockRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IndexerServer).GetBlock(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Indexer_GetBlock_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IndexerServer).GetBlock(ctx, req.(*GetBlockRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Indexer_GetTransaction_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetTransactionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IndexerServer).GetTransaction(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Indexer_GetTransaction_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IndexerServer).GetTransaction(ctx, req.(*GetTransactionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Indexer_GetOutPoint_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetOutPointRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IndexerServer).GetOutPoint(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Indexer_GetOutPoint_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IndexerServer).GetOutPoint(ctx, req.(*GetOutPointRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Indexer_GetTransactionOutPoints_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetTransactionOutPointsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IndexerServer).GetTransactionOutPoints(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Indexer_GetTransactionOutPoints_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IndexerServer).GetTransactionOutPoints(ctx, req.(*GetTransactionOutPointsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Indexer_SubscribeBlocks_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(IndexerServer).SubscribeBlocks(m, &grpc.GenericServerStream[SubscribeRequest, BlockEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Indexer_SubscribeBlocksServer = grpc.ServerStreamingServer[BlockEvent]
+
+func _Indexer_SubscribeTransactions_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(IndexerServer).SubscribeTransactions(m, &grpc.GenericServerStream[SubscribeRequest, TransactionEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Indexer_SubscribeTransactionsServer = grpc.ServerStreamingServer[TransactionEvent]
+
+func _Indexer_SubscribeAddress_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeAddressRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(IndexerServer).SubscribeAddress(m, &grpc.GenericServerStream[SubscribeAddressRequest, AddressEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Indexer_SubscribeAddressServer = grpc.ServerStreamingServer[AddressEvent]
+
+// Indexer_ServiceDesc is the grpc.ServiceDesc for Indexer service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Indexer_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "btcindexer.v1.Indexer",
+	HandlerType: (*IndexerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetTip",
+			Handler:    _Indexer_GetTip_Handler,
+		},
+		{
+			MethodName: "GetBlock",
+			Handler:    _Indexer_GetBlock_Handler,
+		},
+		{
+			MethodName: "GetTransaction",
+			Handler:    _Indexer_GetTransaction_Handler,
+		},
+		{
+			MethodName: "GetOutPoint",
+			Handler:    _Indexer_GetOutPoint_Handler,
+		},
+		{
+			MethodName: "GetTransactionOutPoints",
+			Handler:    _Indexer_GetTransactionOutPoints_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SubscribeBlocks",
+			Handler:       _Indexer_SubscribeBlocks_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "SubscribeTransactions",
+			Handler:       _Indexer_SubscribeTransactions_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "SubscribeAddress",
+			Handler:       _Indexer_SubscribeAddress_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "indexer.proto",
+}
@@ -0,0 +1,169 @@
+package grpcapi
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/pkg/grpcapi/pb"
+	"btc-indexer/pkg/logger"
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Server serves the indexed chain over gRPC, next to the HTTP JSON API
+type Server struct {
+	pb.UnimplementedIndexerServer
+
+	store   database.Store
+	address string
+	grpc    *grpc.Server
+	logger  *logger.CustomLogger
+
+	mu      sync.Mutex
+	streams map[chan struct{}]struct{} // the wake channels of the running streams
+}
+
+// NewServer returns a server for store listening on address
+func NewServer(address string, store database.Store) *Server {
+	s := &Server{
+		store:   store,
+		address: address,
+		grpc:    grpc.NewServer(),
+		logger:  logger.NewDefaultLogger(),
+		streams: make(map[chan struct{}]struct{}),
+	}
+	store.Listen(s.publish)
+	pb.RegisterIndexerServer(s.grpc, s)
+	return s
+}
+
+// Start serves until Shutdown is called
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+	s.logger.Info("gRPC server listening on " + s.address)
+	err = s.grpc.Serve(listener)
+	if errors.Is(err, grpc.ErrServerStopped) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting calls and waits for the running ones until ctx is done, then cancels them.
+// streams only end when cancelled
+func (s *Server) Shutdown(ctx context.Context) {
+	stopped := make(chan struct{})
+	go func() {
+		s.grpc.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.grpc.Stop()
+	}
+}
+
+func (s *Server) GetTip(ctx context.Context, req *pb.GetTipRequest) (*pb.Block, error) {
+	height, err := s.store.GetLatestBlockHeight()
+	if err != nil {
+		return nil, s.storeError("tip", err)
+	}
+	block, err := s.store.GetBlockByHeight(ctx, height)
+	if err != nil {
+		return nil, s.storeError("tip", err)
+	}
+	return newBlock(block), nil
+}
+
+func (s *Server) GetBlock(ctx context.Context, req *pb.GetBlockRequest) (*pb.Block, error) {
+	var block database.Block
+	var err error
+	switch id := req.Block.(type) {
+	case *pb.GetBlockRequest_Hash:
+		hash, ok := hashParam(id.Hash)
+		if !ok {
+			return nil, status.Error(codes.InvalidArgument, "expected a 64 character hex block hash")
+		}
+		block, err = s.store.GetBlockByHash(ctx, hash)
+	case *pb.GetBlockRequest_Height:
+		if id.Height < 0 {
+			return nil, status.Error(codes.InvalidArgument, "height must not be negative")
+		}
+		block, err = s.store.GetBlockByHeight(ctx, id.Height)
+	default:
+		return nil, status.Error(codes.InvalidArgument, "expected a block hash or height")
+	}
+	if err != nil {
+		return nil, s.storeError("block", err)
+	}
+	return newBlock(block), nil
+}
+
+func (s *Server) GetTransaction(ctx context.Context, req *pb.GetTransactionRequest) (*pb.Transaction, error) {
+	txHash, ok := hashParam(req.Txid)
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "expected a 64 character hex txid")
+	}
+	tx, err := s.store.GetTx(ctx, txHash)
+	if err != nil {
+		return nil, s.storeError("transaction", err)
+	}
+	return newTransaction(tx), nil
+}
+
+func (s *Server) GetOutPoint(ctx context.Context, req *pb.GetOutPointRequest) (*pb.OutPoint, error) {
+	txHash, ok := hashParam(req.Txid)
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "expected a 64 character hex txid")
+	}
+	outPoint, err := s.store.GetOutPoint(ctx, txHash, req.Index)
+	if err != nil {
+		return nil, s.storeError("outpoint", err)
+	}
+	return newOutPoint(outPoint), nil
+}
+
+func (s *Server) GetTransactionOutPoints(ctx context.Context, req *pb.GetTransactionOutPointsRequest) (*pb.OutPoints, error) {
+	txHash, ok := hashParam(req.Txid)
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "expected a 64 character hex txid")
+	}
+	outPoints, err := s.store.GetOutPointsByTx(ctx, txHash)
+	if err != nil {
+		return nil, s.storeError("outpoints", err)
+	}
+	if len(outPoints) == 0 {
+		return nil, status.Error(codes.NotFound, "outpoints not found")
+	}
+	resp := &pb.OutPoints{OutPoints: make([]*pb.OutPoint, len(outPoints))}
+	for i, outPoint := range outPoints {
+		resp.OutPoints[i] = newOutPoint(outPoint)
+	}
+	return resp, nil
+}
+
+// storeError maps a store error to a status, NotFound for missing documents
+func (s *Server) storeError(what string, err error) error {
+	if errors.Is(err, database.ErrNotFound) {
+		return status.Error(codes.NotFound, what+" not found")
+	}
+	s.logger.Error(err.Error())
+	return status.Error(codes.Internal, "internal error")
+}
+
+// hashParam lowercases a txid or block hash, false when it is not 32 hex bytes
+func hashParam(id string) (string, bool) {
+	if b, err := hex.DecodeString(id); err != nil || len(b) != 32 {
+		return "", false
+	}
+	return strings.ToLower(id), true
+}
@@ -0,0 +1,320 @@
+package grpcapi
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/pkg/grpcapi/pb"
+	"context"
+	"errors"
+	"math"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// eventBatch bounds the journal events read at once
+	eventBatch = 500
+	// keepHeights is how far below the tip a stream remembers what it sent, the store reconnects no deeper reorgs
+	keepHeights = 100
+	// historyPage bounds the address history read at once
+	historyPage = 500
+)
+
+// chainHandler turns best chain changes into the messages of one stream
+type chainHandler interface {
+	// replay sends what the best chain holds from height from to height to, it was indexed before the stream started
+	replay(from, to int32) error
+	connect(block database.Block) error
+	// orphanTx is called for each tx of a sent block leaving the best chain, before disconnect
+	orphanTx(event database.Event) error
+	disconnect(block database.Block) error
+}
+
+// follow replays the best chain from height from and then follows the event journal until the client goes away,
+// a negative from starts after the tip. around a reorg during the replay a block can be sent twice, clients resume by height so they cope
+func (s *Server) follow(ctx context.Context, from int32, handler chainHandler) error {
+	// registered before the journal is read, so no event is written unnoticed
+	wake := s.watch()
+	defer s.unwatch(wake)
+
+	seq, err := s.store.GetLastEventSeq(ctx)
+	if err != nil {
+		return s.storeError("events", err)
+	}
+	tip, err := s.store.GetLatestBlockHeight()
+	if err != nil {
+		return s.storeError("tip", err)
+	}
+	if from < 0 {
+		from = tip + 1
+	}
+
+	// the blocks near the tip as of seq, events after it are compared against them.
+	// the client saw those below from before, the others are replayed
+	sent := make(map[int32]database.Hash)
+	for height := max(0, tip-keepHeights+1); height <= tip; height++ {
+		hash, err := s.store.GetBlockHashByHeight(ctx, height)
+		if err != nil {
+			return s.storeError("block", err)
+		}
+		sent[height] = database.Hash(hash)
+	}
+	if from <= tip {
+		if err := handler.replay(from, tip); err != nil {
+			return err
+		}
+	}
+
+	for {
+		events, err := s.store.GetEvents(ctx, seq, eventBatch)
+		if err != nil {
+			return s.storeError("events", err)
+		}
+		for _, event := range events {
+			seq = event.Seq
+			// below from only what replaces a block the client saw
+			if event.Height < from && event.Height > tip {
+				continue
+			}
+			switch event.Type {
+			case database.EventBlockConnected:
+				if sent[event.Height] == event.BlockHash {
+					continue
+				}
+				block, err := s.store.GetBlockByHash(ctx, string(event.BlockHash))
+				if err != nil {
+					return s.storeError("block", err)
+				}
+				// disconnected again further down the journal, its txs are gone already
+				if block.IsOrphan {
+					continue
+				}
+				if err := handler.connect(block); err != nil {
+					return err
+				}
+				sent[event.Height] = event.BlockHash
+				delete(sent, event.Height-keepHeights)
+			case database.EventTxOrphaned:
+				if sent[event.Height] == event.BlockHash {
+					if err := handler.orphanTx(event); err != nil {
+						return err
+					}
+				}
+			case database.EventBlockDisconnected:
+				if sent[event.Height] != event.BlockHash {
+					continue
+				}
+				block, err := s.store.GetBlockByHash(ctx, string(event.BlockHash))
+				if errors.Is(err, database.ErrNotFound) {
+					block = database.Block{ID: event.BlockHash, Height: event.Height, IsOrphan: true}
+				} else if err != nil {
+					return s.storeError("block", err)
+				}
+				if err := handler.disconnect(block); err != nil {
+					return err
+				}
+				delete(sent, event.Height)
+			}
+		}
+		if len(events) == eventBatch {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-wake:
+		}
+	}
+}
+
+// watch returns a channel woken after every PutBlock of the store
+func (s *Server) watch() chan struct{} {
+	wake := make(chan struct{}, 1)
+	s.mu.Lock()
+	s.streams[wake] = struct{}{}
+	s.mu.Unlock()
+	return wake
+}
+
+func (s *Server) unwatch(wake chan struct{}) {
+	s.mu.Lock()
+	delete(s.streams, wake)
+	s.mu.Unlock()
+}
+
+// publish is the store listener waking the streams, it must not block
+func (s *Server) publish([]database.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for wake := range s.streams {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// fromHeight is the height a stream starts at, unset is after the tip
+func fromHeight(height *int32) int32 {
+	if height == nil {
+		return -1
+	}
+	return *height
+}
+
+func (s *Server) SubscribeBlocks(req *pb.SubscribeRequest, stream pb.Indexer_SubscribeBlocksServer) error {
+	return s.follow(stream.Context(), fromHeight(req.FromHeight), &blockStream{s: s, stream: stream})
+}
+
+func (s *Server) SubscribeTransactions(req *pb.SubscribeRequest, stream pb.Indexer_SubscribeTransactionsServer) error {
+	return s.follow(stream.Context(), fromHeight(req.FromHeight), &txStream{s: s, stream: stream})
+}
+
+func (s *Server) SubscribeAddress(req *pb.SubscribeAddressRequest, stream pb.Indexer_SubscribeAddressServer) error {
+	if req.Address == "" {
+		return status.Error(codes.InvalidArgument, "expected an address")
+	}
+	return s.follow(stream.Context(), fromHeight(req.FromHeight), &addressStream{s: s, stream: stream, address: req.Address, sent: make(map[int32][]database.HistoryItem)})
+}
+
+type blockStream struct {
+	s      *Server
+	stream pb.Indexer_SubscribeBlocksServer
+}
+
+func (b *blockStream) replay(from, to int32) error {
+	for height := from; height <= to; height++ {
+		block, err := b.s.store.GetBlockByHeight(b.stream.Context(), height)
+		if err != nil {
+			return b.s.storeError("block", err)
+		}
+		if err := b.connect(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *blockStream) connect(block database.Block) error {
+	return b.stream.Send(&pb.BlockEvent{Action: pb.ChainAction_CHAIN_ACTION_CONNECTED, Block: newBlock(block)})
+}
+
+func (b *blockStream) orphanTx(event database.Event) error {
+	return nil
+}
+
+func (b *blockStream) disconnect(block database.Block) error {
+	return b.stream.Send(&pb.BlockEvent{Action: pb.ChainAction_CHAIN_ACTION_DISCONNECTED, Block: newBlock(block)})
+}
+
+type txStream struct {
+	s      *Server
+	stream pb.Indexer_SubscribeTransactionsServer
+}
+
+func (t *txStream) replay(from, to int32) error {
+	for height := from; height <= to; height++ {
+		hash, err := t.s.store.GetBlockHashByHeight(t.stream.Context(), height)
+		if err != nil {
+			return t.s.storeError("block", err)
+		}
+		if err := t.send(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *txStream) connect(block database.Block) error {
+	return t.send(string(block.ID))
+}
+
+func (t *txStream) send(blockHash string) error {
+	txs, err := t.s.store.GetBlockTxs(t.stream.Context(), blockHash)
+	if err != nil {
+		return t.s.storeError("transactions", err)
+	}
+	for _, tx := range txs {
+		if err := t.stream.Send(&pb.TransactionEvent{Action: pb.ChainAction_CHAIN_ACTION_CONNECTED, Transaction: newTransaction(tx)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orphanTx sends what is left of the tx, it is deleted with its block
+func (t *txStream) orphanTx(event database.Event) error {
+	return t.stream.Send(&pb.TransactionEvent{
+		Action:      pb.ChainAction_CHAIN_ACTION_DISCONNECTED,
+		Transaction: &pb.Transaction{Txid: string(event.TxHash), BlockHash: string(event.BlockHash), BlockHeight: event.Height},
+	})
+}
+
+func (t *txStream) disconnect(block database.Block) error {
+	return nil
+}
+
+// addressStream remembers the history it sent near the tip, the txs of a disconnected block no longer tell which address they touched
+type addressStream struct {
+	s       *Server
+	stream  pb.Indexer_SubscribeAddressServer
+	address string
+	sent    map[int32][]database.HistoryItem
+}
+
+func (a *addressStream) replay(from, to int32) error {
+	after := &database.Cursor{Height: from - 1, Position: math.MaxUint32}
+	for {
+		history, err := a.s.store.GetAddressHistory(a.stream.Context(), a.address, after, historyPage)
+		if err != nil {
+			return a.s.storeError("address", err)
+		}
+		for _, item := range history {
+			if item.Height > to {
+				return nil
+			}
+			if err := a.send(pb.ChainAction_CHAIN_ACTION_CONNECTED, item); err != nil {
+				return err
+			}
+			if item.Height > to-keepHeights {
+				a.sent[item.Height] = append(a.sent[item.Height], item)
+			}
+		}
+		if len(history) < historyPage {
+			return nil
+		}
+		after = history[len(history)-1].Cursor()
+	}
+}
+
+func (a *addressStream) connect(block database.Block) error {
+	delete(a.sent, block.Height)
+	delete(a.sent, block.Height-keepHeights)
+	return a.replay(block.Height, block.Height)
+}
+
+func (a *addressStream) orphanTx(event database.Event) error {
+	return nil
+}
+
+func (a *addressStream) disconnect(block database.Block) error {
+	items := a.sent[block.Height]
+	for i := len(items) - 1; i >= 0; i-- {
+		if err := a.send(pb.ChainAction_CHAIN_ACTION_DISCONNECTED, items[i]); err != nil {
+			return err
+		}
+	}
+	delete(a.sent, block.Height)
+	return nil
+}
+
+func (a *addressStream) send(action pb.ChainAction, item database.HistoryItem) error {
+	return a.stream.Send(&pb.AddressEvent{
+		Action:   action,
+		Address:  a.address,
+		Txid:     string(item.TxHash),
+		Height:   item.Height,
+		Position: item.Position,
+	})
+}
@@ -0,0 +1,272 @@
+package grpcapi
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/database/storetest"
+	"btc-indexer/pkg/grpcapi/pb"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// followingStore tells when a stream reads the journal, by then it has settled where it starts
+type followingStore struct {
+	database.Store
+	reading chan struct{}
+}
+
+func (s *followingStore) GetEvents(ctx context.Context, since int64, limit int64) ([]database.Event, error) {
+	select {
+	case s.reading <- struct{}{}:
+	default:
+	}
+	return s.Store.GetEvents(ctx, since, limit)
+}
+
+// newTestClient serves a regtest memory store over an in-memory connection
+func newTestClient(t *testing.T) (pb.IndexerClient, *followingStore, *storetest.Chain) {
+	store := &followingStore{Store: database.NewMemoryStore(&chaincfg.RegressionNetParams), reading: make(chan struct{}, 1)}
+	chain := storetest.NewChain(t, store.Store)
+	s := NewServer("", store)
+	listener := bufconn.Listen(1 << 20)
+	go s.grpc.Serve(listener)
+	t.Cleanup(s.grpc.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewIndexerClient(conn), store, chain
+}
+
+// streamContext bounds a stream, a message that does not come fails the test instead of hanging it
+func streamContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// started waits until a stream starting after the tip has settled on it
+func (s *followingStore) started(t *testing.T) {
+	t.Helper()
+	select {
+	case <-s.reading:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream did not start")
+	}
+}
+
+type blockEvents interface {
+	Recv() (*pb.BlockEvent, error)
+}
+
+func expectBlock(t *testing.T, stream blockEvents, action pb.ChainAction, block *wire.MsgBlock, height int32) {
+	t.Helper()
+	event, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v, want %s of block %d", err, action, height)
+	}
+	if event.Action != action || event.Block.Hash != block.BlockHash().String() || event.Block.Height != height {
+		t.Fatalf("got %s of block %d %s, want %s of block %d %s", event.Action, event.Block.Height, event.Block.Hash, action, height, block.BlockHash())
+	}
+}
+
+func TestSubscribeBlocksResume(t *testing.T) {
+	client, _, chain := newTestClient(t)
+	b1 := chain.Block(chain.Genesis())
+	b2 := chain.Block(b1)
+	b3 := chain.Block(b2)
+	chain.Put(b1, b2, b3)
+
+	// the replay up to the tip, then the blocks connected after it
+	stream, err := client.SubscribeBlocks(streamContext(t), &pb.SubscribeRequest{FromHeight: proto.Int32(1)})
+	if err != nil {
+		t.Fatalf("SubscribeBlocks: %v", err)
+	}
+	expectBlock(t, stream, pb.ChainAction_CHAIN_ACTION_CONNECTED, b1, 1)
+	expectBlock(t, stream, pb.ChainAction_CHAIN_ACTION_CONNECTED, b2, 2)
+	expectBlock(t, stream, pb.ChainAction_CHAIN_ACTION_CONNECTED, b3, 3)
+	b4 := chain.Block(b3)
+	chain.Put(b4)
+	expectBlock(t, stream, pb.ChainAction_CHAIN_ACTION_CONNECTED, b4, 4)
+
+	// a client resumes at the height after the last block it saw
+	resumed, err := client.SubscribeBlocks(streamContext(t), &pb.SubscribeRequest{FromHeight: proto.Int32(4)})
+	if err != nil {
+		t.Fatalf("SubscribeBlocks: %v", err)
+	}
+	expectBlock(t, resumed, pb.ChainAction_CHAIN_ACTION_CONNECTED, b4, 4)
+
+	// height 0 is set, it replays from the genesis block
+	genesis, err := client.SubscribeBlocks(streamContext(t), &pb.SubscribeRequest{FromHeight: proto.Int32(0)})
+	if err != nil {
+		t.Fatalf("SubscribeBlocks: %v", err)
+	}
+	expectBlock(t, genesis, pb.ChainAction_CHAIN_ACTION_CONNECTED, chain.Genesis(), 0)
+	expectBlock(t, genesis, pb.ChainAction_CHAIN_ACTION_CONNECTED, b1, 1)
+}
+
+func TestSubscribeBlocksFromTip(t *testing.T) {
+	for name, req := range map[string]*pb.SubscribeRequest{"unset": {}, "negative": {FromHeight: proto.Int32(-1)}} {
+		t.Run(name, func(t *testing.T) {
+			client, store, chain := newTestClient(t)
+			b1 := chain.Block(chain.Genesis())
+			b2 := chain.Block(b1)
+			chain.Put(b1, b2)
+
+			stream, err := client.SubscribeBlocks(streamContext(t), req)
+			if err != nil {
+				t.Fatalf("SubscribeBlocks: %v", err)
+			}
+			store.started(t)
+			b3 := chain.Block(b2)
+			chain.Put(b3)
+			expectBlock(t, stream, pb.ChainAction_CHAIN_ACTION_CONNECTED, b3, 3)
+		})
+	}
+}
+
+// a client resuming above the tip gets nothing below its height
+func TestSubscribeBlocksAhead(t *testing.T) {
+	client, store, chain := newTestClient(t)
+	b1 := chain.Block(chain.Genesis())
+	chain.Put(b1)
+
+	stream, err := client.SubscribeBlocks(streamContext(t), &pb.SubscribeRequest{FromHeight: proto.Int32(3)})
+	if err != nil {
+		t.Fatalf("SubscribeBlocks: %v", err)
+	}
+	store.started(t)
+	b2 := chain.Block(b1)
+	b3 := chain.Block(b2)
+	chain.Put(b2, b3)
+	expectBlock(t, stream, pb.ChainAction_CHAIN_ACTION_CONNECTED, b3, 3)
+}
+
+func TestSubscribeBlocksReorg(t *testing.T) {
+	client, store, chain := newTestClient(t)
+	b1 := chain.Block(chain.Genesis())
+	b2 := chain.Block(b1)
+	chain.Put(b1, b2)
+
+	stream, err := client.SubscribeBlocks(streamContext(t), &pb.SubscribeRequest{})
+	if err != nil {
+		t.Fatalf("SubscribeBlocks: %v", err)
+	}
+	store.started(t)
+
+	// the orphaned block goes first, then the new branch
+	side2 := chain.Block(b1)
+	side3 := chain.Block(side2)
+	chain.Put(side2, side3)
+	expectBlock(t, stream, pb.ChainAction_CHAIN_ACTION_DISCONNECTED, b2, 2)
+	expectBlock(t, stream, pb.ChainAction_CHAIN_ACTION_CONNECTED, side2, 2)
+	expectBlock(t, stream, pb.ChainAction_CHAIN_ACTION_CONNECTED, side3, 3)
+
+	// a stream replaying from below the fork sees the new branch only
+	replay, err := client.SubscribeBlocks(streamContext(t), &pb.SubscribeRequest{FromHeight: proto.Int32(2)})
+	if err != nil {
+		t.Fatalf("SubscribeBlocks: %v", err)
+	}
+	expectBlock(t, replay, pb.ChainAction_CHAIN_ACTION_CONNECTED, side2, 2)
+	expectBlock(t, replay, pb.ChainAction_CHAIN_ACTION_CONNECTED, side3, 3)
+}
+
+func TestSubscribeTransactionsReorg(t *testing.T) {
+	client, _, chain := newTestClient(t)
+	b1 := chain.Block(chain.Genesis())
+	spend := chain.Spend(b1.Transactions[0], 0)
+	b2 := chain.Block(b1, spend)
+	chain.Put(b1, b2)
+
+	stream, err := client.SubscribeTransactions(streamContext(t), &pb.SubscribeRequest{FromHeight: proto.Int32(2)})
+	if err != nil {
+		t.Fatalf("SubscribeTransactions: %v", err)
+	}
+	expect := func(action pb.ChainAction, tx *wire.MsgTx, height int32) {
+		t.Helper()
+		event, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v, want %s of %s", err, action, tx.TxHash())
+		}
+		if event.Action != action || event.Transaction.Txid != tx.TxHash().String() || event.Transaction.BlockHeight != height {
+			t.Fatalf("got %s of %s at %d, want %s of %s at %d", event.Action, event.Transaction.Txid, event.Transaction.BlockHeight, action, tx.TxHash(), height)
+		}
+	}
+	expect(pb.ChainAction_CHAIN_ACTION_CONNECTED, b2.Transactions[0], 2)
+	expect(pb.ChainAction_CHAIN_ACTION_CONNECTED, spend, 2)
+
+	side2 := chain.Block(b1)
+	side3 := chain.Block(side2)
+	chain.Put(side2, side3)
+	// the txs of the orphaned block, in any order
+	orphaned := map[string]bool{b2.Transactions[0].TxHash().String(): true, spend.TxHash().String(): true}
+	for i := len(orphaned); i > 0; i-- {
+		event, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		if event.Action != pb.ChainAction_CHAIN_ACTION_DISCONNECTED || !orphaned[event.Transaction.Txid] || event.Transaction.BlockHash != b2.BlockHash().String() {
+			t.Fatalf("got %s of %s in %s, want the txs of block %s disconnected", event.Action, event.Transaction.Txid, event.Transaction.BlockHash, b2.BlockHash())
+		}
+		delete(orphaned, event.Transaction.Txid)
+	}
+	expect(pb.ChainAction_CHAIN_ACTION_CONNECTED, side2.Transactions[0], 2)
+	expect(pb.ChainAction_CHAIN_ACTION_CONNECTED, side3.Transactions[0], 3)
+}
+
+func TestSubscribeAddress(t *testing.T) {
+	client, _, chain := newTestClient(t)
+	b1 := chain.Block(chain.Genesis())
+	coinbase := b1.Transactions[0]
+	spend := chain.Spend(coinbase, 0)
+	b2 := chain.Block(b1, spend)
+	chain.Put(b1, b2)
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(coinbase.TxOut[0].PkScript, &chaincfg.RegressionNetParams)
+	if err != nil || len(addrs) != 1 {
+		t.Fatalf("address: %v", err)
+	}
+	address := addrs[0].EncodeAddress()
+
+	if _, err := client.SubscribeAddress(streamContext(t), &pb.SubscribeAddressRequest{}); err != nil {
+		t.Fatalf("SubscribeAddress: %v", err)
+	}
+	stream, err := client.SubscribeAddress(streamContext(t), &pb.SubscribeAddressRequest{Address: address, FromHeight: proto.Int32(0)})
+	if err != nil {
+		t.Fatalf("SubscribeAddress: %v", err)
+	}
+	expect := func(action pb.ChainAction, tx *wire.MsgTx, height int32) {
+		t.Helper()
+		event, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v, want %s of %s", err, action, tx.TxHash())
+		}
+		if event.Action != action || event.Address != address || event.Txid != tx.TxHash().String() || event.Height != height {
+			t.Fatalf("got %s of %s at %d, want %s of %s at %d", event.Action, event.Txid, event.Height, action, tx.TxHash(), height)
+		}
+	}
+	// the funding and the spending tx are replayed, then the spend leaves the best chain
+	expect(pb.ChainAction_CHAIN_ACTION_CONNECTED, coinbase, 1)
+	expect(pb.ChainAction_CHAIN_ACTION_CONNECTED, spend, 2)
+	side2 := chain.Block(b1)
+	side3 := chain.Block(side2)
+	chain.Put(side2, side3)
+	expect(pb.ChainAction_CHAIN_ACTION_DISCONNECTED, spend, 2)
+
+	// and comes back in a block of the new branch
+	b4 := chain.Block(side3, spend)
+	chain.Put(b4)
+	expect(pb.ChainAction_CHAIN_ACTION_CONNECTED, spend, 4)
+}
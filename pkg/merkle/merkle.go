@@ -0,0 +1,200 @@
+// Package merkle builds and checks inclusion proofs of txs in blocks, as merkle branches
+// and as BIP37 merkle blocks like the ones of bitcoind's gettxoutproof
+package merkle
+
+import (
+	"btc-indexer/database"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// ErrBadProof is returned by Verify for merkle blocks that do not form a valid partial tree
+var ErrBadProof = errors.New("invalid merkle block")
+
+// Tree is the merkle tree of a block, levels from the txids up to the root
+type Tree [][]chainhash.Hash
+
+// NewTree builds the tree of txids in block order, an odd level pairs its last hash with itself
+func NewTree(txids []chainhash.Hash) Tree {
+	tree := Tree{txids}
+	for level := txids; len(level) > 1; {
+		next := make([]chainhash.Hash, (len(level)+1)/2)
+		for i := range next {
+			next[i] = hashPair(level[2*i], level[min(2*i+1, len(level)-1)])
+		}
+		tree = append(tree, next)
+		level = next
+	}
+	return tree
+}
+
+// Load returns the header and tree of a stored block, checked against its merkle root
+func Load(ctx context.Context, store database.Store, block database.Block) (*wire.BlockHeader, Tree, error) {
+	stored, err := store.GetBlockTxIDs(ctx, string(block.ID))
+	if err != nil {
+		return nil, nil, err
+	}
+	txids := make([]chainhash.Hash, len(stored))
+	for i, txid := range stored {
+		hash, err := chainhash.NewHashFromStr(string(txid))
+		if err != nil {
+			return nil, nil, err
+		}
+		txids[i] = *hash
+	}
+
+	prev, err := chainhash.NewHashFromStr(string(block.PreviousBlock))
+	if err != nil {
+		return nil, nil, err
+	}
+	merkleRoot, err := chainhash.NewHashFromStr(string(block.MerkleRoot))
+	if err != nil {
+		return nil, nil, err
+	}
+	tree := NewTree(txids)
+	if tree.Root() != *merkleRoot {
+		return nil, nil, fmt.Errorf("block %s: stored txids do not match the merkle root", block.ID)
+	}
+	return &wire.BlockHeader{
+		Version:    block.Version,
+		PrevBlock:  *prev,
+		MerkleRoot: *merkleRoot,
+		Timestamp:  time.Unix(block.Timestamp, 0),
+		Bits:       block.Bits,
+		Nonce:      block.Nonce,
+	}, tree, nil
+}
+
+// Root returns the merkle root
+func (t Tree) Root() chainhash.Hash {
+	return t[len(t)-1][0]
+}
+
+// Index returns the position of txid in the block, -1 when it is not in it
+func (t Tree) Index(txid chainhash.Hash) int {
+	for i, hash := range t[0] {
+		if hash == txid {
+			return i
+		}
+	}
+	return -1
+}
+
+// Branch returns the hashes the tx at index is paired with on the way to the root, lowest first.
+// hashing the txid with them, on the left when the index bit of the level is set, gives the root
+func (t Tree) Branch(index int) []chainhash.Hash {
+	branch := make([]chainhash.Hash, 0, len(t)-1)
+	for _, level := range t[:len(t)-1] {
+		branch = append(branch, level[min(index^1, len(level)-1)])
+		index >>= 1
+	}
+	return branch
+}
+
+// MerkleBlock returns the BIP37 merkle block proving the txs at the matched indexes
+func (t Tree) MerkleBlock(header *wire.BlockHeader, matched func(index int) bool) *wire.MsgMerkleBlock {
+	block := wire.NewMsgMerkleBlock(header)
+	block.Transactions = uint32(len(t[0]))
+
+	var bits []bool
+	// traverse walks the tree depth first from the root, descending only above matched txs
+	var traverse func(height, pos int)
+	traverse = func(height, pos int) {
+		match := false
+		for i := pos << height; i < min((pos+1)<<height, len(t[0])) && !match; i++ {
+			match = matched(i)
+		}
+		bits = append(bits, match)
+		if height == 0 || !match {
+			hash := t[height][pos]
+			block.AddTxHash(&hash)
+			return
+		}
+		traverse(height-1, pos*2)
+		if pos*2+1 < len(t[height-1]) {
+			traverse(height-1, pos*2+1)
+		}
+	}
+	traverse(len(t)-1, 0)
+
+	block.Flags = make([]byte, (len(bits)+7)/8)
+	for i, bit := range bits {
+		if bit {
+			block.Flags[i/8] |= 1 << (i % 8)
+		}
+	}
+	return block
+}
+
+// Verify checks the partial tree of a merkle block hashes up to its merkle root and returns the matched txids in block order
+func Verify(block *wire.MsgMerkleBlock) ([]chainhash.Hash, error) {
+	n := int(block.Transactions)
+	if n == 0 || len(block.Hashes) > n || len(block.Flags)*8 < len(block.Hashes) {
+		return nil, ErrBadProof
+	}
+	width := func(height int) int {
+		return (n + 1<<height - 1) >> height
+	}
+	height := 0
+	for width(height) > 1 {
+		height++
+	}
+
+	var matches []chainhash.Hash
+	bitsUsed, hashesUsed := 0, 0
+	var walk func(height, pos int) (chainhash.Hash, error)
+	walk = func(height, pos int) (chainhash.Hash, error) {
+		if bitsUsed >= len(block.Flags)*8 {
+			return chainhash.Hash{}, ErrBadProof
+		}
+		match := block.Flags[bitsUsed/8]&(1<<(bitsUsed%8)) != 0
+		bitsUsed++
+		if height == 0 || !match {
+			if hashesUsed >= len(block.Hashes) {
+				return chainhash.Hash{}, ErrBadProof
+			}
+			hash := *block.Hashes[hashesUsed]
+			hashesUsed++
+			if height == 0 && match {
+				matches = append(matches, hash)
+			}
+			return hash, nil
+		}
+		left, err := walk(height-1, pos*2)
+		if err != nil {
+			return chainhash.Hash{}, err
+		}
+		right := left
+		if pos*2+1 < width(height-1) {
+			if right, err = walk(height-1, pos*2+1); err != nil {
+				return chainhash.Hash{}, err
+			}
+			// identical siblings would let a tx list with duplicates prove the same root, CVE-2012-2459
+			if right == left {
+				return chainhash.Hash{}, ErrBadProof
+			}
+		}
+		return hashPair(left, right), nil
+	}
+
+	root, err := walk(height, 0)
+	if err != nil {
+		return nil, err
+	}
+	if hashesUsed != len(block.Hashes) || (bitsUsed+7)/8 != len(block.Flags) || root != block.Header.MerkleRoot {
+		return nil, ErrBadProof
+	}
+	return matches, nil
+}
+
+func hashPair(left, right chainhash.Hash) chainhash.Hash {
+	var buf [2 * chainhash.HashSize]byte
+	copy(buf[:chainhash.HashSize], left[:])
+	copy(buf[chainhash.HashSize:], right[:])
+	return chainhash.DoubleHashH(buf[:])
+}
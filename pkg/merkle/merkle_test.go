@@ -0,0 +1,234 @@
+package merkle
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/database/storetest"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/bloom"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// leafCounts covers single-tx blocks, odd widths at every level and exact powers of two
+var leafCounts = []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 11, 15, 16, 17, 31, 33, 100}
+
+// testBlock returns a block of n distinct txs with the merkle root btcd computes for them
+func testBlock(n int) *wire.MsgBlock {
+	block := &wire.MsgBlock{Header: wire.BlockHeader{Version: 4, Nonce: uint32(n)}}
+	for i := 0; i < n; i++ {
+		tx := wire.NewMsgTx(wire.TxVersion)
+		tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{byte(i), byte(i >> 8), 1}, uint32(i)), nil, nil))
+		tx.AddTxOut(wire.NewTxOut(int64(i+1)*1000, []byte{0x51}))
+		block.AddTransaction(tx)
+	}
+	block.Header.MerkleRoot = blockchain.CalcMerkleRoot(utilTxs(block), false)
+	return block
+}
+
+func utilTxs(block *wire.MsgBlock) []*btcutil.Tx {
+	txs := make([]*btcutil.Tx, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		txs[i] = btcutil.NewTx(tx)
+	}
+	return txs
+}
+
+func txids(block *wire.MsgBlock) []chainhash.Hash {
+	hashes := make([]chainhash.Hash, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		hashes[i] = tx.TxHash()
+	}
+	return hashes
+}
+
+func TestTree(t *testing.T) {
+	for _, n := range leafCounts {
+		block := testBlock(n)
+		tree := NewTree(txids(block))
+		if tree.Root() != block.Header.MerkleRoot {
+			t.Fatalf("%d txs: root %s, want %s", n, tree.Root(), block.Header.MerkleRoot)
+		}
+
+		// btcd stores the levels one after the other, each padded with nils to half the width of a power of two below
+		store := blockchain.BuildMerkleTreeStore(utilTxs(block), false)
+		offset, width := 0, (len(store)+1)/2
+		for height, level := range tree {
+			for i := 0; i < width; i++ {
+				want := store[offset+i]
+				if i < len(level) && (want == nil || level[i] != *want) {
+					t.Fatalf("%d txs: hash %d of level %d is %s, want %v", n, i, height, level[i], want)
+				}
+				if i >= len(level) && want != nil {
+					t.Fatalf("%d txs: level %d has %d hashes, btcd has more", n, height, len(level))
+				}
+			}
+			offset += width
+			width /= 2
+		}
+		if offset != len(store) {
+			t.Fatalf("%d txs: %d levels, btcd has more", n, len(tree))
+		}
+	}
+}
+
+func TestBranch(t *testing.T) {
+	for _, n := range leafCounts {
+		block := testBlock(n)
+		hashes := txids(block)
+		tree := NewTree(hashes)
+		for index, txid := range hashes {
+			if tree.Index(txid) != index {
+				t.Fatalf("%d txs: Index of tx %d = %d", n, index, tree.Index(txid))
+			}
+			hash := txid
+			for height, sibling := range tree.Branch(index) {
+				if index>>height&1 == 1 {
+					hash = hashPair(sibling, hash)
+				} else {
+					hash = hashPair(hash, sibling)
+				}
+			}
+			if hash != block.Header.MerkleRoot {
+				t.Fatalf("%d txs: branch of tx %d hashes to %s, want %s", n, index, hash, block.Header.MerkleRoot)
+			}
+		}
+		if tree.Index(chainhash.Hash{}) != -1 {
+			t.Fatalf("%d txs: Index of a tx not in the block", n)
+		}
+	}
+}
+
+func TestMerkleBlock(t *testing.T) {
+	patterns := []struct {
+		name    string
+		matched func(index, n int) bool
+	}{
+		{"none", func(index, n int) bool { return false }},
+		{"first", func(index, n int) bool { return index == 0 }},
+		{"last", func(index, n int) bool { return index == n-1 }},
+		{"middle", func(index, n int) bool { return index == n/2 }},
+		{"every third", func(index, n int) bool { return index%3 == 1 }},
+		{"all", func(index, n int) bool { return true }},
+	}
+	for _, n := range leafCounts {
+		for _, pattern := range patterns {
+			t.Run(fmt.Sprintf("%d txs %s", n, pattern.name), func(t *testing.T) {
+				block := testBlock(n)
+				filter := bloom.NewFilter(uint32(n), 0, 0.000001, wire.BloomUpdateNone)
+				for index, tx := range block.Transactions {
+					if pattern.matched(index, n) {
+						hash := tx.TxHash()
+						filter.AddHash(&hash)
+					}
+				}
+				// the matches of bitcoind's algorithm are the reference, false positives included
+				want, indexes := bloom.NewMerkleBlock(btcutil.NewBlock(block), filter)
+				matched := make(map[int]bool, len(indexes))
+				for _, index := range indexes {
+					matched[int(index)] = true
+				}
+
+				got := NewTree(txids(block)).MerkleBlock(&block.Header, func(index int) bool { return matched[index] })
+				if !bytes.Equal(encode(t, got), encode(t, want)) {
+					t.Fatalf("merkle block %+v, want %+v", got, want)
+				}
+
+				matches, err := Verify(got)
+				if err != nil {
+					t.Fatalf("Verify: %v", err)
+				}
+				if len(matches) != len(indexes) {
+					t.Fatalf("Verify matched %d txs, want %d", len(matches), len(indexes))
+				}
+				for i, index := range indexes {
+					if matches[i] != block.Transactions[index].TxHash() {
+						t.Fatalf("match %d is %s, want tx %d", i, matches[i], index)
+					}
+				}
+			})
+		}
+	}
+}
+
+func encode(t *testing.T, block *wire.MsgMerkleBlock) []byte {
+	var buf bytes.Buffer
+	if err := block.BtcEncode(&buf, wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+		t.Fatalf("BtcEncode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestVerifyRejects(t *testing.T) {
+	block := testBlock(5)
+	valid := func() *wire.MsgMerkleBlock {
+		return NewTree(txids(block)).MerkleBlock(&block.Header, func(index int) bool { return index == 2 })
+	}
+
+	// a duplicated last tx hashes to the same root as the block without it
+	cve := testBlock(3)
+	cveTxids := append(txids(cve), cve.Transactions[2].TxHash())
+	if NewTree(cveTxids).Root() != cve.Header.MerkleRoot {
+		t.Fatal("a duplicated last tx changes the root")
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(*wire.MsgMerkleBlock)
+	}{
+		{"no txs", func(mb *wire.MsgMerkleBlock) { mb.Transactions = 0 }},
+		{"other root", func(mb *wire.MsgMerkleBlock) { mb.Header.MerkleRoot = chainhash.Hash{1} }},
+		{"other hash", func(mb *wire.MsgMerkleBlock) { mb.Hashes[0] = &chainhash.Hash{1} }},
+		{"extra hash", func(mb *wire.MsgMerkleBlock) { mb.Hashes = append(mb.Hashes, &chainhash.Hash{1}) }},
+		{"missing hash", func(mb *wire.MsgMerkleBlock) { mb.Hashes = mb.Hashes[:len(mb.Hashes)-1] }},
+		{"more hashes than txs", func(mb *wire.MsgMerkleBlock) { mb.Transactions = 1 }},
+		{"extra flag byte", func(mb *wire.MsgMerkleBlock) { mb.Flags = append(mb.Flags, 0) }},
+		{"no flags", func(mb *wire.MsgMerkleBlock) { mb.Flags = nil }},
+		{"duplicated tx", func(mb *wire.MsgMerkleBlock) {
+			*mb = *NewTree(cveTxids).MerkleBlock(&cve.Header, func(index int) bool { return index == 3 })
+		}},
+	}
+	for _, test := range tests {
+		mb := valid()
+		test.tamper(mb)
+		if _, err := Verify(mb); !errors.Is(err, ErrBadProof) {
+			t.Errorf("%s: Verify = %v, want ErrBadProof", test.name, err)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	ctx := context.Background()
+	store := database.NewMemoryStore(&chaincfg.RegressionNetParams)
+	chain := storetest.NewChain(t, store)
+	b1 := chain.Block(chain.Genesis())
+	b2 := chain.Block(b1, chain.Spend(b1.Transactions[0], 0))
+	chain.Put(b1, b2)
+
+	stored, err := store.GetBlockByHash(ctx, b2.BlockHash().String())
+	if err != nil {
+		t.Fatalf("GetBlockByHash: %v", err)
+	}
+	header, tree, err := Load(ctx, store, stored)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if header.BlockHash() != b2.BlockHash() {
+		t.Fatalf("header hashes to %s, want %s", header.BlockHash(), b2.BlockHash())
+	}
+	if len(tree[0]) != 2 || tree[0][1] != b2.Transactions[1].TxHash() || tree.Root() != b2.Header.MerkleRoot {
+		t.Fatalf("tree %v of block %s", tree, b2.BlockHash())
+	}
+
+	stored.MerkleRoot = database.Hash(b1.Header.MerkleRoot.String())
+	if _, _, err := Load(ctx, store, stored); err == nil {
+		t.Fatal("Load of txids not matching the merkle root succeeded")
+	}
+}
@@ -0,0 +1,804 @@
+package rpc
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/pkg/blockchain"
+	"btc-indexer/pkg/merkle"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// maxTipAge is how old the tip may be before getblockchaininfo reports an initial block download, like bitcoind
+const maxTipAge = 24 * time.Hour
+
+// methods are the supported RPCs with their bitcoind parameter names. only confirmed txs are indexed,
+// so mempool lookups find nothing
+var methods = map[string]method{
+	"getblockchaininfo":  {names: nil, run: (*Server).getBlockchainInfo},
+	"getblockcount":      {names: nil, run: (*Server).getBlockCount},
+	"getblockhash":       {names: []string{"height"}, run: (*Server).getBlockHash},
+	"getblockheader":     {names: []string{"blockhash", "verbose"}, run: (*Server).getBlockHeader},
+	"getblock":           {names: []string{"blockhash", "verbosity"}, run: (*Server).getBlock},
+	"getrawtransaction":  {names: []string{"txid", "verbose", "blockhash"}, run: (*Server).getRawTransaction},
+	"gettxout":           {names: []string{"txid", "n", "include_mempool"}, run: (*Server).getTxOut},
+	"getchaintips":       {names: nil, run: (*Server).getChainTips},
+	"gettxoutproof":      {names: []string{"txids", "blockhash"}, run: (*Server).getTxOutProof},
+	"verifytxoutproof":   {names: []string{"proof"}, run: (*Server).verifyTxOutProof},
+	"sendrawtransaction": {names: []string{"hexstring", "maxfeerate"}, run: (*Server).sendRawTransaction},
+}
+
+// amount is a value in satoshis written in BTC with 8 decimals, like bitcoind writes amounts
+type amount int64
+
+func (a amount) MarshalJSON() ([]byte, error) {
+	sign, v := "", int64(a)
+	if v < 0 {
+		sign, v = "-", -v
+	}
+	return []byte(fmt.Sprintf("%s%d.%08d", sign, v/btcutil.SatoshiPerBitcoin, v%btcutil.SatoshiPerBitcoin)), nil
+}
+
+type blockchainInfo struct {
+	Chain                string  `json:"chain"`
+	Blocks               int32   `json:"blocks"`
+	Headers              int32   `json:"headers"`
+	BestBlockHash        string  `json:"bestblockhash"`
+	Difficulty           float64 `json:"difficulty"`
+	Time                 int64   `json:"time"`
+	MedianTime           int64   `json:"mediantime"`
+	VerificationProgress float64 `json:"verificationprogress"`
+	InitialBlockDownload bool    `json:"initialblockdownload"`
+	Pruned               bool    `json:"pruned"`
+	Warnings             string  `json:"warnings"`
+}
+
+// blockHeader is the verbose getblockheader result, chainwork is not indexed so it is left out
+type blockHeader struct {
+	Hash              string  `json:"hash"`
+	Confirmations     int32   `json:"confirmations"` // -1 off the best chain
+	Height            int32   `json:"height"`
+	Version           int32   `json:"version"`
+	VersionHex        string  `json:"versionHex"`
+	MerkleRoot        string  `json:"merkleroot"`
+	Time              int64   `json:"time"`
+	MedianTime        int64   `json:"mediantime"`
+	Nonce             uint32  `json:"nonce"`
+	Bits              string  `json:"bits"`
+	Difficulty        float64 `json:"difficulty"`
+	NTx               int     `json:"nTx"`
+	PreviousBlockHash string  `json:"previousblockhash,omitempty"`
+	NextBlockHash     string  `json:"nextblockhash,omitempty"`
+}
+
+// block is the getblock result, Tx holds txids at verbosity 1 and rawTxs at verbosity 2
+type block struct {
+	blockHeader
+	StrippedSize int         `json:"strippedsize"`
+	Size         int         `json:"size"`
+	Weight       int         `json:"weight"`
+	Tx           interface{} `json:"tx"`
+}
+
+// rawTx is the verbose getrawtransaction result. inside a getblock result the block fields are left out and the fee is set
+type rawTx struct {
+	InActiveChain *bool   `json:"in_active_chain,omitempty"`
+	Txid          string  `json:"txid"`
+	Hash          string  `json:"hash"`
+	Version       int32   `json:"version"`
+	Size          int     `json:"size"`
+	VSize         int     `json:"vsize"`
+	Weight        int     `json:"weight"`
+	LockTime      uint32  `json:"locktime"`
+	Vin           []vin   `json:"vin"`
+	Vout          []vout  `json:"vout"`
+	Fee           *amount `json:"fee,omitempty"`
+	Hex           string  `json:"hex"`
+	BlockHash     string  `json:"blockhash,omitempty"`
+	Confirmations int32   `json:"confirmations,omitempty"`
+	Time          int64   `json:"time,omitempty"`
+	BlockTime     int64   `json:"blocktime,omitempty"`
+}
+
+// vin is a tx input, coinbase inputs only carry the coinbase script, witness and sequence
+type vin struct {
+	Coinbase  string     `json:"coinbase,omitempty"`
+	Txid      string     `json:"txid,omitempty"`
+	Vout      *uint32    `json:"vout,omitempty"`
+	ScriptSig *scriptSig `json:"scriptSig,omitempty"`
+	Witness   []string   `json:"txinwitness,omitempty"`
+	Sequence  uint32     `json:"sequence"`
+}
+
+type scriptSig struct {
+	Asm string `json:"asm"`
+	Hex string `json:"hex"`
+}
+
+type vout struct {
+	Value        amount       `json:"value"`
+	N            uint32       `json:"n"`
+	ScriptPubKey scriptPubKey `json:"scriptPubKey"`
+}
+
+type scriptPubKey struct {
+	Asm     string `json:"asm"`
+	Hex     string `json:"hex"`
+	Address string `json:"address,omitempty"`
+	Type    string `json:"type"`
+}
+
+type txOut struct {
+	BestBlock     string       `json:"bestblock"`
+	Confirmations int32        `json:"confirmations"`
+	Value         amount       `json:"value"`
+	ScriptPubKey  scriptPubKey `json:"scriptPubKey"`
+	Coinbase      bool         `json:"coinbase"`
+}
+
+type chainTip struct {
+	Height    int32  `json:"height"`
+	Hash      string `json:"hash"`
+	BranchLen int32  `json:"branchlen"`
+	Status    string `json:"status"`
+}
+
+func (s *Server) getBlockchainInfo(ctx context.Context, params []json.RawMessage) (interface{}, error) {
+	tip, err := s.tip(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return blockchainInfo{
+		Chain:                chainName(s.chainParams.Name),
+		Blocks:               tip.Height,
+		Headers:              tip.Height,
+		BestBlockHash:        string(tip.ID),
+		Difficulty:           tip.Difficulty,
+		Time:                 tip.Timestamp,
+		MedianTime:           tip.MedianTime,
+		VerificationProgress: 1,
+		InitialBlockDownload: time.Since(time.Unix(tip.Timestamp, 0)) > maxTipAge,
+		Pruned:               s.pruned,
+	}, nil
+}
+
+func (s *Server) getBlockCount(ctx context.Context, params []json.RawMessage) (interface{}, error) {
+	return s.store.GetLatestBlockHeight()
+}
+
+func (s *Server) getBlockHash(ctx context.Context, params []json.RawMessage) (interface{}, error) {
+	height, err := intParam(params, 0, "height")
+	if err != nil {
+		return nil, err
+	}
+	hash, err := s.store.GetBlockHashByHeight(ctx, height)
+	if errors.Is(err, database.ErrNotFound) {
+		return nil, &rpcError{Code: codeInvalidParameter, Message: "Block height out of range"}
+	}
+	return hash, err
+}
+
+func (s *Server) getBlockHeader(ctx context.Context, params []json.RawMessage) (interface{}, error) {
+	bl, err := s.blockParam(ctx, params, 0)
+	if err != nil {
+		return nil, err
+	}
+	verbose, err := boolParam(params, 1, "verbose", true)
+	if err != nil {
+		return nil, err
+	}
+	if !verbose {
+		header, err := wireHeader(bl)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := header.Serialize(&buf); err != nil {
+			return nil, err
+		}
+		return hex.EncodeToString(buf.Bytes()), nil
+	}
+	return s.newBlockHeader(ctx, bl)
+}
+
+func (s *Server) getBlock(ctx context.Context, params []json.RawMessage) (interface{}, error) {
+	bl, err := s.blockParam(ctx, params, 0)
+	if err != nil {
+		return nil, err
+	}
+	verbosity, err := verbosityParam(params, 1, "verbosity", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	// orphaned and pruned txs are gone, bitcoind has no data for such blocks either
+	txs, err := s.store.GetBlockTxs(ctx, string(bl.ID))
+	if err != nil {
+		return nil, err
+	}
+	if len(txs) != bl.TxCount {
+		return nil, errPrunedBlock
+	}
+
+	if verbosity == 0 {
+		header, err := wireHeader(bl)
+		if err != nil {
+			return nil, err
+		}
+		msg := wire.NewMsgBlock(header)
+		for _, tx := range txs {
+			msgTx, err := s.store.GetMsgTx(ctx, string(tx.ID))
+			if errors.Is(err, database.ErrNotFound) || errors.Is(err, database.ErrIncompleteTx) {
+				return nil, errPrunedBlock
+			}
+			if err != nil {
+				return nil, err
+			}
+			msg.AddTransaction(msgTx)
+		}
+		var buf bytes.Buffer
+		if err := msg.Serialize(&buf); err != nil {
+			return nil, err
+		}
+		return hex.EncodeToString(buf.Bytes()), nil
+	}
+
+	header, err := s.newBlockHeader(ctx, bl)
+	if err != nil {
+		return nil, err
+	}
+	result := block{blockHeader: header, StrippedSize: bl.StrippedSize, Size: bl.Size, Weight: bl.Weight}
+	if verbosity == 1 {
+		txids := make([]string, len(txs))
+		for i, tx := range txs {
+			txids[i] = string(tx.ID)
+		}
+		result.Tx = txids
+		return result, nil
+	}
+	decoded := make([]rawTx, len(txs))
+	for i, tx := range txs {
+		decoded[i], err = s.newRawTx(ctx, tx)
+		if errors.Is(err, database.ErrNotFound) || errors.Is(err, database.ErrIncompleteTx) {
+			return nil, errPrunedBlock
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !tx.Coinbase {
+			fee := amount(tx.Fee)
+			decoded[i].Fee = &fee
+		}
+	}
+	result.Tx = decoded
+	return result, nil
+}
+
+func (s *Server) getRawTransaction(ctx context.Context, params []json.RawMessage) (interface{}, error) {
+	txid, err := hashParam(params, 0, "txid")
+	if err != nil {
+		return nil, err
+	}
+	verbosity, err := verbosityParam(params, 1, "verbose", 0)
+	if err != nil {
+		return nil, err
+	}
+	var inBlock string
+	if hasParam(params, 2) {
+		if inBlock, err = hashParam(params, 2, "blockhash"); err != nil {
+			return nil, err
+		}
+		if _, err := s.store.GetBlockByHash(ctx, inBlock); errors.Is(err, database.ErrNotFound) {
+			return nil, &rpcError{Code: codeInvalidAddress, Message: "Block hash not found"}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := s.store.GetTx(ctx, txid)
+	if err == nil && inBlock != "" && string(tx.BlockHash) != inBlock {
+		err = database.ErrNotFound
+	}
+	if errors.Is(err, database.ErrNotFound) {
+		if inBlock != "" {
+			return nil, &rpcError{Code: codeInvalidAddress, Message: "No such transaction found in the provided block"}
+		}
+		return nil, &rpcError{Code: codeInvalidAddress, Message: "No such mempool or blockchain transaction"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if verbosity == 0 {
+		msgTx, err := s.store.GetMsgTx(ctx, txid)
+		if err != nil {
+			return nil, txError(err)
+		}
+		return serializeTx(msgTx)
+	}
+	result, err := s.newRawTx(ctx, tx)
+	if err != nil {
+		return nil, txError(err)
+	}
+	bl, err := s.store.GetBlockByHash(ctx, string(tx.BlockHash))
+	if err != nil {
+		return nil, err
+	}
+	if inBlock != "" {
+		// orphaned txs are deleted, a tx found in the given block is in the best chain
+		inActiveChain := true
+		result.InActiveChain = &inActiveChain
+	}
+	result.BlockHash = string(tx.BlockHash)
+	result.Confirmations = tx.Confirmations
+	result.Time = bl.Timestamp
+	result.BlockTime = bl.Timestamp
+	return result, nil
+}
+
+// getTxOut is null for outputs that are spent or unknown
+func (s *Server) getTxOut(ctx context.Context, params []json.RawMessage) (interface{}, error) {
+	txid, err := hashParam(params, 0, "txid")
+	if err != nil {
+		return nil, err
+	}
+	n, err := intParam(params, 1, "n")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := boolParam(params, 2, "include_mempool", true); err != nil {
+		return nil, err
+	}
+
+	outPoint, err := s.store.GetOutPoint(ctx, txid, uint32(n))
+	if errors.Is(err, database.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if outPoint.SpendingTxHash != "" {
+		return nil, nil
+	}
+	tip, err := s.tip(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return txOut{
+		BestBlock:     string(tip.ID),
+		Confirmations: tip.Height - outPoint.FundingHeight + 1,
+		Value:         amount(outPoint.Value),
+		ScriptPubKey:  newScriptPubKey(outPoint),
+		Coinbase:      outPoint.Coinbase,
+	}, nil
+}
+
+// getChainTips lists the best chain tip and the tips of the stored forks off it.
+// fork blocks were stored in full but never validated, like bitcoind's valid-headers
+func (s *Server) getChainTips(ctx context.Context, params []json.RawMessage) (interface{}, error) {
+	tip, err := s.tip(ctx)
+	if err != nil {
+		return nil, err
+	}
+	orphans, err := s.store.GetOrphanBlocks(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	byHash := make(map[database.Hash]database.Block, len(orphans))
+	parents := make(map[database.Hash]bool, len(orphans))
+	for _, orphan := range orphans {
+		byHash[orphan.ID] = orphan
+		parents[orphan.PreviousBlock] = true
+	}
+
+	tips := []chainTip{{Height: tip.Height, Hash: string(tip.ID), BranchLen: 0, Status: "active"}}
+	for _, orphan := range orphans {
+		if parents[orphan.ID] {
+			continue
+		}
+		// walk down to the first block of the fork, its parent is on the best chain
+		first := orphan
+		for parent, ok := byHash[first.PreviousBlock]; ok; parent, ok = byHash[first.PreviousBlock] {
+			first = parent
+		}
+		tips = append(tips, chainTip{Height: orphan.Height, Hash: string(orphan.ID), BranchLen: orphan.Height - first.Height + 1, Status: "valid-headers"})
+	}
+	sort.SliceStable(tips, func(i, j int) bool { return tips[i].Height > tips[j].Height })
+	return tips, nil
+}
+
+// getTxOutProof answers the hex BIP37 merkle block proving txids are in one block,
+// the block of the first stored txid when no blockhash is given
+func (s *Server) getTxOutProof(ctx context.Context, params []json.RawMessage) (interface{}, error) {
+	var values []string
+	if !hasParam(params, 0) {
+		return nil, &rpcError{Code: codeMisc, Message: "missing parameter txids"}
+	}
+	if json.Unmarshal(params[0], &values) != nil {
+		return nil, &rpcError{Code: codeType, Message: "txids must be an array of strings"}
+	}
+	if len(values) == 0 {
+		return nil, &rpcError{Code: codeInvalidParameter, Message: "Parameter 'txids' cannot be empty"}
+	}
+	txids := make(map[chainhash.Hash]bool, len(values))
+	for i := range values {
+		value, err := checkHash(values[i], "txid")
+		if err != nil {
+			return nil, err
+		}
+		txid, _ := chainhash.NewHashFromStr(value)
+		if txids[*txid] {
+			return nil, &rpcError{Code: codeInvalidParameter, Message: "Invalid parameter, duplicated txid: " + value}
+		}
+		txids[*txid] = true
+	}
+
+	var bl database.Block
+	var err error
+	if hasParam(params, 1) {
+		if bl, err = s.blockParam(ctx, params, 1); err != nil {
+			return nil, err
+		}
+	} else {
+		err = database.ErrNotFound
+		for _, value := range values {
+			var tx database.Transaction
+			if tx, err = s.store.GetTx(ctx, strings.ToLower(value)); err == nil {
+				bl, err = s.store.GetBlockByHash(ctx, string(tx.BlockHash))
+				break
+			}
+		}
+		if errors.Is(err, database.ErrNotFound) {
+			return nil, &rpcError{Code: codeInvalidAddress, Message: "Transaction not yet in block"}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	header, tree, err := merkle.Load(ctx, s.store, bl)
+	if errors.Is(err, database.ErrNoTxIDs) {
+		return nil, errPrunedBlock
+	}
+	if err != nil {
+		return nil, err
+	}
+	found := 0
+	for _, txid := range tree[0] {
+		if txids[txid] {
+			found++
+		}
+	}
+	if found != len(txids) {
+		return nil, &rpcError{Code: codeInvalidAddress, Message: "Not all transactions found in specified or retrieved block"}
+	}
+
+	proof := tree.MerkleBlock(header, func(i int) bool { return txids[tree[0][i]] })
+	var buf bytes.Buffer
+	if err := proof.BtcEncode(&buf, wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+		return nil, err
+	}
+	return hex.EncodeToString(buf.Bytes()), nil
+}
+
+// verifyTxOutProof answers the txids a proof commits to, nothing when the proof is invalid. its block must be on the best chain
+func (s *Server) verifyTxOutProof(ctx context.Context, params []json.RawMessage) (interface{}, error) {
+	var value string
+	if !hasParam(params, 0) {
+		return nil, &rpcError{Code: codeMisc, Message: "missing parameter proof"}
+	}
+	if json.Unmarshal(params[0], &value) != nil {
+		return nil, &rpcError{Code: codeType, Message: "proof must be a string"}
+	}
+	data, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, &rpcError{Code: codeInvalidParameter, Message: fmt.Sprintf("proof must be hexadecimal string (not '%s')", value)}
+	}
+	var proof wire.MsgMerkleBlock
+	if err := proof.BtcDecode(bytes.NewReader(data), wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+		return nil, &rpcError{Code: codeDeserialization, Message: "proof decode failed"}
+	}
+
+	txids, err := merkle.Verify(&proof)
+	if errors.Is(err, merkle.ErrBadProof) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	bl, err := s.store.GetBlockByHash(ctx, proof.Header.BlockHash().String())
+	if errors.Is(err, database.ErrNotFound) || (err == nil && bl.IsOrphan) {
+		return nil, &rpcError{Code: codeInvalidAddress, Message: "Block not found in chain"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bl.TxCount != int(proof.Transactions) {
+		return []string{}, nil
+	}
+	result := make([]string, len(txids))
+	for i, txid := range txids {
+		result[i] = txid.String()
+	}
+	return result, nil
+}
+
+// sendRawTransaction checks a hex tx against the index and relays it to the connected peers, answering its txid.
+// maxfeerate is accepted but not checked, there is no mempool to price the fee against
+func (s *Server) sendRawTransaction(ctx context.Context, params []json.RawMessage) (interface{}, error) {
+	var value string
+	if !hasParam(params, 0) {
+		return nil, &rpcError{Code: codeMisc, Message: "missing parameter hexstring"}
+	}
+	if json.Unmarshal(params[0], &value) != nil {
+		return nil, &rpcError{Code: codeType, Message: "hexstring must be a string"}
+	}
+	raw, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, &rpcError{Code: codeDeserialization, Message: "TX decode failed"}
+	}
+
+	broadcast, err := s.broadcaster.Broadcast(ctx, raw)
+	var reject *blockchain.RejectError
+	switch {
+	case errors.Is(err, blockchain.ErrTxDecode):
+		return nil, &rpcError{Code: codeDeserialization, Message: err.Error()}
+	case errors.Is(err, blockchain.ErrAlreadyConfirmed):
+		return nil, &rpcError{Code: codeVerifyAlreadyInChain, Message: err.Error()}
+	case errors.As(err, &reject) && reject.MissingInputs:
+		return nil, &rpcError{Code: codeVerifyError, Message: reject.Reason}
+	case errors.As(err, &reject):
+		return nil, &rpcError{Code: codeVerifyRejected, Message: reject.Reason}
+	case err != nil:
+		return nil, err
+	}
+	return broadcast.ID, nil
+}
+
+// errPrunedBlock is the bitcoind error for blocks whose txs are no longer stored
+var errPrunedBlock = &rpcError{Code: codeMisc, Message: "Block not available (pruned data)"}
+
+// txError maps the errors of rebuilding a tx
+func txError(err error) error {
+	if errors.Is(err, database.ErrIncompleteTx) {
+		return &rpcError{Code: codeMisc, Message: "Transaction not fully stored, parts of it were pruned"}
+	}
+	return err
+}
+
+func (s *Server) tip(ctx context.Context) (database.Block, error) {
+	height, err := s.store.GetLatestBlockHeight()
+	if err != nil {
+		return database.Block{}, err
+	}
+	return s.store.GetBlockByHeight(ctx, height)
+}
+
+func (s *Server) newBlockHeader(ctx context.Context, bl database.Block) (blockHeader, error) {
+	header := blockHeader{
+		Hash:          string(bl.ID),
+		Confirmations: -1,
+		Height:        bl.Height,
+		Version:       bl.Version,
+		VersionHex:    fmt.Sprintf("%08x", uint32(bl.Version)),
+		MerkleRoot:    string(bl.MerkleRoot),
+		Time:          bl.Timestamp,
+		MedianTime:    bl.MedianTime,
+		Nonce:         bl.Nonce,
+		Bits:          fmt.Sprintf("%08x", bl.Bits),
+		Difficulty:    bl.Difficulty,
+		NTx:           bl.TxCount,
+	}
+	if bl.Height > 0 {
+		header.PreviousBlockHash = string(bl.PreviousBlock)
+	}
+	if bl.IsOrphan {
+		return header, nil
+	}
+
+	tip, err := s.store.GetLatestBlockHeight()
+	if err != nil {
+		return header, err
+	}
+	header.Confirmations = tip - bl.Height + 1
+	next, err := s.store.GetBlockHashByHeight(ctx, bl.Height+1)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		return header, err
+	}
+	header.NextBlockHash = next
+	return header, nil
+}
+
+// newRawTx decodes tx without the block fields
+func (s *Server) newRawTx(ctx context.Context, tx database.Transaction) (rawTx, error) {
+	msgTx, err := s.store.GetMsgTx(ctx, string(tx.ID))
+	if err != nil {
+		return rawTx{}, err
+	}
+	outPoints, err := s.store.GetOutPointsByTx(ctx, string(tx.ID))
+	if err != nil {
+		return rawTx{}, err
+	}
+	raw, err := serializeTx(msgTx)
+	if err != nil {
+		return rawTx{}, err
+	}
+
+	result := rawTx{
+		Txid:     string(tx.ID),
+		Hash:     msgTx.WitnessHash().String(),
+		Version:  msgTx.Version,
+		Size:     tx.Size,
+		VSize:    tx.VSize,
+		Weight:   tx.Weight,
+		LockTime: msgTx.LockTime,
+		Vin:      make([]vin, len(msgTx.TxIn)),
+		Vout:     make([]vout, len(outPoints)),
+		Hex:      raw,
+	}
+	for i, txIn := range msgTx.TxIn {
+		input := vin{Sequence: txIn.Sequence}
+		for _, item := range txIn.Witness {
+			input.Witness = append(input.Witness, hex.EncodeToString(item))
+		}
+		if tx.Coinbase {
+			input.Coinbase = hex.EncodeToString(txIn.SignatureScript)
+		} else {
+			index := txIn.PreviousOutPoint.Index
+			asm, _ := txscript.DisasmString(txIn.SignatureScript)
+			input.Txid = txIn.PreviousOutPoint.Hash.String()
+			input.Vout = &index
+			input.ScriptSig = &scriptSig{Asm: asm, Hex: hex.EncodeToString(txIn.SignatureScript)}
+		}
+		result.Vin[i] = input
+	}
+	for i, outPoint := range outPoints {
+		result.Vout[i] = vout{Value: amount(outPoint.Value), N: outPoint.FundingTxIndex, ScriptPubKey: newScriptPubKey(outPoint)}
+	}
+	return result, nil
+}
+
+// newScriptPubKey describes the output script, bitcoind gives p2pk outputs no address
+func newScriptPubKey(outPoint database.OutPoint) scriptPubKey {
+	script := scriptPubKey{Asm: outPoint.PkScriptAsm, Hex: string(outPoint.PkScript), Type: outPoint.Type}
+	if outPoint.Type != txscript.PubKeyTy.String() {
+		script.Address = outPoint.Owner.Address
+	}
+	return script
+}
+
+func serializeTx(tx *wire.MsgTx) (string, error) {
+	var buf bytes.Buffer
+	buf.Grow(tx.SerializeSize())
+	if err := tx.Serialize(&buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf.Bytes()), nil
+}
+
+// wireHeader rebuilds the header of bl
+func wireHeader(bl database.Block) (*wire.BlockHeader, error) {
+	prev, err := chainhash.NewHashFromStr(string(bl.PreviousBlock))
+	if err != nil {
+		return nil, err
+	}
+	merkleRoot, err := chainhash.NewHashFromStr(string(bl.MerkleRoot))
+	if err != nil {
+		return nil, err
+	}
+	return &wire.BlockHeader{
+		Version:    bl.Version,
+		PrevBlock:  *prev,
+		MerkleRoot: *merkleRoot,
+		Timestamp:  time.Unix(bl.Timestamp, 0),
+		Bits:       bl.Bits,
+		Nonce:      bl.Nonce,
+	}, nil
+}
+
+// chainName maps btcd network names to the ones of bitcoind
+func chainName(name string) string {
+	switch name {
+	case "mainnet":
+		return "main"
+	case "testnet3":
+		return "test"
+	}
+	return name
+}
+
+func (s *Server) blockParam(ctx context.Context, params []json.RawMessage, i int) (database.Block, error) {
+	hash, err := hashParam(params, i, "blockhash")
+	if err != nil {
+		return database.Block{}, err
+	}
+	bl, err := s.store.GetBlockByHash(ctx, hash)
+	if errors.Is(err, database.ErrNotFound) {
+		return bl, &rpcError{Code: codeInvalidAddress, Message: "Block not found"}
+	}
+	return bl, err
+}
+
+// hasParam tells if the optional param i is given, null counts as left out
+func hasParam(params []json.RawMessage, i int) bool {
+	return i < len(params) && params[i] != nil && string(params[i]) != "null"
+}
+
+func hashParam(params []json.RawMessage, i int, name string) (string, error) {
+	var v string
+	if !hasParam(params, i) {
+		return "", &rpcError{Code: codeMisc, Message: fmt.Sprintf("missing parameter %s", name)}
+	}
+	if json.Unmarshal(params[i], &v) != nil {
+		return "", &rpcError{Code: codeType, Message: fmt.Sprintf("%s must be a string", name)}
+	}
+	return checkHash(v, name)
+}
+
+// checkHash checks v is a block or tx hash and lowercases it
+func checkHash(v, name string) (string, error) {
+	if len(v) != 2*chainhash.HashSize {
+		return "", &rpcError{Code: codeInvalidParameter, Message: fmt.Sprintf("%s must be of length %d (not %d, for '%s')", name, 2*chainhash.HashSize, len(v), v)}
+	}
+	if _, err := hex.DecodeString(v); err != nil {
+		return "", &rpcError{Code: codeInvalidParameter, Message: fmt.Sprintf("%s must be hexadecimal string (not '%s')", name, v)}
+	}
+	return strings.ToLower(v), nil
+}
+
+func intParam(params []json.RawMessage, i int, name string) (int32, error) {
+	var v int32
+	if !hasParam(params, i) {
+		return 0, &rpcError{Code: codeMisc, Message: fmt.Sprintf("missing parameter %s", name)}
+	}
+	if json.Unmarshal(params[i], &v) != nil {
+		return 0, &rpcError{Code: codeType, Message: fmt.Sprintf("%s must be an integer", name)}
+	}
+	if v < 0 {
+		return 0, &rpcError{Code: codeInvalidParameter, Message: fmt.Sprintf("%s must not be negative", name)}
+	}
+	return v, nil
+}
+
+// boolParam is def when the optional param is left out
+func boolParam(params []json.RawMessage, i int, name string, def bool) (bool, error) {
+	if !hasParam(params, i) {
+		return def, nil
+	}
+	var v bool
+	if json.Unmarshal(params[i], &v) != nil {
+		return false, &rpcError{Code: codeType, Message: fmt.Sprintf("%s must be a boolean", name)}
+	}
+	return v, nil
+}
+
+// verbosityParam takes 0, 1, 2 or a boolean for 0 and 1 like older bitcoind versions, def when left out
+func verbosityParam(params []json.RawMessage, i int, name string, def int) (int, error) {
+	if !hasParam(params, i) {
+		return def, nil
+	}
+	var verbose bool
+	if json.Unmarshal(params[i], &verbose) == nil {
+		if verbose {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	var v int
+	if json.Unmarshal(params[i], &v) != nil || v < 0 {
+		return 0, &rpcError{Code: codeType, Message: fmt.Sprintf("%s must be a boolean or a non negative integer", name)}
+	}
+	return min(v, 2), nil
+}
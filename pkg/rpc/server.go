@@ -0,0 +1,258 @@
+package rpc
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/pkg/blockchain"
+	"btc-indexer/pkg/logger"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+const (
+	// maxRequestSize bounds a request body, batches included
+	maxRequestSize = 1 << 20
+	// requestTimeout bounds reading a request, writeTimeout answering it. verbose blocks take a while
+	requestTimeout = 10 * time.Second
+	writeTimeout   = time.Minute
+)
+
+// Server serves a subset of the bitcoind JSON-RPC interface from the index, so bitcoind clients can use it unchanged
+type Server struct {
+	store       database.Store
+	broadcaster *blockchain.Broadcaster
+	chainParams *chaincfg.Params
+	pruned      bool
+	user        [sha256.Size]byte
+	password    [sha256.Size]byte
+	auth        bool
+	http        *http.Server
+	logger      *logger.CustomLogger
+}
+
+// NewServer returns a server for store listening on address. with a user set requests need HTTP basic auth like bitcoind's rpcuser and rpcpassword.
+// pruned is reported by getblockchaininfo, sendrawtransaction relays through broadcaster
+func NewServer(address, user, password string, chainParams *chaincfg.Params, pruned bool, broadcaster *blockchain.Broadcaster, store database.Store) *Server {
+	s := &Server{
+		store:       store,
+		broadcaster: broadcaster,
+		chainParams: chainParams,
+		pruned:      pruned,
+		user:        sha256.Sum256([]byte(user)),
+		password:    sha256.Sum256([]byte(password)),
+		auth:        user != "",
+		logger:      logger.NewDefaultLogger(),
+	}
+	s.http = &http.Server{
+		Addr:              address,
+		Handler:           http.HandlerFunc(s.handle),
+		ReadHeaderTimeout: requestTimeout,
+		ReadTimeout:       requestTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       2 * time.Minute,
+	}
+	return s
+}
+
+// Start serves until Shutdown is called
+func (s *Server) Start() error {
+	s.logger.Info("JSON-RPC server listening on " + s.http.Addr)
+	err := s.http.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting requests and waits for the running ones until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.http.Shutdown(ctx)
+}
+
+type request struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// response is the JSON-RPC 1.0 form bitcoind answers with, result and error are both always present
+type response struct {
+	Result interface{}     `json:"result"`
+	Error  *rpcError       `json:"error"`
+	ID     json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// error codes of bitcoind
+const (
+	codeMisc                 = -1
+	codeType                 = -3
+	codeInvalidAddress       = -5 // also unknown blocks and txs
+	codeInvalidParameter     = -8
+	codeDeserialization      = -22
+	codeVerifyError          = -25 // also missing or spent inputs
+	codeVerifyRejected       = -26
+	codeVerifyAlreadyInChain = -27
+	codeParseError           = -32700
+	codeInvalidRequest       = -32600
+	codeMethodNotFound       = -32601
+	codeInternal             = -32603
+)
+
+// POST / with a request or a batch of them, any path is accepted like bitcoind does for /wallet/<name>
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if s.auth && !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="jsonrpc"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "JSONRPC server handles only POST requests", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var raw interface{}
+	status := http.StatusOK
+	if body = bytes.TrimSpace(body); len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			raw, status = response{Error: &rpcError{Code: codeParseError, Message: "Parse error"}}, http.StatusInternalServerError
+		} else {
+			// every request of a batch has its own error, the batch itself succeeds
+			responses := make([]response, len(batch))
+			for i, req := range batch {
+				responses[i] = s.call(r.Context(), req)
+			}
+			raw = responses
+		}
+	} else {
+		resp := s.call(r.Context(), body)
+		if resp.Error != nil {
+			status = errorStatus(resp.Error.Code)
+		}
+		raw = resp
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		s.logger.Error(err.Error())
+		data, _ = json.Marshal(response{Error: &rpcError{Code: codeInternal, Message: "internal error"}})
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+// authorized checks the basic auth credentials, hashed so the comparison takes the same time whatever their length
+func (s *Server) authorized(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userHash := sha256.Sum256([]byte(user))
+	passwordHash := sha256.Sum256([]byte(password))
+	userOK := subtle.ConstantTimeCompare(userHash[:], s.user[:])
+	passwordOK := subtle.ConstantTimeCompare(passwordHash[:], s.password[:])
+	return userOK&passwordOK == 1
+}
+
+// errorStatus is the HTTP status bitcoind answers a failed single request with
+func errorStatus(code int) int {
+	switch code {
+	case codeInvalidRequest:
+		return http.StatusBadRequest
+	case codeMethodNotFound:
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// call runs one request, params are an array or an object keyed by the parameter names of the method
+func (s *Server) call(ctx context.Context, raw []byte) response {
+	var req request
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return response{Error: &rpcError{Code: codeParseError, Message: "Parse error"}}
+	}
+	if req.Method == "" {
+		return response{ID: req.ID, Error: &rpcError{Code: codeInvalidRequest, Message: "Method must be a string"}}
+	}
+	m, ok := methods[req.Method]
+	if !ok {
+		return response{ID: req.ID, Error: &rpcError{Code: codeMethodNotFound, Message: "Method not found"}}
+	}
+
+	params, err := m.positional(req.Params)
+	if err == nil {
+		var result interface{}
+		if result, err = m.run(s, ctx, params); err == nil {
+			return response{ID: req.ID, Result: result}
+		}
+	}
+	var rpcErr *rpcError
+	if !errors.As(err, &rpcErr) {
+		s.logger.Error(err.Error())
+		rpcErr = &rpcError{Code: codeInternal, Message: "internal error"}
+	}
+	return response{ID: req.ID, Error: rpcErr}
+}
+
+// method is a supported RPC, names are its parameters in order
+type method struct {
+	names []string
+	run   func(s *Server, ctx context.Context, params []json.RawMessage) (interface{}, error)
+}
+
+// positional orders the params of a request by names, trailing params left out are nil
+func (m method) positional(raw json.RawMessage) ([]json.RawMessage, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var params []json.RawMessage
+	if json.Unmarshal(raw, &params) == nil {
+		if len(params) > len(m.names) {
+			return nil, &rpcError{Code: codeMisc, Message: "too many parameters"}
+		}
+		return params, nil
+	}
+	var named map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &named); err != nil {
+		return nil, &rpcError{Code: codeInvalidRequest, Message: "Params must be an array or object"}
+	}
+	params = make([]json.RawMessage, len(m.names))
+	n := 0
+	for i, name := range m.names {
+		if value, ok := named[name]; ok {
+			params[i] = value
+			n = i + 1
+			delete(named, name)
+		}
+	}
+	for name := range named {
+		return nil, &rpcError{Code: codeInvalidParameter, Message: "Unknown named parameter " + name}
+	}
+	return params[:n], nil
+}
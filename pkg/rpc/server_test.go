@@ -0,0 +1,520 @@
+package rpc
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/database/storetest"
+	"btc-indexer/pkg/blockchain"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// testResponse is a response with the result left raw
+type testResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+	ID     json.RawMessage `json:"id"`
+}
+
+// newTestServer serves a regtest memory store, Start is left out as it listens on the configured address
+func newTestServer(t *testing.T) (*Server, database.Store, *storetest.Chain) {
+	store := database.NewMemoryStore(&chaincfg.RegressionNetParams)
+	chain := storetest.NewChain(t, store)
+	s := NewServer("", "", "", &chaincfg.RegressionNetParams, false, blockchain.NewBroadcaster(&chaincfg.RegressionNetParams, store), store)
+	return s, store, chain
+}
+
+// post sends body and returns the HTTP status and the answer
+func post(s *Server, body string) (int, []byte) {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(w, req)
+	return w.Code, w.Body.Bytes()
+}
+
+// call runs method with positional params and returns its response
+func call(t *testing.T, s *Server, method string, params ...interface{}) testResponse {
+	t.Helper()
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, _ := json.Marshal(map[string]interface{}{"id": 1, "method": method, "params": params})
+	status, data := post(s, string(body))
+	var resp testResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatalf("%s: invalid response %s: %v", method, data, err)
+	}
+	if string(resp.ID) != "1" {
+		t.Fatalf("%s: response id %s", method, resp.ID)
+	}
+	if resp.Error == nil && status != http.StatusOK || resp.Error != nil && status != errorStatus(resp.Error.Code) {
+		t.Fatalf("%s: status %d for %s", method, status, data)
+	}
+	return resp
+}
+
+// result runs method, which must succeed, and decodes its result into v
+func result(t *testing.T, s *Server, v interface{}, method string, params ...interface{}) {
+	t.Helper()
+	resp := call(t, s, method, params...)
+	if resp.Error != nil {
+		t.Fatalf("%s %v: error %+v", method, params, resp.Error)
+	}
+	if err := json.Unmarshal(resp.Result, v); err != nil {
+		t.Fatalf("%s %v: result %s: %v", method, params, resp.Result, err)
+	}
+}
+
+// assertError runs method, which must fail with code
+func assertError(t *testing.T, s *Server, code int, method string, params ...interface{}) {
+	t.Helper()
+	resp := call(t, s, method, params...)
+	if resp.Error == nil || resp.Error.Code != code {
+		t.Fatalf("%s %v: result %s, error %+v, want code %d", method, params, resp.Result, resp.Error, code)
+	}
+	if string(resp.Result) != "null" {
+		t.Fatalf("%s %v: result %s next to an error", method, params, resp.Result)
+	}
+}
+
+// UnmarshalJSON reads amounts back, only in the exact form MarshalJSON writes
+func (a *amount) UnmarshalJSON(data []byte) error {
+	var whole, fraction int64
+	if _, err := fmt.Sscanf(string(data), "%d.%08d", &whole, &fraction); err != nil || len(data) < 10 || data[len(data)-9] != '.' {
+		return fmt.Errorf("amount %s", data)
+	}
+	*a = amount(whole*btcutil.SatoshiPerBitcoin + fraction)
+	return nil
+}
+
+func encodeHex(t *testing.T, serialize func(*bytes.Buffer) error) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := serialize(&buf); err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	return hex.EncodeToString(buf.Bytes())
+}
+
+func txHex(t *testing.T, tx *wire.MsgTx) string {
+	return encodeHex(t, func(buf *bytes.Buffer) error { return tx.Serialize(buf) })
+}
+
+func TestHandle(t *testing.T) {
+	s, _, _ := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+		t.Fatalf("GET answered %d", w.Code)
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   int
+	}{
+		{"parse error", `{"method":`, http.StatusInternalServerError, codeParseError},
+		{"batch parse error", `[{"method":"getblockcount"}`, http.StatusInternalServerError, codeParseError},
+		{"no method", `{"id":1,"params":[]}`, http.StatusBadRequest, codeInvalidRequest},
+		{"unknown method", `{"id":1,"method":"getwalletinfo"}`, http.StatusNotFound, codeMethodNotFound},
+		{"params not a list", `{"id":1,"method":"getblockhash","params":"0"}`, http.StatusBadRequest, codeInvalidRequest},
+		{"too many params", `{"id":1,"method":"getblockhash","params":[0,1]}`, http.StatusInternalServerError, codeMisc},
+		{"unknown named param", `{"id":1,"method":"getblockhash","params":{"hight":0}}`, http.StatusInternalServerError, codeInvalidParameter},
+		{"missing param", `{"id":1,"method":"getblockhash"}`, http.StatusInternalServerError, codeMisc},
+	}
+	for _, test := range tests {
+		status, data := post(s, test.body)
+		var resp testResponse
+		if err := json.Unmarshal(data, &resp); err != nil {
+			t.Fatalf("%s: invalid response %s: %v", test.name, data, err)
+		}
+		if status != test.status || resp.Error == nil || resp.Error.Code != test.code {
+			t.Errorf("%s: answered %d %s, want %d with code %d", test.name, status, data, test.status, test.code)
+		}
+	}
+
+	// named params are ordered by the names of the method
+	var hash string
+	status, data := post(s, `{"id":"named","method":"getblockhash","params":{"height":0}}`)
+	var resp testResponse
+	if json.Unmarshal(data, &resp) != nil || json.Unmarshal(resp.Result, &hash) != nil || status != http.StatusOK ||
+		hash != chaincfg.RegressionNetParams.GenesisHash.String() || string(resp.ID) != `"named"` {
+		t.Fatalf("named params answered %d %s", status, data)
+	}
+
+	// a batch succeeds as a whole, each request has its own result or error
+	status, data = post(s, `[{"id":1,"method":"getblockcount"},{"id":2,"method":"nope"},{"id":3,"method":"getblockhash","params":[5]}]`)
+	var batch []testResponse
+	if err := json.Unmarshal(data, &batch); err != nil || status != http.StatusOK || len(batch) != 3 {
+		t.Fatalf("batch answered %d %s", status, data)
+	}
+	if string(batch[0].ID) != "1" || string(batch[0].Result) != "0" || batch[0].Error != nil {
+		t.Fatalf("batch response 1 %+v", batch[0])
+	}
+	if string(batch[1].ID) != "2" || batch[1].Error == nil || batch[1].Error.Code != codeMethodNotFound {
+		t.Fatalf("batch response 2 %+v", batch[1])
+	}
+	if string(batch[2].ID) != "3" || batch[2].Error == nil || batch[2].Error.Code != codeInvalidParameter {
+		t.Fatalf("batch response 3 %+v", batch[2])
+	}
+}
+
+func TestAuth(t *testing.T) {
+	store := database.NewMemoryStore(&chaincfg.RegressionNetParams)
+	storetest.NewChain(t, store)
+	s := NewServer("", "user", "secret", &chaincfg.RegressionNetParams, false, nil, store)
+
+	tests := []struct {
+		name, user, password string
+		status               int
+	}{
+		{"none", "", "", http.StatusUnauthorized},
+		{"wrong password", "user", "guess", http.StatusUnauthorized},
+		{"wrong user", "admin", "secret", http.StatusUnauthorized},
+		{"right", "user", "secret", http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"id":1,"method":"getblockcount"}`))
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.password)
+		}
+		w := httptest.NewRecorder()
+		s.http.Handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s: answered %d, want %d", test.name, w.Code, test.status)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate header", test.name)
+		}
+	}
+}
+
+func TestBlockMethods(t *testing.T) {
+	s, _, chain := newTestServer(t)
+	b1 := chain.Block(chain.Genesis())
+	spend := chain.Spend(b1.Transactions[0], 0)
+	b2 := chain.Block(b1, spend)
+	b3 := chain.Block(b2)
+	side2 := chain.Block(b1)
+	chain.Put(b1, b2, b3, side2)
+
+	var count int32
+	result(t, s, &count, "getblockcount")
+	if count != 3 {
+		t.Fatalf("getblockcount = %d", count)
+	}
+
+	var info blockchainInfo
+	result(t, s, &info, "getblockchaininfo")
+	if info.Chain != "regtest" || info.Blocks != 3 || info.Headers != 3 || info.BestBlockHash != b3.BlockHash().String() ||
+		info.Time != b3.Header.Timestamp.Unix() || !info.InitialBlockDownload || info.Pruned {
+		t.Fatalf("getblockchaininfo = %+v", info)
+	}
+
+	var hash string
+	result(t, s, &hash, "getblockhash", 2)
+	if hash != b2.BlockHash().String() {
+		t.Fatalf("getblockhash 2 = %s", hash)
+	}
+	assertError(t, s, codeInvalidParameter, "getblockhash", 4)
+	assertError(t, s, codeInvalidParameter, "getblockhash", -1)
+	assertError(t, s, codeType, "getblockhash", "2")
+
+	var header blockHeader
+	result(t, s, &header, "getblockheader", b2.BlockHash().String())
+	want := blockHeader{
+		Hash:              b2.BlockHash().String(),
+		Confirmations:     2,
+		Height:            2,
+		Version:           4,
+		VersionHex:        "00000004",
+		MerkleRoot:        b2.Header.MerkleRoot.String(),
+		Time:              b2.Header.Timestamp.Unix(),
+		MedianTime:        header.MedianTime,
+		Nonce:             b2.Header.Nonce,
+		Bits:              "207fffff",
+		Difficulty:        header.Difficulty,
+		NTx:               2,
+		PreviousBlockHash: b1.BlockHash().String(),
+		NextBlockHash:     b3.BlockHash().String(),
+	}
+	if header != want {
+		t.Fatalf("getblockheader = %+v, want %+v", header, want)
+	}
+	header = blockHeader{}
+	result(t, s, &header, "getblockheader", side2.BlockHash().String())
+	if header.Confirmations != -1 || header.NextBlockHash != "" || header.Height != 2 {
+		t.Fatalf("getblockheader of a fork block = %+v", header)
+	}
+	var raw string
+	result(t, s, &raw, "getblockheader", b2.BlockHash().String(), false)
+	if raw != encodeHex(t, func(buf *bytes.Buffer) error { return b2.Header.Serialize(buf) }) {
+		t.Fatalf("getblockheader not verbose = %s", raw)
+	}
+	assertError(t, s, codeInvalidAddress, "getblockheader", strings.Repeat("ab", 32))
+	assertError(t, s, codeInvalidParameter, "getblockheader", "ab")
+	assertError(t, s, codeInvalidParameter, "getblockheader", strings.Repeat("zz", 32))
+	assertError(t, s, codeType, "getblockheader", b2.BlockHash().String(), "yes")
+
+	result(t, s, &raw, "getblock", b2.BlockHash().String(), 0)
+	if raw != encodeHex(t, func(buf *bytes.Buffer) error { return b2.Serialize(buf) }) {
+		t.Fatalf("getblock verbosity 0 = %s", raw)
+	}
+
+	var withTxids struct {
+		blockHeader
+		Tx []string `json:"tx"`
+	}
+	result(t, s, &withTxids, "getblock", strings.ToUpper(b2.BlockHash().String()))
+	if withTxids.Hash != b2.BlockHash().String() || withTxids.Confirmations != 2 || len(withTxids.Tx) != 2 ||
+		withTxids.Tx[0] != b2.Transactions[0].TxHash().String() || withTxids.Tx[1] != spend.TxHash().String() {
+		t.Fatalf("getblock verbosity 1 = %+v", withTxids)
+	}
+	withTxids.NextBlockHash = ""
+	result(t, s, &withTxids, "getblock", b3.BlockHash().String(), true)
+	if len(withTxids.Tx) != 1 || withTxids.NextBlockHash != "" {
+		t.Fatalf("getblock verbose = %+v", withTxids)
+	}
+
+	var withTxs struct {
+		Tx []map[string]json.RawMessage `json:"tx"`
+	}
+	result(t, s, &withTxs, "getblock", b2.BlockHash().String(), 2)
+	if len(withTxs.Tx) != 2 {
+		t.Fatalf("getblock verbosity 2 has %d txs", len(withTxs.Tx))
+	}
+	if _, ok := withTxs.Tx[0]["fee"]; ok {
+		t.Fatalf("coinbase with a fee %s", withTxs.Tx[0]["fee"])
+	}
+	if string(withTxs.Tx[1]["fee"]) != "0.00001000" || string(withTxs.Tx[1]["txid"]) != `"`+spend.TxHash().String()+`"` {
+		t.Fatalf("getblock verbosity 2 tx %v", withTxs.Tx[1])
+	}
+	if _, ok := withTxs.Tx[1]["blockhash"]; ok {
+		t.Fatalf("getblock verbosity 2 tx with block fields %v", withTxs.Tx[1])
+	}
+	assertError(t, s, codeType, "getblock", b2.BlockHash().String(), -1)
+
+	var tips []chainTip
+	result(t, s, &tips, "getchaintips")
+	wantTips := []chainTip{
+		{Height: 3, Hash: b3.BlockHash().String(), BranchLen: 0, Status: "active"},
+		{Height: 2, Hash: side2.BlockHash().String(), BranchLen: 1, Status: "valid-headers"},
+	}
+	if len(tips) != len(wantTips) || tips[0] != wantTips[0] || tips[1] != wantTips[1] {
+		t.Fatalf("getchaintips = %+v, want %+v", tips, wantTips)
+	}
+}
+
+func TestTxMethods(t *testing.T) {
+	s, _, chain := newTestServer(t)
+	b1 := chain.Block(chain.Genesis())
+	spend := chain.Spend(b1.Transactions[0], 0)
+	b2 := chain.Block(b1, spend)
+	b3 := chain.Block(b2)
+	chain.Put(b1, b2, b3)
+	txid := spend.TxHash().String()
+
+	var raw string
+	result(t, s, &raw, "getrawtransaction", txid)
+	if raw != txHex(t, spend) {
+		t.Fatalf("getrawtransaction = %s", raw)
+	}
+
+	var tx rawTx
+	result(t, s, &tx, "getrawtransaction", txid, true)
+	if tx.Txid != txid || tx.Hash != spend.WitnessHash().String() || tx.Hex != txHex(t, spend) || tx.BlockHash != b2.BlockHash().String() ||
+		tx.Confirmations != 2 || tx.Time != b2.Header.Timestamp.Unix() || tx.BlockTime != tx.Time || tx.InActiveChain != nil || tx.Fee != nil {
+		t.Fatalf("getrawtransaction verbose = %+v", tx)
+	}
+	if len(tx.Vin) != 1 || tx.Vin[0].Txid != b1.Transactions[0].TxHash().String() || tx.Vin[0].Vout == nil || *tx.Vin[0].Vout != 0 ||
+		len(tx.Vin[0].Witness) != 2 || tx.Vin[0].Coinbase != "" {
+		t.Fatalf("getrawtransaction vin = %+v", tx.Vin)
+	}
+	if len(tx.Vout) != 2 || tx.Vout[1].N != 1 || int64(tx.Vout[1].Value) != spend.TxOut[1].Value ||
+		tx.Vout[1].ScriptPubKey.Type != "witness_v0_keyhash" || tx.Vout[1].ScriptPubKey.Address == "" {
+		t.Fatalf("getrawtransaction vout = %+v", tx.Vout)
+	}
+	tx = rawTx{}
+	result(t, s, &tx, "getrawtransaction", b1.Transactions[0].TxHash().String(), 1, b1.BlockHash().String())
+	if tx.InActiveChain == nil || !*tx.InActiveChain || tx.Vin[0].Coinbase == "" || tx.Vin[0].Vout != nil || tx.Confirmations != 3 {
+		t.Fatalf("getrawtransaction of a coinbase in its block = %+v", tx)
+	}
+	assertError(t, s, codeInvalidAddress, "getrawtransaction", strings.Repeat("ab", 32))
+	assertError(t, s, codeInvalidAddress, "getrawtransaction", txid, 0, b1.BlockHash().String())
+	assertError(t, s, codeInvalidAddress, "getrawtransaction", txid, 0, strings.Repeat("ab", 32))
+	assertError(t, s, codeType, "getrawtransaction", 1)
+
+	// amounts are BTC with 8 decimals
+	resp := call(t, s, "gettxout", b3.Transactions[0].TxHash().String(), 0)
+	var out map[string]json.RawMessage
+	if err := json.Unmarshal(resp.Result, &out); err != nil || string(out["value"]) != "50.00000000" {
+		t.Fatalf("gettxout = %s, %v", resp.Result, err)
+	}
+	var txOutResult txOut
+	result(t, s, &txOutResult, "gettxout", txid, 1, false)
+	if txOutResult.BestBlock != b3.BlockHash().String() || txOutResult.Confirmations != 2 || int64(txOutResult.Value) != spend.TxOut[1].Value ||
+		txOutResult.Coinbase || txOutResult.ScriptPubKey.Hex != hex.EncodeToString(spend.TxOut[1].PkScript) {
+		t.Fatalf("gettxout = %+v", txOutResult)
+	}
+	result(t, s, &txOutResult, "gettxout", b3.Transactions[0].TxHash().String(), 0)
+	if !txOutResult.Coinbase || txOutResult.Confirmations != 1 {
+		t.Fatalf("gettxout of a coinbase = %+v", txOutResult)
+	}
+	for _, params := range [][]interface{}{{b1.Transactions[0].TxHash().String(), 0}, {txid, 2}, {strings.Repeat("ab", 32), 0}} {
+		if resp := call(t, s, "gettxout", params...); resp.Error != nil || string(resp.Result) != "null" {
+			t.Fatalf("gettxout of a spent or unknown output %v = %s, %+v", params, resp.Result, resp.Error)
+		}
+	}
+	assertError(t, s, codeInvalidParameter, "gettxout", txid, -1)
+}
+
+func TestTxOutProof(t *testing.T) {
+	s, _, chain := newTestServer(t)
+	b1 := chain.Block(chain.Genesis())
+	spend1 := chain.Spend(b1.Transactions[0], 0)
+	spend2 := chain.Spend(spend1, 0)
+	spend3 := chain.Spend(spend1, 1)
+	b2 := chain.Block(b1, spend1, spend2, spend3)
+	side1 := chain.Block(chain.Genesis())
+	chain.Put(b1, b2, side1)
+
+	for _, params := range [][]interface{}{
+		{[]string{spend3.TxHash().String(), spend1.TxHash().String()}},
+		{[]string{spend1.TxHash().String(), spend3.TxHash().String()}, b2.BlockHash().String()},
+	} {
+		var proof string
+		result(t, s, &proof, "gettxoutproof", params...)
+		var txids []string
+		result(t, s, &txids, "verifytxoutproof", proof)
+		// verified txids come in block order
+		if len(txids) != 2 || txids[0] != spend1.TxHash().String() || txids[1] != spend3.TxHash().String() {
+			t.Fatalf("verifytxoutproof of the proof of %v = %v", params, txids)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		code   int
+		params []interface{}
+	}{
+		{"no txids", codeInvalidParameter, []interface{}{[]string{}}},
+		{"txids not a list", codeType, []interface{}{spend1.TxHash().String()}},
+		{"bad txid", codeInvalidParameter, []interface{}{[]string{"ab"}}},
+		{"duplicated txid", codeInvalidParameter, []interface{}{[]string{spend1.TxHash().String(), strings.ToUpper(spend1.TxHash().String())}}},
+		{"unknown txid", codeInvalidAddress, []interface{}{[]string{strings.Repeat("ab", 32)}}},
+		{"txids of two blocks", codeInvalidAddress, []interface{}{[]string{spend1.TxHash().String(), b1.Transactions[0].TxHash().String()}}},
+		{"txid not in the block", codeInvalidAddress, []interface{}{[]string{spend1.TxHash().String()}, b1.BlockHash().String()}},
+		{"unknown block", codeInvalidAddress, []interface{}{[]string{spend1.TxHash().String()}, strings.Repeat("ab", 32)}},
+	}
+	for _, test := range tests {
+		resp := call(t, s, "gettxoutproof", test.params...)
+		if resp.Error == nil || resp.Error.Code != test.code {
+			t.Errorf("gettxoutproof %s: %s, %+v, want code %d", test.name, resp.Result, resp.Error, test.code)
+		}
+	}
+
+	var proof string
+	result(t, s, &proof, "gettxoutproof", []string{side1.Transactions[0].TxHash().String()}, side1.BlockHash().String())
+	assertError(t, s, codeInvalidAddress, "verifytxoutproof", proof)
+
+	// a valid encoding of an invalid proof verifies nothing
+	result(t, s, &proof, "gettxoutproof", []string{spend2.TxHash().String()})
+	data, _ := hex.DecodeString(proof)
+	var mb wire.MsgMerkleBlock
+	if err := mb.BtcDecode(bytes.NewReader(data), wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+		t.Fatalf("BtcDecode: %v", err)
+	}
+	mb.Hashes[0] = &chainhash.Hash{1}
+	var txids []string
+	result(t, s, &txids, "verifytxoutproof", encodeHex(t, func(buf *bytes.Buffer) error { return mb.BtcEncode(buf, wire.ProtocolVersion, wire.BaseEncoding) }))
+	if txids == nil || len(txids) != 0 {
+		t.Fatalf("verifytxoutproof of a tampered proof = %v, want []", txids)
+	}
+	assertError(t, s, codeInvalidParameter, "verifytxoutproof", "zz")
+	assertError(t, s, codeDeserialization, "verifytxoutproof", "00")
+	assertError(t, s, codeType, "verifytxoutproof", 1)
+}
+
+func TestSendRawTransaction(t *testing.T) {
+	s, _, chain := newTestServer(t)
+	b1 := chain.Block(chain.Genesis())
+	spend := chain.Spend(b1.Transactions[0], 0)
+	b2 := chain.Block(b1, spend)
+	chain.Put(b1, b2)
+
+	next := chain.Spend(spend, 0)
+	var txid string
+	result(t, s, &txid, "sendrawtransaction", txHex(t, next))
+	if txid != next.TxHash().String() {
+		t.Fatalf("sendrawtransaction = %s, want %s", txid, next.TxHash())
+	}
+
+	tooMuch := chain.Spend(spend, 1)
+	tooMuch.TxOut[0].Value = spend.TxOut[1].Value
+	tests := []struct {
+		name string
+		code int
+		raw  string
+	}{
+		{"not hex", codeDeserialization, "zz"},
+		{"not a tx", codeDeserialization, "0100"},
+		{"trailing bytes", codeDeserialization, txHex(t, next) + "00"},
+		{"already in chain", codeVerifyAlreadyInChain, txHex(t, spend)},
+		{"spent input", codeVerifyError, txHex(t, chain.Spend(b1.Transactions[0], 0))},
+		{"unknown input", codeVerifyError, txHex(t, chain.Spend(next, 0))},
+		{"outputs exceed inputs", codeVerifyRejected, txHex(t, tooMuch)},
+		{"immature coinbase", codeVerifyRejected, txHex(t, chain.Spend(b2.Transactions[0], 0))},
+		{"coinbase", codeVerifyRejected, txHex(t, b2.Transactions[0])},
+	}
+	for _, test := range tests {
+		resp := call(t, s, "sendrawtransaction", test.raw)
+		if resp.Error == nil || resp.Error.Code != test.code {
+			t.Errorf("sendrawtransaction %s: %s, %+v, want code %d", test.name, resp.Result, resp.Error, test.code)
+		}
+	}
+	assertError(t, s, codeType, "sendrawtransaction", 1)
+	assertError(t, s, codeMisc, "sendrawtransaction")
+}
+
+func TestPrunedBlock(t *testing.T) {
+	s, store, chain := newTestServer(t)
+	store.SetPruneDepth(1)
+	b1 := chain.Block(chain.Genesis())
+	b2 := chain.Block(b1, chain.Spend(b1.Transactions[0], 0))
+	chain.Put(b1, b2)
+	parent := b2
+	for i := 0; i < 100; i++ {
+		parent = chain.Block(parent)
+		chain.Put(parent)
+	}
+
+	// the fully spent coinbase of b1 is gone, its header and txids are not
+	for _, verbosity := range []int{0, 1, 2} {
+		assertError(t, s, codeMisc, "getblock", b1.BlockHash().String(), verbosity)
+	}
+	var header blockHeader
+	result(t, s, &header, "getblockheader", b1.BlockHash().String())
+	if header.NTx != 1 || header.Confirmations != 102 {
+		t.Fatalf("getblockheader of a pruned block = %+v", header)
+	}
+	var proof string
+	result(t, s, &proof, "gettxoutproof", []string{b1.Transactions[0].TxHash().String()}, b1.BlockHash().String())
+	var txids []string
+	result(t, s, &txids, "verifytxoutproof", proof)
+	if len(txids) != 1 || txids[0] != b1.Transactions[0].TxHash().String() {
+		t.Fatalf("verifytxoutproof of a pruned block = %v", txids)
+	}
+}
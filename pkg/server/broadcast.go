@@ -0,0 +1,59 @@
+package server
+
+import (
+	"btc-indexer/pkg/blockchain"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxTxSize bounds a broadcast tx, the size of a standard tx
+const maxTxSize = 400000
+
+// handleBroadcasts submits the hex tx in the body, POST /api/broadcasts.
+// it answers 202 once the tx passed the checks and is queued for relay, its status is then polled
+func (s *Server) handleBroadcasts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "only POST is supported")
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 2*maxTxSize+2))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, "too_large", "tx is too large")
+		return
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(body)))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "body must be a hex encoded tx")
+		return
+	}
+
+	broadcast, err := s.broadcaster.Broadcast(r.Context(), raw)
+	var reject *blockchain.RejectError
+	switch {
+	case errors.Is(err, blockchain.ErrTxDecode):
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+	case errors.Is(err, blockchain.ErrAlreadyConfirmed):
+		writeError(w, http.StatusConflict, "already_confirmed", err.Error())
+	case errors.As(err, &reject):
+		writeError(w, http.StatusBadRequest, "rejected", reject.Reason)
+	case err != nil:
+		s.writeStoreError(w, "broadcast", err)
+	default:
+		w.Header().Set("Location", "/api/broadcasts/"+string(broadcast.ID))
+		writeJSON(w, http.StatusAccepted, broadcast)
+	}
+}
+
+// handleBroadcast serves the status of a broadcast tx, GET /api/broadcasts/{txid}
+func (s *Server) handleBroadcast(w http.ResponseWriter, r *http.Request) {
+	txid, ok := hashParam(w, strings.TrimPrefix(r.URL.Path, "/api/broadcasts/"))
+	if !ok {
+		return
+	}
+	broadcast, err := s.broadcaster.Status(r.Context(), txid)
+	s.writeResult(w, "broadcast", broadcast, err)
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/database/storetest"
+	"btc-indexer/pkg/blockchain"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func newBroadcastServer(t *testing.T) (*Server, *storetest.Chain) {
+	store := database.NewMemoryStore(&chaincfg.RegressionNetParams)
+	chain := storetest.NewChain(t, store)
+	broadcaster := blockchain.NewBroadcaster(&chaincfg.RegressionNetParams, store)
+	return NewServer("", 0, &chaincfg.RegressionNetParams, broadcaster, store), chain
+}
+
+func serializeHex(t *testing.T, tx *wire.MsgTx) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		t.Fatalf("Serialize: %v", err)
+	}
+	return hex.EncodeToString(buf.Bytes())
+}
+
+func TestBroadcasts(t *testing.T) {
+	s, chain := newBroadcastServer(t)
+	b1 := chain.Block(chain.Genesis())
+	spend := chain.Spend(b1.Transactions[0], 0)
+	b2 := chain.Block(b1, spend)
+	chain.Put(b1, b2)
+
+	tx := chain.Spend(spend, 0)
+	txid := tx.TxHash().String()
+	w := serve(s, http.MethodPost, "/api/broadcasts", " "+serializeHex(t, tx)+"\n")
+	var broadcast database.Broadcast
+	if w.Code != http.StatusAccepted || json.Unmarshal(w.Body.Bytes(), &broadcast) != nil {
+		t.Fatalf("POST /api/broadcasts = %d %s", w.Code, w.Body)
+	}
+	if location := w.Header().Get("Location"); location != "/api/broadcasts/"+txid {
+		t.Fatalf("Location %q", location)
+	}
+	if string(broadcast.ID) != txid || broadcast.Status != database.BroadcastPending {
+		t.Fatalf("broadcast %+v", broadcast)
+	}
+	var status database.Broadcast
+	if w := get(t, s, "/api/broadcasts/"+txid, &status); w.Code != http.StatusOK || status.ID != broadcast.ID || status.Status != database.BroadcastPending {
+		t.Fatalf("GET /api/broadcasts/%s = %d %s", txid, w.Code, w.Body)
+	}
+
+	// the status turns confirmed once the tx is indexed
+	chain.Put(chain.Block(b2, tx))
+	if w := get(t, s, "/api/broadcasts/"+txid, &status); w.Code != http.StatusOK || status.Status != database.BroadcastConfirmed {
+		t.Fatalf("GET /api/broadcasts/%s = %d %s", txid, w.Code, w.Body)
+	}
+
+	raw := serializeHex(t, chain.Spend(spend, 1))
+	tooMuch := chain.Spend(spend, 1)
+	tooMuch.TxOut[0].Value = spend.TxOut[1].Value
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+	}{
+		{"not hex", "xyz", http.StatusBadRequest, "bad_request"},
+		{"odd hex", raw[1:], http.StatusBadRequest, "bad_request"},
+		{"empty", "", http.StatusBadRequest, "bad_request"},
+		{"truncated tx", raw[:len(raw)-2], http.StatusBadRequest, "bad_request"},
+		{"trailing bytes", raw + "00", http.StatusBadRequest, "bad_request"},
+		{"outputs exceed inputs", serializeHex(t, tooMuch), http.StatusBadRequest, "rejected"},
+		{"spent input", serializeHex(t, chain.Spend(b1.Transactions[0], 0)), http.StatusBadRequest, "rejected"},
+		{"confirmed", serializeHex(t, tx), http.StatusConflict, "already_confirmed"},
+		{"too large", strings.Repeat("00", maxTxSize+2), http.StatusRequestEntityTooLarge, "too_large"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assertError(t, serve(s, http.MethodPost, "/api/broadcasts", test.body), test.status, test.code)
+		})
+	}
+
+	w = serve(s, http.MethodGet, "/api/broadcasts", "")
+	assertError(t, w, http.StatusMethodNotAllowed, "method_not_allowed")
+	if allow := w.Header().Get("Allow"); allow != "POST" {
+		t.Fatalf("Allow %q", allow)
+	}
+	assertError(t, get(t, s, "/api/broadcasts/"+strings.Repeat("ab", 32), nil), http.StatusNotFound, "not_found")
+	assertError(t, get(t, s, "/api/broadcasts/xyz", nil), http.StatusBadRequest, "bad_request")
+}
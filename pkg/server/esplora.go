@@ -0,0 +1,634 @@
+package server
+
+import (
+	"btc-indexer/database"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// the esplora routes are served under /esplora, so clients take http://host:port/esplora as base url.
+// responses follow the shapes of blockstream's esplora, script asm is btcd's rather than rust-bitcoin's
+// and there is no mempool, every tx is confirmed
+
+// esploraTxsPage is the number of confirmed txs per page of /address/:addr/txs
+const esploraTxsPage = 25
+
+// esploraUTXOLimit caps the utxos /address/:addr/utxo returns like electrs does
+const esploraUTXOLimit = 500
+
+// esploraTypes maps our script classes to esplora's scriptpubkey_type
+var esploraTypes = map[string]string{
+	"pubkey":                "p2pk",
+	"pubkeyhash":            "p2pkh",
+	"scripthash":            "p2sh",
+	"witness_v0_keyhash":    "v0_p2wpkh",
+	"witness_v0_scripthash": "v0_p2wsh",
+	"witness_v1_taproot":    "v1_p2tr",
+	"multisig":              "multisig",
+	"nulldata":              "op_return",
+}
+
+type esploraBlock struct {
+	ID                string  `json:"id"`
+	Height            int32   `json:"height"`
+	Version           int32   `json:"version"`
+	Timestamp         int64   `json:"timestamp"`
+	TxCount           int     `json:"tx_count"`
+	Size              int     `json:"size"`
+	Weight            int     `json:"weight"`
+	MerkleRoot        string  `json:"merkle_root"`
+	PreviousBlockHash *string `json:"previousblockhash"`
+	MedianTime        int64   `json:"mediantime"`
+	Nonce             uint32  `json:"nonce"`
+	Bits              uint32  `json:"bits"`
+	Difficulty        float64 `json:"difficulty"`
+}
+
+type esploraStatus struct {
+	Confirmed   bool   `json:"confirmed"`
+	BlockHeight int32  `json:"block_height"`
+	BlockHash   string `json:"block_hash"`
+	BlockTime   int64  `json:"block_time"`
+}
+
+// MarshalJSON leaves the block fields out of an unconfirmed status only, the genesis block is at height 0
+func (status esploraStatus) MarshalJSON() ([]byte, error) {
+	if !status.Confirmed {
+		return []byte(`{"confirmed":false}`), nil
+	}
+	type confirmed esploraStatus
+	return json.Marshal(confirmed(status))
+}
+
+type esploraOutput struct {
+	ScriptPubKey        string `json:"scriptpubkey"`
+	ScriptPubKeyAsm     string `json:"scriptpubkey_asm"`
+	ScriptPubKeyType    string `json:"scriptpubkey_type"`
+	ScriptPubKeyAddress string `json:"scriptpubkey_address,omitempty"`
+	Value               int64  `json:"value"`
+}
+
+type esploraInput struct {
+	TxID                  string         `json:"txid"`
+	Vout                  uint32         `json:"vout"`
+	Prevout               *esploraOutput `json:"prevout"`
+	ScriptSig             string         `json:"scriptsig"`
+	ScriptSigAsm          string         `json:"scriptsig_asm"`
+	Witness               []string       `json:"witness,omitempty"`
+	IsCoinbase            bool           `json:"is_coinbase"`
+	Sequence              uint32         `json:"sequence"`
+	InnerRedeemScriptAsm  string         `json:"inner_redeemscript_asm,omitempty"`
+	InnerWitnessScriptAsm string         `json:"inner_witnessscript_asm,omitempty"`
+}
+
+type esploraTx struct {
+	TxID     string          `json:"txid"`
+	Version  int32           `json:"version"`
+	LockTime uint32          `json:"locktime"`
+	Vin      []esploraInput  `json:"vin"`
+	Vout     []esploraOutput `json:"vout"`
+	Size     int             `json:"size"`
+	Weight   int             `json:"weight"`
+	Fee      int64           `json:"fee"`
+	Status   esploraStatus   `json:"status"`
+}
+
+type esploraOutSpend struct {
+	Spent  bool           `json:"spent"`
+	TxID   string         `json:"txid,omitempty"`
+	Vin    *uint32        `json:"vin,omitempty"`
+	Status *esploraStatus `json:"status,omitempty"`
+}
+
+type esploraUTXO struct {
+	TxID   string        `json:"txid"`
+	Vout   uint32        `json:"vout"`
+	Status esploraStatus `json:"status"`
+	Value  int64         `json:"value"`
+}
+
+// esploraRequest serves one esplora request, caching the blocks it looks up
+type esploraRequest struct {
+	s       *Server
+	w       http.ResponseWriter
+	ctx     context.Context
+	blocks  map[database.Hash]database.Block
+	heights map[int32]database.Block // best chain blocks
+}
+
+// handleEsplora routes /esplora/...
+func (s *Server) handleEsplora(w http.ResponseWriter, r *http.Request) {
+	req := &esploraRequest{s: s, w: w, ctx: r.Context(), blocks: make(map[database.Hash]database.Block), heights: make(map[int32]database.Block)}
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/esplora/"), "/")
+
+	switch {
+	case len(path) == 2 && path[0] == "block":
+		req.block(path[1])
+	case len(path) == 2 && path[0] == "block-height":
+		req.blockHeight(path[1])
+	case len(path) == 3 && path[0] == "blocks" && path[1] == "tip" && path[2] == "height":
+		req.tipHeight()
+	case len(path) == 3 && path[0] == "blocks" && path[1] == "tip" && path[2] == "hash":
+		req.tipHash()
+	case len(path) == 2 && path[0] == "tx":
+		req.tx(path[1])
+	case len(path) == 3 && path[0] == "tx" && path[2] == "outspends":
+		req.outSpends(path[1])
+	case len(path) == 3 && path[0] == "tx" && path[2] == "merkle-proof":
+		req.merkleProof(path[1])
+	case len(path) == 3 && path[0] == "tx" && path[2] == "merkleblock-proof":
+		req.merkleBlockProof(path[1])
+	case len(path) == 3 && path[0] == "address" && path[2] == "utxo":
+		if address, ok := req.address(path[1]); ok {
+			req.utxos(address)
+		}
+	case len(path) == 3 && path[0] == "address" && path[2] == "txs",
+		len(path) == 4 && path[0] == "address" && path[2] == "txs" && path[3] == "chain":
+		if address, ok := req.address(path[1]); ok {
+			req.addressTxs(address, "")
+		}
+	case len(path) == 5 && path[0] == "address" && path[2] == "txs" && path[3] == "chain":
+		if address, ok := req.address(path[1]); ok {
+			req.addressTxs(address, path[4])
+		}
+	default:
+		req.text(http.StatusNotFound, "Not Found")
+	}
+}
+
+// GET /block/:hash
+func (req *esploraRequest) block(hash string) {
+	if !isHash(hash) {
+		req.text(http.StatusBadRequest, "Invalid hex string")
+		return
+	}
+	block, err := req.s.store.GetBlockByHash(req.ctx, strings.ToLower(hash))
+	if err != nil {
+		req.storeError("Block", err)
+		return
+	}
+	req.json(newEsploraBlock(block))
+}
+
+// GET /block-height/:height answers the hash of the best chain block at height
+func (req *esploraRequest) blockHeight(value string) {
+	height, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || height < 0 {
+		req.text(http.StatusBadRequest, "Invalid height")
+		return
+	}
+	hash, err := req.s.store.GetBlockHashByHeight(req.ctx, int32(height))
+	if err != nil {
+		req.storeError("Block", err)
+		return
+	}
+	req.text(http.StatusOK, hash)
+}
+
+// GET /blocks/tip/height
+func (req *esploraRequest) tipHeight() {
+	height, err := req.s.store.GetLatestBlockHeight()
+	if err != nil {
+		req.storeError("Block", err)
+		return
+	}
+	req.text(http.StatusOK, strconv.Itoa(int(height)))
+}
+
+// GET /blocks/tip/hash
+func (req *esploraRequest) tipHash() {
+	hash, err := req.s.store.GetLatestBlockHash(req.ctx)
+	if err != nil {
+		req.storeError("Block", err)
+		return
+	}
+	req.text(http.StatusOK, hash.String())
+}
+
+// GET /tx/:txid
+func (req *esploraRequest) tx(txid string) {
+	if !isHash(txid) {
+		req.text(http.StatusBadRequest, "Invalid hex string")
+		return
+	}
+	tx, err := req.s.store.GetTx(req.ctx, strings.ToLower(txid))
+	if err != nil {
+		req.storeError("Transaction", err)
+		return
+	}
+	etxs, err := req.newTxs([]database.Transaction{tx})
+	if err != nil {
+		req.storeError("Transaction", err)
+		return
+	}
+	req.json(etxs[0])
+}
+
+// GET /tx/:txid/outspends answers the spend of every output in output order
+func (req *esploraRequest) outSpends(txid string) {
+	if !isHash(txid) {
+		req.text(http.StatusBadRequest, "Invalid hex string")
+		return
+	}
+	tx, err := req.s.store.GetTx(req.ctx, strings.ToLower(txid))
+	if err != nil {
+		req.storeError("Transaction", err)
+		return
+	}
+	outPoints, err := req.s.store.GetOutPointsByTx(req.ctx, string(tx.ID))
+	if err != nil {
+		req.storeError("Transaction", err)
+		return
+	}
+
+	heights := make([]int32, 0, len(outPoints))
+	for _, outPoint := range outPoints {
+		if outPoint.SpendingTxHash != "" {
+			heights = append(heights, outPoint.SpendingHeight)
+		}
+	}
+	if err := req.loadBlocks(heights); err != nil {
+		req.storeError("Transaction", err)
+		return
+	}
+
+	// outputs pruned after their spend are reported spent without details
+	spends := make([]esploraOutSpend, tx.OutputCount)
+	for i := range spends {
+		spends[i].Spent = true
+	}
+	for _, outPoint := range outPoints {
+		if int(outPoint.FundingTxIndex) >= len(spends) {
+			continue
+		}
+		spend := esploraOutSpend{}
+		if outPoint.SpendingTxHash != "" {
+			status, err := req.heightStatus(outPoint.SpendingHeight)
+			if err != nil {
+				req.storeError("Transaction", err)
+				return
+			}
+			vin := outPoint.SpendingTxIndex
+			spend = esploraOutSpend{Spent: true, TxID: string(outPoint.SpendingTxHash), Vin: &vin, Status: &status}
+		}
+		spends[outPoint.FundingTxIndex] = spend
+	}
+	req.json(spends)
+}
+
+// address returns the indexed form of an address of the configured network, other values are answered 400.
+// raw public keys are no addresses to esplora
+func (req *esploraRequest) address(value string) (string, bool) {
+	address, err := btcutil.DecodeAddress(value, req.s.chainParams)
+	if err != nil || isHex(value) || !address.IsForNet(req.s.chainParams) {
+		req.text(http.StatusBadRequest, "Invalid Bitcoin address")
+		return "", false
+	}
+	return address.EncodeAddress(), true
+}
+
+// GET /address/:addr/utxo
+func (req *esploraRequest) utxos(address string) {
+	outPoints, err := req.s.store.GetAddressUTXOs(req.ctx, address, nil, esploraUTXOLimit+1)
+	if err != nil {
+		req.storeError("Address", err)
+		return
+	}
+	if len(outPoints) > esploraUTXOLimit {
+		req.text(http.StatusBadRequest, "Too many unspent outputs")
+		return
+	}
+
+	heights := make([]int32, len(outPoints))
+	for i, outPoint := range outPoints {
+		heights[i] = outPoint.FundingHeight
+	}
+	if err := req.loadBlocks(heights); err != nil {
+		req.storeError("Address", err)
+		return
+	}
+
+	utxos := make([]esploraUTXO, len(outPoints))
+	for i, outPoint := range outPoints {
+		status, err := req.heightStatus(outPoint.FundingHeight)
+		if err != nil {
+			req.storeError("Address", err)
+			return
+		}
+		utxos[i] = esploraUTXO{TxID: string(outPoint.FundingTxHash), Vout: outPoint.FundingTxIndex, Status: status, Value: outPoint.Value}
+	}
+	req.json(utxos)
+}
+
+// GET /address/:addr/txs and /address/:addr/txs/chain/:last_seen_txid, newest first
+func (req *esploraRequest) addressTxs(address, lastSeen string) {
+	var before *database.Cursor
+	if lastSeen != "" {
+		if !isHash(lastSeen) {
+			req.text(http.StatusBadRequest, "Invalid hex string")
+			return
+		}
+		tx, err := req.s.store.GetTx(req.ctx, strings.ToLower(lastSeen))
+		if err != nil {
+			req.storeError("Transaction", err)
+			return
+		}
+		before = &database.Cursor{Height: tx.BlockHeight, Position: tx.BlockIndex, TxHash: tx.ID}
+	}
+
+	history, err := req.s.store.GetAddressHistoryBefore(req.ctx, address, before, esploraTxsPage)
+	if err != nil {
+		req.storeError("Address", err)
+		return
+	}
+	hashes := make([]string, len(history))
+	for i, item := range history {
+		hashes[i] = string(item.TxHash)
+	}
+	stored, err := req.s.store.GetTxs(req.ctx, hashes)
+	if err != nil {
+		req.storeError("Transaction", err)
+		return
+	}
+	byID := make(map[database.Hash]database.Transaction, len(stored))
+	for _, tx := range stored {
+		byID[tx.ID] = tx
+	}
+	// pruned txs are left out
+	txs := make([]database.Transaction, 0, len(history))
+	for _, item := range history {
+		if tx, ok := byID[item.TxHash]; ok {
+			txs = append(txs, tx)
+		}
+	}
+
+	etxs, err := req.newTxs(txs)
+	if err != nil {
+		req.storeError("Transaction", err)
+		return
+	}
+	req.json(etxs)
+}
+
+func newEsploraBlock(block database.Block) esploraBlock {
+	eblock := esploraBlock{
+		ID:         string(block.ID),
+		Height:     block.Height,
+		Version:    block.Version,
+		Timestamp:  block.Timestamp,
+		TxCount:    block.TxCount,
+		Size:       block.Size,
+		Weight:     block.Weight,
+		MerkleRoot: string(block.MerkleRoot),
+		MedianTime: block.MedianTime,
+		Nonce:      block.Nonce,
+		Bits:       block.Bits,
+		Difficulty: block.Difficulty,
+	}
+	if block.Height > 0 {
+		prev := string(block.PreviousBlock)
+		eblock.PreviousBlockHash = &prev
+	}
+	return eblock
+}
+
+// newTxs assembles txs with their outputs and the outpoints they spend, those already pruned are left out.
+// the outpoints and blocks of every tx are looked up at once
+func (req *esploraRequest) newTxs(txs []database.Transaction) ([]esploraTx, error) {
+	hashes := make([]string, len(txs))
+	spending := make([]string, 0, len(txs))
+	heights := make([]int32, len(txs))
+	for i, tx := range txs {
+		hashes[i] = string(tx.ID)
+		// coinbase txs spend the placeholder outpoint, not a prevout
+		if !tx.Coinbase {
+			spending = append(spending, string(tx.ID))
+		}
+		heights[i] = tx.BlockHeight
+	}
+
+	outPoints, err := req.s.store.GetOutPointsByTxs(req.ctx, hashes)
+	if err != nil {
+		return nil, err
+	}
+	outputs := make(map[database.Hash][]database.OutPoint, len(txs))
+	for _, outPoint := range outPoints {
+		outputs[outPoint.FundingTxHash] = append(outputs[outPoint.FundingTxHash], outPoint)
+	}
+	spent := make(map[database.Hash][]database.OutPoint, len(spending))
+	if len(spending) > 0 {
+		outPoints, err := req.s.store.GetOutPointsSpentByTxs(req.ctx, spending)
+		if err != nil {
+			return nil, err
+		}
+		for _, outPoint := range outPoints {
+			spent[outPoint.SpendingTxHash] = append(spent[outPoint.SpendingTxHash], outPoint)
+		}
+	}
+	if err := req.loadBlocks(heights); err != nil {
+		return nil, err
+	}
+
+	etxs := make([]esploraTx, len(txs))
+	for i, tx := range txs {
+		status, err := req.blockStatus(tx.BlockHash)
+		if err != nil {
+			return nil, err
+		}
+		etxs[i] = newEsploraTx(tx, outputs[tx.ID], spent[tx.ID], status)
+	}
+	return etxs, nil
+}
+
+// newEsploraTx assembles tx from its outputs and the outpoints it spends
+func newEsploraTx(tx database.Transaction, outPoints, spent []database.OutPoint, status esploraStatus) esploraTx {
+	etx := esploraTx{
+		TxID:     string(tx.ID),
+		Version:  tx.Version,
+		LockTime: tx.LockTime,
+		Vin:      make([]esploraInput, len(tx.Inputs)),
+		Vout:     make([]esploraOutput, 0, len(outPoints)),
+		Size:     tx.Size,
+		Weight:   tx.Weight,
+		Fee:      tx.Fee,
+		Status:   status,
+	}
+	for i, input := range tx.Inputs {
+		etx.Vin[i] = esploraInput{TxID: string(input.TxHash), Vout: input.Index}
+		if tx.Coinbase {
+			etx.Vin[i].IsCoinbase = true
+			etx.Vin[i].Sequence = input.Sequence
+			etx.Vin[i].ScriptSig = string(input.SignatureScript)
+			etx.Vin[i].ScriptSigAsm = scriptAsm(input.SignatureScript)
+			etx.Vin[i].Witness = scriptStrings(input.Witness)
+		}
+	}
+	for _, outPoint := range spent {
+		if int(outPoint.SpendingTxIndex) < len(etx.Vin) {
+			fillInput(&etx.Vin[outPoint.SpendingTxIndex], outPoint)
+		}
+	}
+	for _, outPoint := range outPoints {
+		etx.Vout = append(etx.Vout, newEsploraOutput(outPoint))
+	}
+	return etx
+}
+
+// fillInput sets the spend details stored on the spent outpoint
+func fillInput(input *esploraInput, outPoint database.OutPoint) {
+	prevout := newEsploraOutput(outPoint)
+	input.Prevout = &prevout
+	input.Sequence = outPoint.Sequence
+	input.ScriptSig = string(outPoint.SignatureScript)
+	input.ScriptSigAsm = outPoint.SignatureScriptAsm
+	input.Witness = scriptStrings(outPoint.Witness)
+
+	switch prevout.ScriptPubKeyType {
+	case "p2sh":
+		sigScript, _ := outPoint.SignatureScript.Bytes()
+		pushes, _ := txscript.PushedData(sigScript)
+		if len(pushes) == 0 {
+			return
+		}
+		redeemScript := pushes[len(pushes)-1]
+		input.InnerRedeemScriptAsm, _ = txscript.DisasmString(redeemScript)
+		// nested p2wsh reveals its witness script, nested p2wpkh the redeem script again
+		if len(outPoint.Witness) > 0 && outPoint.RevealedScriptAsm != input.InnerRedeemScriptAsm {
+			input.InnerWitnessScriptAsm = outPoint.RevealedScriptAsm
+		}
+	case "v0_p2wsh", "v1_p2tr":
+		input.InnerWitnessScriptAsm = outPoint.RevealedScriptAsm
+	}
+}
+
+func newEsploraOutput(outPoint database.OutPoint) esploraOutput {
+	output := esploraOutput{
+		ScriptPubKey:     string(outPoint.PkScript),
+		ScriptPubKeyAsm:  outPoint.PkScriptAsm,
+		ScriptPubKeyType: "unknown",
+		Value:            outPoint.Value,
+	}
+	if scriptType, ok := esploraTypes[outPoint.Type]; ok {
+		output.ScriptPubKeyType = scriptType
+	}
+	// esplora has no address for p2pk, we give them the p2pkh one
+	if outPoint.Type != "pubkey" {
+		output.ScriptPubKeyAddress = outPoint.Owner.Address
+	}
+	return output
+}
+
+func (req *esploraRequest) getBlock(hash database.Hash) (database.Block, error) {
+	if block, ok := req.blocks[hash]; ok {
+		return block, nil
+	}
+	block, err := req.s.store.GetBlockByHash(req.ctx, string(hash))
+	if err != nil {
+		return block, err
+	}
+	req.blocks[hash] = block
+	return block, nil
+}
+
+func (req *esploraRequest) blockStatus(hash database.Hash) (esploraStatus, error) {
+	block, err := req.getBlock(hash)
+	if err != nil {
+		return esploraStatus{}, err
+	}
+	return esploraStatus{Confirmed: true, BlockHeight: block.Height, BlockHash: string(block.ID), BlockTime: block.Timestamp}, nil
+}
+
+// loadBlocks caches the best chain blocks at heights with one lookup
+func (req *esploraRequest) loadBlocks(heights []int32) error {
+	missing := make([]int32, 0, len(heights))
+	for _, height := range heights {
+		if _, ok := req.heights[height]; !ok {
+			missing = append(missing, height)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	blocks, err := req.s.store.GetBlocksByHeights(req.ctx, missing)
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		req.heights[block.Height] = block
+		req.blocks[block.ID] = block
+	}
+	return nil
+}
+
+func (req *esploraRequest) heightStatus(height int32) (esploraStatus, error) {
+	if err := req.loadBlocks([]int32{height}); err != nil {
+		return esploraStatus{}, err
+	}
+	block, ok := req.heights[height]
+	if !ok {
+		return esploraStatus{}, database.ErrNotFound
+	}
+	return req.blockStatus(block.ID)
+}
+
+func (req *esploraRequest) json(body interface{}) {
+	writeJSON(req.w, http.StatusOK, body)
+}
+
+// text answers like esplora does for plain values and errors
+func (req *esploraRequest) text(status int, body string) {
+	req.w.Header().Set("Content-Type", "text/plain")
+	req.w.WriteHeader(status)
+	fmt.Fprint(req.w, body)
+}
+
+func (req *esploraRequest) storeError(what string, err error) {
+	if errors.Is(err, database.ErrNotFound) {
+		req.text(http.StatusNotFound, what+" not found")
+		return
+	}
+	if isCancelled(err) {
+		req.text(http.StatusServiceUnavailable, "Request timed out")
+		return
+	}
+	req.s.logger.Error(err.Error())
+	req.text(http.StatusInternalServerError, "Internal error")
+}
+
+func scriptAsm(script database.Script) string {
+	data, err := script.Bytes()
+	if err != nil {
+		return ""
+	}
+	asm, _ := txscript.DisasmString(data)
+	return asm
+}
+
+func scriptStrings(scripts []database.Script) []string {
+	if len(scripts) == 0 {
+		return nil
+	}
+	items := make([]string, len(scripts))
+	for i, script := range scripts {
+		items[i] = string(script)
+	}
+	return items
+}
+
+// isHex tells if value is a hex string, odd lengths included
+func isHex(value string) bool {
+	if len(value)%2 == 1 {
+		value += "0"
+	}
+	_, err := hex.DecodeString(value)
+	return value != "" && err == nil
+}
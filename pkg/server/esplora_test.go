@@ -0,0 +1,296 @@
+package server
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/database/storetest"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// countingStore counts the lookups the esplora handlers make
+type countingStore struct {
+	database.Store
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (s *countingStore) count(method string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[method]++
+}
+
+func (s *countingStore) reset() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	calls := s.calls
+	s.calls = make(map[string]int)
+	return calls
+}
+
+func (s *countingStore) GetTx(ctx context.Context, hash string) (database.Transaction, error) {
+	s.count("GetTx")
+	return s.Store.GetTx(ctx, hash)
+}
+
+func (s *countingStore) GetTxs(ctx context.Context, hashes []string) ([]database.Transaction, error) {
+	s.count("GetTxs")
+	return s.Store.GetTxs(ctx, hashes)
+}
+
+func (s *countingStore) GetOutPointsByTx(ctx context.Context, fundingTxHash string) ([]database.OutPoint, error) {
+	s.count("GetOutPointsByTx")
+	return s.Store.GetOutPointsByTx(ctx, fundingTxHash)
+}
+
+func (s *countingStore) GetOutPointsByTxs(ctx context.Context, fundingTxHashes []string) ([]database.OutPoint, error) {
+	s.count("GetOutPointsByTxs")
+	return s.Store.GetOutPointsByTxs(ctx, fundingTxHashes)
+}
+
+func (s *countingStore) GetOutPointsSpentBy(ctx context.Context, spendingTxHash string) ([]database.OutPoint, error) {
+	s.count("GetOutPointsSpentBy")
+	return s.Store.GetOutPointsSpentBy(ctx, spendingTxHash)
+}
+
+func (s *countingStore) GetOutPointsSpentByTxs(ctx context.Context, spendingTxHashes []string) ([]database.OutPoint, error) {
+	s.count("GetOutPointsSpentByTxs")
+	return s.Store.GetOutPointsSpentByTxs(ctx, spendingTxHashes)
+}
+
+func (s *countingStore) GetBlockByHash(ctx context.Context, hash string) (database.Block, error) {
+	s.count("GetBlockByHash")
+	return s.Store.GetBlockByHash(ctx, hash)
+}
+
+func (s *countingStore) GetBlockHashByHeight(ctx context.Context, height int32) (string, error) {
+	s.count("GetBlockHashByHeight")
+	return s.Store.GetBlockHashByHeight(ctx, height)
+}
+
+func (s *countingStore) GetBlocksByHeights(ctx context.Context, heights []int32) ([]database.Block, error) {
+	s.count("GetBlocksByHeights")
+	return s.Store.GetBlocksByHeights(ctx, heights)
+}
+
+// newCountingServer serves a regtest memory store, its lookups counted
+func newCountingServer(t *testing.T) (*Server, *countingStore, *storetest.Chain) {
+	store := &countingStore{Store: database.NewMemoryStore(&chaincfg.RegressionNetParams), calls: make(map[string]int)}
+	chain := storetest.NewChain(t, store.Store)
+	return NewServer("", 0, &chaincfg.RegressionNetParams, nil, store), store, chain
+}
+
+func assertText(t *testing.T, s *Server, path string, status int, body string) {
+	t.Helper()
+	w := get(t, s, path, nil)
+	if w.Code != status || w.Body.String() != body {
+		t.Fatalf("GET %s = %d %q, want %d %q", path, w.Code, w.Body, status, body)
+	}
+}
+
+func TestEsploraBlocks(t *testing.T) {
+	s, _, chain := newTestServer(t)
+	b1 := chain.Block(chain.Genesis())
+	b2 := chain.Block(b1)
+	chain.Put(b1, b2)
+
+	var block esploraBlock
+	if w := get(t, s, "/esplora/block/"+b2.BlockHash().String(), &block); w.Code != http.StatusOK {
+		t.Fatalf("GET block = %d %s", w.Code, w.Body)
+	}
+	if block.ID != b2.BlockHash().String() || block.Height != 2 || block.TxCount != 1 || block.PreviousBlockHash == nil ||
+		*block.PreviousBlockHash != b1.BlockHash().String() || block.Timestamp != b2.Header.Timestamp.Unix() {
+		t.Fatalf("block %+v", block)
+	}
+	var genesis esploraBlock
+	get(t, s, "/esplora/block/"+chain.Genesis().BlockHash().String(), &genesis)
+	if genesis.Height != 0 || genesis.PreviousBlockHash != nil {
+		t.Fatalf("genesis block %+v, want no previous block", genesis)
+	}
+
+	assertText(t, s, "/esplora/block-height/1", http.StatusOK, b1.BlockHash().String())
+	assertText(t, s, "/esplora/blocks/tip/height", http.StatusOK, "2")
+	assertText(t, s, "/esplora/blocks/tip/hash", http.StatusOK, b2.BlockHash().String())
+
+	assertText(t, s, "/esplora/block/xyz", http.StatusBadRequest, "Invalid hex string")
+	assertText(t, s, "/esplora/block/"+strings.Repeat("ab", 32), http.StatusNotFound, "Block not found")
+	assertText(t, s, "/esplora/block-height/3", http.StatusNotFound, "Block not found")
+	assertText(t, s, "/esplora/block-height/-1", http.StatusBadRequest, "Invalid height")
+	assertText(t, s, "/esplora/blocks/tip", http.StatusNotFound, "Not Found")
+}
+
+func TestEsploraTx(t *testing.T) {
+	s, _, chain := newTestServer(t)
+	b1 := chain.Block(chain.Genesis())
+	coinbase := b1.Transactions[0]
+	spend := chain.Spend(coinbase, 0)
+	b2 := chain.Block(b1, spend)
+	chain.Put(b1, b2)
+
+	var tx esploraTx
+	if w := get(t, s, "/esplora/tx/"+spend.TxHash().String(), &tx); w.Code != http.StatusOK {
+		t.Fatalf("GET tx = %d %s", w.Code, w.Body)
+	}
+	wantStatus := esploraStatus{Confirmed: true, BlockHeight: 2, BlockHash: b2.BlockHash().String(), BlockTime: b2.Header.Timestamp.Unix()}
+	if tx.TxID != spend.TxHash().String() || tx.Fee != 1000 || tx.Status != wantStatus || len(tx.Vin) != 1 || len(tx.Vout) != 2 {
+		t.Fatalf("tx %+v", tx)
+	}
+	vin := tx.Vin[0]
+	if vin.TxID != coinbase.TxHash().String() || vin.Vout != 0 || vin.IsCoinbase || vin.Prevout == nil ||
+		vin.Prevout.Value != coinbase.TxOut[0].Value || vin.Prevout.ScriptPubKeyType != "v0_p2wpkh" ||
+		vin.Prevout.ScriptPubKeyAddress != address(t, coinbase.TxOut[0].PkScript) || len(vin.Witness) != 2 {
+		t.Fatalf("vin %+v, prevout %+v", vin, vin.Prevout)
+	}
+	for i, out := range tx.Vout {
+		if out.Value != spend.TxOut[i].Value || out.ScriptPubKeyAddress != address(t, spend.TxOut[i].PkScript) {
+			t.Fatalf("vout %d %+v", i, out)
+		}
+	}
+
+	var cb esploraTx
+	get(t, s, "/esplora/tx/"+coinbase.TxHash().String(), &cb)
+	if len(cb.Vin) != 1 || !cb.Vin[0].IsCoinbase || cb.Vin[0].Prevout != nil || cb.Status.BlockHeight != 1 {
+		t.Fatalf("coinbase tx %+v", cb)
+	}
+
+	var spends []esploraOutSpend
+	get(t, s, "/esplora/tx/"+coinbase.TxHash().String()+"/outspends", &spends)
+	if len(spends) != 1 || !spends[0].Spent || spends[0].TxID != spend.TxHash().String() || spends[0].Vin == nil || *spends[0].Vin != 0 ||
+		spends[0].Status == nil || *spends[0].Status != wantStatus {
+		t.Fatalf("outspends %+v", spends)
+	}
+	spends = nil
+	get(t, s, "/esplora/tx/"+spend.TxHash().String()+"/outspends", &spends)
+	if len(spends) != 2 || spends[0] != (esploraOutSpend{}) || spends[1] != (esploraOutSpend{}) {
+		t.Fatalf("outspends of unspent outputs %+v", spends)
+	}
+
+	assertText(t, s, "/esplora/tx/abc", http.StatusBadRequest, "Invalid hex string")
+	assertText(t, s, "/esplora/tx/"+strings.Repeat("ab", 32), http.StatusNotFound, "Transaction not found")
+	assertText(t, s, "/esplora/tx/"+strings.Repeat("ab", 32)+"/outspends", http.StatusNotFound, "Transaction not found")
+}
+
+func TestEsploraAddress(t *testing.T) {
+	s, store, chain := newCountingServer(t)
+	b1 := chain.Block(chain.Genesis())
+	// every tx pays the same address and spends its output 1 of the one before
+	pkScript := chain.Spend(b1.Transactions[0], 0).TxOut[0].PkScript
+	addr := address(t, pkScript)
+	blocks := []*wire.MsgBlock{b1}
+	txs := []*wire.MsgTx{pay(b1.Transactions[0], 0, pkScript)}
+	for i := 1; i < esploraTxsPage+5; i++ {
+		txs = append(txs, pay(txs[i-1], 1, pkScript))
+	}
+	for _, tx := range txs {
+		blocks = append(blocks, chain.Block(blocks[len(blocks)-1], tx))
+	}
+	chain.Put(blocks...)
+	store.reset()
+
+	// newest first, a page at a time
+	var page []esploraTx
+	get(t, s, "/esplora/address/"+addr+"/txs", &page)
+	if len(page) != esploraTxsPage {
+		t.Fatalf("first page has %d txs, want %d", len(page), esploraTxsPage)
+	}
+	for i, tx := range page {
+		want := txs[len(txs)-1-i]
+		if tx.TxID != want.TxHash().String() || tx.Status.BlockHeight != int32(len(txs)-i+1) || len(tx.Vout) != 2 || tx.Vin[0].Prevout == nil {
+			t.Fatalf("tx %d of the first page %+v, want %s", i, tx, want.TxHash())
+		}
+	}
+
+	// the lookups do not grow with the number of txs
+	calls := store.reset()
+	want := map[string]int{"GetTxs": 1, "GetOutPointsByTxs": 1, "GetOutPointsSpentByTxs": 1, "GetBlocksByHeights": 1}
+	if len(calls) != len(want) {
+		t.Fatalf("lookups %v, want %v", calls, want)
+	}
+	for method, n := range want {
+		if calls[method] != n {
+			t.Fatalf("lookups %v, want %v", calls, want)
+		}
+	}
+
+	last := page[len(page)-1].TxID
+	page = nil
+	get(t, s, "/esplora/address/"+addr+"/txs/chain/"+last, &page)
+	if len(page) != len(txs)-esploraTxsPage {
+		t.Fatalf("second page has %d txs, want %d", len(page), len(txs)-esploraTxsPage)
+	}
+	if page[len(page)-1].TxID != txs[0].TxHash().String() {
+		t.Fatalf("second page ends with %s, want the oldest tx %s", page[len(page)-1].TxID, txs[0].TxHash())
+	}
+	page = nil
+	get(t, s, "/esplora/address/"+addr+"/txs/chain/"+txs[0].TxHash().String(), &page)
+	if len(page) != 0 {
+		t.Fatalf("page after the oldest tx %+v", page)
+	}
+
+	// output 0 of every tx is unspent, so is output 1 of the last one
+	store.reset()
+	var utxos []esploraUTXO
+	get(t, s, "/esplora/address/"+addr+"/utxo", &utxos)
+	if len(utxos) != len(txs)+1 {
+		t.Fatalf("%d utxos, want %d", len(utxos), len(txs)+1)
+	}
+	for _, utxo := range utxos {
+		if !utxo.Status.Confirmed || utxo.Status.BlockHash != blocks[utxo.Status.BlockHeight-1].BlockHash().String() {
+			t.Fatalf("utxo %+v", utxo)
+		}
+	}
+	if calls := store.reset(); calls["GetBlocksByHeights"] != 1 || calls["GetBlockHashByHeight"] != 0 || calls["GetBlockByHash"] != 0 {
+		t.Fatalf("utxo lookups %v, want one GetBlocksByHeights", calls)
+	}
+
+	assertText(t, s, "/esplora/address/"+addr+"/txs/chain/xyz", http.StatusBadRequest, "Invalid hex string")
+	assertText(t, s, "/esplora/address/"+addr+"/txs/chain/"+strings.Repeat("ab", 32), http.StatusNotFound, "Transaction not found")
+	assertText(t, s, "/esplora/address/"+addr+"/txs/chain/1/x", http.StatusNotFound, "Not Found")
+
+	mainnet, err := btcutil.NewAddressWitnessPubKeyHash(pkScript[2:], &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("NewAddressWitnessPubKeyHash: %v", err)
+	}
+	pubKey := "02" + strings.Repeat("ab", 32)
+	for _, bad := range []string{"xyz", mainnet.EncodeAddress(), pubKey} {
+		for _, path := range []string{"/utxo", "/txs", "/txs/chain", "/txs/chain/" + last} {
+			assertText(t, s, "/esplora/address/"+bad+path, http.StatusBadRequest, "Invalid Bitcoin address")
+		}
+	}
+	// addresses are looked up in their indexed form
+	page = nil
+	get(t, s, "/esplora/address/"+strings.ToUpper(addr)+"/txs", &page)
+	if len(page) != esploraTxsPage {
+		t.Fatalf("upper case address has %d txs, want %d", len(page), esploraTxsPage)
+	}
+}
+
+func TestEsploraStatus(t *testing.T) {
+	tests := []struct {
+		status esploraStatus
+		want   string
+	}{
+		{esploraStatus{Confirmed: true, BlockHeight: 0, BlockHash: "00ab", BlockTime: 1296688602}, `{"confirmed":true,"block_height":0,"block_hash":"00ab","block_time":1296688602}`},
+		{esploraStatus{Confirmed: true, BlockHeight: 2, BlockHash: "00cd", BlockTime: 1296688603}, `{"confirmed":true,"block_height":2,"block_hash":"00cd","block_time":1296688603}`},
+		{esploraStatus{}, `{"confirmed":false}`},
+	}
+	for _, test := range tests {
+		data, err := json.Marshal(test.status)
+		if err != nil || string(data) != test.want {
+			t.Fatalf("Marshal(%+v) = %s, %v, want %s", test.status, data, err, test.want)
+		}
+	}
+	// a pointer to a status, as in outspends, marshals the same
+	data, err := json.Marshal(esploraOutSpend{Spent: true, Status: &tests[0].status})
+	if err != nil || !strings.Contains(string(data), tests[0].want) {
+		t.Fatalf("Marshal of an outspend = %s, %v", data, err)
+	}
+}
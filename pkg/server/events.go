@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// keepAliveInterval keeps idle event streams from being closed by proxies
+var keepAliveInterval = 30 * time.Second
+
+const (
+	// pongWait is how long a websocket may stay silent, pings go out well before
+	pongWait   = time.Minute
+	pingPeriod = pongWait * 9 / 10
+	writeWait  = 10 * time.Second
+	// maxRequestSize bounds a websocket subscribe request
+	maxRequestSize = 64 << 10
+)
+
+// browsers on any origin may subscribe, the API is read only like the JSON endpoints
+var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+
+// GET /api/events?topics={topic},{topic}
+// server-sent events, each named after the message type with the message as data
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	topics := splitTopics(r.URL.Query().Get("topics"))
+	if len(topics) == 0 {
+		writeError(w, http.StatusBadRequest, "bad_request", "expected topics")
+		return
+	}
+	c := s.hub.connect()
+	defer s.hub.disconnect(c)
+	if _, err := s.hub.subscribe(r.Context(), c, topics); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	// the stream outlives the server timeouts
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Time{}); err != nil {
+		s.logger.Error(err.Error())
+	}
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		s.logger.Error(err.Error())
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-c.dropped:
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case msg := <-c.send:
+			data, err := json.Marshal(msg)
+			if err != nil {
+				s.logger.Error(err.Error())
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.Type, data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// wsRequest changes the topics of a websocket, op is subscribe or unsubscribe
+type wsRequest struct {
+	Op     string   `json:"op"`
+	Topics []string `json:"topics"`
+}
+
+// wsReply answers a wsRequest, type is subscribed, unsubscribed or error
+type wsReply struct {
+	Type    string   `json:"type"`
+	Topics  []string `json:"topics,omitempty"`
+	Message string   `json:"message,omitempty"`
+}
+
+// GET /api/ws, optionally ?topics={topic},{topic}
+// the client sends wsRequests and receives their replies and the messages of its topics
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader answered already
+		return
+	}
+	defer conn.Close()
+
+	c := s.hub.connect()
+	defer s.hub.disconnect(c)
+
+	replies := make(chan wsReply, 16)
+	if topics := splitTopics(r.URL.Query().Get("topics")); len(topics) > 0 {
+		replies <- s.wsHandle(r.Context(), c, wsRequest{Op: "subscribe", Topics: topics})
+	}
+
+	// the reader stops when the connection fails or closes, the writer when the reader stopped or the handler returns
+	done := make(chan struct{})
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		defer close(done)
+		conn.SetReadLimit(maxRequestSize)
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		conn.SetPongHandler(func(string) error { return conn.SetReadDeadline(time.Now().Add(pongWait)) })
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			reply := wsReply{Type: "error", Message: "invalid JSON"}
+			var req wsRequest
+			if json.Unmarshal(data, &req) == nil {
+				reply = s.wsHandle(r.Context(), c, req)
+			}
+			select {
+			case replies <- reply:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(pingPeriod)
+	defer ping.Stop()
+	for {
+		var err error
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		select {
+		case <-done:
+			return
+		case <-c.dropped:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too slow"), time.Now().Add(writeWait))
+			return
+		case <-ping.C:
+			err = conn.WriteMessage(websocket.PingMessage, nil)
+		case reply := <-replies:
+			err = conn.WriteJSON(reply)
+		case msg := <-c.send:
+			err = conn.WriteJSON(msg)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) wsHandle(ctx context.Context, c *client, req wsRequest) wsReply {
+	switch req.Op {
+	case "subscribe":
+		topics, err := s.hub.subscribe(ctx, c, req.Topics)
+		if err != nil {
+			return wsReply{Type: "error", Message: err.Error()}
+		}
+		return wsReply{Type: "subscribed", Topics: topics}
+	case "unsubscribe":
+		return wsReply{Type: "unsubscribed", Topics: s.hub.unsubscribe(c, req.Topics)}
+	}
+	return wsReply{Type: "error", Message: "op must be subscribe or unsubscribe"}
+}
+
+func splitTopics(value string) []string {
+	var topics []string
+	for _, topic := range strings.Split(value, ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
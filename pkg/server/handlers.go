@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type tip struct {
+	Height int32  `json:"height"`
+	Hash   string `json:"hash"`
+}
+
+// GET /api/tip
+func (s *Server) handleTip(w http.ResponseWriter, r *http.Request) {
+	height, err := s.store.GetLatestBlockHeight()
+	if err != nil {
+		s.writeStoreError(w, "tip", err)
+		return
+	}
+	hash, err := s.store.GetBlockHashByHeight(r.Context(), height)
+	s.writeResult(w, "tip", tip{Height: height, Hash: hash}, err)
+}
+
+// GET /api/blocks/{height or hash}
+func (s *Server) handleBlock(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathSegments(w, r, "/api/blocks/", 1)
+	if !ok {
+		return
+	}
+	if isHash(id[0]) {
+		block, err := s.store.GetBlockByHash(r.Context(), strings.ToLower(id[0]))
+		s.writeResult(w, "block", block, err)
+		return
+	}
+	height, err := strconv.ParseInt(id[0], 10, 32)
+	if err != nil || height < 0 {
+		writeError(w, http.StatusBadRequest, "bad_request", "expected a block height or hash")
+		return
+	}
+	block, err := s.store.GetBlockByHeight(r.Context(), int32(height))
+	s.writeResult(w, "block", block, err)
+}
+
+// GET /api/txs/{txid}
+func (s *Server) handleTx(w http.ResponseWriter, r *http.Request) {
+	if txid, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/txs/"), "/proof"); ok && txid != "" && !strings.Contains(txid, "/") {
+		s.handleTxProof(w, r, txid)
+		return
+	}
+	id, ok := pathSegments(w, r, "/api/txs/", 1)
+	if !ok {
+		return
+	}
+	txHash, ok := hashParam(w, id[0])
+	if !ok {
+		return
+	}
+	tx, err := s.store.GetTx(r.Context(), txHash)
+	s.writeResult(w, "transaction", tx, err)
+}
+
+// GET /api/outpoints?funding_tx={txid} or ?spending_tx={txid}
+func (s *Server) handleOutPoints(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch {
+	case query.Has("funding_tx"):
+		txHash, ok := hashParam(w, query.Get("funding_tx"))
+		if !ok {
+			return
+		}
+		outPoints, err := s.store.GetOutPointsByTx(r.Context(), txHash)
+		s.writeResult(w, "outpoints", page{Items: outPoints}, err)
+	case query.Has("spending_tx"):
+		txHash, ok := hashParam(w, query.Get("spending_tx"))
+		if !ok {
+			return
+		}
+		outPoints, err := s.store.GetOutPointsSpentBy(r.Context(), txHash)
+		s.writeResult(w, "outpoints", page{Items: outPoints}, err)
+	default:
+		writeError(w, http.StatusBadRequest, "bad_request", "expected a funding_tx or spending_tx parameter")
+	}
+}
+
+// GET /api/outpoints/{txid}/{index}
+func (s *Server) handleOutPoint(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathSegments(w, r, "/api/outpoints/", 2)
+	if !ok {
+		return
+	}
+	txHash, ok := hashParam(w, id[0])
+	if !ok {
+		return
+	}
+	index, err := strconv.ParseUint(id[1], 10, 32)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "expected an output index")
+		return
+	}
+	outPoint, err := s.store.GetOutPoint(r.Context(), txHash, uint32(index))
+	s.writeResult(w, "outpoint", outPoint, err)
+}
+
+// GET /api/addresses/{address}, /api/addresses/{address}/utxos and /api/addresses/{address}/history
+func (s *Server) handleAddress(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/addresses/"), "/")
+	if segments[0] == "" || len(segments) > 2 {
+		writeError(w, http.StatusNotFound, "not_found", "no such endpoint")
+		return
+	}
+	address := segments[0]
+	if len(segments) == 1 {
+		summary, err := s.store.GetAddress(r.Context(), address)
+		s.writeResult(w, "address", summary, err)
+		return
+	}
+
+	after, limit, err := pageParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	switch segments[1] {
+	case "utxos":
+		utxos, err := s.store.GetAddressUTXOs(r.Context(), address, after, limit)
+		body := page{Items: utxos}
+		if err == nil && int64(len(utxos)) == limit {
+			body.NextCursor = encodeCursor(utxos[len(utxos)-1].UTXOCursor())
+		}
+		s.writeResult(w, "address", body, err)
+	case "history":
+		history, err := s.store.GetAddressHistory(r.Context(), address, after, limit)
+		body := page{Items: history}
+		if err == nil && int64(len(history)) == limit {
+			body.NextCursor = encodeCursor(history[len(history)-1].Cursor())
+		}
+		s.writeResult(w, "address", body, err)
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "no such endpoint")
+	}
+}
+
+// pathSegments splits the path after prefix into n non empty segments, answering 404 otherwise
+func pathSegments(w http.ResponseWriter, r *http.Request, prefix string, n int) ([]string, bool) {
+	segments := strings.Split(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	if len(segments) != n {
+		writeError(w, http.StatusNotFound, "not_found", "no such endpoint")
+		return nil, false
+	}
+	for _, segment := range segments {
+		if segment == "" {
+			writeError(w, http.StatusNotFound, "not_found", "no such endpoint")
+			return nil, false
+		}
+	}
+	return segments, true
+}
+
+func isHash(value string) bool {
+	if len(value) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
+
+// hashParam checks value is a block or tx hash, answering 400 otherwise
+func hashParam(w http.ResponseWriter, value string) (string, bool) {
+	if !isHash(value) {
+		writeError(w, http.StatusBadRequest, "bad_request", "expected a 64 character hex hash")
+		return "", false
+	}
+	return strings.ToLower(value), true
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/pkg/merkle"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// txProof proves a tx is in a best chain block. Branch hashes the txid up to MerkleRoot,
+// MerkleBlock is the hex BIP37 merkle block bitcoind's gettxoutproof answers
+type txProof struct {
+	TxID        string   `json:"txid"`
+	BlockHash   string   `json:"block_hash"`
+	BlockHeight int32    `json:"block_height"`
+	MerkleRoot  string   `json:"merkle_root"`
+	Position    int      `json:"position"`
+	Branch      []string `json:"branch"`
+	MerkleBlock string   `json:"merkle_block"`
+}
+
+// proof holds what the proofs of a tx are built from
+type proof struct {
+	block  database.Block
+	header *wire.BlockHeader
+	tree   merkle.Tree
+	index  int
+}
+
+// loadProof finds txid in blockHash, or in the block the index stored it in when blockHash is empty.
+// only a given block finds txs pruned from the index
+func (s *Server) loadProof(ctx context.Context, txid, blockHash string) (proof, error) {
+	if blockHash == "" {
+		tx, err := s.store.GetTx(ctx, txid)
+		if err != nil {
+			return proof{}, err
+		}
+		blockHash = string(tx.BlockHash)
+	}
+	block, err := s.store.GetBlockByHash(ctx, blockHash)
+	if err != nil {
+		return proof{}, err
+	}
+	if block.IsOrphan {
+		return proof{}, database.ErrNotFound
+	}
+	header, tree, err := merkle.Load(ctx, s.store, block)
+	if err != nil {
+		return proof{}, err
+	}
+	hash, err := chainhash.NewHashFromStr(txid)
+	if err != nil {
+		return proof{}, err
+	}
+	index := tree.Index(*hash)
+	if index < 0 {
+		return proof{}, database.ErrNotFound
+	}
+	return proof{block: block, header: header, tree: tree, index: index}, nil
+}
+
+func (p proof) branch() []string {
+	branch := p.tree.Branch(p.index)
+	hashes := make([]string, len(branch))
+	for i, hash := range branch {
+		hashes[i] = hash.String()
+	}
+	return hashes
+}
+
+func (p proof) merkleBlock() (string, error) {
+	var buf bytes.Buffer
+	block := p.tree.MerkleBlock(p.header, func(i int) bool { return i == p.index })
+	if err := block.BtcEncode(&buf, wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf.Bytes()), nil
+}
+
+// GET /api/txs/{txid}/proof?block_hash={hash}
+func (s *Server) handleTxProof(w http.ResponseWriter, r *http.Request, txid string) {
+	txid, ok := hashParam(w, txid)
+	if !ok {
+		return
+	}
+	blockHash := r.URL.Query().Get("block_hash")
+	if blockHash != "" {
+		if blockHash, ok = hashParam(w, blockHash); !ok {
+			return
+		}
+	}
+
+	p, err := s.loadProof(r.Context(), txid, blockHash)
+	if errors.Is(err, database.ErrNoTxIDs) {
+		writeError(w, http.StatusNotFound, "not_found", err.Error())
+		return
+	}
+	if err != nil {
+		s.writeStoreError(w, "transaction", err)
+		return
+	}
+	merkleBlock, err := p.merkleBlock()
+	if err != nil {
+		s.writeStoreError(w, "transaction", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, txProof{
+		TxID:        txid,
+		BlockHash:   string(p.block.ID),
+		BlockHeight: p.block.Height,
+		MerkleRoot:  string(p.block.MerkleRoot),
+		Position:    p.index,
+		Branch:      p.branch(),
+		MerkleBlock: merkleBlock,
+	})
+}
+
+// esploraMerkleProof is the electrum style proof of GET /tx/:txid/merkle-proof
+type esploraMerkleProof struct {
+	BlockHeight int32    `json:"block_height"`
+	Merkle      []string `json:"merkle"`
+	Pos         int      `json:"pos"`
+}
+
+// GET /tx/:txid/merkle-proof
+func (req *esploraRequest) merkleProof(txid string) {
+	p, ok := req.proof(txid)
+	if !ok {
+		return
+	}
+	req.json(esploraMerkleProof{BlockHeight: p.block.Height, Merkle: p.branch(), Pos: p.index})
+}
+
+// GET /tx/:txid/merkleblock-proof
+func (req *esploraRequest) merkleBlockProof(txid string) {
+	p, ok := req.proof(txid)
+	if !ok {
+		return
+	}
+	merkleBlock, err := p.merkleBlock()
+	if err != nil {
+		req.storeError("Transaction", err)
+		return
+	}
+	req.text(http.StatusOK, merkleBlock)
+}
+
+func (req *esploraRequest) proof(txid string) (proof, bool) {
+	if !isHash(txid) {
+		req.text(http.StatusBadRequest, "Invalid hex string")
+		return proof{}, false
+	}
+	p, err := req.s.loadProof(req.ctx, strings.ToLower(txid), "")
+	if errors.Is(err, database.ErrNoTxIDs) {
+		req.text(http.StatusNotFound, "Transaction proof not available")
+		return proof{}, false
+	}
+	if err != nil {
+		req.storeError("Transaction", err)
+		return proof{}, false
+	}
+	return p, true
+}
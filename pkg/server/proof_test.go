@@ -0,0 +1,146 @@
+package server
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/database/storetest"
+	"btc-indexer/pkg/merkle"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// rootOf hashes txid up branch from position
+func rootOf(t *testing.T, txid string, branch []string, position int) chainhash.Hash {
+	t.Helper()
+	hash, err := chainhash.NewHashFromStr(txid)
+	if err != nil {
+		t.Fatalf("txid %s: %v", txid, err)
+	}
+	root := *hash
+	for _, item := range branch {
+		sibling, err := chainhash.NewHashFromStr(item)
+		if err != nil {
+			t.Fatalf("branch hash %s: %v", item, err)
+		}
+		var buf [2 * chainhash.HashSize]byte
+		if position%2 == 0 {
+			copy(buf[:chainhash.HashSize], root[:])
+			copy(buf[chainhash.HashSize:], sibling[:])
+		} else {
+			copy(buf[:chainhash.HashSize], sibling[:])
+			copy(buf[chainhash.HashSize:], root[:])
+		}
+		root = chainhash.DoubleHashH(buf[:])
+		position /= 2
+	}
+	return root
+}
+
+func TestTxProof(t *testing.T) {
+	s, _, chain := newTestServer(t)
+	b1 := chain.Block(chain.Genesis())
+	spend1 := chain.Spend(b1.Transactions[0], 0)
+	spend2 := chain.Spend(spend1, 0)
+	spend3 := chain.Spend(spend1, 1)
+	b2 := chain.Block(b1, spend1, spend2, spend3)
+	side := chain.Block(chain.Genesis())
+	chain.Put(b1, b2, side)
+
+	for position, tx := range b2.Transactions {
+		txid := tx.TxHash().String()
+		for _, path := range []string{"/api/txs/" + txid + "/proof", "/api/txs/" + strings.ToUpper(txid) + "/proof?block_hash=" + b2.BlockHash().String()} {
+			var proof txProof
+			if w := get(t, s, path, &proof); w.Code != http.StatusOK {
+				t.Fatalf("GET %s = %d %s", path, w.Code, w.Body)
+			}
+			if proof.TxID != txid || proof.BlockHash != b2.BlockHash().String() || proof.BlockHeight != 2 || proof.Position != position ||
+				proof.MerkleRoot != b2.Header.MerkleRoot.String() {
+				t.Fatalf("GET %s = %+v", path, proof)
+			}
+			if root := rootOf(t, txid, proof.Branch, position); root != b2.Header.MerkleRoot {
+				t.Fatalf("GET %s: branch hashes to %s, not the merkle root", path, root)
+			}
+
+			data, err := hex.DecodeString(proof.MerkleBlock)
+			if err != nil {
+				t.Fatalf("merkle block %q: %v", proof.MerkleBlock, err)
+			}
+			var mb wire.MsgMerkleBlock
+			if err := mb.BtcDecode(bytes.NewReader(data), wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+				t.Fatalf("BtcDecode: %v", err)
+			}
+			matches, err := merkle.Verify(&mb)
+			if err != nil || len(matches) != 1 || matches[0] != tx.TxHash() || mb.Header.BlockHash() != b2.BlockHash() {
+				t.Fatalf("merkle block of %s verifies %v, %v", txid, matches, err)
+			}
+		}
+	}
+
+	var esplora esploraMerkleProof
+	if w := get(t, s, "/esplora/tx/"+spend3.TxHash().String()+"/merkle-proof", &esplora); w.Code != http.StatusOK {
+		t.Fatalf("GET merkle-proof = %d %s", w.Code, w.Body)
+	}
+	if esplora.BlockHeight != 2 || esplora.Pos != 3 || rootOf(t, spend3.TxHash().String(), esplora.Merkle, 3) != b2.Header.MerkleRoot {
+		t.Fatalf("merkle-proof = %+v", esplora)
+	}
+	w := get(t, s, "/esplora/tx/"+spend2.TxHash().String()+"/merkleblock-proof", nil)
+	var proof txProof
+	get(t, s, "/api/txs/"+spend2.TxHash().String()+"/proof", &proof)
+	if w.Code != http.StatusOK || w.Body.String() != proof.MerkleBlock {
+		t.Fatalf("merkleblock-proof = %d %q, want %q", w.Code, w.Body, proof.MerkleBlock)
+	}
+
+	unknown := strings.Repeat("ab", 32)
+	spend1ID := spend1.TxHash().String()
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		code   string
+	}{
+		{"bad txid", "/api/txs/xyz/proof", http.StatusBadRequest, "bad_request"},
+		{"bad block hash", "/api/txs/" + spend1ID + "/proof?block_hash=xyz", http.StatusBadRequest, "bad_request"},
+		{"unknown txid", "/api/txs/" + unknown + "/proof", http.StatusNotFound, "not_found"},
+		{"unknown block", "/api/txs/" + spend1ID + "/proof?block_hash=" + unknown, http.StatusNotFound, "not_found"},
+		{"tx of another block", "/api/txs/" + spend1ID + "/proof?block_hash=" + b1.BlockHash().String(), http.StatusNotFound, "not_found"},
+		{"orphan block", "/api/txs/" + side.Transactions[0].TxHash().String() + "/proof?block_hash=" + side.BlockHash().String(), http.StatusNotFound, "not_found"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assertError(t, get(t, s, test.path, nil), test.status, test.code)
+		})
+	}
+	assertText(t, s, "/esplora/tx/xyz/merkle-proof", http.StatusBadRequest, "Invalid hex string")
+	assertText(t, s, "/esplora/tx/"+unknown+"/merkle-proof", http.StatusNotFound, "Transaction not found")
+}
+
+// noTxIDsStore stores no txids, like blocks indexed before they were
+type noTxIDsStore struct {
+	database.Store
+}
+
+func (noTxIDsStore) GetBlockTxIDs(ctx context.Context, blockHash string) ([]database.Hash, error) {
+	return nil, database.ErrNoTxIDs
+}
+
+func TestTxProofUnavailable(t *testing.T) {
+	store := database.NewMemoryStore(&chaincfg.RegressionNetParams)
+	chain := storetest.NewChain(t, store)
+	b1 := chain.Block(chain.Genesis())
+	spend := chain.Spend(b1.Transactions[0], 0)
+	chain.Put(b1, chain.Block(b1, spend))
+	txid := spend.TxHash().String()
+
+	s := NewServer("", 0, &chaincfg.RegressionNetParams, nil, noTxIDsStore{store})
+	assertError(t, get(t, s, "/api/txs/"+txid+"/proof", nil), http.StatusNotFound, "not_found")
+	assertText(t, s, "/esplora/tx/"+txid+"/merkle-proof", http.StatusNotFound, "Transaction proof not available")
+	assertText(t, s, "/esplora/tx/"+txid+"/merkleblock-proof", http.StatusNotFound, "Transaction proof not available")
+
+}
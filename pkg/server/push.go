@@ -0,0 +1,416 @@
+package server
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/pkg/logger"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// topics a push client subscribes to
+//
+//	blocks             blocks joining the best chain
+//	reorgs             blocks leaving it
+//	address:<address>  txs funding or spending the address, and them leaving the best chain
+//	scripthash:<hash>  the same by electrum script hash
+//	tx:<txid>[:<n>]    the tx reaching n confirmations, 1 by default, and it leaving the best chain
+const (
+	topicBlocks      = "blocks"
+	topicReorgs      = "reorgs"
+	prefixAddress    = "address:"
+	prefixScriptHash = "scripthash:"
+	prefixTx         = "tx:"
+)
+
+const (
+	// maxTopics bounds the topics of one client
+	maxTopics = 100
+	// sendBuffer is how many messages a client may lag behind before it is dropped
+	sendBuffer = 256
+	// keepHeights is how far below the tip the hub remembers the address topics a tx matched
+	keepHeights = 100
+)
+
+// message is what a client receives, Type is the journal event type or tx_confirmations
+type message struct {
+	Topic         string          `json:"topic"`
+	Type          string          `json:"type"`
+	BlockHash     database.Hash   `json:"block_hash,omitempty"`
+	Height        int32           `json:"height"`
+	TxHash        database.Hash   `json:"txid,omitempty"`
+	Confirmations int32           `json:"confirmations,omitempty"`
+	Block         *database.Block `json:"block,omitempty"`
+}
+
+const typeTxConfirmations = "tx_confirmations"
+
+// client is a push connection, the transport drains send until dropped is closed
+type client struct {
+	send    chan message
+	dropped chan struct{}
+	topics  map[string]*txWatch // tx topics carry a watch, the others nil
+}
+
+// txWatch tracks a tx topic of one client, it fires once per time the tx reaches the confirmations
+type txWatch struct {
+	txHash        database.Hash
+	confirmations int32
+	fired         bool
+}
+
+// matchedTx is a confirmed tx that matched address topics, its outpoints are gone once it is orphaned
+type matchedTx struct {
+	height int32
+	topics []string
+}
+
+// hub fans the journal events out to push clients. the store hands them over while locked,
+// so they are queued and dispatched from a goroutine of the hub
+type hub struct {
+	store  database.Store
+	logger *logger.CustomLogger
+
+	mu      sync.Mutex
+	queue   []database.Event
+	wake    chan struct{}
+	clients map[*client]struct{}
+	matched map[database.Hash]matchedTx
+}
+
+func newHub(store database.Store) *hub {
+	h := &hub{
+		store:   store,
+		logger:  logger.NewDefaultLogger(),
+		wake:    make(chan struct{}, 1),
+		clients: make(map[*client]struct{}),
+		matched: make(map[database.Hash]matchedTx),
+	}
+	store.Listen(h.publish)
+	go h.run()
+	return h
+}
+
+// publish is the store listener, it must not block
+func (h *hub) publish(events []database.Event) {
+	h.mu.Lock()
+	h.queue = append(h.queue, events...)
+	h.mu.Unlock()
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (h *hub) run() {
+	for range h.wake {
+		h.mu.Lock()
+		events := h.queue
+		h.queue = nil
+		h.mu.Unlock()
+		h.dispatch(context.Background(), events)
+	}
+}
+
+func (h *hub) connect() *client {
+	c := &client{
+		send:    make(chan message, sendBuffer),
+		dropped: make(chan struct{}),
+		topics:  make(map[string]*txWatch),
+	}
+	h.mu.Lock()
+	h.clients[c] = struct{}{}
+	h.mu.Unlock()
+	return c
+}
+
+func (h *hub) disconnect(c *client) {
+	h.mu.Lock()
+	delete(h.clients, c)
+	h.mu.Unlock()
+}
+
+// subscribe adds topics to c, tx topics already reached fire right away.
+// either all topics are added or, on an error, none
+func (h *hub) subscribe(ctx context.Context, c *client, topics []string) ([]string, error) {
+	parsed := make(map[string]*txWatch, len(topics))
+	for _, topic := range topics {
+		name, watch, err := parseTopic(topic)
+		if err != nil {
+			return nil, err
+		}
+		parsed[name] = watch
+	}
+
+	h.mu.Lock()
+	for name := range parsed {
+		if _, ok := c.topics[name]; ok {
+			delete(parsed, name)
+		}
+	}
+	if len(c.topics)+len(parsed) > maxTopics {
+		h.mu.Unlock()
+		return nil, fmt.Errorf("at most %d topics per connection", maxTopics)
+	}
+	added := make([]string, 0, len(parsed))
+	for name, watch := range parsed {
+		c.topics[name] = watch
+		added = append(added, name)
+	}
+	h.mu.Unlock()
+
+	if err := h.checkConfirmations(ctx, c); err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+func (h *hub) unsubscribe(c *client, topics []string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	removed := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		name, _, err := parseTopic(topic)
+		if err != nil {
+			continue
+		}
+		if _, ok := c.topics[name]; ok {
+			delete(c.topics, name)
+			removed = append(removed, name)
+		}
+	}
+	return removed
+}
+
+// parseTopic validates a topic and returns its canonical name, with a watch for tx topics
+func parseTopic(topic string) (string, *txWatch, error) {
+	switch {
+	case topic == topicBlocks || topic == topicReorgs:
+		return topic, nil, nil
+	case strings.HasPrefix(topic, prefixAddress) && len(topic) > len(prefixAddress):
+		return topic, nil, nil
+	case strings.HasPrefix(topic, prefixScriptHash):
+		hash := strings.TrimPrefix(topic, prefixScriptHash)
+		if !isHash(hash) {
+			return "", nil, errors.New("expected scripthash:<64 hex characters>")
+		}
+		return prefixScriptHash + strings.ToLower(hash), nil, nil
+	case strings.HasPrefix(topic, prefixTx):
+		txHash, confirmations, _ := strings.Cut(strings.TrimPrefix(topic, prefixTx), ":")
+		if !isHash(txHash) {
+			return "", nil, errors.New("expected tx:<txid>[:<confirmations>]")
+		}
+		n := int64(1)
+		if confirmations != "" {
+			var err error
+			if n, err = strconv.ParseInt(confirmations, 10, 32); err != nil || n < 1 {
+				return "", nil, errors.New("confirmations must be a positive integer")
+			}
+		}
+		txHash = strings.ToLower(txHash)
+		return fmt.Sprintf("%s%s:%d", prefixTx, txHash, n), &txWatch{txHash: database.Hash(txHash), confirmations: int32(n)}, nil
+	}
+	return "", nil, fmt.Errorf("unknown topic %q", topic)
+}
+
+// deliver queues msg for c, a client lagging sendBuffer messages behind is dropped. h.mu is held
+func (h *hub) deliver(c *client, msg message) {
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	select {
+	case c.send <- msg:
+	default:
+		delete(h.clients, c)
+		close(c.dropped)
+	}
+}
+
+// broadcast delivers msg to the clients subscribed to its topic
+func (h *hub) broadcast(msg message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if _, ok := c.topics[msg.Topic]; ok {
+			h.deliver(c, msg)
+		}
+	}
+}
+
+// interests tells which kinds of topics are subscribed at all, so dispatch skips the store lookups nobody needs
+func (h *hub) interests() (blocks, addresses, txs bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		for name, watch := range c.topics {
+			switch {
+			case name == topicBlocks:
+				blocks = true
+			case watch != nil:
+				txs = true
+			case name != topicReorgs:
+				addresses = true
+			}
+		}
+	}
+	return blocks, addresses, txs
+}
+
+func (h *hub) dispatch(ctx context.Context, events []database.Event) {
+	blocks, addresses, txs := h.interests()
+	connected := false
+	for _, event := range events {
+		switch event.Type {
+		case database.EventBlockConnected:
+			connected = true
+			h.forget(event.Height - keepHeights)
+			if !blocks {
+				continue
+			}
+			msg := message{Topic: topicBlocks, Type: string(event.Type), BlockHash: event.BlockHash, Height: event.Height}
+			if block, err := h.store.GetBlockByHash(ctx, string(event.BlockHash)); err == nil {
+				msg.Block = &block
+			}
+			h.broadcast(msg)
+		case database.EventBlockDisconnected:
+			h.broadcast(message{Topic: topicReorgs, Type: string(event.Type), BlockHash: event.BlockHash, Height: event.Height})
+		case database.EventTxConfirmed:
+			if addresses {
+				h.confirmTx(ctx, event)
+			}
+		case database.EventTxOrphaned:
+			h.orphanTx(event)
+		}
+	}
+	if connected && txs {
+		h.mu.Lock()
+		clients := make([]*client, 0, len(h.clients))
+		for c := range h.clients {
+			clients = append(clients, c)
+		}
+		h.mu.Unlock()
+		for _, c := range clients {
+			if err := h.checkConfirmations(ctx, c); err != nil {
+				h.logger.Error(err.Error())
+			}
+		}
+	}
+}
+
+// confirmTx notifies the address and script hash topics of the outputs a tx funds and spends
+func (h *hub) confirmTx(ctx context.Context, event database.Event) {
+	funded, err := h.store.GetOutPointsByTx(ctx, string(event.TxHash))
+	if err != nil {
+		h.logger.Error(err.Error())
+		return
+	}
+	spent, err := h.store.GetOutPointsSpentBy(ctx, string(event.TxHash))
+	if err != nil {
+		h.logger.Error(err.Error())
+		return
+	}
+
+	seen := make(map[string]bool)
+	var topics []string
+	for _, outPoint := range append(funded, spent...) {
+		for _, topic := range []string{prefixAddress + outPoint.Spender, prefixScriptHash + string(outPoint.ScriptHash)} {
+			if !seen[topic] {
+				seen[topic] = true
+				topics = append(topics, topic)
+			}
+		}
+	}
+
+	h.mu.Lock()
+	var matched []string
+	for _, topic := range topics {
+		msg := message{Topic: topic, Type: string(event.Type), BlockHash: event.BlockHash, Height: event.Height, TxHash: event.TxHash}
+		subscribed := false
+		for c := range h.clients {
+			if _, ok := c.topics[topic]; ok {
+				h.deliver(c, msg)
+				subscribed = true
+			}
+		}
+		if subscribed {
+			matched = append(matched, topic)
+		}
+	}
+	if len(matched) > 0 {
+		h.matched[event.TxHash] = matchedTx{height: event.Height, topics: matched}
+	}
+	h.mu.Unlock()
+}
+
+// orphanTx notifies the topics that heard of a tx when it was confirmed
+func (h *hub) orphanTx(event database.Event) {
+	h.mu.Lock()
+	matched := h.matched[event.TxHash]
+	delete(h.matched, event.TxHash)
+	h.mu.Unlock()
+
+	for _, topic := range matched.topics {
+		h.broadcast(message{Topic: topic, Type: string(event.Type), BlockHash: event.BlockHash, Height: event.Height, TxHash: event.TxHash})
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		for name, watch := range c.topics {
+			if watch != nil && watch.txHash == event.TxHash && watch.fired {
+				watch.fired = false
+				h.deliver(c, message{Topic: name, Type: string(event.Type), BlockHash: event.BlockHash, Height: event.Height, TxHash: event.TxHash})
+			}
+		}
+	}
+}
+
+// forget drops the matched txs at height and below, they are too deep to be orphaned
+func (h *hub) forget(height int32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for txHash, matched := range h.matched {
+		if matched.height <= height {
+			delete(h.matched, txHash)
+		}
+	}
+}
+
+// checkConfirmations fires the tx topics of c whose tx reached its confirmations
+func (h *hub) checkConfirmations(ctx context.Context, c *client) error {
+	h.mu.Lock()
+	pending := make(map[database.Hash]bool)
+	for _, watch := range c.topics {
+		if watch != nil && !watch.fired {
+			pending[watch.txHash] = true
+		}
+	}
+	h.mu.Unlock()
+
+	for txHash := range pending {
+		tx, err := h.store.GetTx(ctx, string(txHash))
+		if errors.Is(err, database.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		h.mu.Lock()
+		if _, ok := h.clients[c]; !ok {
+			h.mu.Unlock()
+			return nil
+		}
+		for name, watch := range c.topics {
+			if watch != nil && watch.txHash == txHash && !watch.fired && tx.Confirmations >= watch.confirmations {
+				watch.fired = true
+				h.deliver(c, message{Topic: name, Type: typeTxConfirmations, BlockHash: tx.BlockHash, Height: tx.BlockHeight, TxHash: tx.ID, Confirmations: tx.Confirmations})
+			}
+		}
+		h.mu.Unlock()
+	}
+	return nil
+}
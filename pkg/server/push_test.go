@@ -0,0 +1,460 @@
+package server
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/database/storetest"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/gorilla/websocket"
+)
+
+// receive returns the next message of c
+func receive(t *testing.T, c *client) message {
+	t.Helper()
+	select {
+	case msg := <-c.send:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("no message")
+	}
+	return message{}
+}
+
+// subscribe subscribes c to topics and returns the topics added in order
+func subscribe(t *testing.T, h *hub, c *client, topics ...string) []string {
+	t.Helper()
+	added, err := h.subscribe(context.Background(), c, topics)
+	if err != nil {
+		t.Fatalf("subscribe %v: %v", topics, err)
+	}
+	sort.Strings(added)
+	return added
+}
+
+func TestParseTopic(t *testing.T) {
+	txid := strings.Repeat("ab", 32)
+	tests := []struct {
+		topic string
+		name  string // empty for an invalid topic
+		n     int32
+	}{
+		{"blocks", "blocks", 0},
+		{"reorgs", "reorgs", 0},
+		{"address:bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080", "address:bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080", 0},
+		{"address:", "", 0},
+		{"scripthash:" + strings.ToUpper(txid), "scripthash:" + txid, 0},
+		{"scripthash:abc", "", 0},
+		{"tx:" + txid, "tx:" + txid + ":1", 1},
+		{"tx:" + strings.ToUpper(txid) + ":6", "tx:" + txid + ":6", 6},
+		{"tx:" + txid + ":0", "", 0},
+		{"tx:" + txid + ":-1", "", 0},
+		{"tx:" + txid + ":x", "", 0},
+		{"tx:" + txid + ":", "tx:" + txid + ":1", 1},
+		{"tx:abc", "", 0},
+		{"Blocks", "", 0},
+		{"mempool", "", 0},
+	}
+	for _, test := range tests {
+		name, watch, err := parseTopic(test.topic)
+		if test.name == "" {
+			if err == nil {
+				t.Errorf("parseTopic(%q) = %q, want an error", test.topic, name)
+			}
+			continue
+		}
+		if err != nil || name != test.name {
+			t.Errorf("parseTopic(%q) = %q, %v, want %q", test.topic, name, err, test.name)
+			continue
+		}
+		if test.n == 0 && watch != nil {
+			t.Errorf("parseTopic(%q) watches %+v", test.topic, watch)
+		}
+		if test.n != 0 && (watch == nil || watch.txHash != database.Hash(txid) || watch.confirmations != test.n) {
+			t.Errorf("parseTopic(%q) watches %+v, want %d confirmations of %s", test.topic, watch, test.n, txid)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	h := newHub(database.NewMemoryStore(&chaincfg.RegressionNetParams))
+	c := h.connect()
+
+	topics := make([]string, maxTopics-1)
+	for i := range topics {
+		topics[i] = fmt.Sprintf("address:%d", i)
+	}
+	if added := subscribe(t, h, c, topics...); len(added) != maxTopics-1 {
+		t.Fatalf("added %d topics", len(added))
+	}
+	// topics subscribed already do not count, an invalid one fails the whole request
+	if added := subscribe(t, h, c, topics[0], "blocks", "blocks"); len(added) != 1 || added[0] != "blocks" {
+		t.Fatalf("added %v, want [blocks]", added)
+	}
+	if _, err := h.subscribe(context.Background(), c, []string{"reorgs", "tx:abc"}); err == nil {
+		t.Fatal("subscribed an invalid topic")
+	}
+	if _, err := h.subscribe(context.Background(), c, []string{topics[1], "reorgs"}); err == nil {
+		t.Fatalf("subscribed more than %d topics", maxTopics)
+	}
+	if len(c.topics) != maxTopics {
+		t.Fatalf("%d topics after a failed subscribe, want %d", len(c.topics), maxTopics)
+	}
+	if _, ok := c.topics["reorgs"]; ok {
+		t.Fatal("a failed subscribe added reorgs")
+	}
+
+	removed := h.unsubscribe(c, []string{"blocks", "reorgs", "tx:abc", topics[0]})
+	sort.Strings(removed)
+	if len(removed) != 2 || removed[0] != topics[0] || removed[1] != "blocks" {
+		t.Fatalf("removed %v", removed)
+	}
+	if added := subscribe(t, h, c, "reorgs", "blocks"); len(added) != 2 {
+		t.Fatalf("added %v after unsubscribing", added)
+	}
+}
+
+func TestPushBlocks(t *testing.T) {
+	s, store, chain := newTestServer(t)
+	h := s.hub
+	blocks, reorgs := h.connect(), h.connect()
+	subscribe(t, h, blocks, "blocks")
+	subscribe(t, h, reorgs, "reorgs")
+
+	b1 := chain.Block(chain.Genesis())
+	b2 := chain.Block(b1)
+	chain.Put(b1, b2)
+	for _, want := range []int32{1, 2} {
+		msg := receive(t, blocks)
+		if msg.Topic != "blocks" || msg.Type != string(database.EventBlockConnected) || msg.Height != want || msg.Block == nil || msg.Block.Height != want {
+			t.Fatalf("message %+v, want block %d", msg, want)
+		}
+	}
+
+	// a longer fork reorgs b2 out
+	fork := chain.Block(b1)
+	chain.Put(fork, chain.Block(fork))
+	msg := receive(t, reorgs)
+	if msg.Topic != "reorgs" || msg.Type != string(database.EventBlockDisconnected) || msg.BlockHash != database.Hash(b2.BlockHash().String()) {
+		t.Fatalf("message %+v, want b2 disconnected", msg)
+	}
+	if tip, _ := store.GetLatestBlockHeight(); tip != 3 {
+		t.Fatalf("tip %d after the fork", tip)
+	}
+}
+
+func TestPushAddress(t *testing.T) {
+	// b1 is put before the hub listens, its coinbase confirms no topic
+	store := database.NewMemoryStore(&chaincfg.RegressionNetParams)
+	chain := storetest.NewChain(t, store)
+	b1 := chain.Block(chain.Genesis())
+	chain.Put(b1)
+	h := NewServer("", 0, &chaincfg.RegressionNetParams, nil, store).hub
+
+	pkScript := []byte{0x00, 0x14, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	tx := pay(b1.Transactions[0], 0, pkScript)
+	b2 := chain.Block(b1, tx)
+	outPoints, err := store.GetOutPointsByTx(context.Background(), b1.Transactions[0].TxHash().String())
+	if err != nil || len(outPoints) == 0 {
+		t.Fatalf("GetOutPointsByTx: %v", err)
+	}
+
+	funded, spent, other := h.connect(), h.connect(), h.connect()
+	subscribe(t, h, funded, "address:"+address(t, pkScript))
+	subscribe(t, h, spent, "scripthash:"+strings.ToUpper(string(outPoints[0].ScriptHash)))
+	subscribe(t, h, other, "address:"+address(t, append([]byte{0x00, 0x14}, make([]byte, 20)...)), "blocks")
+	chain.Put(b2)
+
+	txid := database.Hash(tx.TxHash().String())
+	for _, c := range []*client{funded, spent} {
+		msg := receive(t, c)
+		if msg.Type != string(database.EventTxConfirmed) || msg.TxHash != txid || msg.Height != 2 || msg.BlockHash != database.Hash(b2.BlockHash().String()) {
+			t.Fatalf("message %+v, want %s confirmed", msg, txid)
+		}
+	}
+	// the address of other is not touched, the block is the only message it gets
+	if msg := receive(t, other); msg.Topic != "blocks" {
+		t.Fatalf("message %+v, want the block", msg)
+	}
+
+	fork := chain.Block(b1)
+	chain.Put(fork, chain.Block(fork))
+	for _, c := range []*client{funded, spent} {
+		if msg := receive(t, c); msg.Type != string(database.EventTxOrphaned) || msg.TxHash != txid {
+			t.Fatalf("message %+v, want %s orphaned", msg, txid)
+		}
+	}
+}
+
+func TestPushTxConfirmations(t *testing.T) {
+	s, _, chain := newTestServer(t)
+	h := s.hub
+	b1 := chain.Block(chain.Genesis())
+	tx := chain.Spend(b1.Transactions[0], 0)
+	txid := tx.TxHash().String()
+	chain.Put(b1)
+
+	two := h.connect()
+	subscribe(t, h, two, "tx:"+txid+":2")
+	b2 := chain.Block(b1, tx)
+	chain.Put(b2)
+	b3 := chain.Block(b2)
+	chain.Put(b3)
+	// the first block confirming the tx fires nothing, the second fires once
+	msg := receive(t, two)
+	if msg.Topic != "tx:"+txid+":2" || msg.Type != typeTxConfirmations || msg.Confirmations != 2 || msg.Height != 2 ||
+		msg.TxHash != database.Hash(txid) || msg.BlockHash != database.Hash(b2.BlockHash().String()) {
+		t.Fatalf("message %+v, want 2 confirmations", msg)
+	}
+
+	// a tx deep enough fires on subscribe
+	one := h.connect()
+	subscribe(t, h, one, "tx:"+txid)
+	if msg := receive(t, one); msg.Type != typeTxConfirmations || msg.Confirmations != 2 {
+		t.Fatalf("message %+v, want 2 confirmations right away", msg)
+	}
+
+	// orphaned, the topics fire again once the tx is confirmed again
+	fork := chain.Block(b1)
+	fork2 := chain.Block(fork)
+	fork3 := chain.Block(fork2)
+	chain.Put(fork, fork2, fork3)
+	for _, c := range []*client{two, one} {
+		if msg := receive(t, c); msg.Type != string(database.EventTxOrphaned) || msg.TxHash != database.Hash(txid) {
+			t.Fatalf("message %+v, want the tx orphaned", msg)
+		}
+	}
+	chain.Put(chain.Block(fork3, tx))
+	if msg := receive(t, one); msg.Type != typeTxConfirmations || msg.Confirmations != 1 || msg.Height != 5 {
+		t.Fatalf("message %+v, want 1 confirmation", msg)
+	}
+	select {
+	case msg := <-two.send:
+		t.Fatalf("message %+v before 2 confirmations", msg)
+	default:
+	}
+}
+
+func TestSlowClient(t *testing.T) {
+	h := newHub(database.NewMemoryStore(&chaincfg.RegressionNetParams))
+	slow, idle := h.connect(), h.connect()
+	subscribe(t, h, slow, "blocks")
+	for i := 0; i < sendBuffer; i++ {
+		h.broadcast(message{Topic: topicBlocks, Height: int32(i)})
+	}
+	select {
+	case <-slow.dropped:
+		t.Fatal("dropped with a full buffer")
+	default:
+	}
+
+	h.broadcast(message{Topic: topicBlocks, Height: sendBuffer})
+	select {
+	case <-slow.dropped:
+	default:
+		t.Fatal("not dropped once the buffer overflowed")
+	}
+	h.mu.Lock()
+	_, slowConnected := h.clients[slow]
+	_, idleConnected := h.clients[idle]
+	h.mu.Unlock()
+	if slowConnected || !idleConnected {
+		t.Fatalf("connected slow %v, idle %v", slowConnected, idleConnected)
+	}
+	// messages already queued are kept, a dropped client gets no more
+	if len(slow.send) != sendBuffer {
+		t.Fatalf("%d queued messages", len(slow.send))
+	}
+	h.broadcast(message{Topic: topicBlocks})
+	if len(slow.send) != sendBuffer {
+		t.Fatalf("%d queued messages after the drop", len(slow.send))
+	}
+}
+
+// dropAll drops the clients of h like slow ones
+func dropAll(h *hub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		delete(h.clients, c)
+		close(c.dropped)
+	}
+}
+
+// waitClients waits until h has n clients
+func waitClients(t *testing.T, h *hub, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		h.mu.Lock()
+		connected := len(h.clients)
+		h.mu.Unlock()
+		if connected == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients, want %d", connected, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	interval := keepAliveInterval
+	keepAliveInterval = 20 * time.Millisecond
+	t.Cleanup(func() { keepAliveInterval = interval })
+
+	s, _, chain := newTestServer(t)
+	srv := httptest.NewServer(s.http.Handler)
+	defer srv.Close()
+
+	assertError(t, serve(s, http.MethodGet, "/api/events", ""), http.StatusBadRequest, "bad_request")
+	assertError(t, serve(s, http.MethodGet, "/api/events?topics=blocks,nope", ""), http.StatusBadRequest, "bad_request")
+	many := make([]string, maxTopics+1)
+	for i := range many {
+		many[i] = fmt.Sprintf("address:%d", i)
+	}
+	assertError(t, serve(s, http.MethodGet, "/api/events?topics="+strings.Join(many, ","), ""), http.StatusBadRequest, "bad_request")
+	assertError(t, serve(s, http.MethodPost, "/api/events?topics=blocks", ""), http.StatusMethodNotAllowed, "method_not_allowed")
+	waitClients(t, s.hub, 0)
+
+	resp, err := http.Get(srv.URL + "/api/events?topics=blocks,%20reorgs")
+	if err != nil {
+		t.Fatalf("GET /api/events: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" || resp.Header.Get("Cache-Control") != "no-cache" {
+		t.Fatalf("GET /api/events = %d %v", resp.StatusCode, resp.Header)
+	}
+	r := bufio.NewReader(resp.Body)
+	readLine := func() string {
+		t.Helper()
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the stream: %v", err)
+		}
+		return strings.TrimSuffix(line, "\n")
+	}
+	// comments keep the idle stream alive, each ends with a blank line
+	if line := readLine(); line != ": keep-alive" {
+		t.Fatalf("line %q, want a keep-alive", line)
+	}
+	if line := readLine(); line != "" {
+		t.Fatalf("line %q after the keep-alive", line)
+	}
+
+	b1 := chain.Block(chain.Genesis())
+	chain.Put(b1)
+	line := readLine()
+	for line == ": keep-alive" || line == "" {
+		line = readLine()
+	}
+	if line != "event: block_connected" {
+		t.Fatalf("line %q, want the event name", line)
+	}
+	data, ok := strings.CutPrefix(readLine(), "data: ")
+	var msg message
+	if !ok || json.Unmarshal([]byte(data), &msg) != nil || msg.Topic != "blocks" || msg.Height != 1 || msg.BlockHash != database.Hash(b1.BlockHash().String()) {
+		t.Fatalf("data %q", data)
+	}
+	if line := readLine(); line != "" {
+		t.Fatalf("line %q after the data, want a blank line", line)
+	}
+
+	// a dropped client's stream ends
+	dropAll(s.hub)
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := r.ReadString('\n'); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream still open after the drop")
+		}
+	}
+}
+
+// wsMessage decodes both the replies and the messages of a websocket
+type wsMessage struct {
+	Type          string   `json:"type"`
+	Topic         string   `json:"topic"`
+	Topics        []string `json:"topics"`
+	Message       string   `json:"message"`
+	Confirmations int32    `json:"confirmations"`
+}
+
+func TestWebSocket(t *testing.T) {
+	s, _, chain := newTestServer(t)
+	srv := httptest.NewServer(s.http.Handler)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/ws?topics=blocks", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	read := func() wsMessage {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var msg wsMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("ReadJSON: %v", err)
+		}
+		return msg
+	}
+	request := func(req string) wsMessage {
+		t.Helper()
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(req)); err != nil {
+			t.Fatalf("WriteMessage: %v", err)
+		}
+		return read()
+	}
+
+	if reply := read(); reply.Type != "subscribed" || len(reply.Topics) != 1 || reply.Topics[0] != "blocks" {
+		t.Fatalf("reply %+v to the query topics", reply)
+	}
+	b1 := chain.Block(chain.Genesis())
+	tx := chain.Spend(b1.Transactions[0], 0)
+	txid := tx.TxHash().String()
+	tests := []struct {
+		req   string
+		reply wsMessage
+	}{
+		{`{"op":"subscribe","topics":["tx:` + strings.ToUpper(txid) + `","reorgs"]}`, wsMessage{Type: "subscribed", Topics: []string{"reorgs", "tx:" + txid + ":1"}}},
+		{`{"op":"subscribe","topics":["reorgs"]}`, wsMessage{Type: "subscribed"}},
+		{`{"op":"unsubscribe","topics":["blocks","reorgs","nope"]}`, wsMessage{Type: "unsubscribed", Topics: []string{"blocks", "reorgs"}}},
+		{`{"op":"subscribe","topics":["nope"]}`, wsMessage{Type: "error", Message: `unknown topic "nope"`}},
+		{`{"op":"list"}`, wsMessage{Type: "error", Message: "op must be subscribe or unsubscribe"}},
+		{`{"op":`, wsMessage{Type: "error", Message: "invalid JSON"}},
+	}
+	for _, test := range tests {
+		reply := request(test.req)
+		sort.Strings(reply.Topics)
+		if reply.Type != test.reply.Type || reply.Message != test.reply.Message || strings.Join(reply.Topics, ",") != strings.Join(test.reply.Topics, ",") {
+			t.Fatalf("reply %+v to %s, want %+v", reply, test.req, test.reply)
+		}
+	}
+
+	// unsubscribed from blocks, the tx is the only message
+	chain.Put(b1, chain.Block(b1, tx))
+	if msg := read(); msg.Type != typeTxConfirmations || msg.Topic != "tx:"+txid+":1" || msg.Confirmations != 1 {
+		t.Fatalf("message %+v, want the tx confirmed", msg)
+	}
+
+	// a dropped client is closed as too slow
+	dropAll(s.hub)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("ReadMessage after the drop: %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"btc-indexer/database"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// timeoutBody answers the requests that time out
+const timeoutBody = `{"error":{"code":"timeout","message":"request timed out"}}`
+
+type errorBody struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// page is the body of list endpoints, NextCursor is empty on the last page
+type page struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	var body errorBody
+	body.Error.Code = code
+	body.Error.Message = message
+	writeJSON(w, status, body)
+}
+
+// writeResult writes body or the error a store getter returned along with it
+func (s *Server) writeResult(w http.ResponseWriter, what string, body interface{}, err error) {
+	if err != nil {
+		s.writeStoreError(w, what, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+func (s *Server) writeStoreError(w http.ResponseWriter, what string, err error) {
+	if errors.Is(err, database.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", what+" not found")
+		return
+	}
+	// a cancelled or timed out request is no store failure, the timeout handler answered it already
+	if isCancelled(err) {
+		writeError(w, http.StatusServiceUnavailable, "timeout", "request timed out")
+		return
+	}
+	s.logger.Error(err.Error())
+	writeError(w, http.StatusInternalServerError, "internal", "internal error")
+}
+
+func isCancelled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// pageParams reads the cursor and limit query parameters, a missing cursor starts at the first item
+func pageParams(r *http.Request) (*database.Cursor, int64, error) {
+	limit := int64(defaultPageLimit)
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, 0, errors.New("limit must be a positive integer")
+		}
+		limit = min(n, maxPageLimit)
+	}
+
+	value := r.URL.Query().Get("cursor")
+	if value == "" {
+		return nil, limit, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, 0, errors.New("invalid cursor")
+	}
+	var cursor database.Cursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, 0, errors.New("invalid cursor")
+	}
+	return &cursor, limit, nil
+}
+
+// encodeCursor returns the opaque form of cursor handed to clients
+func encodeCursor(cursor *database.Cursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
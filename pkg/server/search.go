@@ -0,0 +1,175 @@
+package server
+
+import (
+	"btc-indexer/database"
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+// errBadOutPoint rejects a txid followed by a colon and anything but an output index
+var errBadOutPoint = errors.New("expected txid:vout with vout a non-negative integer")
+
+const (
+	// minPrefixLength hex characters are needed before an input is looked up as a hash prefix
+	minPrefixLength = 4
+	// prefixLimit blocks and prefixLimit txs at most are answered for a hash prefix
+	prefixLimit = 10
+)
+
+// searchResult is an indexed resource matching a search, Link is where the API serves it
+type searchResult struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	Link string `json:"link"`
+}
+
+type searchResponse struct {
+	Query   string         `json:"query"`
+	Results []searchResult `json:"results"`
+}
+
+// GET /api/search?q={height, block hash, txid, txid:vout, address or hash prefix}
+// answers every indexed resource the input may stand for, block heights first, hash prefix matches last
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		writeError(w, http.StatusBadRequest, "bad_request", "expected a q parameter")
+		return
+	}
+
+	results, err := s.search(r.Context(), query)
+	if errors.Is(err, errBadOutPoint) {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	if err != nil {
+		s.writeStoreError(w, "search result", err)
+		return
+	}
+	if len(results) == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "no block, transaction, outpoint or address matches "+strconv.Quote(query))
+		return
+	}
+	writeJSON(w, http.StatusOK, searchResponse{Query: query, Results: results})
+}
+
+func (s *Server) search(ctx context.Context, query string) ([]searchResult, error) {
+	results := make([]searchResult, 0)
+	add := func(result searchResult, err error) error {
+		if errors.Is(err, database.ErrNotFound) {
+			return nil
+		}
+		if err == nil {
+			results = append(results, result)
+		}
+		return err
+	}
+
+	// a height, digits may also start a hash
+	if height, err := strconv.ParseInt(query, 10, 32); err == nil && height >= 0 && query[0] != '+' {
+		if err := add(s.searchHeight(ctx, int32(height))); err != nil {
+			return nil, err
+		}
+	}
+
+	if txid, vout, ok := strings.Cut(query, ":"); ok && isHash(txid) {
+		index, err := strconv.ParseUint(vout, 10, 32)
+		if err != nil {
+			return nil, errBadOutPoint
+		}
+		return results, add(s.searchOutPoint(ctx, strings.ToLower(txid), uint32(index)))
+	}
+
+	if isHash(query) {
+		hash := strings.ToLower(query)
+		if err := add(s.searchBlock(ctx, hash)); err != nil {
+			return nil, err
+		}
+		return results, add(s.searchTx(ctx, hash))
+	}
+
+	if address, ok := s.decodeAddress(query); ok {
+		return results, add(s.searchAddress(ctx, address))
+	}
+
+	if len(query) >= minPrefixLength && len(query) < 64 && isHex(query) {
+		blocks, err := s.store.GetBlocksByPrefix(ctx, query, prefixLimit)
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range blocks {
+			results = append(results, blockResult(block))
+		}
+		txs, err := s.store.GetTxsByPrefix(ctx, query, prefixLimit)
+		if err != nil {
+			return nil, err
+		}
+		for _, tx := range txs {
+			results = append(results, txResult(string(tx.ID)))
+		}
+	}
+	return results, nil
+}
+
+func (s *Server) searchHeight(ctx context.Context, height int32) (searchResult, error) {
+	hash, err := s.store.GetBlockHashByHeight(ctx, height)
+	if err != nil {
+		return searchResult{}, err
+	}
+	return searchResult{Type: "block", ID: hash, Link: "/api/blocks/" + hash}, nil
+}
+
+func (s *Server) searchBlock(ctx context.Context, hash string) (searchResult, error) {
+	block, err := s.store.GetBlockByHash(ctx, hash)
+	return blockResult(block), err
+}
+
+func (s *Server) searchTx(ctx context.Context, txid string) (searchResult, error) {
+	_, err := s.store.GetTx(ctx, txid)
+	return txResult(txid), err
+}
+
+func (s *Server) searchOutPoint(ctx context.Context, txid string, index uint32) (searchResult, error) {
+	if _, err := s.store.GetOutPoint(ctx, txid, index); err != nil {
+		return searchResult{}, err
+	}
+	id := txid + ":" + strconv.FormatUint(uint64(index), 10)
+	return searchResult{Type: "outpoint", ID: id, Link: "/api/outpoints/" + txid + "/" + strconv.FormatUint(uint64(index), 10)}, nil
+}
+
+func (s *Server) searchAddress(ctx context.Context, address string) (searchResult, error) {
+	if _, err := s.store.GetAddress(ctx, address); err != nil {
+		return searchResult{}, err
+	}
+	return searchResult{Type: "address", ID: address, Link: "/api/addresses/" + url.PathEscape(address)}, nil
+}
+
+// decodeAddress returns the indexed form of an address of the configured network, pasted alone or as a bitcoin: URI.
+// raw public keys are left to the hash prefix search
+func (s *Server) decodeAddress(value string) (string, bool) {
+	if len(value) > len("bitcoin:") && strings.EqualFold(value[:len("bitcoin:")], "bitcoin:") {
+		value, _, _ = strings.Cut(value[len("bitcoin:"):], "?")
+	}
+	if isHex(value) {
+		return "", false
+	}
+	address, err := btcutil.DecodeAddress(value, s.chainParams)
+	if err != nil || !address.IsForNet(s.chainParams) {
+		return "", false
+	}
+	return address.EncodeAddress(), true
+}
+
+func blockResult(block database.Block) searchResult {
+	return searchResult{Type: "block", ID: string(block.ID), Link: "/api/blocks/" + string(block.ID)}
+}
+
+func txResult(txid string) searchResult {
+	return searchResult{Type: "transaction", ID: txid, Link: "/api/txs/" + txid}
+}
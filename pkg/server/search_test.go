@@ -0,0 +1,144 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// digitPrefix returns the first minPrefixLength characters of the first hash starting with as many digits
+func digitPrefix(hashes []string) (string, bool) {
+	for _, hash := range hashes {
+		prefix := hash[:minPrefixLength]
+		if _, err := strconv.Atoi(prefix); err == nil {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+func TestSearch(t *testing.T) {
+	s, _, chain := newTestServer(t)
+	pkScript := []byte{0x00, 0x14, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	addr := address(t, pkScript)
+	b1 := chain.Block(chain.Genesis())
+	tx := pay(b1.Transactions[0], 0, pkScript)
+	b2 := chain.Block(b1, tx)
+	chain.Put(b1, b2)
+
+	// more blocks until a hash starts with digits, an all-digit input is both a height and a hash prefix
+	best := []*wire.MsgBlock{chain.Genesis(), b1, b2}
+	hashes := []string{b1.BlockHash().String(), b2.BlockHash().String(), tx.TxHash().String()}
+	prefix, ok := digitPrefix(hashes)
+	for !ok {
+		next := chain.Block(best[len(best)-1])
+		chain.Put(next)
+		best = append(best, next)
+		hashes = []string{next.BlockHash().String(), next.Transactions[0].TxHash().String()}
+		prefix, ok = digitPrefix(hashes)
+	}
+	prefixed := searchResult{Type: "transaction", ID: hashes[len(hashes)-1], Link: "/api/txs/" + hashes[len(hashes)-1]}
+	if strings.HasPrefix(hashes[0], prefix) {
+		prefixed = searchResult{Type: "block", ID: hashes[0], Link: "/api/blocks/" + hashes[0]}
+	}
+
+	mainnet, err := btcutil.NewAddressWitnessPubKeyHash(pkScript[2:], &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("NewAddressWitnessPubKeyHash: %v", err)
+	}
+	unused, err := btcutil.NewAddressWitnessPubKeyHash(make([]byte, 20), &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatalf("NewAddressWitnessPubKeyHash: %v", err)
+	}
+
+	block := func(b *wire.MsgBlock) searchResult {
+		hash := b.BlockHash().String()
+		return searchResult{Type: "block", ID: hash, Link: "/api/blocks/" + hash}
+	}
+	txid := tx.TxHash().String()
+	txResult := searchResult{Type: "transaction", ID: txid, Link: "/api/txs/" + txid}
+	addrResult := searchResult{Type: "address", ID: addr, Link: "/api/addresses/" + addr}
+
+	type searchTest struct {
+		name     string
+		query    string
+		status   int
+		results  []searchResult // wanted in order
+		contains bool           // other results may come along
+	}
+	tests := []searchTest{
+		{"height", "1", http.StatusOK, []searchResult{block(b1)}, false},
+		{"genesis height", "0", http.StatusOK, []searchResult{block(chain.Genesis())}, false},
+		{"spaced height", " 2 ", http.StatusOK, []searchResult{block(b2)}, false},
+		{"height above the tip", "999", http.StatusNotFound, nil, false},
+		{"signed height", "+1", http.StatusNotFound, nil, false},
+		{"negative height", "-1", http.StatusNotFound, nil, false},
+		{"block hash", strings.ToUpper(b2.BlockHash().String()), http.StatusOK, []searchResult{block(b2)}, false},
+		{"txid", txid, http.StatusOK, []searchResult{txResult}, false},
+		{"unknown hash", strings.Repeat("ab", 32), http.StatusNotFound, nil, false},
+		{"outpoint", strings.ToUpper(txid) + ":1", http.StatusOK, []searchResult{{Type: "outpoint", ID: txid + ":1", Link: "/api/outpoints/" + txid + "/1"}}, false},
+		{"unknown outpoint", txid + ":2", http.StatusNotFound, nil, false},
+		{"outpoint of an unknown tx", strings.Repeat("ab", 32) + ":0", http.StatusNotFound, nil, false},
+		{"vout not a number", txid + ":abc", http.StatusBadRequest, nil, false},
+		{"negative vout", txid + ":-1", http.StatusBadRequest, nil, false},
+		{"missing vout", txid + ":", http.StatusBadRequest, nil, false},
+		{"address", addr, http.StatusOK, []searchResult{addrResult}, false},
+		{"bitcoin uri", "bitcoin:" + addr + "?amount=1&label=x", http.StatusOK, []searchResult{addrResult}, false},
+		{"upper case uri", "BITCOIN:" + addr, http.StatusOK, []searchResult{addrResult}, false},
+		{"empty uri", "bitcoin:", http.StatusNotFound, nil, false},
+		{"address of another network", mainnet.EncodeAddress(), http.StatusNotFound, nil, false},
+		{"address without history", unused.EncodeAddress(), http.StatusNotFound, nil, false},
+		{"block hash prefix", b1.BlockHash().String()[:10], http.StatusOK, []searchResult{block(b1)}, true},
+		{"txid prefix", strings.ToUpper(txid[:minPrefixLength+1]), http.StatusOK, []searchResult{txResult}, true},
+		{"prefix too short", txid[:minPrefixLength-1], http.StatusNotFound, nil, false},
+		{"not hex", "xyz1", http.StatusNotFound, nil, false},
+	}
+	digits := searchTest{"digits", prefix, http.StatusOK, []searchResult{prefixed}, true}
+	if height, _ := strconv.Atoi(prefix); height < len(best) {
+		digits.results = []searchResult{block(best[height]), prefixed}
+	}
+	// zero padded digits long enough for a prefix are a height still
+	tests = append(tests, digits, searchTest{"padded height", "0002", http.StatusOK, []searchResult{block(b2)}, true})
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := "/api/search?q=" + url.QueryEscape(test.query)
+			if test.status != http.StatusOK {
+				code := "not_found"
+				if test.status == http.StatusBadRequest {
+					code = "bad_request"
+				}
+				assertError(t, get(t, s, path, nil), test.status, code)
+				return
+			}
+			var body searchResponse
+			if w := get(t, s, path, &body); w.Code != http.StatusOK {
+				t.Fatalf("GET %s = %d %s", path, w.Code, w.Body)
+			}
+			if body.Query != strings.TrimSpace(test.query) {
+				t.Fatalf("query %q, want %q", body.Query, test.query)
+			}
+			if !test.contains && len(body.Results) != len(test.results) {
+				t.Fatalf("results %+v, want %+v", body.Results, test.results)
+			}
+			// wanted results come in order, a height before the prefix matches
+			next := 0
+			for _, result := range body.Results {
+				if next < len(test.results) && result == test.results[next] {
+					next++
+				}
+			}
+			if next != len(test.results) {
+				t.Fatalf("results %+v, want %+v in order", body.Results, test.results)
+			}
+		})
+	}
+	assertError(t, get(t, s, "/api/search", nil), http.StatusBadRequest, "bad_request")
+	assertError(t, get(t, s, "/api/search?q=%20", nil), http.StatusBadRequest, "bad_request")
+}
@@ -1 +1,113 @@
 package server
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/pkg/blockchain"
+	"btc-indexer/pkg/logger"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// DefaultAddress is listened on when no address is configured
+const DefaultAddress = "127.0.0.1:8080"
+
+// DefaultRequestTimeout bounds a request when no timeout is configured
+const DefaultRequestTimeout = 10 * time.Second
+
+// Server serves the indexed chain over an HTTP JSON API
+type Server struct {
+	store       database.Store
+	chainParams *chaincfg.Params
+	broadcaster *blockchain.Broadcaster
+	hub         *hub
+	http        *http.Server
+	logger      *logger.CustomLogger
+}
+
+// NewServer returns a server for store listening on address, requests taking longer than timeout are answered with an error.
+// esplora and searched addresses are decoded for chainParams, submitted txs are relayed by broadcaster
+func NewServer(address string, timeout time.Duration, chainParams *chaincfg.Params, broadcaster *blockchain.Broadcaster, store database.Store) *Server {
+	if address == "" {
+		address = DefaultAddress
+	}
+	if timeout <= 0 {
+		timeout = DefaultRequestTimeout
+	}
+
+	s := &Server{
+		store:       store,
+		chainParams: chainParams,
+		broadcaster: broadcaster,
+		hub:         newHub(store),
+		logger:      logger.NewDefaultLogger(),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/tip", s.handleTip)
+	mux.HandleFunc("/api/blocks/", s.handleBlock)
+	mux.HandleFunc("/api/txs/", s.handleTx)
+	mux.HandleFunc("/api/outpoints", s.handleOutPoints)
+	mux.HandleFunc("/api/outpoints/", s.handleOutPoint)
+	mux.HandleFunc("/api/addresses/", s.handleAddress)
+	mux.HandleFunc("/api/broadcasts/", s.handleBroadcast)
+	mux.HandleFunc("/api/search", s.handleSearch)
+	mux.HandleFunc("/esplora/", s.handleEsplora)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "not_found", "no such endpoint")
+	})
+
+	// push connections stay open, they bypass the request timeout
+	root := http.NewServeMux()
+	root.Handle("/api/events", jsonContent(getOnly(http.HandlerFunc(s.handleEvents))))
+	root.HandleFunc("/api/ws", s.handleWebSocket)
+	root.Handle("/api/broadcasts", jsonContent(http.TimeoutHandler(http.HandlerFunc(s.handleBroadcasts), timeout, timeoutBody)))
+	root.Handle("/", jsonContent(http.TimeoutHandler(getOnly(mux), timeout, timeoutBody)))
+
+	s.http = &http.Server{
+		Addr:              address,
+		Handler:           root,
+		ReadHeaderTimeout: timeout,
+		ReadTimeout:       timeout,
+		WriteTimeout:      timeout + time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	return s
+}
+
+// Start serves until Shutdown is called
+func (s *Server) Start() error {
+	s.logger.Info("API server listening on " + s.http.Addr)
+	err := s.http.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting requests and waits for the running ones until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.http.Shutdown(ctx)
+}
+
+// jsonContent sets the content type before the timeout handler so its error body is json too
+func jsonContent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		next.ServeHTTP(w, r)
+	})
+}
+
+func getOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "only GET is supported")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/database/storetest"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// newTestServer serves a regtest memory store
+func newTestServer(t *testing.T) (*Server, database.Store, *storetest.Chain) {
+	store := database.NewMemoryStore(&chaincfg.RegressionNetParams)
+	chain := storetest.NewChain(t, store)
+	return NewServer("", 0, &chaincfg.RegressionNetParams, nil, store), store, chain
+}
+
+// serve answers a request of method for path with body
+func serve(s *Server, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+// get answers a GET of path, decoding a JSON body into body
+func get(t *testing.T, s *Server, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	w := serve(s, http.MethodGet, path, "")
+	if body != nil && w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), body); err != nil {
+			t.Fatalf("GET %s: %v in %s", path, err, w.Body)
+		}
+	}
+	return w
+}
+
+// assertError checks w is a JSON error body with status and code
+func assertError(t *testing.T, w *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	var body errorBody
+	if w.Code != status || w.Header().Get("Content-Type") != "application/json" || json.Unmarshal(w.Body.Bytes(), &body) != nil ||
+		body.Error.Code != code || body.Error.Message == "" {
+		t.Fatalf("answered %d %s %q, want %d with error code %s", w.Code, w.Header().Get("Content-Type"), w.Body, status, code)
+	}
+}
+
+func address(t *testing.T, pkScript []byte) string {
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(pkScript, &chaincfg.RegressionNetParams)
+	if err != nil || len(addrs) != 1 {
+		t.Fatalf("address of %x: %v", pkScript, err)
+	}
+	return addrs[0].EncodeAddress()
+}
+
+// pay returns a tx spending output index of prev into two outputs to pkScript
+func pay(prev *wire.MsgTx, index uint32, pkScript []byte) *wire.MsgTx {
+	tx := wire.NewMsgTx(wire.TxVersion)
+	prevHash := prev.TxHash()
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prevHash, index), nil, [][]byte{{0x30, byte(index)}, {0x02}}))
+	value := prev.TxOut[index].Value
+	tx.AddTxOut(wire.NewTxOut(value/2, pkScript))
+	tx.AddTxOut(wire.NewTxOut(value/2-1000, pkScript))
+	return tx
+}
+
+func TestBlocksAndTxs(t *testing.T) {
+	s, _, chain := newTestServer(t)
+	b1 := chain.Block(chain.Genesis())
+	spend := chain.Spend(b1.Transactions[0], 0)
+	b2 := chain.Block(b1, spend)
+	chain.Put(b1, b2)
+
+	var tip tip
+	if w := get(t, s, "/api/tip", &tip); w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("GET /api/tip = %d %s", w.Code, w.Body)
+	}
+	if tip.Height != 2 || tip.Hash != b2.BlockHash().String() {
+		t.Fatalf("tip %+v", tip)
+	}
+
+	for _, id := range []string{"1", b1.BlockHash().String(), strings.ToUpper(b1.BlockHash().String())} {
+		var block database.Block
+		if w := get(t, s, "/api/blocks/"+id, &block); w.Code != http.StatusOK {
+			t.Fatalf("GET block %s = %d %s", id, w.Code, w.Body)
+		}
+		if string(block.ID) != b1.BlockHash().String() || block.Height != 1 || block.TxCount != 1 {
+			t.Fatalf("block %s %+v", id, block)
+		}
+	}
+
+	var tx database.Transaction
+	get(t, s, "/api/txs/"+spend.TxHash().String(), &tx)
+	if string(tx.ID) != spend.TxHash().String() || string(tx.BlockHash) != b2.BlockHash().String() || tx.Confirmations != 1 || tx.Fee != 1000 {
+		t.Fatalf("tx %+v", tx)
+	}
+
+	var funded, spent page
+	var fundedItems, spentItems []database.OutPoint
+	funded.Items, spent.Items = &fundedItems, &spentItems
+	get(t, s, "/api/outpoints?funding_tx="+spend.TxHash().String(), &funded)
+	get(t, s, "/api/outpoints?spending_tx="+spend.TxHash().String(), &spent)
+	if len(fundedItems) != 2 || fundedItems[1].FundingTxIndex != 1 || fundedItems[1].Value != spend.TxOut[1].Value {
+		t.Fatalf("outpoints funded by the tx %+v", fundedItems)
+	}
+	if len(spentItems) != 1 || string(spentItems[0].FundingTxHash) != b1.Transactions[0].TxHash().String() || string(spentItems[0].SpendingTxHash) != spend.TxHash().String() {
+		t.Fatalf("outpoints spent by the tx %+v", spentItems)
+	}
+
+	var outPoint database.OutPoint
+	get(t, s, "/api/outpoints/"+b1.Transactions[0].TxHash().String()+"/0", &outPoint)
+	if !outPoint.Coinbase || string(outPoint.SpendingTxHash) != spend.TxHash().String() || outPoint.SpendingHeight != 2 {
+		t.Fatalf("outpoint %+v", outPoint)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	s, _, chain := newTestServer(t)
+	b1 := chain.Block(chain.Genesis())
+	chain.Put(b1)
+	txid := b1.Transactions[0].TxHash().String()
+	unknown := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		path   string
+		status int
+		code   string
+	}{
+		{"/api/blocks/2", http.StatusNotFound, "not_found"},
+		{"/api/blocks/" + unknown, http.StatusNotFound, "not_found"},
+		{"/api/blocks/-1", http.StatusBadRequest, "bad_request"},
+		{"/api/blocks/abc", http.StatusBadRequest, "bad_request"},
+		{"/api/blocks/", http.StatusNotFound, "not_found"},
+		{"/api/blocks/1/txs", http.StatusNotFound, "not_found"},
+		{"/api/txs/" + unknown, http.StatusNotFound, "not_found"},
+		{"/api/txs/" + txid[:63], http.StatusBadRequest, "bad_request"},
+		{"/api/txs/" + strings.Repeat("zz", 32), http.StatusBadRequest, "bad_request"},
+		{"/api/outpoints", http.StatusBadRequest, "bad_request"},
+		{"/api/outpoints?funding_tx=abc", http.StatusBadRequest, "bad_request"},
+		{"/api/outpoints/" + txid + "/1", http.StatusNotFound, "not_found"},
+		{"/api/outpoints/" + txid + "/x", http.StatusBadRequest, "bad_request"},
+		{"/api/outpoints/" + txid + "/-1", http.StatusBadRequest, "bad_request"},
+		{"/api/outpoints/" + txid, http.StatusNotFound, "not_found"},
+		{"/api/addresses/unknown", http.StatusNotFound, "not_found"},
+		{"/api/addresses/unknown/balance", http.StatusNotFound, "not_found"},
+		{"/api/addresses/", http.StatusNotFound, "not_found"},
+		{"/api/addresses/a/history?limit=0", http.StatusBadRequest, "bad_request"},
+		{"/api/addresses/a/history?limit=x", http.StatusBadRequest, "bad_request"},
+		{"/api/addresses/a/utxos?cursor=!", http.StatusBadRequest, "bad_request"},
+		{"/api/addresses/a/utxos?cursor=e30", http.StatusOK, ""},
+		{"/api/addresses/a/utxos?cursor=bm90IGpzb24", http.StatusBadRequest, "bad_request"},
+		{"/api/nothing", http.StatusNotFound, "not_found"},
+		{"/", http.StatusNotFound, "not_found"},
+	}
+	for _, test := range tests {
+		w := get(t, s, test.path, nil)
+		if test.status == http.StatusOK {
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET %s = %d %s", test.path, w.Code, w.Body)
+			}
+			continue
+		}
+		t.Run(test.path, func(t *testing.T) { assertError(t, w, test.status, test.code) })
+	}
+
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+		w := serve(s, method, "/api/tip", "")
+		assertError(t, w, http.StatusMethodNotAllowed, "method_not_allowed")
+		if w.Header().Get("Allow") != "GET, HEAD" {
+			t.Fatalf("%s answered Allow %q", method, w.Header().Get("Allow"))
+		}
+	}
+	if w := serve(s, http.MethodHead, "/api/tip", ""); w.Code != http.StatusOK {
+		t.Fatalf("HEAD answered %d", w.Code)
+	}
+}
+
+func TestAddressPages(t *testing.T) {
+	s, _, chain := newTestServer(t)
+	b1 := chain.Block(chain.Genesis())
+	// every tx pays the same address and spends its output 1 of the one before
+	pkScript := chain.Spend(b1.Transactions[0], 0).TxOut[0].PkScript
+	addr := address(t, pkScript)
+	blocks := []*wire.MsgBlock{b1}
+	txs := []*wire.MsgTx{pay(b1.Transactions[0], 0, pkScript)}
+	for i := 1; i < 7; i++ {
+		txs = append(txs, pay(txs[i-1], 1, pkScript))
+	}
+	for _, tx := range txs {
+		blocks = append(blocks, chain.Block(blocks[len(blocks)-1], tx))
+	}
+	chain.Put(blocks...)
+
+	var summary database.Address
+	get(t, s, "/api/addresses/"+addr, &summary)
+	if summary.ID != addr || summary.TxCount != int64(len(txs)) || summary.UTXOCount != int64(len(txs)+1) || summary.FirstSeenHeight != 2 {
+		t.Fatalf("address %+v", summary)
+	}
+
+	// pages of 3 follow the cursor of the page before, the last one has none
+	var history []database.HistoryItem
+	path := "/api/addresses/" + addr + "/history?limit=3"
+	for pages := 0; ; pages++ {
+		var items []database.HistoryItem
+		body := page{Items: &items}
+		if w := get(t, s, path, &body); w.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d %s", path, w.Code, w.Body)
+		}
+		if len(items) > 3 || pages > 3 {
+			t.Fatalf("page %d has %d items", pages, len(items))
+		}
+		history = append(history, items...)
+		if body.NextCursor == "" {
+			break
+		}
+		path = "/api/addresses/" + addr + "/history?limit=3&cursor=" + body.NextCursor
+	}
+	if len(history) != len(txs) {
+		t.Fatalf("history has %d txs, want %d", len(history), len(txs))
+	}
+	for i, item := range history {
+		if string(item.TxHash) != txs[i].TxHash().String() || item.Height != int32(i+2) || item.Position != 1 {
+			t.Fatalf("history item %d %+v, want %s", i, item, txs[i].TxHash())
+		}
+	}
+
+	var utxos []database.OutPoint
+	path = "/api/addresses/" + addr + "/utxos?limit=4"
+	for {
+		var items []database.OutPoint
+		body := page{Items: &items}
+		get(t, s, path, &body)
+		utxos = append(utxos, items...)
+		if body.NextCursor == "" {
+			break
+		}
+		path = "/api/addresses/" + addr + "/utxos?limit=4&cursor=" + body.NextCursor
+	}
+	if len(utxos) != len(txs)+1 {
+		t.Fatalf("%d utxos, want %d", len(utxos), len(txs)+1)
+	}
+	seen := make(map[string]bool)
+	for i, utxo := range utxos {
+		key := fmt.Sprintf("%s:%d", utxo.FundingTxHash, utxo.FundingTxIndex)
+		if seen[key] || utxo.SpendingTxHash != "" || (i > 0 && utxo.FundingHeight < utxos[i-1].FundingHeight) {
+			t.Fatalf("utxo %d %+v", i, utxo)
+		}
+		seen[key] = true
+	}
+
+	// a full last page still gets a cursor, the page after it is empty
+	var items []database.HistoryItem
+	body := page{Items: &items}
+	get(t, s, "/api/addresses/"+addr+"/history?limit=7", &body)
+	if len(items) != 7 || body.NextCursor == "" {
+		t.Fatalf("full page of %d items, cursor %q", len(items), body.NextCursor)
+	}
+	items = nil
+	get(t, s, "/api/addresses/"+addr+"/history?limit=7&cursor="+body.NextCursor, &body)
+	if len(items) != 0 {
+		t.Fatalf("page after the last %+v", items)
+	}
+}
+
+// blockingStore answers GetBlockByHeight only once the request is cancelled
+type blockingStore struct {
+	database.Store
+}
+
+func (blockingStore) GetBlockByHeight(ctx context.Context, height int32) (database.Block, error) {
+	<-ctx.Done()
+	return database.Block{}, ctx.Err()
+}
+
+func TestTimeout(t *testing.T) {
+	store := database.NewMemoryStore(&chaincfg.RegressionNetParams)
+	storetest.NewChain(t, store)
+	s := NewServer("", 50*time.Millisecond, &chaincfg.RegressionNetParams, nil, blockingStore{store})
+
+	start := time.Now()
+	w := get(t, s, "/api/blocks/0", nil)
+	if time.Since(start) > time.Second {
+		t.Fatalf("request took %s", time.Since(start))
+	}
+	assertError(t, w, http.StatusServiceUnavailable, "timeout")
+	if w.Body.String() != timeoutBody {
+		t.Fatalf("timeout body %q", w.Body)
+	}
+}
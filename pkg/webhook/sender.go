@@ -0,0 +1,249 @@
+package webhook
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/pkg/logger"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// pollInterval is how often due deliveries are looked for without a new block or replay
+	pollInterval = time.Second
+	// batchSize deliveries are sent per round, up to workers at a time
+	batchSize = 100
+	workers   = 8
+	// sendTimeout bounds a POST, receivers should answer before doing slow work
+	sendTimeout = 10 * time.Second
+	// maxAttempts failed attempts make a delivery dead, the retries back off from minBackoff doubling up to maxBackoff
+	maxAttempts = 8
+	minBackoff  = 10 * time.Second
+	maxBackoff  = time.Hour
+	// keepDepth blocks of delivered deliveries are kept before they are pruned
+	keepDepth = 100
+)
+
+// payload is the body POSTed to a watch URL. Confirmations is 0 for tx_orphaned
+type payload struct {
+	ID            string             `json:"id"`
+	Type          database.EventType `json:"type"`
+	WatchID       string             `json:"watch_id"`
+	Kind          string             `json:"kind"`
+	Target        string             `json:"target"`
+	TxHash        database.Hash      `json:"txid"`
+	BlockHash     database.Hash      `json:"block_hash"`
+	Height        int32              `json:"height"`
+	Confirmations int32              `json:"confirmations"`
+	Attempt       int                `json:"attempt"`
+}
+
+// sender POSTs the due deliveries. a delivery may be sent more than once, receivers dedupe by the X-Webhook-Id header
+type sender struct {
+	store  database.Store
+	secret []byte
+	client *http.Client
+	wake   chan struct{}
+	quit   chan struct{}
+	done   chan struct{}
+	ctx    context.Context // cancelled by stop to abort the deliveries in flight
+	cancel context.CancelFunc
+	pruned int32
+	logger *logger.CustomLogger
+}
+
+func newSender(secret string, store database.Store) *sender {
+	s := &sender{
+		store:  store,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: sendTimeout},
+		wake:   make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+		logger: logger.NewDefaultLogger(),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	store.Listen(func([]database.Event) { s.notify() })
+	return s
+}
+
+// notify wakes the sender, it must not block as it runs as a store listener
+func (s *sender) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *sender) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+		s.round(s.ctx)
+	}
+}
+
+// stop waits for the running round until ctx is done, then aborts the deliveries in flight.
+// an aborted delivery stays due and is sent again on the next start
+func (s *sender) stop(ctx context.Context) {
+	close(s.quit)
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+	}
+	s.cancel()
+}
+
+// fail logs err unless the sender is stopping, the store calls of a stopped round fail with the cancelled ctx
+func (s *sender) fail(ctx context.Context, err error) {
+	if ctx.Err() == nil {
+		s.logger.Error(err.Error())
+	}
+}
+
+// round sends the due deliveries and prunes the old delivered ones
+func (s *sender) round(ctx context.Context) {
+	tip, err := s.store.GetLatestBlockHeight()
+	if err != nil {
+		s.fail(ctx, err)
+		return
+	}
+	deliveries, err := s.store.GetDueDeliveries(ctx, tip, time.Now().Unix(), batchSize)
+	if err != nil {
+		s.fail(ctx, err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, workers)
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			break
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(delivery database.Delivery) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			s.attempt(ctx, delivery, tip)
+		}(delivery)
+	}
+	wg.Wait()
+
+	if tip-keepDepth > s.pruned {
+		if err := s.store.PruneDeliveries(ctx, tip-keepDepth); err != nil {
+			s.fail(ctx, err)
+			return
+		}
+		s.pruned = tip - keepDepth
+	}
+}
+
+func (s *sender) attempt(ctx context.Context, delivery database.Delivery, tip int32) {
+	delivery.Attempts++
+	err := s.send(ctx, delivery, tip)
+	if ctx.Err() != nil {
+		// aborted by stop, the delivery is left due
+		return
+	}
+	if err == nil {
+		delivery.Status = database.DeliveryDelivered
+		delivery.LastError = ""
+	} else {
+		delivery.LastError = err.Error()
+		// a replayed delivery gets another maxAttempts attempts
+		if delivery.Attempts%maxAttempts == 0 {
+			delivery.Status = database.DeliveryDead
+		} else {
+			delivery.NextAttempt = time.Now().Add(backoff(delivery.Attempts % maxAttempts)).Unix()
+		}
+	}
+
+	err = s.store.UpdateDelivery(ctx, delivery)
+	if errors.Is(err, database.ErrNotFound) {
+		// the store cancelled the delivery while it was sent, its block left the best chain
+		if delivery.Type == database.EventTxConfirmed && delivery.Status == database.DeliveryDelivered {
+			err = s.store.AddDeliveries(ctx, []database.Delivery{database.OrphanedDelivery(delivery)})
+		} else {
+			err = nil
+		}
+	}
+	if err != nil {
+		s.fail(ctx, err)
+	}
+}
+
+// send POSTs a delivery signed with HMAC-SHA256 of the timestamp, a dot and the body
+func (s *sender) send(ctx context.Context, delivery database.Delivery, tip int32) error {
+	body := payload{
+		ID:        delivery.ID,
+		Type:      delivery.Type,
+		WatchID:   delivery.WatchID,
+		Kind:      delivery.Kind,
+		Target:    delivery.Target,
+		TxHash:    delivery.TxHash,
+		BlockHash: delivery.BlockHash,
+		Height:    delivery.Height,
+		Attempt:   delivery.Attempts,
+	}
+	if delivery.Type == database.EventTxConfirmed {
+		body.Confirmations = tip - delivery.Height + 1
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(data)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", delivery.ID)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
+
+// backoff is the wait after the nth failed attempt
+func backoff(attempts int) time.Duration {
+	wait := minBackoff
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, maxBackoff)
+}
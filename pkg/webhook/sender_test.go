@@ -0,0 +1,339 @@
+package webhook
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/database/storetest"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const testSecret = "test secret"
+
+var ctx = context.Background()
+
+// receiver is a webhook endpoint answering status and recording what it gets
+type receiver struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu       sync.Mutex
+	status   int
+	payloads []payload
+	hook     func() // runs before answering
+}
+
+func newReceiver(t *testing.T) *receiver {
+	r := &receiver{t: t, status: http.StatusOK}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *receiver) serve(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	timestamp := req.Header.Get("X-Webhook-Timestamp")
+	mac := hmac.New(sha256.New, []byte(testSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(req.Header.Get("X-Webhook-Signature")), []byte(want)) {
+		r.t.Errorf("signature %q, want %q", req.Header.Get("X-Webhook-Signature"), want)
+	}
+	if sent, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+		r.t.Errorf("timestamp %q", timestamp)
+	}
+
+	var p payload
+	if err := json.Unmarshal(body, &p); err != nil {
+		r.t.Errorf("payload %s: %v", body, err)
+	}
+	if req.Header.Get("X-Webhook-Id") != p.ID {
+		r.t.Errorf("X-Webhook-Id %q, payload id %q", req.Header.Get("X-Webhook-Id"), p.ID)
+	}
+
+	r.mu.Lock()
+	r.payloads = append(r.payloads, p)
+	status, hook := r.status, r.hook
+	r.hook = nil
+	r.mu.Unlock()
+	if hook != nil {
+		hook()
+	}
+	w.WriteHeader(status)
+}
+
+func (r *receiver) answer(status int) {
+	r.mu.Lock()
+	r.status = status
+	r.mu.Unlock()
+}
+
+func (r *receiver) received() []payload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]payload(nil), r.payloads...)
+}
+
+// setup returns a sender for a regtest memory store and a watch on the coinbase of a block it confirms at height 1
+func setup(t *testing.T, r *receiver) (*sender, database.Store, *storetest.Chain, database.Delivery) {
+	store := database.NewMemoryStore(&chaincfg.RegressionNetParams)
+	chain := storetest.NewChain(t, store)
+	s := newSender(testSecret, store)
+
+	b1 := chain.Block(chain.Genesis())
+	watch := database.Watch{ID: "w1", URL: r.server.URL, Kind: database.WatchTx, Target: b1.Transactions[0].TxHash().String(), Confirmations: 1}
+	if err := store.PutWatch(ctx, watch); err != nil {
+		t.Fatalf("PutWatch: %v", err)
+	}
+	chain.Put(b1)
+	txHash := database.Hash(watch.Target)
+	delivery, err := store.GetDelivery(ctx, database.DeliveryID(watch.ID, database.EventTxConfirmed, txHash, database.Hash(b1.BlockHash().String())))
+	if err != nil {
+		t.Fatalf("GetDelivery: %v", err)
+	}
+	return s, store, chain, delivery
+}
+
+func getDelivery(t *testing.T, store database.Store, id string) database.Delivery {
+	t.Helper()
+	delivery, err := store.GetDelivery(ctx, id)
+	if err != nil {
+		t.Fatalf("GetDelivery %s: %v", id, err)
+	}
+	return delivery
+}
+
+func TestDeliver(t *testing.T) {
+	r := newReceiver(t)
+	s, store, _, delivery := setup(t, r)
+	s.round(ctx)
+
+	received := r.received()
+	if len(received) != 1 {
+		t.Fatalf("received %+v, want one delivery", received)
+	}
+	want := payload{
+		ID:            delivery.ID,
+		Type:          database.EventTxConfirmed,
+		WatchID:       "w1",
+		Kind:          database.WatchTx,
+		Target:        delivery.Target,
+		TxHash:        delivery.TxHash,
+		BlockHash:     delivery.BlockHash,
+		Height:        1,
+		Confirmations: 1,
+		Attempt:       1,
+	}
+	if received[0] != want {
+		t.Fatalf("payload %+v, want %+v", received[0], want)
+	}
+	if got := getDelivery(t, store, delivery.ID); got.Status != database.DeliveryDelivered || got.Attempts != 1 || got.LastError != "" {
+		t.Fatalf("delivery %+v, want delivered", got)
+	}
+
+	// delivered ones are not sent again
+	s.round(ctx)
+	if received := r.received(); len(received) != 1 {
+		t.Fatalf("received %d deliveries, want 1", len(received))
+	}
+}
+
+func TestRetryUntilDead(t *testing.T) {
+	r := newReceiver(t)
+	r.answer(http.StatusInternalServerError)
+	s, store, _, delivery := setup(t, r)
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		before := time.Now().Unix()
+		s.round(ctx)
+		got := getDelivery(t, store, delivery.ID)
+		if got.Attempts != attempt || got.LastError != "receiver answered 500 Internal Server Error" {
+			t.Fatalf("attempt %d: delivery %+v", attempt, got)
+		}
+		if attempt == maxAttempts {
+			if got.Status != database.DeliveryDead {
+				t.Fatalf("delivery %+v, want dead after %d attempts", got, maxAttempts)
+			}
+			break
+		}
+		wait := int64(backoff(attempt).Seconds())
+		if got.Status != database.DeliveryPending || got.NextAttempt < before+wait || got.NextAttempt > time.Now().Unix()+wait {
+			t.Fatalf("attempt %d: delivery %+v, want pending %ds from now", attempt, got, wait)
+		}
+
+		// not due before the backoff is over
+		s.round(ctx)
+		if received := r.received(); len(received) != attempt {
+			t.Fatalf("attempt %d: received %d deliveries during the backoff", attempt, len(received))
+		}
+		got.NextAttempt = time.Now().Unix()
+		if err := store.UpdateDelivery(ctx, got); err != nil {
+			t.Fatalf("UpdateDelivery: %v", err)
+		}
+	}
+
+	// dead ones are not sent again until replayed
+	s.round(ctx)
+	if received := r.received(); len(received) != maxAttempts {
+		t.Fatalf("received %d deliveries, want %d", len(received), maxAttempts)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, minBackoff},
+		{2, 2 * minBackoff},
+		{3, 4 * minBackoff},
+		{7, 64 * minBackoff},
+		{10, maxBackoff},
+		{100, maxBackoff},
+	}
+	for _, test := range tests {
+		if got := backoff(test.attempts); got != test.want {
+			t.Errorf("backoff(%d) = %s, want %s", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	r := newReceiver(t)
+	s, store, _, delivery := setup(t, r)
+	dead := delivery
+	dead.Status = database.DeliveryDead
+	dead.Attempts = maxAttempts
+	dead.LastError = "receiver answered 500 Internal Server Error"
+	if err := store.UpdateDelivery(ctx, dead); err != nil {
+		t.Fatalf("UpdateDelivery: %v", err)
+	}
+
+	server, err := NewServer("", "", testSecret, &chaincfg.RegressionNetParams, store)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	server.sender = s
+	req := httptest.NewRequest(http.MethodPost, "/deliveries/"+delivery.ID+"/replay", nil)
+	w := httptest.NewRecorder()
+	server.http.Handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("replay answered %d %s", w.Code, w.Body)
+	}
+	if got := getDelivery(t, store, delivery.ID); got.Status != database.DeliveryPending || got.NextAttempt > time.Now().Unix() {
+		t.Fatalf("replayed delivery %+v, want pending and due", got)
+	}
+
+	// a replayed delivery gets another maxAttempts attempts, numbered on
+	s.round(ctx)
+	received := r.received()
+	if len(received) != 1 || received[0].Attempt != maxAttempts+1 {
+		t.Fatalf("received %+v, want attempt %d", received, maxAttempts+1)
+	}
+	if got := getDelivery(t, store, delivery.ID); got.Status != database.DeliveryDelivered {
+		t.Fatalf("delivery %+v, want delivered", got)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/deliveries/unknown/replay", nil)
+	w = httptest.NewRecorder()
+	server.http.Handler.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("replay of an unknown delivery answered %d %s", w.Code, w.Body)
+	}
+}
+
+// a reorg cancelling a delivery while it is sent leaves the receiver told of a tx that left the best chain,
+// so the sender queues the tx_orphaned delivery the store would have
+func TestOrphanedWhileSending(t *testing.T) {
+	r := newReceiver(t)
+	s, store, chain, delivery := setup(t, r)
+
+	side1 := chain.Block(chain.Genesis())
+	side2 := chain.Block(side1)
+	var reorgErr error
+	r.hook = func() {
+		for _, block := range []*wire.MsgBlock{side1, side2} {
+			if err := store.PutBlock(ctx, block); err != nil {
+				reorgErr = err
+			}
+		}
+	}
+	s.round(ctx)
+	if reorgErr != nil {
+		t.Fatalf("PutBlock: %v", reorgErr)
+	}
+	if _, err := store.GetDelivery(ctx, delivery.ID); err != database.ErrNotFound {
+		t.Fatalf("GetDelivery of the cancelled delivery: %v, want ErrNotFound", err)
+	}
+	orphaned := getDelivery(t, store, database.OrphanedDelivery(delivery).ID)
+	if orphaned.Type != database.EventTxOrphaned || orphaned.Status != database.DeliveryPending || orphaned.TxHash != delivery.TxHash {
+		t.Fatalf("orphaned delivery %+v", orphaned)
+	}
+
+	s.round(ctx)
+	received := r.received()
+	if len(received) != 2 || received[1].Type != database.EventTxOrphaned || received[1].ID != orphaned.ID || received[1].Confirmations != 0 {
+		t.Fatalf("received %+v, want the tx_orphaned delivery last", received)
+	}
+}
+
+// a failed attempt of a delivery cancelled meanwhile needs no follow-up, the receiver heard of nothing
+func TestCancelledWhileFailing(t *testing.T) {
+	r := newReceiver(t)
+	r.answer(http.StatusServiceUnavailable)
+	s, store, chain, delivery := setup(t, r)
+
+	side1 := chain.Block(chain.Genesis())
+	side2 := chain.Block(side1)
+	r.hook = func() {
+		store.PutBlock(ctx, side1)
+		store.PutBlock(ctx, side2)
+	}
+	s.round(ctx)
+	if _, err := store.GetDelivery(ctx, delivery.ID); err != database.ErrNotFound {
+		t.Fatalf("GetDelivery of the cancelled delivery: %v, want ErrNotFound", err)
+	}
+	if _, err := store.GetDelivery(ctx, database.OrphanedDelivery(delivery).ID); err != database.ErrNotFound {
+		t.Fatalf("GetDelivery of a tx_orphaned delivery: %v, want ErrNotFound", err)
+	}
+}
+
+// stop aborts a delivery the receiver holds once its ctx is done, the delivery stays due
+func TestStopAbortsInFlight(t *testing.T) {
+	r := newReceiver(t)
+	s, store, _, delivery := setup(t, r)
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	r.hook = func() {
+		close(started)
+		<-release
+	}
+
+	go s.run()
+	s.notify()
+	<-started
+	stopCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	s.stop(stopCtx)
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the round did not end once stopped")
+	}
+	if got := getDelivery(t, store, delivery.ID); got.Status != database.DeliveryPending || got.Attempts != 0 || got.LastError != "" {
+		t.Fatalf("aborted delivery %+v, want pending and untried", got)
+	}
+}
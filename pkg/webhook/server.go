@@ -0,0 +1,318 @@
+package webhook
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/pkg/logger"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+const (
+	requestTimeout = 10 * time.Second
+	// maxRequestSize bounds a watch registration
+	maxRequestSize = 64 << 10
+	defaultLimit   = 50
+	maxLimit       = 500
+)
+
+// Server registers watches over an admin HTTP API and delivers their matches to the watch URLs.
+// the store queues deliveries as it connects and disconnects blocks, the server only sends them
+type Server struct {
+	store       database.Store
+	chainParams *chaincfg.Params
+	token       [sha256.Size]byte
+	auth        bool
+	sender      *sender
+	http        *http.Server
+	logger      *logger.CustomLogger
+}
+
+// NewServer returns a server for store with the admin API on address. with a token set admin requests need it as a bearer token,
+// deliveries are signed with secret which receivers use to check them
+func NewServer(address, token, secret string, chainParams *chaincfg.Params, store database.Store) (*Server, error) {
+	if secret == "" {
+		return nil, errors.New("webhook: a secret is needed to sign deliveries")
+	}
+
+	s := &Server{
+		store:       store,
+		chainParams: chainParams,
+		token:       sha256.Sum256([]byte(token)),
+		auth:        token != "",
+		sender:      newSender(secret, store),
+		logger:      logger.NewDefaultLogger(),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/watches", s.handleWatches)
+	mux.HandleFunc("/watches/", s.handleWatch)
+	mux.HandleFunc("/deliveries/dead", s.handleDeadDeliveries)
+	mux.HandleFunc("/deliveries/", s.handleDelivery)
+
+	s.http = &http.Server{
+		Addr:              address,
+		Handler:           s.authorize(mux),
+		ReadHeaderTimeout: requestTimeout,
+		ReadTimeout:       requestTimeout,
+		WriteTimeout:      requestTimeout + time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	return s, nil
+}
+
+// Start sends deliveries and serves the admin API until Shutdown is called
+func (s *Server) Start() error {
+	go s.sender.run()
+	s.logger.Info("webhook admin API listening on " + s.http.Addr)
+	err := s.http.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting requests and sending deliveries, it waits for the running ones until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.http.Shutdown(ctx)
+	s.sender.stop(ctx)
+	return err
+}
+
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if s.auth {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			digest := sha256.Sum256([]byte(token))
+			if !ok || subtle.ConstantTimeCompare(digest[:], s.token[:]) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, "unauthorized", "a valid bearer token is required")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleWatches lists the watches on GET and registers one on POST
+func (s *Server) handleWatches(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		watches, err := s.store.GetWatches(r.Context())
+		if watches == nil {
+			watches = []database.Watch{}
+		}
+		s.writeResult(w, "watch", watches, err)
+	case http.MethodPost:
+		s.createWatch(w, r)
+	default:
+		allow(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (s *Server) createWatch(w http.ResponseWriter, r *http.Request) {
+	var watch database.Watch
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&watch); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid watch: "+err.Error())
+		return
+	}
+	if err := s.validate(&watch); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		s.writeStoreError(w, "watch", err)
+		return
+	}
+	watch.ID = hex.EncodeToString(id)
+	watch.Created = time.Now().Unix()
+	if err := s.store.PutWatch(r.Context(), watch); err != nil {
+		s.writeStoreError(w, "watch", err)
+		return
+	}
+
+	// a tx confirmed before it was watched is queued here, blocks connected from now on are matched by the store
+	if watch.Kind == database.WatchTx {
+		tx, err := s.store.GetTx(r.Context(), watch.Target)
+		if err == nil {
+			err = s.store.AddDeliveries(r.Context(), []database.Delivery{database.ConfirmedDelivery(watch, tx.ID, tx.BlockHash, tx.BlockHeight)})
+		}
+		if err != nil && !errors.Is(err, database.ErrNotFound) {
+			s.logger.Error(err.Error())
+		}
+	}
+	s.sender.notify()
+	writeJSON(w, http.StatusCreated, watch)
+}
+
+// validate checks a watch to register and normalizes its target
+func (s *Server) validate(watch *database.Watch) error {
+	target, err := url.Parse(watch.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return errors.New("url must be an http or https URL")
+	}
+	if watch.Confirmations == 0 {
+		watch.Confirmations = 1
+	}
+	if watch.Confirmations < 0 {
+		return errors.New("confirmations must be positive")
+	}
+
+	switch watch.Kind {
+	case database.WatchAddress:
+		address, err := btcutil.DecodeAddress(watch.Target, s.chainParams)
+		if err != nil || !address.IsForNet(s.chainParams) {
+			return errors.New("target is not an address of this network")
+		}
+		watch.Target = address.EncodeAddress()
+	case database.WatchScriptHash, database.WatchTx:
+		if len(watch.Target) != 64 {
+			return errors.New("target must be 64 hex characters")
+		}
+		if _, err := hex.DecodeString(watch.Target); err != nil {
+			return errors.New("target must be 64 hex characters")
+		}
+		watch.Target = strings.ToLower(watch.Target)
+	default:
+		return errors.New("kind must be address, scripthash or tx")
+	}
+	return nil
+}
+
+// handleWatch deletes the watch /watches/{id}, its queued deliveries are still sent
+func (s *Server) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		allow(w, http.MethodDelete)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/watches/")
+	if err := s.store.DeleteWatch(r.Context(), id); err != nil {
+		s.writeStoreError(w, "watch", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDeadDeliveries lists the dead deliveries in ID order, after is the last ID of the previous page
+func (s *Server) handleDeadDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		allow(w, http.MethodGet)
+		return
+	}
+	limit := int64(defaultLimit)
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "bad_request", "limit must be a positive integer")
+			return
+		}
+		limit = min(n, maxLimit)
+	}
+	deliveries, err := s.store.GetDeadDeliveries(r.Context(), r.URL.Query().Get("after"), limit)
+	if deliveries == nil {
+		deliveries = []database.Delivery{}
+	}
+	s.writeResult(w, "delivery", deliveries, err)
+}
+
+// handleDelivery serves /deliveries/{id} and its replay, POST /deliveries/{id}/replay
+func (s *Server) handleDelivery(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/deliveries/")
+	if id, ok := strings.CutSuffix(id, "/replay"); ok {
+		if r.Method != http.MethodPost {
+			allow(w, http.MethodPost)
+			return
+		}
+		s.replay(w, r, id)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		delivery, err := s.store.GetDelivery(r.Context(), id)
+		s.writeResult(w, "delivery", delivery, err)
+	case http.MethodDelete:
+		if err := s.store.DeleteDelivery(r.Context(), id); err != nil {
+			s.writeStoreError(w, "delivery", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		allow(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// replay queues a delivery again right away, whatever its status
+func (s *Server) replay(w http.ResponseWriter, r *http.Request, id string) {
+	delivery, err := s.store.GetDelivery(r.Context(), id)
+	if err != nil {
+		s.writeStoreError(w, "delivery", err)
+		return
+	}
+	delivery.Status = database.DeliveryPending
+	delivery.NextAttempt = time.Now().Unix()
+	if err := s.store.UpdateDelivery(r.Context(), delivery); err != nil {
+		s.writeStoreError(w, "delivery", err)
+		return
+	}
+	s.sender.notify()
+	writeJSON(w, http.StatusOK, delivery)
+}
+
+type errorBody struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	var body errorBody
+	body.Error.Code = code
+	body.Error.Message = message
+	writeJSON(w, status, body)
+}
+
+func allow(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "only "+strings.Join(methods, " and ")+" supported")
+}
+
+func (s *Server) writeResult(w http.ResponseWriter, what string, body interface{}, err error) {
+	if err != nil {
+		s.writeStoreError(w, what, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+func (s *Server) writeStoreError(w http.ResponseWriter, what string, err error) {
+	if errors.Is(err, database.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", what+" not found")
+		return
+	}
+	s.logger.Error(err.Error())
+	writeError(w, http.StatusInternalServerError, "internal", "internal error")
+}
@@ -0,0 +1,259 @@
+package webhook
+
+import (
+	"btc-indexer/database"
+	"btc-indexer/database/storetest"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const testToken = "test token"
+
+func newTestServer(t *testing.T) (*Server, database.Store, *storetest.Chain) {
+	store := database.NewMemoryStore(&chaincfg.RegressionNetParams)
+	chain := storetest.NewChain(t, store)
+	s, err := NewServer("", testToken, testSecret, &chaincfg.RegressionNetParams, store)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	return s, store, chain
+}
+
+// serve answers an authorized request of method for path with body, decoding a JSON answer into out
+func serve(t *testing.T, s *Server, method, path, body string, out interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	w := httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(w, req)
+	if out != nil && w.Code < 300 {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: %v in %s", method, path, err, w.Body)
+		}
+	}
+	return w
+}
+
+// assertError checks w is a JSON error body with status and code
+func assertError(t *testing.T, w *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	var body errorBody
+	if w.Code != status || w.Header().Get("Content-Type") != "application/json" || json.Unmarshal(w.Body.Bytes(), &body) != nil ||
+		body.Error.Code != code || body.Error.Message == "" {
+		t.Fatalf("answered %d %s %q, want %d with error code %s", w.Code, w.Header().Get("Content-Type"), w.Body, status, code)
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	store := database.NewMemoryStore(&chaincfg.RegressionNetParams)
+	if _, err := NewServer("", testToken, "", &chaincfg.RegressionNetParams, store); err == nil {
+		t.Fatal("NewServer without a secret succeeded")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	s, _, _ := newTestServer(t)
+	for _, header := range []string{"", "Bearer", "Bearer wrong", "Basic " + testToken, testToken} {
+		req := httptest.NewRequest(http.MethodGet, "/watches", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		s.http.Handler.ServeHTTP(w, req)
+		assertError(t, w, http.StatusUnauthorized, "unauthorized")
+		if w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Fatalf("Authorization %q: WWW-Authenticate %q", header, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+	if w := serve(t, s, http.MethodGet, "/watches", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("GET /watches with the token = %d %s", w.Code, w.Body)
+	}
+
+	// without a token the admin API is open
+	open, err := NewServer("", "", testSecret, &chaincfg.RegressionNetParams, database.NewMemoryStore(&chaincfg.RegressionNetParams))
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	w := httptest.NewRecorder()
+	open.http.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/watches", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /watches without a token = %d %s", w.Code, w.Body)
+	}
+}
+
+func TestCreateWatchValidation(t *testing.T) {
+	s, store, _ := newTestServer(t)
+	txid := strings.Repeat("ab", 32)
+	mainnet, err := btcutil.NewAddressWitnessPubKeyHash(make([]byte, 20), &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("NewAddressWitnessPubKeyHash: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"not json", `{`},
+		{"unknown field", `{"url":"http://example.com","kind":"tx","target":"` + txid + `","extra":1}`},
+		{"no url", `{"kind":"tx","target":"` + txid + `"}`},
+		{"relative url", `{"url":"/hook","kind":"tx","target":"` + txid + `"}`},
+		{"ftp url", `{"url":"ftp://example.com/hook","kind":"tx","target":"` + txid + `"}`},
+		{"url without host", `{"url":"http://","kind":"tx","target":"` + txid + `"}`},
+		{"bad url", `{"url":"http://[::1","kind":"tx","target":"` + txid + `"}`},
+		{"negative confirmations", `{"url":"http://example.com","kind":"tx","target":"` + txid + `","confirmations":-1}`},
+		{"unknown kind", `{"url":"http://example.com","kind":"block","target":"` + txid + `"}`},
+		{"short target", `{"url":"http://example.com","kind":"tx","target":"` + txid[2:] + `"}`},
+		{"target not hex", `{"url":"http://example.com","kind":"scripthash","target":"` + strings.Repeat("zz", 32) + `"}`},
+		{"address of another network", `{"url":"http://example.com","kind":"address","target":"` + mainnet.EncodeAddress() + `"}`},
+		{"not an address", `{"url":"http://example.com","kind":"address","target":"` + txid + `"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assertError(t, serve(t, s, http.MethodPost, "/watches", test.body, nil), http.StatusBadRequest, "bad_request")
+		})
+	}
+	assertError(t, serve(t, s, http.MethodPost, "/watches", `{"url":"`+strings.Repeat("a", maxRequestSize)+`"}`, nil), http.StatusBadRequest, "bad_request")
+	if watches, err := store.GetWatches(ctx); err != nil || len(watches) != 0 {
+		t.Fatalf("GetWatches = %+v, %v, want none registered", watches, err)
+	}
+}
+
+func TestWatches(t *testing.T) {
+	s, store, chain := newTestServer(t)
+	b1 := chain.Block(chain.Genesis())
+	chain.Put(b1)
+	coinbase := b1.Transactions[0].TxHash().String()
+	regtest, err := btcutil.NewAddressWitnessPubKeyHash(make([]byte, 20), &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatalf("NewAddressWitnessPubKeyHash: %v", err)
+	}
+
+	// targets are normalized, confirmations default to 1
+	var address database.Watch
+	body := `{"url":"https://example.com/hook","kind":"address","target":"` + strings.ToUpper(regtest.EncodeAddress()) + `"}`
+	if w := serve(t, s, http.MethodPost, "/watches", body, &address); w.Code != http.StatusCreated {
+		t.Fatalf("POST /watches = %d %s", w.Code, w.Body)
+	}
+	if len(address.ID) != 32 || address.Target != regtest.EncodeAddress() || address.Confirmations != 1 || address.Created == 0 {
+		t.Fatalf("watch %+v", address)
+	}
+
+	// a tx confirmed before it is watched is queued right away
+	var tx database.Watch
+	body = `{"url":"http://example.com/hook","kind":"tx","target":"` + strings.ToUpper(coinbase) + `","confirmations":3}`
+	if w := serve(t, s, http.MethodPost, "/watches", body, &tx); w.Code != http.StatusCreated {
+		t.Fatalf("POST /watches = %d %s", w.Code, w.Body)
+	}
+	if tx.Target != coinbase || tx.Confirmations != 3 {
+		t.Fatalf("watch %+v", tx)
+	}
+	id := database.DeliveryID(tx.ID, database.EventTxConfirmed, database.Hash(coinbase), database.Hash(b1.BlockHash().String()))
+	if delivery, err := store.GetDelivery(ctx, id); err != nil || delivery.Status != database.DeliveryPending || delivery.Height != 1 {
+		t.Fatalf("GetDelivery = %+v, %v, want the confirmation queued", delivery, err)
+	}
+
+	var watches []database.Watch
+	if w := serve(t, s, http.MethodGet, "/watches", "", &watches); w.Code != http.StatusOK || len(watches) != 2 {
+		t.Fatalf("GET /watches = %d %s", w.Code, w.Body)
+	}
+
+	if w := serve(t, s, http.MethodDelete, "/watches/"+address.ID, "", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /watches/%s = %d %s", address.ID, w.Code, w.Body)
+	}
+	assertError(t, serve(t, s, http.MethodDelete, "/watches/"+address.ID, "", nil), http.StatusNotFound, "not_found")
+	if w := serve(t, s, http.MethodGet, "/watches", "", &watches); w.Code != http.StatusOK || len(watches) != 1 || watches[0].ID != tx.ID {
+		t.Fatalf("GET /watches = %d %s", w.Code, w.Body)
+	}
+	serve(t, s, http.MethodDelete, "/watches/"+tx.ID, "", nil)
+	if w := serve(t, s, http.MethodGet, "/watches", "", nil); w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Fatalf("GET /watches with none = %d %s", w.Code, w.Body)
+	}
+
+	for _, test := range []struct{ method, path, allow string }{
+		{http.MethodPut, "/watches", "GET, POST"},
+		{http.MethodGet, "/watches/" + tx.ID, "DELETE"},
+		{http.MethodPost, "/deliveries/dead", "GET"},
+		{http.MethodPost, "/deliveries/" + id, "GET, DELETE"},
+		{http.MethodGet, "/deliveries/" + id + "/replay", "POST"},
+	} {
+		w := serve(t, s, test.method, test.path, "", nil)
+		assertError(t, w, http.StatusMethodNotAllowed, "method_not_allowed")
+		if w.Header().Get("Allow") != test.allow {
+			t.Fatalf("%s %s: Allow %q, want %q", test.method, test.path, w.Header().Get("Allow"), test.allow)
+		}
+	}
+}
+
+func TestDeliveries(t *testing.T) {
+	s, store, chain := newTestServer(t)
+	b1 := chain.Block(chain.Genesis())
+	b2 := chain.Block(b1)
+	b3 := chain.Block(b2)
+	chain.Put(b1, b2, b3)
+
+	// a dead delivery per confirmed coinbase
+	var ids []string
+	for _, block := range []*wire.MsgBlock{b1, b2, b3} {
+		var watch database.Watch
+		body := `{"url":"http://example.com/hook","kind":"tx","target":"` + block.Transactions[0].TxHash().String() + `"}`
+		if w := serve(t, s, http.MethodPost, "/watches", body, &watch); w.Code != http.StatusCreated {
+			t.Fatalf("POST /watches = %d %s", w.Code, w.Body)
+		}
+		id := database.DeliveryID(watch.ID, database.EventTxConfirmed, database.Hash(watch.Target), database.Hash(block.BlockHash().String()))
+		delivery := getDelivery(t, store, id)
+		delivery.Status = database.DeliveryDead
+		delivery.Attempts = maxAttempts
+		if err := store.UpdateDelivery(ctx, delivery); err != nil {
+			t.Fatalf("UpdateDelivery: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// pages in ID order
+	var page []database.Delivery
+	if w := serve(t, s, http.MethodGet, "/deliveries/dead?limit=2", "", &page); w.Code != http.StatusOK || len(page) != 2 || page[0].ID != ids[0] || page[1].ID != ids[1] {
+		t.Fatalf("GET /deliveries/dead?limit=2 = %d %s", w.Code, w.Body)
+	}
+	if w := serve(t, s, http.MethodGet, "/deliveries/dead?limit=2&after="+ids[1], "", &page); w.Code != http.StatusOK || len(page) != 1 || page[0].ID != ids[2] {
+		t.Fatalf("GET the second page = %d %s", w.Code, w.Body)
+	}
+	if w := serve(t, s, http.MethodGet, "/deliveries/dead?limit=100000", "", &page); w.Code != http.StatusOK || len(page) != 3 {
+		t.Fatalf("GET /deliveries/dead?limit=100000 = %d %s", w.Code, w.Body)
+	}
+	for _, limit := range []string{"0", "-1", "x"} {
+		assertError(t, serve(t, s, http.MethodGet, "/deliveries/dead?limit="+limit, "", nil), http.StatusBadRequest, "bad_request")
+	}
+
+	var delivery database.Delivery
+	if w := serve(t, s, http.MethodGet, "/deliveries/"+ids[0], "", &delivery); w.Code != http.StatusOK || delivery.ID != ids[0] || delivery.Status != database.DeliveryDead {
+		t.Fatalf("GET /deliveries/%s = %d %s", ids[0], w.Code, w.Body)
+	}
+
+	// a replay queues the delivery again right away
+	if w := serve(t, s, http.MethodPost, "/deliveries/"+ids[1]+"/replay", "", &delivery); w.Code != http.StatusOK || delivery.Status != database.DeliveryPending {
+		t.Fatalf("POST /deliveries/%s/replay = %d %s", ids[1], w.Code, w.Body)
+	}
+	if got := getDelivery(t, store, ids[1]); got.Status != database.DeliveryPending || got.NextAttempt > time.Now().Unix() || got.Attempts != maxAttempts {
+		t.Fatalf("replayed delivery %+v, want pending and due", got)
+	}
+	if w := serve(t, s, http.MethodGet, "/deliveries/dead", "", &page); w.Code != http.StatusOK || len(page) != 2 {
+		t.Fatalf("GET /deliveries/dead after a replay = %d %s", w.Code, w.Body)
+	}
+
+	if w := serve(t, s, http.MethodDelete, "/deliveries/"+ids[0], "", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /deliveries/%s = %d %s", ids[0], w.Code, w.Body)
+	}
+	assertError(t, serve(t, s, http.MethodGet, "/deliveries/"+ids[0], "", nil), http.StatusNotFound, "not_found")
+	assertError(t, serve(t, s, http.MethodDelete, "/deliveries/"+ids[0], "", nil), http.StatusNotFound, "not_found")
+	assertError(t, serve(t, s, http.MethodPost, "/deliveries/"+ids[0]+"/replay", "", nil), http.StatusNotFound, "not_found")
+}